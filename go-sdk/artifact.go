@@ -0,0 +1,245 @@
+package sdk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/openpgp"
+)
+
+// VerifiedUploadOptions controls UploadVerified. Keyring holds the keys
+// trusted to sign artifacts. Signature is the detached signature of the
+// artifact, binary or armored, defaulting to the artifact path with a .sig
+// or .asc extension.
+//
+// Manifest optionally names a sha256sum style listing, itself signed by the
+// detached signature at ManifestSignature or found next to it the same way,
+// that has to contain the artifact under ManifestName, which defaults to the
+// base name of the artifact. VerifyOnDevice has the agent hash the staged
+// upload and compare it with the signed hash before it replaces the file.
+type VerifiedUploadOptions struct {
+	Keyring           openpgp.KeyRing
+	Signature         string
+	Manifest          string
+	ManifestSignature string
+	ManifestName      string
+	VerifyOnDevice    bool
+	Writer            WriterOptions
+}
+
+// VerifiedArtifact describes an artifact written by UploadVerified.
+type VerifiedArtifact struct {
+	Path   string
+	SHA256 string
+	Signer *openpgp.Entity
+}
+
+// LoadKeyring reads an armored or binary OpenPGP keyring.
+func LoadKeyring(path string) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed reading '%v'", path)
+	}
+
+	var keyring openpgp.EntityList
+
+	if isArmored(data) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed parsing keyring '%v'", path)
+	}
+
+	return keyring, nil
+}
+
+// UploadVerified writes the artifact at local to remote after checking its
+// detached signature against the trusted keyring. The bytes uploaded are the
+// ones that were verified: a file changing in between is detected and the
+// upload aborted. The write is atomic, so a refused artifact, including one
+// found modified on the device by VerifyOnDevice, never replaces the current
+// file. Unsigned and tampered artifacts fail with an *ErrUnverifiedArtifact.
+func UploadVerified(ctx context.Context, fs DeviceFilesystem, local, remote string, opts VerifiedUploadOptions) (*VerifiedArtifact, error) {
+	if opts.Keyring == nil {
+		return nil, stacktrace.NewError("no keyring to verify '%v' against", local)
+	}
+
+	file, err := os.Open(local)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed opening '%v'", local)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	signer, err := checkDetachedSignature(opts.Keyring, io.TeeReader(file, hash), local, opts.Signature)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	if opts.Manifest != "" {
+		name := opts.ManifestName
+
+		if name == "" {
+			name = filepath.Base(local)
+		}
+
+		signed, err := readSignedManifest(opts.Keyring, opts.Manifest, opts.ManifestSignature, name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if signed != sum {
+			return nil, &ErrUnverifiedArtifact{
+				Path:   local,
+				Reason: fmt.Sprintf("hash %v differs from %v in the signed manifest", sum, signed),
+			}
+		}
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, stacktrace.Propagate(err, "failed rewinding '%v'", local)
+	}
+
+	wopts := opts.Writer
+	wopts.Atomic = true
+
+	if opts.VerifyOnDevice {
+		wopts.verify = func(ctx context.Context, staged string) error {
+			ondevice, err := fs.Hash(ctx, staged, HashSHA256)
+
+			if err != nil {
+				return err
+			}
+
+			if ondevice != sum {
+				return &ErrUnverifiedArtifact{
+					Path:   remote,
+					Reason: fmt.Sprintf("hash %v on the device differs from the signed %v", ondevice, sum),
+				}
+			}
+
+			return nil
+		}
+	}
+
+	w := fs.Writer(ctx, remote, wopts)
+	hash.Reset()
+
+	if _, err := io.Copy(io.MultiWriter(w, hash), file); err != nil {
+		w.Abort()
+		return nil, stacktrace.Propagate(err, "failed uploading '%v'", local)
+	}
+
+	if uploaded := hex.EncodeToString(hash.Sum(nil)); uploaded != sum {
+		w.Abort()
+		return nil, &ErrUnverifiedArtifact{
+			Path:   local,
+			Reason: "file changed after its signature was verified",
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return &VerifiedArtifact{
+		Path:   remote,
+		SHA256: sum,
+		Signer: signer,
+	}, nil
+}
+
+// checkDetachedSignature checks signed, read from path, against its detached
+// signature at signature or next to path.
+func checkDetachedSignature(keyring openpgp.KeyRing, signed io.Reader, path, signature string) (*openpgp.Entity, error) {
+	candidates := []string{signature}
+
+	if signature == "" {
+		candidates = []string{path + ".sig", path + ".asc"}
+	}
+
+	var sig []byte
+	var err error
+
+	for _, candidate := range candidates {
+		if sig, err = ioutil.ReadFile(candidate); !os.IsNotExist(err) {
+			break
+		}
+	}
+
+	if os.IsNotExist(err) {
+		return nil, &ErrUnverifiedArtifact{Path: path, Reason: "no detached signature found"}
+	}
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed reading signature of '%v'", path)
+	}
+
+	var signer *openpgp.Entity
+
+	if isArmored(sig) {
+		signer, err = openpgp.CheckArmoredDetachedSignature(keyring, signed, bytes.NewReader(sig))
+	} else {
+		signer, err = openpgp.CheckDetachedSignature(keyring, signed, bytes.NewReader(sig))
+	}
+
+	if err != nil {
+		return nil, &ErrUnverifiedArtifact{Path: path, Reason: err.Error()}
+	}
+
+	return signer, nil
+}
+
+// readSignedManifest verifies the manifest at path against its detached
+// signature at signature or next to it and returns the hash it lists for
+// name.
+func readSignedManifest(keyring openpgp.KeyRing, path, signature, name string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return "", stacktrace.Propagate(err, "failed reading manifest '%v'", path)
+	}
+
+	if _, err := checkDetachedSignature(keyring, bytes.NewReader(data), path, signature); err != nil {
+		return "", err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		// sha256sum marks files hashed in binary mode with a leading '*'
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+
+	return "", &ErrUnverifiedArtifact{
+		Path:   name,
+		Reason: fmt.Sprintf("not listed in the signed manifest '%v'", path),
+	}
+}
+
+func isArmored(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN PGP"))
+}
@@ -0,0 +1,149 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func (t *Test_DeviceFilesystem) Test_upload_verified() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	agent := newTestFilesystemAgent()
+	hash := agent.handlers["hash"]
+	rename := agent.handlers["rename"]
+	tamper := false
+	renames := 0
+
+	// an agent whose disk is modified once the artifact was uploaded
+	agent.handlers["hash"] = func(rw http.ResponseWriter, r *http.Request) {
+		if tamper {
+			ioutil.WriteFile(r.FormValue("path"), []byte("backdoored"), 0644)
+		}
+
+		hash(rw, r)
+	}
+	agent.handlers["rename"] = func(rw http.ResponseWriter, r *http.Request) {
+		renames++
+		rename(rw, r)
+	}
+
+	agent.register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-artifact")
+	defer os.RemoveAll(dir)
+
+	config := &packet.Config{RSABits: 1024}
+	release, _ := openpgp.NewEntity("release", "", "release@example.com", config)
+	stranger, _ := openpgp.NewEntity("stranger", "", "stranger@example.com", config)
+	keyring := openpgp.EntityList{release}
+
+	sign := func(signer *openpgp.Entity, path, sig string, armored bool) {
+		data, _ := ioutil.ReadFile(path)
+		buf := &bytes.Buffer{}
+
+		if armored {
+			openpgp.ArmoredDetachSign(buf, signer, bytes.NewReader(data), config)
+		} else {
+			openpgp.DetachSign(buf, signer, bytes.NewReader(data), config)
+		}
+
+		ioutil.WriteFile(sig, buf.Bytes(), 0644)
+	}
+
+	artifact := filepath.Join(dir, "firmware.bin")
+	remote := filepath.Join(dir, "installed.bin")
+	manifest := filepath.Join(dir, "SHA256SUMS")
+	fs := objects.client.Device("whatever").Filesystem()
+
+	ioutil.WriteFile(artifact, []byte("firmware v1"), 0644)
+	ioutil.WriteFile(manifest, []byte(fmt.Sprintf("%v  firmware.bin\n", hashBytes([]byte("firmware v1")))), 0644)
+	sign(release, manifest, manifest+".asc", true)
+
+	refused := func(err error) bool {
+		_, ok := err.(*ErrUnverifiedArtifact)
+		return ok
+	}
+
+	_, err := UploadVerified(context.Background(), fs, artifact, remote, VerifiedUploadOptions{Keyring: keyring})
+	assert.True(t.T(), refused(err))
+
+	sign(stranger, artifact, artifact+".sig", false)
+
+	_, err = UploadVerified(context.Background(), fs, artifact, remote, VerifiedUploadOptions{Keyring: keyring})
+	assert.True(t.T(), refused(err))
+
+	sign(release, artifact, artifact+".sig", false)
+
+	verified, err := UploadVerified(context.Background(), fs, artifact, remote, VerifiedUploadOptions{
+		Keyring:        keyring,
+		Manifest:       manifest,
+		VerifyOnDevice: true,
+	})
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), hashBytes([]byte("firmware v1")), verified.SHA256)
+	assert.Equal(t.T(), release.PrimaryKey.KeyId, verified.Signer.PrimaryKey.KeyId)
+
+	data, _ := ioutil.ReadFile(remote)
+	assert.Equal(t.T(), "firmware v1", string(data))
+
+	// tampered after signing
+	ioutil.WriteFile(artifact, []byte("firmware v2"), 0644)
+
+	_, err = UploadVerified(context.Background(), fs, artifact, remote, VerifiedUploadOptions{Keyring: keyring})
+	assert.True(t.T(), refused(err))
+
+	data, _ = ioutil.ReadFile(remote)
+	assert.Equal(t.T(), "firmware v1", string(data))
+
+	// signed, but not what the manifest lists
+	sign(release, artifact, artifact+".sig", false)
+
+	_, err = UploadVerified(context.Background(), fs, artifact, remote, VerifiedUploadOptions{Keyring: keyring, Manifest: manifest})
+	assert.True(t.T(), refused(err))
+
+	_, err = UploadVerified(context.Background(), fs, artifact, remote, VerifiedUploadOptions{Keyring: keyring, Manifest: manifest, ManifestName: "other.bin"})
+	assert.True(t.T(), refused(err))
+
+	// a manifest signature kept apart from the manifest
+	ioutil.WriteFile(artifact, []byte("firmware v1"), 0644)
+	sign(release, artifact, artifact+".sig", false)
+	os.Rename(manifest+".asc", filepath.Join(dir, "manifest.sig"))
+
+	_, err = UploadVerified(context.Background(), fs, artifact, remote, VerifiedUploadOptions{Keyring: keyring, Manifest: manifest})
+	assert.True(t.T(), refused(err))
+
+	_, err = UploadVerified(context.Background(), fs, artifact, remote, VerifiedUploadOptions{
+		Keyring:           keyring,
+		Manifest:          manifest,
+		ManifestSignature: filepath.Join(dir, "manifest.sig"),
+	})
+	assert.Nil(t.T(), err)
+
+	// modified on the device before it was renamed into place
+	tamper = true
+	renames = 0
+
+	_, err = UploadVerified(context.Background(), fs, artifact, remote, VerifiedUploadOptions{Keyring: keyring, VerifyOnDevice: true})
+	assert.True(t.T(), refused(err))
+	assert.Equal(t.T(), 0, renames)
+
+	data, _ = ioutil.ReadFile(remote)
+	assert.Equal(t.T(), "firmware v1", string(data))
+
+	entries, _ := ioutil.ReadDir(dir)
+
+	for _, entry := range entries {
+		assert.NotContains(t.T(), entry.Name(), "installed.bin.")
+	}
+}
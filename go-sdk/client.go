@@ -1,14 +1,20 @@
 package sdk
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"net/http"
+	"sync"
 
 	"github.com/deviceio/hmapi"
+	"golang.org/x/crypto/ed25519"
 )
 
 type Client interface {
 	Device(deviceid string) Device
+	CopyBetween(ctx context.Context, src Device, srcPath string, dst Device, dstPath string, opts CopyOptions) (*CopyResult, error)
+	Close() error
 }
 
 type ClientConfig struct {
@@ -18,18 +24,87 @@ type ClientConfig struct {
 	TOTPSecret string
 	PrivateKey string
 	HMClient   hmapi.Client
+
+	// HubAuth signs the requests of the hmapi client NewClient builds when
+	// HMClient is nil, by default through ClientAuth with UserID, TOTPSecret
+	// and PrivateKey.
+	HubAuth hmapi.Auth
+
+	// HubPlainHTTP makes the hmapi client NewClient builds talk to the hub
+	// over HTTP rather than HTTPS, for hubs behind a proxy terminating TLS on
+	// the same host.
+	HubPlainHTTP bool
+
+	// DisableCompression stops the client from requesting compressed
+	// streams from agents that offer them. Process output is negotiated
+	// through the Auth of the hmapi client, so a client passed in HMClient
+	// leaves the coding of process output to its transport.
+	DisableCompression bool
+
+	// BandwidthLimit caps the bytes per second all streams of the client
+	// move together, zero leaves them unlimited.
+	BandwidthLimit int64
+
+	// EndToEnd encrypts what Writers send to and Readers receive from devices
+	// with the key of the device, so the hub only relays ciphertext. The keys of
+	// the streams are signed with PrivateKey, which clients passing an HMClient
+	// set as well, along with the path and the time, and agents reject keys not
+	// signed by a client they trust, so a hub substituting keys of its own
+	// cannot read or write files either, nor replay a write elsewhere or later.
+	// Delta sync, archives, Follow, Grep and CopyBetween then move file content
+	// through the read and write forms rather than the agent's own forms for
+	// them, which cannot be encrypted. Devices whose agent does not support it,
+	// or does not take a signature, fail with ErrUnsupportedOperation. Encrypted
+	// streams are not compressed.
+	EndToEnd bool
+
+	// KeyStore pins the keys of devices for EndToEnd, by default keys are
+	// pinned in memory.
+	KeyStore KeyStore
 }
 
 type client struct {
-	hmclient hmapi.Client
+	hmclient           hmapi.Client
+	linkAuth           *encodingAuth
+	signingKey         ed25519.PrivateKey
+	disableCompression bool
+	endToEnd           bool
+	keys               KeyStore
+	limiter            *rateLimiter
+	limitersmu         sync.Mutex
+	limiters           map[string]*rateLimiter
+	tempsmu            sync.Mutex
+	temps              map[TempHandle]struct{}
+	resourcesmu        sync.Mutex
+	resources          map[string]cachedResource
+	sweptmu            sync.Mutex
+	swept              map[string]struct{}
 }
 
 func NewClient(config ClientConfig) Client {
+	var linkAuth *encodingAuth
+
 	if config.HMClient == nil {
+		if config.HubAuth == nil {
+			config.HubAuth = &ClientAuth{
+				UserID:         config.UserID,
+				UserTOTPSecret: config.TOTPSecret,
+				UserPrivateKey: config.PrivateKey,
+			}
+		}
+
+		scheme := hmapi.HTTPS
+
+		if config.HubPlainHTTP {
+			scheme = hmapi.HTTP
+		}
+
+		linkAuth = newEncodingAuth(config.HubAuth)
+
 		config.HMClient = hmapi.NewClient(&hmapi.ClientConfig{
 			Host:   config.HubHost,
 			Port:   config.HubPort,
-			Scheme: hmapi.HTTPS,
+			Scheme: scheme,
 			HTTPClient: &http.Client{
 				Transport: &http.Transport{
 					TLSClientConfig: &tls.Config{
@@ -37,17 +112,36 @@ func NewClient(config ClientConfig) Client {
 					},
 				},
 			},
-			Auth: &ClientAuth{
-				UserID:         config.UserID,
-				UserTOTPSecret: config.TOTPSecret,
-				UserPrivateKey: config.PrivateKey,
-			},
+			Auth: linkAuth,
 		})
 	}
 
-	return &client{
-		hmclient: config.HMClient,
+	client := &client{
+		hmclient:           config.HMClient,
+		linkAuth:           linkAuth,
+		disableCompression: config.DisableCompression,
+		endToEnd:           config.EndToEnd,
+		keys:               config.KeyStore,
+		limiters:           map[string]*rateLimiter{},
+		temps:              map[TempHandle]struct{}{},
+		resources:          map[string]cachedResource{},
+		swept:              map[string]struct{}{},
+	}
+
+	// ClientAuth reports an invalid key, EndToEnd fails without one
+	if key, err := base64.StdEncoding.DecodeString(config.PrivateKey); err == nil && len(key) == ed25519.PrivateKeySize {
+		client.signingKey = ed25519.PrivateKey(key)
+	}
+
+	if client.keys == nil {
+		client.keys = NewMemoryKeyStore()
 	}
+
+	if config.BandwidthLimit > 0 {
+		client.limiter = newRateLimiter(config.BandwidthLimit)
+	}
+
+	return client
 }
 
 func (t *client) Device(deviceid string) Device {
@@ -56,3 +150,81 @@ func (t *client) Device(deviceid string) Device {
 		client: t,
 	}
 }
+
+// Close removes the temporary files and directories created through the
+// client that have not been cleaned up yet, returning the first failure.
+func (t *client) Close() error {
+	t.tempsmu.Lock()
+	temps := make([]TempHandle, 0, len(t.temps))
+
+	for temp := range t.temps {
+		temps = append(temps, temp)
+	}
+
+	t.tempsmu.Unlock()
+
+	var first error
+
+	for _, temp := range temps {
+		if err := temp.Cleanup(); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+func (t *client) track(temp TempHandle) {
+	t.tempsmu.Lock()
+	defer t.tempsmu.Unlock()
+
+	t.temps[temp] = struct{}{}
+}
+
+func (t *client) untrack(temp TempHandle) {
+	t.tempsmu.Lock()
+	defer t.tempsmu.Unlock()
+
+	delete(t.temps, temp)
+}
+
+func (t *client) deviceLimiter(deviceid string) *rateLimiter {
+	t.limitersmu.Lock()
+	defer t.limitersmu.Unlock()
+
+	return t.limiters[deviceid]
+}
+
+func (t *client) setDeviceLimit(deviceid string, bytesPerSecond int64) {
+	t.limitersmu.Lock()
+	defer t.limitersmu.Unlock()
+
+	if bytesPerSecond <= 0 {
+		delete(t.limiters, deviceid)
+		return
+	}
+
+	if limiter, ok := t.limiters[deviceid]; ok {
+		limiter.setRate(bytesPerSecond)
+		return
+	}
+
+	t.limiters[deviceid] = newRateLimiter(bytesPerSecond)
+}
+
+// sweep reports whether the directory of the device has not been swept for
+// stale staging files yet, marking it swept.
+func (t *client) sweep(deviceid, dir string) bool {
+	t.sweptmu.Lock()
+	defer t.sweptmu.Unlock()
+
+	key := deviceid + "\x00" + dir
+
+	if _, ok := t.swept[key]; ok {
+		return false
+	}
+
+	t.swept[key] = struct{}{}
+
+	return true
+}
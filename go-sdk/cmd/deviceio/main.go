@@ -0,0 +1,127 @@
+// Command deviceio works with the devices connected to a deviceio hub.
+//
+//	deviceio edit <device> <path>
+//
+// The hub and the credentials of the user are taken from the flags or from
+// the DEVICEIO_HUB_HOST, DEVICEIO_HUB_PORT, DEVICEIO_USER_ID,
+// DEVICEIO_TOTP_SECRET and DEVICEIO_PRIVATE_KEY environment variables.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/deviceio/sdk"
+)
+
+const usage = `usage: deviceio [flags] <command> [arguments]
+
+commands:
+  edit <device> <path>   edit a file on a device in $VISUAL or $EDITOR
+
+flags:
+`
+
+func main() {
+	port, _ := strconv.Atoi(os.Getenv("DEVICEIO_HUB_PORT"))
+
+	if port == 0 {
+		port = 443
+	}
+
+	config := sdk.ClientConfig{}
+
+	flag.StringVar(&config.HubHost, "hub-host", os.Getenv("DEVICEIO_HUB_HOST"), "host of the hub")
+	flag.IntVar(&config.HubPort, "hub-port", port, "port of the hub")
+	flag.StringVar(&config.UserID, "user-id", os.Getenv("DEVICEIO_USER_ID"), "id of the user")
+	flag.StringVar(&config.TOTPSecret, "totp-secret", os.Getenv("DEVICEIO_TOTP_SECRET"), "totp secret of the user")
+	flag.StringVar(&config.PrivateKey, "private-key", os.Getenv("DEVICEIO_PRIVATE_KEY"), "private key of the user")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	client := sdk.NewClient(config)
+
+	var err error
+
+	switch flag.Arg(0) {
+	case "edit":
+		err = edit(ctx, client, flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	client.Close()
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "deviceio:", err)
+		os.Exit(1)
+	}
+}
+
+// edit opens a file of a device in the local editor. When the file changed
+// on the device in the meantime nothing is written and the three-way merge
+// is saved locally for the user to resolve.
+func edit(ctx context.Context, client sdk.Client, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: deviceio edit <device> <path>")
+	}
+
+	fs := client.Device(args[0]).Filesystem()
+	result, err := sdk.EditFile(ctx, fs, args[1], sdk.EditFileOptions{})
+
+	if conflict, ok := err.(*sdk.ErrEditConflict); ok {
+		base := path.Base(strings.Replace(args[1], `\`, "/", -1))
+		merged, err := ioutil.TempFile("", base+".merged-")
+
+		if err != nil {
+			return err
+		}
+		defer merged.Close()
+
+		if _, err := merged.Write(conflict.Merged); err != nil {
+			return err
+		}
+
+		return fmt.Errorf("%v, the merge was saved to %v", conflict, merged.Name())
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !result.Changed {
+		fmt.Fprintf(os.Stderr, "%v unchanged\n", args[1])
+		return nil
+	}
+
+	fmt.Print(result.Diff)
+
+	return nil
+}
@@ -0,0 +1,399 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+type ConfigFormat string
+
+const (
+	ConfigJSON = ConfigFormat("json")
+	ConfigYAML = ConfigFormat("yaml")
+	ConfigTOML = ConfigFormat("toml")
+	ConfigINI  = ConfigFormat("ini")
+)
+
+type ConfigChangeOp string
+
+const (
+	ConfigAdded   = ConfigChangeOp("add")
+	ConfigRemoved = ConfigChangeOp("remove")
+	ConfigChanged = ConfigChangeOp("change")
+)
+
+// ConfigChange is one entry of the semantic diff of a ConfigFile. Path
+// addresses a scalar, changes to nested documents are reported per scalar.
+type ConfigChange struct {
+	Op   ConfigChangeOp
+	Path string
+	Old  interface{}
+	New  interface{}
+}
+
+func (t ConfigChange) String() string {
+	switch t.Op {
+	case ConfigAdded:
+		return fmt.Sprintf("+ %v = %v", t.Path, t.New)
+	case ConfigRemoved:
+		return fmt.Sprintf("- %v = %v", t.Path, t.Old)
+	default:
+		return fmt.Sprintf("~ %v: %v -> %v", t.Path, t.Old, t.New)
+	}
+}
+
+// configDocument edits the text of a config file in place so comments,
+// ordering and formatting outside the edited values survive.
+type configDocument interface {
+	get(path []string) (interface{}, bool, error)
+	set(path []string, value interface{}) error
+	delete(path []string) (bool, error)
+	values() (map[string]interface{}, error)
+	bytes() []byte
+}
+
+// ConfigFile is a structured view of a JSON, YAML, TOML or INI file on a
+// device. Paths are dot separated keys, a literal dot in a key is escaped
+// with a backslash and array elements of JSON documents are addressed by
+// their index. Only the subset of YAML made of block mappings of scalars
+// and the subset of TOML made of tables and single line key/value pairs can
+// be edited, other constructs are kept as they are but cannot be addressed.
+type ConfigFile struct {
+	fs       DeviceFilesystem
+	path     string
+	format   ConfigFormat
+	original []byte
+	doc      configDocument
+}
+
+// OpenConfigFile reads path from fs. An empty format is derived from the
+// file extension.
+func OpenConfigFile(ctx context.Context, fs DeviceFilesystem, path string, format ConfigFormat) (*ConfigFile, error) {
+	if format == "" {
+		format = configFormatOf(path)
+	}
+
+	file, err := fs.Open(ctx, path)
+
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed reading '%v'", path)
+	}
+
+	doc, err := parseConfig(data, format)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed parsing '%v'", path)
+	}
+
+	return &ConfigFile{
+		fs:       fs,
+		path:     path,
+		format:   format,
+		original: data,
+		doc:      doc,
+	}, nil
+}
+
+func configFormatOf(file string) ConfigFormat {
+	switch strings.ToLower(path.Ext(strings.Replace(file, `\`, "/", -1))) {
+	case ".json":
+		return ConfigJSON
+	case ".yaml", ".yml":
+		return ConfigYAML
+	case ".toml":
+		return ConfigTOML
+	default:
+		return ConfigINI
+	}
+}
+
+func parseConfig(data []byte, format ConfigFormat) (configDocument, error) {
+	switch format {
+	case ConfigJSON:
+		return parseJSONConfig(data)
+	case ConfigYAML:
+		return parseYAMLConfig(data)
+	case ConfigTOML:
+		return parseTOMLConfig(data)
+	case ConfigINI:
+		return parseINIConfig(data)
+	default:
+		return nil, stacktrace.NewError("unsupported config format '%v'", format)
+	}
+}
+
+func (t *ConfigFile) Path() string {
+	return t.path
+}
+
+func (t *ConfigFile) Format() ConfigFormat {
+	return t.format
+}
+
+// Get returns the value at path and whether it exists. Scalars of JSON and
+// YAML documents are returned as decoded by encoding/json, INI values are
+// always strings.
+func (t *ConfigFile) Get(path string) (interface{}, bool, error) {
+	keys, err := splitConfigPath(path)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return t.doc.get(keys)
+}
+
+// Set stores value at path, creating missing parents.
+func (t *ConfigFile) Set(path string, value interface{}) error {
+	keys, err := splitConfigPath(path)
+
+	if err != nil {
+		return err
+	}
+
+	return t.doc.set(keys, value)
+}
+
+// Delete removes path and reports whether it existed.
+func (t *ConfigFile) Delete(path string) (bool, error) {
+	keys, err := splitConfigPath(path)
+
+	if err != nil {
+		return false, err
+	}
+
+	return t.doc.delete(keys)
+}
+
+// Bytes returns the edited content.
+func (t *ConfigFile) Bytes() []byte {
+	return t.doc.bytes()
+}
+
+// Changed reports whether the content differs from what was read.
+func (t *ConfigFile) Changed() bool {
+	return !bytes.Equal(t.original, t.doc.bytes())
+}
+
+// Diff compares the values of the edited document with the ones that were
+// read, ignoring changes to comments and formatting. Changes are sorted by
+// path.
+func (t *ConfigFile) Diff() ([]ConfigChange, error) {
+	original, err := parseConfig(t.original, t.format)
+
+	if err != nil {
+		return nil, err
+	}
+
+	before, err := original.values()
+
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := t.doc.values()
+
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []ConfigChange{}
+
+	for path, value := range after {
+		old, ok := before[path]
+
+		switch {
+		case !ok:
+			changes = append(changes, ConfigChange{Op: ConfigAdded, Path: path, New: value})
+		case !reflect.DeepEqual(old, value):
+			changes = append(changes, ConfigChange{Op: ConfigChanged, Path: path, Old: old, New: value})
+		}
+	}
+
+	for path, value := range before {
+		if _, ok := after[path]; !ok {
+			changes = append(changes, ConfigChange{Op: ConfigRemoved, Path: path, Old: value})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+
+	return changes, nil
+}
+
+// Save writes the edited content back atomically. The write fails with
+// ErrPreconditionFailed when the file no longer has the content that was
+// read, in which case the file has to be opened and edited again. Saving an
+// unchanged file does nothing.
+func (t *ConfigFile) Save(ctx context.Context) error {
+	if !t.Changed() {
+		return nil
+	}
+
+	data := t.doc.bytes()
+
+	err := t.fs.WriteFile(ctx, t.path, data, WriterOptions{
+		ExpectedHash: hashBytes(t.original),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	t.original = append([]byte{}, data...)
+
+	return nil
+}
+
+// splitConfigPath splits a path on dots that are not escaped.
+func splitConfigPath(path string) ([]string, error) {
+	keys := []string{}
+	key := strings.Builder{}
+	escaped := false
+
+	for _, r := range path {
+		switch {
+		case escaped:
+			key.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '.':
+			keys = append(keys, key.String())
+			key.Reset()
+		default:
+			key.WriteRune(r)
+		}
+	}
+
+	keys = append(keys, key.String())
+
+	for _, key := range keys {
+		if key == "" {
+			return nil, stacktrace.NewError("invalid config path '%v'", path)
+		}
+	}
+
+	return keys, nil
+}
+
+// joinConfigPath is the inverse of splitConfigPath.
+func joinConfigPath(keys []string) string {
+	escaped := make([]string, len(keys))
+
+	for i, key := range keys {
+		escaped[i] = strings.Replace(strings.Replace(key, `\`, `\\`, -1), ".", `\.`, -1)
+	}
+
+	return strings.Join(escaped, ".")
+}
+
+// flattenConfig adds the scalars of value to values keyed by their path.
+func flattenConfig(values map[string]interface{}, prefix []string, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			flattenConfig(values, append(append([]string{}, prefix...), key), child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			flattenConfig(values, append(append([]string{}, prefix...), fmt.Sprint(i)), child)
+		}
+	default:
+		values[joinConfigPath(prefix)] = v
+	}
+}
+
+// errConfigUnsupported reports a path addressing a construct that is kept as
+// is but cannot be read or edited.
+func errConfigUnsupported(path []string) error {
+	return stacktrace.NewError("'%v' uses an unsupported construct", joinConfigPath(path))
+}
+
+// configText holds the lines of a line oriented config format along with
+// the line ending and whether the file ended with one.
+type configText struct {
+	lines    []string
+	eol      string
+	trailing bool
+}
+
+func newConfigText(data []byte) *configText {
+	text := &configText{eol: "\n"}
+
+	if bytes.Contains(data, []byte("\r\n")) {
+		text.eol = "\r\n"
+	}
+
+	content := string(data)
+	text.trailing = content == "" || strings.HasSuffix(content, text.eol)
+	text.lines = splitEditLines(strings.TrimSuffix(content, text.eol), text.eol)
+
+	return text
+}
+
+func (t *configText) bytes() []byte {
+	if len(t.lines) == 0 {
+		return nil
+	}
+
+	joined := strings.Join(t.lines, t.eol)
+
+	if t.trailing {
+		joined += t.eol
+	}
+
+	return []byte(joined)
+}
+
+func (t *configText) insert(at int, lines ...string) {
+	t.lines = append(t.lines[:at], append(lines, t.lines[at:]...)...)
+}
+
+func (t *configText) remove(from, to int) {
+	t.lines = append(t.lines[:from], t.lines[to:]...)
+}
+
+// stripConfigComment removes a trailing comment introduced by one of
+// markers outside of quotes. Markers only start a comment at the beginning
+// of the text or after whitespace.
+func stripConfigComment(s string, markers string) string {
+	quote := rune(0)
+	escaped := false
+
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0:
+			if r == '\\' && quote == '"' {
+				escaped = true
+			} else if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case strings.ContainsRune(markers, r) && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return strings.TrimRight(s[:i], " \t")
+		}
+	}
+
+	return s
+}
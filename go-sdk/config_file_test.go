@@ -0,0 +1,330 @@
+package sdk
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_config_file_formats() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-config")
+	defer os.RemoveAll(dir)
+
+	fs := objects.client.Device("whatever").Filesystem()
+
+	for _, test := range []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{
+			name: "app.json",
+			content: strings.Join([]string{
+				`{`,
+				`  "server": {`,
+				`    "port": 80,`,
+				`    "hosts": ["a", "b"]`,
+				`  },`,
+				`  "debug": true`,
+				`}`,
+				``,
+			}, "\n"),
+			expected: strings.Join([]string{
+				`{`,
+				`  "server": {`,
+				`    "port": 8080,`,
+				`    "hosts": ["a", "b"],`,
+				`    "tls": {"cert": "/etc/ssl/app.pem"}`,
+				`  }`,
+				`}`,
+				``,
+			}, "\n"),
+		},
+		{
+			name: "app.yaml",
+			content: strings.Join([]string{
+				`# application settings`,
+				`server:`,
+				`  port: 80 # http`,
+				`  hosts:`,
+				`    - a`,
+				`    - b`,
+				`debug: true`,
+				``,
+			}, "\n"),
+			expected: strings.Join([]string{
+				`# application settings`,
+				`server:`,
+				`  port: 8080 # http`,
+				`  hosts:`,
+				`    - a`,
+				`    - b`,
+				`  tls:`,
+				`    cert: /etc/ssl/app.pem`,
+				``,
+			}, "\n"),
+		},
+		{
+			name: "app.toml",
+			content: strings.Join([]string{
+				`# application settings`,
+				`debug = true`,
+				``,
+				`[server]`,
+				`port = 80 # http`,
+				`hosts = ["a", "b"]`,
+				``,
+			}, "\n"),
+			expected: strings.Join([]string{
+				`# application settings`,
+				``,
+				`[server]`,
+				`port = 8080 # http`,
+				`hosts = ["a", "b"]`,
+				``,
+				`[server.tls]`,
+				`cert = "/etc/ssl/app.pem"`,
+				``,
+			}, "\n"),
+		},
+		{
+			name: "app.ini",
+			content: strings.Join([]string{
+				`; application settings`,
+				`debug=true`,
+				``,
+				`[server]`,
+				`port=80 ; http`,
+				`hosts=a,b`,
+				``,
+			}, "\n"),
+			expected: strings.Join([]string{
+				`; application settings`,
+				``,
+				`[server]`,
+				`port=8080 ; http`,
+				`hosts=a,b`,
+				``,
+				`[server.tls]`,
+				`cert=/etc/ssl/app.pem`,
+				``,
+			}, "\n"),
+		},
+	} {
+		path := filepath.Join(dir, test.name)
+		ioutil.WriteFile(path, []byte(test.content), 0644)
+
+		config, err := OpenConfigFile(context.Background(), fs, path, "")
+
+		assert.Nil(t.T(), err, test.name)
+
+		debug, ok, err := config.Get("debug")
+
+		assert.Nil(t.T(), err, test.name)
+		assert.True(t.T(), ok, test.name)
+		assert.Contains(t.T(), []interface{}{true, "true"}, debug, test.name)
+
+		_, ok, err = config.Get("server.missing")
+
+		assert.Nil(t.T(), err, test.name)
+		assert.False(t.T(), ok, test.name)
+
+		assert.Nil(t.T(), config.Set("server.port", 8080), test.name)
+
+		if config.Format() == ConfigINI {
+			assert.Nil(t.T(), config.Set(`server\.tls.cert`, "/etc/ssl/app.pem"), test.name)
+		} else {
+			assert.Nil(t.T(), config.Set("server.tls.cert", "/etc/ssl/app.pem"), test.name)
+		}
+
+		deleted, err := config.Delete("debug")
+
+		assert.Nil(t.T(), err, test.name)
+		assert.True(t.T(), deleted, test.name)
+
+		assert.Equal(t.T(), test.expected, string(config.Bytes()), test.name)
+		assert.True(t.T(), config.Changed(), test.name)
+
+		changes, err := config.Diff()
+
+		assert.Nil(t.T(), err, test.name)
+		assert.Len(t.T(), changes, 3, test.name)
+
+		for _, change := range changes {
+			switch change.Op {
+			case ConfigAdded:
+				assert.Equal(t.T(), "/etc/ssl/app.pem", change.New, test.name)
+			case ConfigRemoved:
+				assert.Equal(t.T(), "debug", change.Path, test.name)
+			case ConfigChanged:
+				assert.Equal(t.T(), "server.port", change.Path, test.name)
+			}
+		}
+
+		assert.Nil(t.T(), config.Save(context.Background()), test.name)
+
+		data, _ := ioutil.ReadFile(path)
+		assert.Equal(t.T(), test.expected, string(data), test.name)
+		assert.False(t.T(), config.Changed(), test.name)
+
+		reopened, err := OpenConfigFile(context.Background(), fs, path, "")
+
+		assert.Nil(t.T(), err, test.name)
+
+		port, _, _ := reopened.Get("server.port")
+		assert.Contains(t.T(), []interface{}{float64(8080), int64(8080), "8080"}, port, test.name)
+	}
+}
+
+func (t *Test_DeviceFilesystem) Test_config_file_unsupported_and_conflicts() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-config")
+	defer os.RemoveAll(dir)
+
+	fs := objects.client.Device("whatever").Filesystem()
+
+	path := filepath.Join(dir, "compose.yml")
+	ioutil.WriteFile(path, []byte("services:\n  web:\n    ports:\n    - 80:80\n    image: nginx\n"), 0644)
+
+	config, err := OpenConfigFile(context.Background(), fs, path, "")
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), ConfigYAML, config.Format())
+
+	image, ok, err := config.Get("services.web.image")
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), ok)
+	assert.Equal(t.T(), "nginx", image)
+
+	_, _, err = config.Get("services.web.ports")
+	assert.NotNil(t.T(), err)
+
+	assert.NotNil(t.T(), config.Set("services.web.ports.0", "8080:80"))
+	assert.Nil(t.T(), config.Set("services.web.image", "nginx:1.25"))
+
+	ioutil.WriteFile(path, []byte("services: {}\n"), 0644)
+
+	err = config.Save(context.Background())
+
+	_, ok = err.(*ErrPreconditionFailed)
+	assert.True(t.T(), ok)
+
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t.T(), "services: {}\n", string(data))
+
+	_, err = OpenConfigFile(context.Background(), fs, filepath.Join(dir, "broken.json"), ConfigJSON)
+	assert.NotNil(t.T(), err)
+
+	ioutil.WriteFile(filepath.Join(dir, "broken.json"), []byte(`{"a": `), 0644)
+
+	_, err = OpenConfigFile(context.Background(), fs, filepath.Join(dir, "broken.json"), ConfigJSON)
+	assert.NotNil(t.T(), err)
+}
+
+func (t *Test_DeviceFilesystem) Test_config_yaml_quotes_yaml11_keywords() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-config")
+	defer os.RemoveAll(dir)
+
+	fs := objects.client.Device("whatever").Filesystem()
+
+	path := filepath.Join(dir, "app.yaml")
+	ioutil.WriteFile(path, []byte("debug: true\n"), 0644)
+
+	config, err := OpenConfigFile(context.Background(), fs, path, "")
+
+	assert.Nil(t.T(), err)
+
+	values := map[string]string{
+		"on":      "yes",
+		"answer":  "No",
+		"flag":    "OFF",
+		"short":   "y",
+		"empty":   "~",
+		"nothing": "Null",
+		"plain":   "yesterday",
+	}
+
+	for key, value := range values {
+		assert.Nil(t.T(), config.Set(key, value), key)
+	}
+
+	assert.Nil(t.T(), config.Save(context.Background()))
+
+	data, _ := ioutil.ReadFile(path)
+
+	for _, line := range []string{`"on": "yes"`, `answer: "No"`, `flag: "OFF"`, `short: "y"`, `empty: "~"`, `nothing: "Null"`, `plain: yesterday`} {
+		assert.Contains(t.T(), string(data), line+"\n")
+	}
+
+	reopened, err := OpenConfigFile(context.Background(), fs, path, "")
+
+	assert.Nil(t.T(), err)
+
+	for key, value := range values {
+		read, ok, err := reopened.Get(key)
+
+		assert.Nil(t.T(), err, key)
+		assert.True(t.T(), ok, key)
+		assert.Equal(t.T(), value, read, key)
+	}
+}
+
+func (t *Test_DeviceFilesystem) Test_config_yaml_quotes_yaml11_typed_scalars() {
+	for _, test := range []struct {
+		value  string
+		quoted bool
+	}{
+		{value: "0x10", quoted: true},
+		{value: "0o17", quoted: true},
+		{value: "017", quoted: true},
+		{value: "0b101", quoted: true},
+		{value: "1_000", quoted: true},
+		{value: "190:20:30", quoted: true},
+		{value: "1_000.5", quoted: true},
+		{value: "6.8523015e+5", quoted: true},
+		{value: ".5", quoted: true},
+		{value: ".inf", quoted: true},
+		{value: "-.Inf", quoted: true},
+		{value: ".nan", quoted: true},
+		{value: "2001-12-14", quoted: true},
+		{value: "2001-12-14t21:59:43.10-05:00", quoted: true},
+		{value: "2001-12-14 21:59:43.10 Z", quoted: true},
+		{value: "1.2.3"},
+		{value: "0x"},
+		{value: "v1.0"},
+		{value: "inf"},
+		{value: "2001-12"},
+		{value: "10.0.0.1"},
+	} {
+		formatted, err := formatYAMLScalar(test.value)
+
+		assert.Nil(t.T(), err, test.value)
+
+		if test.quoted {
+			assert.Equal(t.T(), quoteJSON(test.value), formatted, test.value)
+		} else {
+			assert.Equal(t.T(), test.value, formatted, test.value)
+		}
+
+		assert.Equal(t.T(), test.value, parseYAMLScalar(formatted), test.value)
+	}
+}
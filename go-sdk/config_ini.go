@@ -0,0 +1,307 @@
+package sdk
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+// iniConfig edits an ini file line by line. Paths are either a key of the
+// part before the first section, a section or a key of a section.
+type iniConfig struct {
+	text     *configText
+	sections []*iniSection
+}
+
+// iniSection is a section whose header is at line, the global section has
+// none. Its entries end at end.
+type iniSection struct {
+	name    string
+	line    int
+	end     int
+	entries []*iniEntry
+}
+
+type iniEntry struct {
+	key     string
+	line    int
+	indent  string
+	sep     string
+	value   string
+	comment string
+}
+
+func parseINIConfig(data []byte) (*iniConfig, error) {
+	doc := &iniConfig{text: newConfigText(data)}
+	doc.parse()
+
+	return doc, nil
+}
+
+func (t *iniConfig) bytes() []byte {
+	return t.text.bytes()
+}
+
+func (t *iniConfig) parse() {
+	section := &iniSection{line: -1}
+	sections := []*iniSection{section}
+
+	for i, line := range t.text.lines {
+		content := strings.TrimSpace(line)
+
+		if content == "" || content[0] == ';' || content[0] == '#' {
+			continue
+		}
+
+		if content[0] == '[' && strings.Contains(content, "]") {
+			section = &iniSection{
+				name: strings.TrimSpace(content[1:strings.Index(content, "]")]),
+				line: i,
+				end:  i + 1,
+			}
+			sections = append(sections, section)
+
+			continue
+		}
+
+		entry := &iniEntry{
+			line:   i,
+			indent: line[:len(line)-len(strings.TrimLeft(line, " \t"))],
+		}
+
+		sep := strings.IndexAny(content, "=:")
+
+		if sep < 0 {
+			entry.key = content
+		} else {
+			entry.key = strings.TrimSpace(content[:sep])
+
+			rest := strings.TrimLeft(content[sep+1:], " \t")
+			value := stripConfigComment(rest, ";#")
+
+			entry.sep = content[len(entry.key) : len(content)-len(rest)]
+			entry.value = value
+			entry.comment = rest[len(value):]
+		}
+
+		section.entries = append(section.entries, entry)
+		section.end = i + 1
+	}
+
+	t.sections = sections
+}
+
+func (t *iniConfig) section(name string) *iniSection {
+	var found *iniSection
+
+	for _, section := range t.sections[1:] {
+		if section.name == name {
+			found = section
+		}
+	}
+
+	return found
+}
+
+// lookup resolves path to a section and a key, an empty key addresses the
+// section itself.
+func (t *iniConfig) lookup(path []string) (*iniSection, string, error) {
+	switch len(path) {
+	case 1:
+		if t.sections[0].entry(path[0]) != nil || t.section(path[0]) == nil {
+			return t.sections[0], path[0], nil
+		}
+
+		return t.section(path[0]), "", nil
+	case 2:
+		return t.section(path[0]), path[1], nil
+	default:
+		return nil, "", stacktrace.NewError("ini path '%v' has more than two keys", joinConfigPath(path))
+	}
+}
+
+func (t *iniSection) entry(key string) *iniEntry {
+	var found *iniEntry
+
+	for _, entry := range t.entries {
+		if entry.key == key {
+			found = entry
+		}
+	}
+
+	return found
+}
+
+func (t *iniConfig) get(path []string) (interface{}, bool, error) {
+	section, key, err := t.lookup(path)
+
+	if err != nil || section == nil {
+		return nil, false, err
+	}
+
+	if key == "" {
+		values := map[string]interface{}{}
+
+		for _, entry := range section.entries {
+			values[entry.key] = entry.value
+		}
+
+		return values, true, nil
+	}
+
+	entry := section.entry(key)
+
+	if entry == nil {
+		return nil, false, nil
+	}
+
+	return entry.value, true, nil
+}
+
+func (t *iniConfig) set(path []string, value interface{}) error {
+	if mapping, ok := value.(map[string]interface{}); ok && len(path) == 1 {
+		keys := []string{}
+
+		for key := range mapping {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if err := t.set([]string{path[0], key}, mapping[key]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	text, err := formatINIValue(value)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "cannot set '%v'", joinConfigPath(path))
+	}
+
+	section, key, err := t.lookup(path)
+
+	if err != nil {
+		return err
+	}
+
+	if section != nil && key == "" {
+		return stacktrace.NewError("cannot set '%v': it is a section", joinConfigPath(path))
+	}
+
+	if section != nil {
+		if entry := section.entry(key); entry != nil {
+			t.text.lines[entry.line] = entry.indent + entry.key + entry.sep + text + entry.comment
+			t.parse()
+
+			return nil
+		}
+	}
+
+	line := key + t.separator() + text
+
+	if section == nil {
+		lines := []string{"[" + path[0] + "]", line}
+
+		if n := len(t.text.lines); n > 0 && strings.TrimSpace(t.text.lines[n-1]) != "" {
+			lines = append([]string{""}, lines...)
+		}
+
+		t.text.insert(len(t.text.lines), lines...)
+		t.parse()
+
+		return nil
+	}
+
+	if len(section.entries) > 0 {
+		line = section.entries[len(section.entries)-1].indent + line
+	}
+
+	t.text.insert(section.end, line)
+	t.parse()
+
+	return nil
+}
+
+// separator returns the separator used by the last entry, so new entries
+// look like the existing ones.
+func (t *iniConfig) separator() string {
+	sep := " = "
+
+	for _, section := range t.sections {
+		for _, entry := range section.entries {
+			if entry.sep != "" {
+				sep = entry.sep
+			}
+		}
+	}
+
+	return sep
+}
+
+func (t *iniConfig) delete(path []string) (bool, error) {
+	section, key, err := t.lookup(path)
+
+	if err != nil || section == nil {
+		return false, err
+	}
+
+	if key == "" {
+		t.text.remove(section.line, section.end)
+		t.parse()
+
+		return true, nil
+	}
+
+	found := false
+
+	for i := len(section.entries) - 1; i >= 0; i-- {
+		if entry := section.entries[i]; entry.key == key {
+			t.text.remove(entry.line, entry.line+1)
+			found = true
+		}
+	}
+
+	t.parse()
+
+	return found, nil
+}
+
+func (t *iniConfig) values() (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+
+	for i, section := range t.sections {
+		for _, entry := range section.entries {
+			if i == 0 {
+				values[joinConfigPath([]string{entry.key})] = entry.value
+			} else {
+				values[joinConfigPath([]string{section.name, entry.key})] = entry.value
+			}
+		}
+	}
+
+	return values, nil
+}
+
+func formatINIValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		if strings.ContainsAny(v, "\r\n") {
+			return "", stacktrace.NewError("ini values cannot span lines")
+		}
+
+		return v, nil
+	case map[string]interface{}, []interface{}:
+		return "", stacktrace.NewError("cannot store a %T in ini", value)
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
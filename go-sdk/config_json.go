@@ -0,0 +1,443 @@
+package sdk
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+
+	"github.com/palantir/stacktrace"
+)
+
+// jsonConfig edits a json document by splicing re-encoded values into the
+// original text, so the untouched parts keep their formatting and order.
+type jsonConfig struct {
+	data []byte
+}
+
+// jsonSpan is the position of a value in the document.
+type jsonSpan struct {
+	start   int
+	end     int
+	kind    byte
+	members []*jsonMember
+	items   []*jsonSpan
+}
+
+type jsonMember struct {
+	key      string
+	keyStart int
+	keyEnd   int
+	value    *jsonSpan
+}
+
+func parseJSONConfig(data []byte) (*jsonConfig, error) {
+	if len(bytes.TrimSpace(data)) > 0 && !json.Valid(data) {
+		return nil, stacktrace.NewError("invalid json document")
+	}
+
+	return &jsonConfig{data: data}, nil
+}
+
+func (t *jsonConfig) bytes() []byte {
+	return t.data
+}
+
+func (t *jsonConfig) root() (*jsonSpan, error) {
+	if len(bytes.TrimSpace(t.data)) == 0 {
+		t.data = []byte("{}\n")
+	}
+
+	scanner := &jsonScanner{data: t.data}
+
+	return scanner.value()
+}
+
+// find returns the span at path and the spans of its parents.
+func (t *jsonConfig) find(path []string) ([]*jsonSpan, error) {
+	root, err := t.root()
+
+	if err != nil {
+		return nil, err
+	}
+
+	spans := []*jsonSpan{root}
+
+	for _, key := range path {
+		child, err := root.child(key)
+
+		if err != nil || child == nil {
+			return spans, err
+		}
+
+		spans = append(spans, child)
+		root = child
+	}
+
+	return spans, nil
+}
+
+func (t *jsonConfig) get(path []string) (interface{}, bool, error) {
+	if len(bytes.TrimSpace(t.data)) == 0 {
+		return nil, false, nil
+	}
+
+	spans, err := t.find(path)
+
+	if err != nil || len(spans) <= len(path) {
+		return nil, false, err
+	}
+
+	span := spans[len(spans)-1]
+
+	var value interface{}
+
+	if err := json.Unmarshal(t.data[span.start:span.end], &value); err != nil {
+		return nil, false, stacktrace.Propagate(err, "failed decoding '%v'", joinConfigPath(path))
+	}
+
+	return value, true, nil
+}
+
+func (t *jsonConfig) set(path []string, value interface{}) error {
+	encoded, err := marshalJSON(value)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed encoding value of '%v'", joinConfigPath(path))
+	}
+
+	spans, err := t.find(path)
+
+	if err != nil {
+		return err
+	}
+
+	if len(spans) > len(path) {
+		span := spans[len(spans)-1]
+		t.splice(span.start, span.end, string(encoded))
+
+		return nil
+	}
+
+	parent := spans[len(spans)-1]
+	missing := path[len(spans)-1:]
+
+	switch parent.kind {
+	case '{':
+		sep := ": "
+
+		if len(parent.members) > 0 {
+			last := parent.members[len(parent.members)-1]
+			sep = string(t.data[last.keyEnd:last.value.start])
+		}
+
+		raw := string(encoded)
+
+		for i := len(missing) - 1; i > 0; i-- {
+			raw = "{" + quoteJSON(missing[i]) + sep + raw + "}"
+		}
+
+		if len(parent.members) == 0 {
+			t.splice(parent.start, parent.end, "{"+quoteJSON(missing[0])+sep+raw+"}")
+			return nil
+		}
+
+		last := parent.members[len(parent.members)-1]
+		indent := t.data[t.whitespaceBefore(last.keyStart):last.keyStart]
+		t.splice(last.value.end, last.value.end, ","+string(indent)+quoteJSON(missing[0])+sep+raw)
+
+		return nil
+
+	case '[':
+		if index, err := strconv.Atoi(missing[0]); err != nil || index != len(parent.items) || len(missing) > 1 {
+			return stacktrace.NewError("cannot set '%v': array index out of range", joinConfigPath(path))
+		}
+
+		if len(parent.items) == 0 {
+			t.splice(parent.start, parent.end, "["+string(encoded)+"]")
+			return nil
+		}
+
+		last := parent.items[len(parent.items)-1]
+		indent := t.data[t.whitespaceBefore(last.start):last.start]
+		t.splice(last.end, last.end, ","+string(indent)+string(encoded))
+
+		return nil
+
+	default:
+		return stacktrace.NewError("cannot set '%v': parent is not an object", joinConfigPath(path))
+	}
+}
+
+func (t *jsonConfig) delete(path []string) (bool, error) {
+	if len(bytes.TrimSpace(t.data)) == 0 {
+		return false, nil
+	}
+
+	spans, err := t.find(path)
+
+	if err != nil || len(spans) <= len(path) {
+		return false, err
+	}
+
+	parent := spans[len(spans)-2]
+	span := spans[len(spans)-1]
+	starts := []int{}
+	ends := []int{}
+
+	for _, member := range parent.members {
+		starts = append(starts, member.keyStart)
+		ends = append(ends, member.value.end)
+	}
+
+	for _, item := range parent.items {
+		starts = append(starts, item.start)
+		ends = append(ends, item.end)
+	}
+
+	index := 0
+
+	for i, end := range ends {
+		if end == span.end {
+			index = i
+		}
+	}
+
+	switch {
+	case len(ends) == 1:
+		t.splice(parent.start, parent.end, string(t.data[parent.start])+string(t.data[parent.end-1]))
+	case index < len(ends)-1:
+		t.splice(starts[index], starts[index+1], "")
+	default:
+		t.splice(ends[index-1], ends[index], "")
+	}
+
+	return true, nil
+}
+
+func (t *jsonConfig) values() (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+
+	if len(bytes.TrimSpace(t.data)) == 0 {
+		return values, nil
+	}
+
+	var document interface{}
+
+	if err := json.Unmarshal(t.data, &document); err != nil {
+		return nil, stacktrace.Propagate(err, "failed decoding json document")
+	}
+
+	flattenConfig(values, nil, document)
+
+	return values, nil
+}
+
+func (t *jsonConfig) splice(start, end int, replacement string) {
+	data := make([]byte, 0, len(t.data)-(end-start)+len(replacement))
+	data = append(data, t.data[:start]...)
+	data = append(data, replacement...)
+	data = append(data, t.data[end:]...)
+
+	t.data = data
+}
+
+// whitespaceBefore returns the offset of the whitespace run ending at pos.
+func (t *jsonConfig) whitespaceBefore(pos int) int {
+	for pos > 0 && isJSONSpace(t.data[pos-1]) {
+		pos--
+	}
+
+	return pos
+}
+
+func (t *jsonSpan) child(key string) (*jsonSpan, error) {
+	switch t.kind {
+	case '{':
+		var found *jsonSpan
+
+		// like encoding/json the last of duplicate keys wins
+		for _, member := range t.members {
+			if member.key == key {
+				found = member.value
+			}
+		}
+
+		return found, nil
+
+	case '[':
+		index, err := strconv.Atoi(key)
+
+		if err != nil || index < 0 {
+			return nil, stacktrace.NewError("'%v' is not an array index", key)
+		}
+
+		if index >= len(t.items) {
+			return nil, nil
+		}
+
+		return t.items[index], nil
+
+	default:
+		return nil, stacktrace.NewError("cannot descend into scalar to reach '%v'", key)
+	}
+}
+
+// jsonScanner records the spans of a document already known to be valid.
+type jsonScanner struct {
+	data []byte
+	pos  int
+}
+
+func (t *jsonScanner) skip() {
+	for t.pos < len(t.data) && isJSONSpace(t.data[t.pos]) {
+		t.pos++
+	}
+}
+
+func (t *jsonScanner) expect(c byte) error {
+	t.skip()
+
+	if t.pos >= len(t.data) || t.data[t.pos] != c {
+		return stacktrace.NewError("expected '%c' at offset %v", c, t.pos)
+	}
+
+	t.pos++
+
+	return nil
+}
+
+func (t *jsonScanner) value() (*jsonSpan, error) {
+	t.skip()
+
+	if t.pos >= len(t.data) {
+		return nil, stacktrace.NewError("unexpected end of json document")
+	}
+
+	span := &jsonSpan{start: t.pos, kind: t.data[t.pos]}
+
+	switch span.kind {
+	case '{':
+		t.pos++
+		t.skip()
+
+		for t.pos < len(t.data) && t.data[t.pos] != '}' {
+			member := &jsonMember{keyStart: t.pos}
+
+			key, err := t.str()
+
+			if err != nil {
+				return nil, err
+			}
+
+			member.key = key
+			member.keyEnd = t.pos
+
+			if err := t.expect(':'); err != nil {
+				return nil, err
+			}
+
+			if member.value, err = t.value(); err != nil {
+				return nil, err
+			}
+
+			span.members = append(span.members, member)
+
+			if t.skip(); t.pos < len(t.data) && t.data[t.pos] == ',' {
+				t.pos++
+				t.skip()
+			}
+		}
+
+		if err := t.expect('}'); err != nil {
+			return nil, err
+		}
+
+	case '[':
+		t.pos++
+		t.skip()
+
+		for t.pos < len(t.data) && t.data[t.pos] != ']' {
+			item, err := t.value()
+
+			if err != nil {
+				return nil, err
+			}
+
+			span.items = append(span.items, item)
+
+			if t.skip(); t.pos < len(t.data) && t.data[t.pos] == ',' {
+				t.pos++
+				t.skip()
+			}
+		}
+
+		if err := t.expect(']'); err != nil {
+			return nil, err
+		}
+
+	case '"':
+		if _, err := t.str(); err != nil {
+			return nil, err
+		}
+
+		span.kind = 0
+
+	default:
+		for t.pos < len(t.data) && !isJSONSpace(t.data[t.pos]) && bytes.IndexByte([]byte(",]}"), t.data[t.pos]) < 0 {
+			t.pos++
+		}
+
+		span.kind = 0
+	}
+
+	span.end = t.pos
+
+	return span, nil
+}
+
+func (t *jsonScanner) str() (string, error) {
+	start := t.pos
+
+	if t.pos >= len(t.data) || t.data[t.pos] != '"' {
+		return "", stacktrace.NewError("expected string at offset %v", t.pos)
+	}
+
+	for t.pos++; t.pos < len(t.data) && t.data[t.pos] != '"'; t.pos++ {
+		if t.data[t.pos] == '\\' {
+			t.pos++
+		}
+	}
+
+	t.pos++
+
+	var s string
+
+	if err := json.Unmarshal(t.data[start:t.pos], &s); err != nil {
+		return "", stacktrace.Propagate(err, "invalid string at offset %v", start)
+	}
+
+	return s, nil
+}
+
+func isJSONSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func quoteJSON(s string) string {
+	data, _ := marshalJSON(s)
+	return string(data)
+}
+
+// marshalJSON encodes v without escaping HTML characters, which would only
+// obscure the edited files.
+func marshalJSON(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,571 @@
+package sdk
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+var (
+	tomlInteger = regexp.MustCompile(`^[-+]?\d[\d_]*$`)
+	tomlFloat   = regexp.MustCompile(`^[-+]?\d[\d_]*(\.\d[\d_]*)?([eE][-+]?\d[\d_]*)?$`)
+	tomlBareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// tomlConfig edits the tables and key/value pairs of a toml document line by
+// line. Arrays of tables, arrays, inline tables, dates and multi-line strings
+// are opaque, their lines are kept but cannot be addressed.
+type tomlConfig struct {
+	text   *configText
+	tables []*tomlTable
+}
+
+// tomlTable is a table whose header is at line, the root table has none.
+// Its entries end at end.
+type tomlTable struct {
+	path    []string
+	line    int
+	end     int
+	array   bool
+	entries []*tomlEntry
+}
+
+// tomlEntry is a key/value pair spanning the lines [line, end). path is the
+// full path of the key, including the one of its table.
+type tomlEntry struct {
+	path    []string
+	line    int
+	end     int
+	prefix  string
+	value   string
+	comment string
+}
+
+func parseTOMLConfig(data []byte) (*tomlConfig, error) {
+	doc := &tomlConfig{text: newConfigText(data)}
+
+	if err := doc.parse(); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+func (t *tomlConfig) bytes() []byte {
+	return t.text.bytes()
+}
+
+func (t *tomlConfig) parse() error {
+	table := &tomlTable{path: []string{}, line: -1}
+	tables := []*tomlTable{table}
+	lines := t.text.lines
+
+	for i := 0; i < len(lines); i++ {
+		content := strings.TrimSpace(lines[i])
+
+		if content == "" || content[0] == '#' {
+			continue
+		}
+
+		if content[0] == '[' {
+			header := stripConfigComment(content, "#")
+			array := strings.HasPrefix(header, "[[")
+
+			name := strings.TrimSuffix(strings.TrimPrefix(header, "["), "]")
+
+			if array {
+				name = strings.TrimSuffix(strings.TrimPrefix(name, "["), "]")
+			}
+
+			path, err := parseTOMLKey(name)
+
+			if err != nil {
+				return stacktrace.Propagate(err, "line %v", i+1)
+			}
+
+			table = &tomlTable{path: path, line: i, end: i + 1, array: array}
+			tables = append(tables, table)
+
+			continue
+		}
+
+		line := lines[i]
+		lead := len(line) - len(strings.TrimLeft(line, " \t"))
+		eq := tomlAssignment(line[lead:])
+
+		if eq < 0 {
+			return stacktrace.NewError("line %v: expected a key/value pair", i+1)
+		}
+
+		key, err := parseTOMLKey(line[lead : lead+eq])
+
+		if err != nil {
+			return stacktrace.Propagate(err, "line %v", i+1)
+		}
+
+		start := lead + eq + 1
+
+		for start < len(line) && (line[start] == ' ' || line[start] == '\t') {
+			start++
+		}
+
+		rest := line[start:]
+		value := stripConfigComment(rest, "#")
+
+		entry := &tomlEntry{
+			path:    append(append([]string{}, table.path...), key...),
+			line:    i,
+			end:     i + 1,
+			prefix:  line[:start],
+			value:   strings.TrimSpace(value),
+			comment: rest[len(value):],
+		}
+
+		// multi-line strings and arrays continue until they are closed
+		if end := tomlValueEnd(lines, i, entry.value); end > i+1 {
+			entry.end = end
+			entry.value = strings.TrimSpace(strings.Join(append([]string{rest}, lines[i+1:end]...), t.text.eol))
+			entry.comment = ""
+			i = end - 1
+		}
+
+		table.entries = append(table.entries, entry)
+		table.end = entry.end
+	}
+
+	t.tables = tables
+
+	return nil
+}
+
+// tomlAssignment returns the offset of the '=' separating key and value.
+func tomlAssignment(s string) int {
+	quote := rune(0)
+
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '=':
+			return i
+		}
+	}
+
+	return -1
+}
+
+// tomlValueEnd returns the line after the last one of the value starting at
+// line.
+func tomlValueEnd(lines []string, line int, value string) int {
+	for _, delim := range []string{`"""`, `'''`} {
+		if strings.HasPrefix(value, delim) && !strings.Contains(value[3:], delim) {
+			for i := line + 1; i < len(lines); i++ {
+				if strings.Contains(lines[i], delim) {
+					return i + 1
+				}
+			}
+
+			return len(lines)
+		}
+	}
+
+	if value == "" || (value[0] != '[' && value[0] != '{') {
+		return line + 1
+	}
+
+	depth := 0
+
+	for i := line; i < len(lines); i++ {
+		text := value
+
+		if i > line {
+			text = stripConfigComment(lines[i], "#")
+		}
+
+		quote := rune(0)
+
+		for _, r := range text {
+			switch {
+			case quote != 0:
+				if r == quote {
+					quote = 0
+				}
+			case r == '"' || r == '\'':
+				quote = r
+			case r == '[' || r == '{':
+				depth++
+			case r == ']' || r == '}':
+				depth--
+			}
+		}
+
+		if depth <= 0 {
+			return i + 1
+		}
+	}
+
+	return len(lines)
+}
+
+// parseTOMLKey splits a possibly dotted and quoted key.
+func parseTOMLKey(s string) ([]string, error) {
+	keys := []string{}
+	quote := rune(0)
+	start := 0
+
+	split := func(end int) error {
+		key := strings.TrimSpace(s[start:end])
+
+		switch {
+		case strings.HasPrefix(key, `"`):
+			var unquoted string
+
+			if err := json.Unmarshal([]byte(key), &unquoted); err != nil {
+				return stacktrace.Propagate(err, "invalid key '%v'", key)
+			}
+
+			key = unquoted
+		case strings.HasPrefix(key, "'"):
+			key = strings.Trim(key, "'")
+		case !tomlBareKey.MatchString(key):
+			return stacktrace.NewError("invalid key '%v'", key)
+		}
+
+		keys = append(keys, key)
+		start = end + 1
+
+		return nil
+	}
+
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '.':
+			if err := split(i); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := split(len(s)); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (t *tomlConfig) entry(path []string) *tomlEntry {
+	var found *tomlEntry
+
+	for _, table := range t.tables {
+		if table.array {
+			continue
+		}
+
+		for _, entry := range table.entries {
+			if equalLines(entry.path, path) {
+				found = entry
+			}
+		}
+	}
+
+	return found
+}
+
+func (t *tomlConfig) get(path []string) (interface{}, bool, error) {
+	if entry := t.entry(path); entry != nil {
+		value, ok := parseTOMLValue(entry.value)
+
+		if !ok {
+			return nil, false, errConfigUnsupported(path)
+		}
+
+		return value, true, nil
+	}
+
+	table := map[string]interface{}{}
+	found := false
+
+	for _, candidate := range t.tables {
+		if hasConfigPrefix(candidate.path, path) {
+			if candidate.array {
+				return nil, false, errConfigUnsupported(path)
+			}
+
+			found = true
+		}
+
+		for _, entry := range candidate.entries {
+			if !hasConfigPrefix(entry.path, path) || candidate.array {
+				continue
+			}
+
+			value, ok := parseTOMLValue(entry.value)
+
+			if !ok {
+				return nil, false, errConfigUnsupported(entry.path)
+			}
+
+			nested := table
+
+			for _, key := range entry.path[len(path) : len(entry.path)-1] {
+				child, ok := nested[key].(map[string]interface{})
+
+				if !ok {
+					child = map[string]interface{}{}
+					nested[key] = child
+				}
+
+				nested = child
+			}
+
+			nested[entry.path[len(entry.path)-1]] = value
+			found = true
+		}
+	}
+
+	if !found {
+		return nil, false, nil
+	}
+
+	return table, true, nil
+}
+
+func (t *tomlConfig) set(path []string, value interface{}) error {
+	if mapping, ok := value.(map[string]interface{}); ok {
+		keys := []string{}
+
+		for key := range mapping {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if err := t.set(append(path[:len(path):len(path)], key), mapping[key]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	text, err := formatTOMLValue(value)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "cannot set '%v'", joinConfigPath(path))
+	}
+
+	if entry := t.entry(path); entry != nil {
+		t.text.remove(entry.line+1, entry.end)
+		t.text.lines[entry.line] = entry.prefix + text + entry.comment
+
+		return t.parse()
+	}
+
+	for i := 1; i < len(path); i++ {
+		if t.entry(path[:i]) != nil {
+			return stacktrace.NewError("cannot set '%v': '%v' is not a table", joinConfigPath(path), joinConfigPath(path[:i]))
+		}
+	}
+
+	// the key goes into the deepest table holding it, when that is not its
+	// direct parent a new table is appended instead of using dotted keys
+	var table *tomlTable
+
+	for _, candidate := range t.tables {
+		if candidate.array && hasConfigPrefix(path, candidate.path) {
+			return errConfigUnsupported(path)
+		}
+
+		if !candidate.array && len(candidate.path) == len(path)-1 && hasConfigPrefix(path, candidate.path) {
+			table = candidate
+		}
+	}
+
+	line := formatTOMLKey(path[len(path)-1:]) + " = " + text
+
+	if table == nil {
+		lines := []string{"[" + formatTOMLKey(path[:len(path)-1]) + "]", line}
+
+		if n := len(t.text.lines); n > 0 && strings.TrimSpace(t.text.lines[n-1]) != "" {
+			lines = append([]string{""}, lines...)
+		}
+
+		t.text.insert(len(t.text.lines), lines...)
+
+		return t.parse()
+	}
+
+	if len(table.entries) > 0 {
+		last := table.entries[len(table.entries)-1]
+		line = last.prefix[:len(last.prefix)-len(strings.TrimLeft(last.prefix, " \t"))] + line
+	}
+
+	t.text.insert(table.end, line)
+
+	return t.parse()
+}
+
+func (t *tomlConfig) delete(path []string) (bool, error) {
+	ranges := [][2]int{}
+
+	for _, table := range t.tables {
+		if table.line >= 0 && hasConfigPrefix(table.path, path) {
+			ranges = append(ranges, [2]int{table.line, table.end})
+			continue
+		}
+
+		if table.array {
+			continue
+		}
+
+		for _, entry := range table.entries {
+			if hasConfigPrefix(entry.path, path) {
+				ranges = append(ranges, [2]int{entry.line, entry.end})
+			}
+		}
+	}
+
+	if len(ranges) == 0 {
+		return false, nil
+	}
+
+	// removing from the bottom keeps the earlier line numbers valid
+	for i := len(ranges) - 1; i >= 0; i-- {
+		t.text.remove(ranges[i][0], ranges[i][1])
+	}
+
+	return true, t.parse()
+}
+
+func (t *tomlConfig) values() (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+
+	for _, table := range t.tables {
+		if table.array {
+			raw, _ := values[joinConfigPath(table.path)].(string)
+			values[joinConfigPath(table.path)] = raw + strings.Join(t.text.lines[table.line:table.end], t.text.eol)
+
+			continue
+		}
+
+		for _, entry := range table.entries {
+			value, ok := parseTOMLValue(entry.value)
+
+			if !ok {
+				value = entry.value
+			}
+
+			values[joinConfigPath(entry.path)] = value
+		}
+	}
+
+	return values, nil
+}
+
+// parseTOMLValue decodes strings, booleans, integers and floats, the second
+// result is false for other values.
+func parseTOMLValue(s string) (interface{}, bool) {
+	switch {
+	case s == "true":
+		return true, true
+	case s == "false":
+		return false, true
+	case strings.HasPrefix(s, `"""`) || strings.HasPrefix(s, `'''`):
+		return nil, false
+	case strings.HasPrefix(s, `"`):
+		var unquoted string
+
+		if err := json.Unmarshal([]byte(s), &unquoted); err != nil {
+			return nil, false
+		}
+
+		return unquoted, true
+	case strings.HasPrefix(s, "'") && len(s) > 1 && strings.HasSuffix(s, "'"):
+		return s[1 : len(s)-1], true
+	case tomlInteger.MatchString(s):
+		if i, err := strconv.ParseInt(strings.Replace(s, "_", "", -1), 10, 64); err == nil {
+			return i, true
+		}
+	case tomlFloat.MatchString(s):
+		if f, err := strconv.ParseFloat(strings.Replace(s, "_", "", -1), 64); err == nil {
+			return f, true
+		}
+	}
+
+	return nil, false
+}
+
+func formatTOMLValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case bool:
+		return strconv.FormatBool(v), nil
+	case string:
+		return quoteJSON(v), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case float32:
+		return formatTOMLValue(float64(v))
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			return "nan", nil
+		case math.IsInf(v, 1):
+			return "inf", nil
+		case math.IsInf(v, -1):
+			return "-inf", nil
+		}
+
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0"
+		}
+
+		return s, nil
+	}
+
+	switch reflect.ValueOf(value).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return fmt.Sprint(value), nil
+	}
+
+	return "", stacktrace.NewError("cannot store a %T in toml", value)
+}
+
+func formatTOMLKey(path []string) string {
+	keys := make([]string, len(path))
+
+	for i, key := range path {
+		keys[i] = key
+
+		if !tomlBareKey.MatchString(key) {
+			keys[i] = quoteJSON(key)
+		}
+	}
+
+	return strings.Join(keys, ".")
+}
+
+func hasConfigPrefix(path, prefix []string) bool {
+	return len(path) >= len(prefix) && equalLines(path[:len(prefix)], prefix)
+}
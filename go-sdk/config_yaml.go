@@ -0,0 +1,483 @@
+package sdk
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+var yamlNumber = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)([eE][-+]?\d+)?$`)
+
+// yaml11Keyword matches the plain scalars YAML 1.1 parsers read as booleans
+// or null, which have to be quoted to stay strings.
+var yaml11Keyword = regexp.MustCompile(`^(?i:y|n|yes|no|on|off|true|false|null|~)$`)
+
+// yaml11Typed matches the plain scalars the int, float and timestamp
+// resolvers of YAML 1.1, and the octal ints of YAML 1.2, read as other
+// types than strings.
+var yaml11Typed = regexp.MustCompile(`^(?:` +
+	`[-+]?0b[01_]+|[-+]?0o?[0-7_]+|[-+]?(?:0|[1-9][0-9_]*)|[-+]?0x[0-9a-fA-F_]+|[-+]?[1-9][0-9_]*(?::[0-5]?[0-9])+|` +
+	`[-+]?(?:[0-9][0-9_]*)?\.[0-9_]*(?:[eE][-+]?[0-9]+)?|[-+]?[0-9][0-9_]*(?::[0-5]?[0-9])+\.[0-9_]*|[-+]?\.(?:inf|Inf|INF)|\.(?:nan|NaN|NAN)|` +
+	`[0-9]{4}-[0-9]{1,2}-[0-9]{1,2}(?:(?:[Tt]|[ \t]+)[0-9]{1,2}:[0-9]{2}:[0-9]{2}(?:\.[0-9]*)?(?:[ \t]*Z|[-+][0-9]{1,2}(?::[0-9]{2})?)?)?` +
+	`)$`)
+
+// yamlConfig edits the block mappings of a yaml document line by line.
+// Sequences, flow collections, block scalars, anchors and tags are opaque,
+// their lines are kept but cannot be addressed.
+type yamlConfig struct {
+	text *configText
+	root *yamlNode
+}
+
+// yamlNode is a mapping entry spanning the lines [line, end).
+type yamlNode struct {
+	key      string
+	keyText  string
+	line     int
+	end      int
+	indent   int
+	value    string
+	comment  string
+	opaque   bool
+	children []*yamlNode
+}
+
+func parseYAMLConfig(data []byte) (*yamlConfig, error) {
+	doc := &yamlConfig{text: newConfigText(data)}
+
+	if err := doc.parse(); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+func (t *yamlConfig) bytes() []byte {
+	return t.text.bytes()
+}
+
+func (t *yamlConfig) parse() error {
+	root := &yamlNode{line: -1, indent: -1}
+	stack := []*yamlNode{root}
+
+	for i, line := range t.text.lines {
+		content := strings.TrimLeft(line, " ")
+
+		if content == "" || content[0] == '#' || line == "---" || line == "..." || strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "%") {
+			continue
+		}
+
+		if content[0] == '\t' {
+			return stacktrace.NewError("line %v: tabs are not allowed in indentation", i+1)
+		}
+
+		indent := len(line) - len(content)
+		sequence := content == "-" || strings.HasPrefix(content, "- ")
+
+		for len(stack) > 1 {
+			top := stack[len(stack)-1]
+
+			if top.indent < indent || (top.indent == indent && sequence) {
+				break
+			}
+
+			stack = stack[:len(stack)-1]
+		}
+
+		for _, node := range stack {
+			node.end = i + 1
+		}
+
+		top := stack[len(stack)-1]
+
+		// a sequence belongs to the entry above it, even when it is not
+		// indented any further
+		if sequence {
+			top.opaque = true
+			continue
+		}
+
+		// lines below opaque entries and continuations of multi-line plain
+		// scalars are skipped
+		if top.opaque || top.value != "" {
+			top.opaque = true
+			continue
+		}
+
+		node, err := parseYAMLEntry(content)
+
+		if err != nil {
+			return stacktrace.Propagate(err, "line %v", i+1)
+		}
+
+		node.line = i
+		node.end = i + 1
+		node.indent = indent
+
+		top.children = append(top.children, node)
+		stack = append(stack, node)
+	}
+
+	t.root = root
+
+	return nil
+}
+
+func parseYAMLEntry(content string) (*yamlNode, error) {
+	node := &yamlNode{}
+	rest := ""
+
+	if content[0] == '"' || content[0] == '\'' {
+		end := yamlQuoteEnd(content)
+
+		if end < 0 {
+			return nil, stacktrace.NewError("unterminated key")
+		}
+
+		node.keyText = content[:end+1]
+		node.key = fmt.Sprint(parseYAMLScalar(node.keyText))
+		rest = content[end+1:]
+	} else {
+		sep := strings.Index(content, ": ")
+
+		if sep < 0 && strings.HasSuffix(content, ":") {
+			sep = len(content) - 1
+		}
+
+		if sep < 0 {
+			return nil, stacktrace.NewError("expected a mapping entry")
+		}
+
+		node.keyText = content[:sep]
+		node.key = strings.TrimSpace(node.keyText)
+		rest = content[sep:]
+	}
+
+	if !strings.HasPrefix(rest, ":") {
+		return nil, stacktrace.NewError("expected ':' after key")
+	}
+
+	rest = rest[1:]
+	value := stripConfigComment(rest, "#")
+
+	node.comment = rest[len(value):]
+	node.value = strings.TrimSpace(value)
+	node.opaque = node.value != "" && strings.ContainsAny(node.value[:1], "|>[{&*!")
+
+	return node, nil
+}
+
+// yamlQuoteEnd returns the offset of the quote closing the one s starts with.
+func yamlQuoteEnd(s string) int {
+	quote := s[0]
+
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quote == '"' && s[i] == '\\':
+			i++
+		case quote == '\'' && s[i] == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case s[i] == quote:
+			return i
+		}
+	}
+
+	return -1
+}
+
+// lookup returns the deepest node along path and the number of keys of path
+// it matched.
+func (t *yamlConfig) lookup(path []string) (*yamlNode, int, error) {
+	node := t.root
+
+	for i, key := range path {
+		if node.opaque {
+			return nil, i, errConfigUnsupported(path[:i])
+		}
+
+		var child *yamlNode
+
+		for _, candidate := range node.children {
+			if candidate.key == key {
+				child = candidate
+			}
+		}
+
+		if child == nil {
+			return node, i, nil
+		}
+
+		node = child
+	}
+
+	return node, len(path), nil
+}
+
+func (t *yamlConfig) get(path []string) (interface{}, bool, error) {
+	node, matched, err := t.lookup(path)
+
+	if err != nil || matched < len(path) {
+		return nil, false, err
+	}
+
+	value, err := t.decode(node, path)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return value, true, nil
+}
+
+func (t *yamlConfig) decode(node *yamlNode, path []string) (interface{}, error) {
+	if node.opaque {
+		return nil, errConfigUnsupported(path)
+	}
+
+	if len(node.children) == 0 {
+		return parseYAMLScalar(node.value), nil
+	}
+
+	mapping := map[string]interface{}{}
+
+	for _, child := range node.children {
+		value, err := t.decode(child, append(path[:len(path):len(path)], child.key))
+
+		if err != nil {
+			return nil, err
+		}
+
+		mapping[child.key] = value
+	}
+
+	return mapping, nil
+}
+
+func (t *yamlConfig) set(path []string, value interface{}) error {
+	mapping, ok := value.(map[string]interface{})
+
+	if !ok || len(mapping) == 0 {
+		text, err := formatYAMLScalar(value)
+
+		if err != nil {
+			return stacktrace.Propagate(err, "cannot set '%v'", joinConfigPath(path))
+		}
+
+		return t.put(path, text)
+	}
+
+	if node, matched, err := t.lookup(path); err != nil || matched < len(path) || node.opaque || len(node.children) == 0 {
+		if err := t.put(path, ""); err != nil {
+			return err
+		}
+	}
+
+	keys := []string{}
+
+	for key := range mapping {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := t.set(append(path[:len(path):len(path)], key), mapping[key]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// put stores the formatted scalar text at path, an empty text stores an
+// empty mapping.
+func (t *yamlConfig) put(path []string, text string) error {
+	node, matched, err := t.lookup(path)
+
+	if err != nil {
+		return err
+	}
+
+	if matched == len(path) {
+		t.text.remove(node.line+1, node.end)
+		t.text.lines[node.line] = node.render(text)
+
+		return t.parse()
+	}
+
+	if node.value != "" {
+		return stacktrace.NewError("cannot set '%v': '%v' is not a mapping", joinConfigPath(path), joinConfigPath(path[:matched]))
+	}
+
+	indent, step, at := 0, 2, node.end
+
+	if node != t.root {
+		indent = node.indent + 2
+	}
+
+	if len(node.children) > 0 {
+		indent = node.children[0].indent
+
+		if node != t.root {
+			step = indent - node.indent
+		}
+	} else if node == t.root {
+		at = len(t.text.lines)
+	}
+
+	missing := path[matched:]
+	lines := []string{}
+
+	for i, key := range missing {
+		line := strings.Repeat(" ", indent+i*step) + formatYAMLKey(key) + ":"
+
+		if i == len(missing)-1 && text != "" {
+			line += " " + text
+		}
+
+		lines = append(lines, line)
+	}
+
+	t.text.insert(at, lines...)
+
+	return t.parse()
+}
+
+func (t *yamlNode) render(text string) string {
+	line := strings.Repeat(" ", t.indent) + t.keyText + ":"
+
+	if text != "" {
+		line += " " + text
+	}
+
+	return line + t.comment
+}
+
+func (t *yamlConfig) delete(path []string) (bool, error) {
+	node, matched, err := t.lookup(path)
+
+	if err != nil || matched < len(path) {
+		return false, err
+	}
+
+	t.text.remove(node.line, node.end)
+
+	return true, t.parse()
+}
+
+func (t *yamlConfig) values() (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+
+	if t.root.opaque {
+		values[""] = strings.Join(t.text.lines, t.text.eol)
+		return values, nil
+	}
+
+	for _, child := range t.root.children {
+		t.flatten(values, []string{child.key}, child)
+	}
+
+	return values, nil
+}
+
+// flatten adds the scalars below node to values, opaque entries are added
+// with their raw text so changes to them still show up in diffs.
+func (t *yamlConfig) flatten(values map[string]interface{}, path []string, node *yamlNode) {
+	switch {
+	case node.opaque:
+		values[joinConfigPath(path)] = strings.Join(t.text.lines[node.line:node.end], t.text.eol)
+	case len(node.children) == 0:
+		values[joinConfigPath(path)] = parseYAMLScalar(node.value)
+	default:
+		for _, child := range node.children {
+			t.flatten(values, append(path[:len(path):len(path)], child.key), child)
+		}
+	}
+}
+
+// parseYAMLScalar decodes a plain or quoted scalar the way encoding/json
+// would decode the equivalent json value.
+func parseYAMLScalar(s string) interface{} {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+
+	switch {
+	case s[0] == '"':
+		var unquoted string
+
+		if err := json.Unmarshal([]byte(s), &unquoted); err == nil {
+			return unquoted
+		}
+
+		return strings.Trim(s, `"`)
+
+	case s[0] == '\'' && len(s) > 1 && strings.HasSuffix(s, "'"):
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1)
+
+	case yamlNumber.MatchString(s):
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+
+	return s
+}
+
+func formatYAMLScalar(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "null", nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case string:
+		if isPlainYAML(v) && parseYAMLScalar(v) == v {
+			return v, nil
+		}
+
+		return quoteJSON(v), nil
+	case map[string]interface{}:
+		return "{}", nil
+	}
+
+	switch reflect.ValueOf(value).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return fmt.Sprint(value), nil
+	}
+
+	return "", stacktrace.NewError("cannot store a %T in yaml", value)
+}
+
+func formatYAMLKey(key string) string {
+	if isPlainYAML(key) && !strings.Contains(key, ":") {
+		return key
+	}
+
+	return quoteJSON(key)
+}
+
+// isPlainYAML reports whether s can be written without quotes.
+func isPlainYAML(s string) bool {
+	return s != "" &&
+		!yaml11Keyword.MatchString(s) &&
+		!yaml11Typed.MatchString(s) &&
+		strings.TrimSpace(s) == s &&
+		!strings.ContainsAny(s[:1], "-?:,[]{}#&*!|>'\"%@`") &&
+		!strings.ContainsAny(s, "\n\r\t") &&
+		!strings.Contains(s, ": ") &&
+		!strings.Contains(s, " #") &&
+		!strings.HasSuffix(s, ":")
+}
@@ -0,0 +1,226 @@
+package sdk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/palantir/stacktrace"
+)
+
+// CopyOptions controls CopyBetween. Relay forces the bytes through the
+// client even when the devices could exchange them directly.
+// BandwidthLimit caps the bytes per second of the copy, it is enforced by
+// the destination agent for direct copies.
+type CopyOptions struct {
+	Relay          bool
+	BandwidthLimit int64
+	Progress       func(TransferProgress)
+}
+
+// CopyResult describes a finished CopyBetween. Hash is the hex encoded
+// SHA-256 of the copied file and Relayed reports whether the bytes passed
+// through the client.
+type CopyResult struct {
+	Size    int64
+	Hash    string
+	Relayed bool
+}
+
+type copyProgressMessage struct {
+	Transferred int64 `json:"transferred"`
+	Total       int64 `json:"total"`
+}
+
+// CopyBetween copies srcPath on src to dstPath on dst. When both devices
+// are reached through this client and the destination agent has a fetch
+// form, the destination pulls the file from the source through the hub and
+// the client only receives progress and the final hash. Otherwise, or when
+// the destination reports that it cannot reach the source, the client reads
+// from src and writes to dst itself. The hash is confirmed by the side that
+// did not compute it whenever that side can hash files.
+func (t *client) CopyBetween(ctx context.Context, src Device, srcPath string, dst Device, dstPath string, opts CopyOptions) (*CopyResult, error) {
+	srcdevice, srcok := src.(*device)
+	dstdevice, dstok := dst.(*device)
+
+	if opts.Relay || !srcok || !dstok || srcdevice.client != t || dstdevice.client != t {
+		return relayCopy(ctx, src, srcPath, dst, dstPath, opts)
+	}
+
+	dstfs := dstdevice.Filesystem().(*deviceFilesystem)
+	ok, err := dstfs.supportsUnsealed(ctx, "fetch")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return relayCopy(ctx, src, srcPath, dst, dstPath, opts)
+	}
+
+	result, err := dstfs.fetch(ctx, srcdevice.id, srcPath, dstPath, opts)
+
+	var apierr *ErrInvalidAPIResponse
+
+	if errors.As(err, &apierr) && apierr.StatusCode == http.StatusBadGateway {
+		return relayCopy(ctx, src, srcPath, dst, dstPath, opts)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	srcfs := srcdevice.Filesystem().(*deviceFilesystem)
+
+	if err := srcfs.confirmHash(ctx, srcPath, result.Hash); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// fetch has the agent pull srcPath from the device srcID into path. The
+// agent streams json progress objects and reports the hash of what it wrote
+// in the Hash trailer.
+func (t *deviceFilesystem) fetch(ctx context.Context, srcID, srcPath, path string, opts CopyOptions) (*CopyResult, error) {
+	form := t.form("fetch").
+		AddFieldAsString("path", path).
+		AddFieldAsString("device", srcID).
+		AddFieldAsString("source", srcPath)
+
+	if opts.BandwidthLimit > 0 {
+		addInt64Field(form, "bandwidth", opts.BandwidthLimit)
+	}
+
+	resp, err := t.device.submit(ctx, form)
+
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &CopyResult{}
+	decoder := json.NewDecoder(resp.Body)
+	tracker := newProgressTracker(0, 0, opts.Progress)
+
+	for {
+		var message copyProgressMessage
+
+		if err := decoder.Decode(&message); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, stacktrace.Propagate(err, "failed decoding progress of fetching '%v'", srcPath)
+		}
+
+		result.Size = message.Transferred
+		tracker.total = message.Total
+		tracker.report(message.Transferred)
+	}
+
+	if trailerError := resp.Trailer.Get("Error"); trailerError != "" {
+		return nil, stacktrace.NewError("failed fetching '%v' from device '%v': %v", srcPath, srcID, trailerError)
+	}
+
+	if result.Hash = resp.Trailer.Get("Hash"); result.Hash == "" {
+		return nil, stacktrace.NewError("agent did not report the hash of '%v'", path)
+	}
+
+	return result, nil
+}
+
+// confirmHash compares sum with the SHA-256 of path computed by the agent,
+// agents without a hash form are trusted.
+func (t *deviceFilesystem) confirmHash(ctx context.Context, path, sum string) error {
+	ok, err := t.supports(ctx, "hash")
+
+	if err != nil || !ok {
+		return err
+	}
+
+	remotesum, err := t.Hash(ctx, path, HashSHA256)
+
+	if err != nil {
+		return err
+	}
+
+	if remotesum != sum {
+		return &ErrChecksumMismatch{
+			Path:     path,
+			Expected: sum,
+			Actual:   remotesum,
+		}
+	}
+
+	return nil
+}
+
+// relayCopy streams srcPath from src to dstPath on dst through the client.
+func relayCopy(ctx context.Context, src Device, srcPath string, dst Device, dstPath string, opts CopyOptions) (*CopyResult, error) {
+	ctx = WithStreamOptions(ctx, StreamOptions{
+		BandwidthLimit: opts.BandwidthLimit,
+	})
+
+	srcfs := src.Filesystem()
+	dstfs := dst.Filesystem()
+
+	info, err := srcfs.Stat(ctx, srcPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := srcfs.Open(ctx, srcPath)
+
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	writer := dstfs.Writer(ctx, dstPath, WriterOptions{})
+
+	progress := &copyProgressWriter{
+		tracker: newProgressTracker(0, info.Size(), opts.Progress),
+	}
+
+	n, err := io.Copy(io.MultiWriter(writer, hash, progress), reader)
+
+	if err != nil {
+		writer.Abort()
+		return nil, stacktrace.Propagate(err, "failed relaying '%v' to '%v'", srcPath, dstPath)
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	result := &CopyResult{
+		Size:    n,
+		Hash:    hex.EncodeToString(hash.Sum(nil)),
+		Relayed: true,
+	}
+
+	if fs, ok := dstfs.(*deviceFilesystem); ok {
+		if err := fs.confirmHash(ctx, dstPath, result.Hash); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+type copyProgressWriter struct {
+	transferred int64
+	tracker     *progressTracker
+}
+
+func (t *copyProgressWriter) Write(p []byte) (int, error) {
+	t.transferred += int64(len(p))
+	t.tracker.report(t.transferred)
+
+	return len(p), nil
+}
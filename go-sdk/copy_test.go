@@ -0,0 +1,82 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_copy_between() {
+	for _, test := range []struct {
+		fetch   bool
+		source  string
+		relayed bool
+	}{
+		{fetch: true, source: "gateway", relayed: false},
+		{fetch: true, source: "offline", relayed: true},
+		{fetch: false, source: "gateway", relayed: true},
+	} {
+		objects := t.getTestObjects()
+
+		agent := newTestFilesystemAgent()
+
+		if !test.fetch {
+			delete(agent.handlers, "fetch")
+		}
+
+		agent.register(objects.mux)
+
+		dir, _ := ioutil.TempDir("", "go-sdk-copy-between")
+
+		data := make([]byte, 150*1024)
+		rand.Read(data)
+		sum := sha256.Sum256(data)
+
+		src := filepath.Join(dir, "dataset.bin")
+		dst := filepath.Join(dir, "copy.bin")
+
+		ioutil.WriteFile(src, data, 0644)
+
+		var progress []TransferProgress
+
+		result, err := objects.client.CopyBetween(
+			context.Background(),
+			objects.client.Device(test.source), src,
+			objects.client.Device("edge"), dst,
+			CopyOptions{
+				Progress: func(p TransferProgress) {
+					progress = append(progress, p)
+				},
+			},
+		)
+
+		assert.Nil(t.T(), err)
+		assert.Equal(t.T(), &CopyResult{
+			Size:    int64(len(data)),
+			Hash:    hex.EncodeToString(sum[:]),
+			Relayed: test.relayed,
+		}, result)
+		assert.NotEmpty(t.T(), progress)
+		assert.Equal(t.T(), int64(len(data)), progress[len(progress)-1].Transferred)
+		assert.Equal(t.T(), int64(len(data)), progress[len(progress)-1].Total)
+
+		if test.relayed {
+			assert.Empty(t.T(), agent.fetched)
+		} else {
+			assert.Equal(t.T(), []string{test.source}, agent.fetched)
+		}
+
+		copied, _ := ioutil.ReadFile(dst)
+		assert.True(t.T(), bytes.Equal(data, copied))
+
+		os.RemoveAll(dir)
+		objects.server.Close()
+	}
+}
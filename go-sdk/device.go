@@ -1,8 +1,21 @@
 package sdk
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/deviceio/hmapi"
+	"github.com/palantir/stacktrace"
+)
 
 type Device interface {
+	ID() string
+	Facts(ctx context.Context) (*DeviceFacts, error)
+	PublicKey(ctx context.Context) ([]byte, error)
+	SetBandwidthLimit(bytesPerSecond int64)
 	Filesystem() DeviceFilesystem
 	System() DeviceSystem
 	Network() DeviceNetwork
@@ -14,6 +27,56 @@ type device struct {
 	client *client
 }
 
+func (t *device) ID() string {
+	return t.id
+}
+
+// DeviceFacts describes a device as reported by the root resource of its
+// agent. Tags and Addresses are empty for agents that do not report them.
+// TempDir is the temp directory of the user the agent runs as, honouring
+// TMPDIR or TEMP, and empty for agents that do not report it.
+type DeviceFacts struct {
+	ID           string
+	Hostname     string
+	Platform     string
+	Architecture string
+	Tags         []string
+	Addresses    []string
+	TempDir      string
+}
+
+func (t *device) Facts(ctx context.Context) (*DeviceFacts, error) {
+	resource, err := t.client.hmclient.
+		Resource(fmt.Sprintf("/device/%v", t.id)).
+		Get(ctx)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed retrieving device resource")
+	}
+
+	facts := &DeviceFacts{
+		ID:           contentString(resource, "id"),
+		Hostname:     contentString(resource, "hostname"),
+		Platform:     contentString(resource, "platform"),
+		Architecture: contentString(resource, "architecture"),
+		Tags:         contentStrings(resource, "tags"),
+		Addresses:    contentStrings(resource, "addresses"),
+		TempDir:      contentString(resource, "tempDir"),
+	}
+
+	if facts.ID == "" {
+		facts.ID = t.id
+	}
+
+	return facts, nil
+}
+
+// SetBandwidthLimit caps the bytes per second all streams to and from the
+// device move together through this client, zero removes the limit.
+func (t *device) SetBandwidthLimit(bytesPerSecond int64) {
+	t.client.setDeviceLimit(t.id, bytesPerSecond)
+}
+
 func (t *device) Filesystem() DeviceFilesystem {
 	return &deviceFilesystem{
 		device:       t,
@@ -35,3 +98,98 @@ func (t *device) Process() DeviceProcess {
 		resourcePath: fmt.Sprintf("/device/%v/process", t.id),
 	}
 }
+
+func (t *device) submit(ctx context.Context, form hmapi.FormRequest) (*hmapi.FormResponse, error) {
+	resp, err := form.Submit(ctx)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed form submission")
+	}
+
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		return nil, &ErrInvalidAPIResponse{
+			StatusCode: resp.StatusCode,
+			Message:    string(body),
+		}
+	}
+
+	return resp, nil
+}
+
+// resourceCacheTTL is how long the forms and links of a resource are reused
+// to negotiate streams before they are fetched again, so an upgraded agent
+// is picked up.
+const resourceCacheTTL = time.Minute
+
+type cachedResource struct {
+	resource *hmapi.Resource
+	fetched  time.Time
+}
+
+// resource returns the resource at path for negotiating what its forms and
+// links support, reusing a copy fetched within resourceCacheTTL.
+func (t *device) resource(ctx context.Context, path string) (*hmapi.Resource, error) {
+	t.client.resourcesmu.Lock()
+	cached, ok := t.client.resources[path]
+	t.client.resourcesmu.Unlock()
+
+	if ok && time.Since(cached.fetched) < resourceCacheTTL {
+		return cached.resource, nil
+	}
+
+	resource, err := t.client.hmclient.Resource(path).Get(ctx)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed retrieving resource '%v'", path)
+	}
+
+	t.client.resourcesmu.Lock()
+	defer t.client.resourcesmu.Unlock()
+
+	for stale, entry := range t.client.resources {
+		if time.Since(entry.fetched) >= resourceCacheTTL {
+			delete(t.client.resources, stale)
+		}
+	}
+
+	t.client.resources[path] = cachedResource{resource: resource, fetched: time.Now()}
+
+	return resource, nil
+}
+
+func contentString(resource *hmapi.Resource, name string) string {
+	if content, ok := resource.Content[name]; ok && content != nil && content.Value != nil {
+		return fmt.Sprint(content.Value)
+	}
+
+	return ""
+}
+
+// contentStrings reads a list either sent as an array or as a comma
+// separated string.
+func contentStrings(resource *hmapi.Resource, name string) []string {
+	values := []string{}
+	content, ok := resource.Content[name]
+
+	if !ok || content == nil {
+		return values
+	}
+
+	switch v := content.Value.(type) {
+	case []interface{}:
+		for _, value := range v {
+			values = append(values, fmt.Sprint(value))
+		}
+	case string:
+		for _, value := range strings.Split(v, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+
+	return values
+}
@@ -5,24 +5,65 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/deviceio/hmapi"
 )
 
 type DeviceFilesystem interface {
 	Reader(ctx context.Context, path string, offset, count int) io.Reader
-	Writer(ctx context.Context, path string, append bool) io.WriteCloser
+	Open(ctx context.Context, path string) (File, error)
+	Stat(ctx context.Context, path string) (os.FileInfo, error)
+	ReadDir(ctx context.Context, path string) ([]os.FileInfo, error)
+	Writer(ctx context.Context, path string, opts WriterOptions) FileWriter
+	WriteFile(ctx context.Context, path string, data []byte, opts WriterOptions) error
+	Upload(ctx context.Context, local, remote string, opts TransferOptions) error
+	Download(ctx context.Context, remote, local string, opts TransferOptions) error
+	ParallelRead(ctx context.Context, path string, w io.Writer, opts ParallelOptions) (int64, error)
+	ParallelReadAt(ctx context.Context, path string, w io.WriterAt, opts ParallelOptions) (int64, error)
+	Hash(ctx context.Context, path string, algorithm HashAlgorithm) (string, error)
+	Manifest(ctx context.Context, dir string, algorithm HashAlgorithm) (Manifest, error)
+	PutArchive(ctx context.Context, dst string, r io.Reader, format ArchiveFormat) (*ArchiveResult, error)
+	GetArchive(ctx context.Context, src string, format ArchiveFormat) (ArchiveReader, error)
+	Follow(ctx context.Context, path string, opts FollowOptions) (io.ReadCloser, error)
+	Watch(ctx context.Context, dir string, opts WatchOptions) (Watcher, error)
+	Find(ctx context.Context, root string, query FindQuery, fn func(*FindMatch) error) error
+	Grep(ctx context.Context, root, pattern string, opts GrepOptions, fn func(*GrepMatch) error) error
+	Usage(ctx context.Context, path string) (*FilesystemUsage, error)
+	DiskUsage(ctx context.Context, dir string) (*DiskUsage, error)
+	TempFile(ctx context.Context, pattern string) (TempHandle, error)
+	TempDir(ctx context.Context, pattern string) (TempHandle, error)
+	EnsureLine(ctx context.Context, path, line string, opts LineOptions) (*EditResult, error)
+	EnsureLineAbsent(ctx context.Context, path, line string, opts LineOptions) (*EditResult, error)
+	ReplaceRegexp(ctx context.Context, path, pattern, replacement string) (*EditResult, error)
+	EnsureBlock(ctx context.Context, path, block string, opts BlockOptions) (*EditResult, error)
+	Rename(ctx context.Context, oldpath, newpath string) error
+	Remove(ctx context.Context, path string) error
+	RemoveAll(ctx context.Context, path string) error
+	MkdirAll(ctx context.Context, path string, mode os.FileMode) error
+	Chmod(ctx context.Context, path string, mode os.FileMode) error
+	Chown(ctx context.Context, path string, uid, gid int) error
+	ChownName(ctx context.Context, path string, owner, group string) error
+	Chtimes(ctx context.Context, path string, atime, mtime time.Time) error
+	GetXattr(ctx context.Context, path, name string) ([]byte, error)
+	SetXattr(ctx context.Context, path, name string, value []byte) error
+	ListXattr(ctx context.Context, path string) ([]string, error)
+	RemoveXattr(ctx context.Context, path, name string) error
 }
 
 type deviceFilesystemReader struct {
 	resp        *hmapi.FormResponse
 	resperr     error
 	resperrbody string
+	body        io.Reader
+	stats       streamStats
 }
 
 func (t *deviceFilesystemReader) Read(p []byte) (n int, err error) {
 	if t.resperr != nil {
-		return 0, err
+		return 0, t.resperr
 	}
 
 	if t.resp != nil && t.resp.StatusCode >= 300 {
@@ -38,31 +79,13 @@ func (t *deviceFilesystemReader) Read(p []byte) (n int, err error) {
 		return 0, errors.New(trailerError)
 	}
 
-	n, err = t.resp.Body.Read(p)
+	n, err = t.body.Read(p)
 
 	return n, err
 }
 
-type deviceFilesystemWriter struct {
-	reqerr chan error
-	dataw  *io.PipeWriter
-	datar  *io.PipeReader
-	ctx    context.Context
-}
-
-func (t *deviceFilesystemWriter) Write(p []byte) (n int, err error) {
-	select {
-	case err := <-t.reqerr:
-		return 0, err
-	case <-t.ctx.Done():
-		return 0, t.ctx.Err()
-	default:
-		return t.dataw.Write(p)
-	}
-}
-
-func (t *deviceFilesystemWriter) Close() error {
-	return t.datar.Close()
+func (t *deviceFilesystemReader) Stats() StreamStats {
+	return t.stats.Stats()
 }
 
 type deviceFilesystem struct {
@@ -71,19 +94,62 @@ type deviceFilesystem struct {
 }
 
 func (t *deviceFilesystem) Reader(ctx context.Context, path string, offset, count int) io.Reader {
-	resp, err := t.device.client.hmclient.
+	encoding, err := t.device.formEncoding(ctx, t.resourcePath, "read")
+
+	if err != nil {
+		return &deviceFilesystemReader{
+			resperr: err,
+		}
+	}
+
+	devicekey, err := t.device.endToEndKey(ctx, t.resourcePath, "read")
+
+	if err != nil {
+		return &deviceFilesystemReader{
+			resperr: err,
+		}
+	}
+
+	if devicekey != nil {
+		encoding = EncodingIdentity
+	}
+
+	form := t.device.client.hmclient.
 		Resource(t.resourcePath).
 		Form("read").
 		AddFieldAsString("path", path).
 		AddFieldAsInt("offset", offset).
-		AddFieldAsInt("count", count).
-		Submit(ctx)
+		AddFieldAsInt("count", count)
+
+	if encoding != EncodingIdentity {
+		form.AddFieldAsString("encoding", string(encoding))
+	}
+
+	var private *[32]byte
+
+	if devicekey != nil {
+		if _, private, err = t.device.streamKey(form, "read", path, "recipient"); err != nil {
+			return &deviceFilesystemReader{
+				resperr: err,
+			}
+		}
+	}
+
+	resp, err := form.Submit(ctx)
 
 	fsReader := &deviceFilesystemReader{
 		resp:    resp,
 		resperr: err,
 	}
 
+	if resp != nil {
+		fsReader.body = decodeStream(resp.Body, encoding, &fsReader.stats, t.device.meter(ctx, int64(count)))
+
+		if devicekey != nil {
+			fsReader.body = openStream(fsReader.body, private, devicekey)
+		}
+	}
+
 	if resp != nil && resp.StatusCode >= 300 {
 		data, _ := ioutil.ReadAll(resp.Body)
 		fsReader.resperrbody = string(data)
@@ -92,39 +158,85 @@ func (t *deviceFilesystem) Reader(ctx context.Context, path string, offset, coun
 	return fsReader
 }
 
-func (t *deviceFilesystem) Writer(ctx context.Context, path string, append bool) io.WriteCloser {
-	datar, dataw := io.Pipe()
+func (t *deviceFilesystem) Rename(ctx context.Context, oldpath, newpath string) error {
+	return t.submitAndClose(ctx, t.form("rename").
+		AddFieldAsString("path", oldpath).
+		AddFieldAsString("newpath", newpath))
+}
 
-	reqerr := make(chan error)
+func (t *deviceFilesystem) Remove(ctx context.Context, path string) error {
+	return t.submitAndClose(ctx, t.form("remove").
+		AddFieldAsString("path", path))
+}
 
-	go func() {
-		resp, err := t.device.client.hmclient.
-			Resource(t.resourcePath).
-			Form("write").
-			AddFieldAsString("path", path).
-			AddFieldAsBool("append", append).
-			AddFieldAsOctetStream("data", datar).
-			Submit(ctx)
+func (t *deviceFilesystem) RemoveAll(ctx context.Context, path string) error {
+	return t.submitAndClose(ctx, t.form("remove").
+		AddFieldAsString("path", path).
+		AddFieldAsBool("recursive", true))
+}
 
-		if err != nil {
-			reqerr <- err
-		}
+func (t *deviceFilesystem) MkdirAll(ctx context.Context, path string, mode os.FileMode) error {
+	return t.submitAndClose(ctx, t.form("mkdir").
+		AddFieldAsString("path", path).
+		AddFieldAsInt("mode", int(mode)).
+		AddFieldAsBool("parents", true))
+}
+
+// supports reports whether the agent advertises the named form on the
+// filesystem resource, so newer behaviour can degrade on older agents.
+func (t *deviceFilesystem) supports(ctx context.Context, name string) (bool, error) {
+	resource, err := t.device.resource(ctx, t.resourcePath)
+
+	if err != nil {
+		return false, err
+	}
+
+	_, ok := resource.Forms[name]
+
+	return ok, nil
+}
 
-		if resp.StatusCode >= 300 {
-			body, _ := ioutil.ReadAll(resp.Body)
-			reqerr <- &ErrInvalidAPIResponse{
-				StatusCode: resp.StatusCode,
-				Message:    string(body),
+// supportsUnsealed is supports for forms whose streams carry file content
+// the sdk cannot seal end-to-end. Clients encrypting end-to-end do not use
+// them and take the path of older agents through the sealed read and write
+// forms instead, so the hub never relays file content in the clear.
+func (t *deviceFilesystem) supportsUnsealed(ctx context.Context, name string) (bool, error) {
+	if t.device.client.endToEnd {
+		return false, nil
+	}
+
+	return t.supports(ctx, name)
+}
+
+// supportsField reports whether the named form of the filesystem resource
+// has the named field.
+func (t *deviceFilesystem) supportsField(ctx context.Context, name, field string) (bool, error) {
+	resource, err := t.device.resource(ctx, t.resourcePath)
+
+	if err != nil {
+		return false, err
+	}
+
+	if form, ok := resource.Forms[name]; ok {
+		for _, candidate := range form.Fields {
+			if candidate.Name == field {
+				return true, nil
 			}
 		}
-	}()
-
-	writer := &deviceFilesystemWriter{
-		reqerr: make(chan error),
-		dataw:  dataw,
-		datar:  datar,
-		ctx:    ctx,
 	}
 
-	return writer
+	return false, nil
+}
+
+func (t *deviceFilesystem) form(name string) hmapi.FormRequest {
+	return t.device.client.hmclient.
+		Resource(t.resourcePath).
+		Form(name)
+}
+
+// addInt64Field adds an int field without narrowing value to int, which
+// would wrap offsets past 2 GiB on 32-bit builds. AddFieldAsInt sends the
+// same decimal text.
+func addInt64Field(form hmapi.FormRequest, name string, value int64) hmapi.FormRequest {
+	return form.AddFieldAsString(name, strconv.FormatInt(value, 10))
 }
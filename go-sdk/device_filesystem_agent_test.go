@@ -0,0 +1,1064 @@
+package sdk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deviceio/agent/resources/filesystem"
+	"github.com/deviceio/hmapi"
+	"github.com/gorilla/mux"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// testClientKey signs the stream keys of the clients of getTestObjects, the
+// agents of withEndToEnd trust its public key.
+var testClientKey = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{7}, ed25519.SeedSize))
+
+// testFilesystemAgent serves the filesystem resource of the vendored agent
+// and extends it with the forms the sdk expects from newer agents so the
+// client side of those forms can be exercised against a real disk.
+type testFilesystemAgent struct {
+	root       *filesystem.Root
+	handlers   map[string]http.HandlerFunc
+	encodings  hmapi.MediaType
+	usage      FilesystemUsage
+	fetched    []string
+	facts      map[string]interface{}
+	public     *[32]byte
+	private    *[32]byte
+	clientKey  ed25519.PublicKey
+	keysmu     sync.Mutex
+	keys       map[string]bool
+	renamemu   sync.Mutex
+	positioned bool
+	modes      bool
+	syncs      bool
+	syncmu     sync.Mutex
+	synced     []string
+	xattrmu    sync.Mutex
+	xattrs     map[string]map[string][]byte
+}
+
+func newTestFilesystemAgent() *testFilesystemAgent {
+	t := &testFilesystemAgent{
+		root: &filesystem.Root{},
+		usage: FilesystemUsage{
+			Mount:      "/",
+			Total:      1 << 40,
+			Free:       1 << 39,
+			Available:  1 << 39,
+			Inodes:     1 << 20,
+			InodesFree: 1 << 19,
+		},
+		facts: map[string]interface{}{
+			"hostname":     "edge-01",
+			"platform":     "linux",
+			"architecture": "arm64",
+			"tags":         []string{"edge", "eu-west"},
+			"addresses":    []string{"10.0.0.5/24", "fe80::1/64"},
+		},
+		xattrs: map[string]map[string][]byte{},
+	}
+
+	t.handlers = map[string]http.HandlerFunc{
+		"read":        t.root.Read,
+		"write":       t.root.Write,
+		"chmod":       t.chmod,
+		"chown":       t.chown,
+		"chtimes":     t.chtimes,
+		"stat":        t.stat,
+		"readdir":     t.readdir,
+		"rename":      t.rename,
+		"remove":      t.remove,
+		"hash":        t.hash,
+		"manifest":    t.manifest,
+		"mkdir":       t.mkdir,
+		"signature":   t.signature,
+		"patch":       t.patch,
+		"delta":       t.delta,
+		"extract":     t.extract,
+		"archive":     t.archive,
+		"follow":      t.follow,
+		"watch":       t.watch,
+		"find":        t.find,
+		"grep":        t.grep,
+		"usage":       t.diskfree,
+		"du":          t.du,
+		"fetch":       t.fetch,
+		"mktemp":      t.mktemp,
+		"getxattr":    t.getxattr,
+		"setxattr":    t.setxattr,
+		"listxattr":   t.listxattr,
+		"removexattr": t.removexattr,
+	}
+
+	return t
+}
+
+// withEncoding replaces the read and write forms of the vendored agent with
+// ones that advertise and apply the given content codings.
+func (t *testFilesystemAgent) withEncoding(encodings hmapi.MediaType) *testFilesystemAgent {
+	t.encodings = encodings
+	t.handlers["read"] = t.read
+	t.handlers["write"] = t.write
+
+	return t
+}
+
+// withEndToEnd gives the agent a key pair, presented on the root resource,
+// and read and write forms that accept end-to-end encrypted streams whose
+// keys testClientKey signed.
+func (t *testFilesystemAgent) withEndToEnd() *testFilesystemAgent {
+	t.public, t.private, _ = box.GenerateKey(rand.Reader)
+	t.clientKey = testClientKey.Public().(ed25519.PublicKey)
+	t.keys = map[string]bool{}
+	t.facts["publicKey"] = base64.StdEncoding.EncodeToString(t.public[:])
+	t.handlers["read"] = t.read
+	t.handlers["write"] = t.write
+
+	return t
+}
+
+// withPositionedWrites gives the agent a write form that writes at an
+// offset and truncates the file after the data.
+func (t *testFilesystemAgent) withPositionedWrites() *testFilesystemAgent {
+	t.positioned = true
+	t.handlers["write"] = t.write
+
+	return t
+}
+
+// withModedWrites gives the agent a write form that creates the file with
+// the mode it is given.
+func (t *testFilesystemAgent) withModedWrites() *testFilesystemAgent {
+	t.modes = true
+	t.handlers["write"] = t.write
+
+	return t
+}
+
+// withSyncedWrites gives the agent a write form that fsyncs the file when
+// asked to and records the paths it synced.
+func (t *testFilesystemAgent) withSyncedWrites() *testFilesystemAgent {
+	t.syncs = true
+	t.handlers["write"] = t.write
+
+	return t
+}
+
+func (t *testFilesystemAgent) register(mux *mux.Router) {
+	mux.HandleFunc("/device/{id}", t.device)
+	mux.HandleFunc("/device/{id}/filesystem", t.get)
+
+	for name, handler := range t.handlers {
+		mux.HandleFunc("/filesystem/"+name, handler)
+	}
+}
+
+// device serves the root resource of the agent with t.facts as content.
+func (t *testFilesystemAgent) device(rw http.ResponseWriter, r *http.Request) {
+	resource := &hmapi.Resource{
+		Links: map[string]*hmapi.Link{
+			"filesystem": {Type: hmapi.MediaTypeJSON, Href: r.URL.Path + "/filesystem"},
+		},
+		Content: map[string]*hmapi.Content{
+			"id": {Type: hmapi.MediaTypeHMAPIString, Value: mux.Vars(r)["id"]},
+		},
+	}
+
+	for name, value := range t.facts {
+		resource.Content[name] = &hmapi.Content{Value: value}
+	}
+
+	rw.Header().Set("Content-Type", hmapi.MediaTypeJSON.String())
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(&resource)
+}
+
+func (t *testFilesystemAgent) get(rw http.ResponseWriter, r *http.Request) {
+	resource := &hmapi.Resource{
+		Links:   map[string]*hmapi.Link{},
+		Forms:   map[string]*hmapi.Form{},
+		Content: map[string]*hmapi.Content{},
+	}
+
+	for name := range t.handlers {
+		resource.Forms[name] = &hmapi.Form{
+			Action:  "/filesystem/" + name,
+			Method:  hmapi.POST,
+			Enctype: hmapi.MediaTypeMultipartFormData,
+		}
+	}
+
+	for _, name := range []string{"read", "write"} {
+		if t.encodings != "" {
+			resource.Forms[name].Fields = append(resource.Forms[name].Fields,
+				&hmapi.FormField{Name: "encoding", Type: hmapi.MediaTypeHMAPIString, Encoding: t.encodings})
+		}
+
+		if t.public != nil {
+			resource.Forms[name].Fields = append(resource.Forms[name].Fields,
+				&hmapi.FormField{Name: "encryption", Type: hmapi.MediaTypeHMAPIString, Encoding: EncryptionNaClBox},
+				&hmapi.FormField{Name: "timestamp", Type: hmapi.MediaTypeHMAPIString},
+				&hmapi.FormField{Name: "signature", Type: hmapi.MediaTypeHMAPIString})
+		}
+	}
+
+	if t.positioned {
+		resource.Forms["write"].Fields = append(resource.Forms["write"].Fields,
+			&hmapi.FormField{Name: "offset", Type: hmapi.MediaTypeHMAPIInt})
+	}
+
+	if t.modes {
+		resource.Forms["write"].Fields = append(resource.Forms["write"].Fields,
+			&hmapi.FormField{Name: "mode", Type: hmapi.MediaTypeHMAPIInt})
+	}
+
+	if t.syncs {
+		resource.Forms["write"].Fields = append(resource.Forms["write"].Fields,
+			&hmapi.FormField{Name: "sync", Type: hmapi.MediaTypeHMAPIBoolean})
+	}
+
+	rw.Header().Set("Content-Type", hmapi.MediaTypeJSON.String())
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(&resource)
+}
+
+func (t *testFilesystemAgent) read(rw http.ResponseWriter, r *http.Request) {
+	file, err := os.Open(r.FormValue("path"))
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+	defer file.Close()
+
+	offset, _ := strconv.ParseInt(r.FormValue("offset"), 10, 64)
+	count, _ := strconv.ParseInt(r.FormValue("count"), 10, 64)
+
+	var reader io.Reader = io.NewSectionReader(file, offset, 1<<62)
+
+	if count >= 0 {
+		reader = io.LimitReader(reader, count)
+	}
+
+	if r.FormValue("encryption") == EncryptionNaClBox {
+		recipient, err := t.streamKey(r, "read", "recipient")
+
+		if err != nil {
+			t.fail(rw, err)
+			return
+		}
+
+		reader, _ = newSealingReader(reader, t.public, t.private, recipient)
+	}
+
+	rw.Header().Set("Trailer", "Error")
+	rw.WriteHeader(http.StatusOK)
+
+	var out io.Writer = rw
+
+	switch ContentEncoding(r.FormValue("encoding")) {
+	case EncodingGzip:
+		gz := gzip.NewWriter(rw)
+		defer gz.Close()
+
+		out = gz
+	case EncodingZstd:
+		zw, _ := zstd.NewWriter(rw)
+		defer zw.Close()
+
+		out = zw
+	}
+
+	if _, err := io.Copy(out, reader); err != nil {
+		rw.Header().Set("Error", err.Error())
+	}
+}
+
+func (t *testFilesystemAgent) write(rw http.ResponseWriter, r *http.Request) {
+	var data io.Reader = strings.NewReader(r.FormValue("data"))
+
+	switch ContentEncoding(r.FormValue("encoding")) {
+	case EncodingGzip:
+		gz, err := gzip.NewReader(data)
+
+		if err != nil {
+			t.fail(rw, err)
+			return
+		}
+
+		data = gz
+	case EncodingZstd:
+		zr, err := zstd.NewReader(data)
+
+		if err != nil {
+			t.fail(rw, err)
+			return
+		}
+		defer zr.Close()
+
+		data = zr
+	}
+
+	if r.FormValue("encryption") == EncryptionNaClBox {
+		sender, err := t.streamKey(r, "write", "sender")
+
+		if err != nil {
+			t.fail(rw, err)
+			return
+		}
+
+		data = openStream(data, t.private, sender)
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+
+	if r.FormValue("append") == "true" {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+
+	if r.FormValue("offset") != "" {
+		flag = os.O_WRONLY | os.O_CREATE
+	}
+
+	file, err := os.OpenFile(r.FormValue("path"), flag, 0666)
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+	defer file.Close()
+
+	if v := r.FormValue("offset"); v != "" {
+		offset, _ := strconv.ParseInt(v, 10, 64)
+
+		if err := file.Truncate(offset); err != nil {
+			t.fail(rw, err)
+			return
+		}
+
+		file.Seek(offset, io.SeekStart)
+	}
+
+	if v := r.FormValue("mode"); v != "" && t.modes {
+		mode, _ := strconv.ParseUint(v, 10, 32)
+
+		if err := file.Chmod(os.FileMode(mode)); err != nil {
+			t.fail(rw, err)
+			return
+		}
+	}
+
+	n, err := io.Copy(file, data)
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+
+	if uid, gid, err := t.owner(r); err != nil || uid >= 0 || gid >= 0 {
+		if err == nil {
+			err = file.Chown(uid, gid)
+		}
+
+		if err != nil {
+			t.fail(rw, err)
+			return
+		}
+	}
+
+	if r.FormValue("sync") == "true" {
+		if err := file.Sync(); err != nil {
+			t.fail(rw, err)
+			return
+		}
+
+		t.syncmu.Lock()
+		t.synced = append(t.synced, r.FormValue("path"))
+		t.syncmu.Unlock()
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte(strconv.FormatInt(n, 10)))
+}
+
+func (t *testFilesystemAgent) chmod(rw http.ResponseWriter, r *http.Request) {
+	mode, err := strconv.ParseUint(r.FormValue("mode"), 10, 32)
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+
+	t.result(rw, os.Chmod(r.FormValue("path"), os.FileMode(mode)))
+}
+
+func (t *testFilesystemAgent) chown(rw http.ResponseWriter, r *http.Request) {
+	uid, gid, err := t.owner(r)
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+
+	t.result(rw, os.Chown(r.FormValue("path"), uid, gid))
+}
+
+// owner resolves the owner fields of a form, -1 leaving a part unchanged.
+func (t *testFilesystemAgent) owner(r *http.Request) (int, int, error) {
+	uid, gid := -1, -1
+
+	if v := r.FormValue("uid"); v != "" {
+		uid, _ = strconv.Atoi(v)
+	}
+
+	if v := r.FormValue("gid"); v != "" {
+		gid, _ = strconv.Atoi(v)
+	}
+
+	if name := r.FormValue("owner"); name != "" {
+		u, err := user.Lookup(name)
+
+		if err != nil {
+			return -1, -1, err
+		}
+
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+
+	if name := r.FormValue("group"); name != "" {
+		g, err := user.LookupGroup(name)
+
+		if err != nil {
+			return -1, -1, err
+		}
+
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	return uid, gid, nil
+}
+
+// the xattr forms keep attributes in memory since the filesystems tests run
+// on do not all support user attributes
+func (t *testFilesystemAgent) getxattr(rw http.ResponseWriter, r *http.Request) {
+	t.xattrmu.Lock()
+	value, ok := t.xattrs[r.FormValue("path")][r.FormValue("name")]
+	t.xattrmu.Unlock()
+
+	if !ok {
+		t.fail(rw, fmt.Errorf("no attribute '%v' on '%v'", r.FormValue("name"), r.FormValue("path")))
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(value)
+}
+
+func (t *testFilesystemAgent) setxattr(rw http.ResponseWriter, r *http.Request) {
+	if _, err := os.Stat(r.FormValue("path")); err != nil {
+		t.fail(rw, err)
+		return
+	}
+
+	t.xattrmu.Lock()
+	defer t.xattrmu.Unlock()
+
+	if t.xattrs[r.FormValue("path")] == nil {
+		t.xattrs[r.FormValue("path")] = map[string][]byte{}
+	}
+
+	t.xattrs[r.FormValue("path")][r.FormValue("name")] = []byte(r.FormValue("value"))
+	rw.WriteHeader(http.StatusOK)
+}
+
+func (t *testFilesystemAgent) listxattr(rw http.ResponseWriter, r *http.Request) {
+	t.xattrmu.Lock()
+	names := []string{}
+
+	for name := range t.xattrs[r.FormValue("path")] {
+		names = append(names, name)
+	}
+	t.xattrmu.Unlock()
+
+	sort.Strings(names)
+	t.json(rw, names)
+}
+
+func (t *testFilesystemAgent) removexattr(rw http.ResponseWriter, r *http.Request) {
+	t.xattrmu.Lock()
+	defer t.xattrmu.Unlock()
+
+	if _, ok := t.xattrs[r.FormValue("path")][r.FormValue("name")]; !ok {
+		t.fail(rw, fmt.Errorf("no attribute '%v' on '%v'", r.FormValue("name"), r.FormValue("path")))
+		return
+	}
+
+	delete(t.xattrs[r.FormValue("path")], r.FormValue("name"))
+	rw.WriteHeader(http.StatusOK)
+}
+
+func (t *testFilesystemAgent) chtimes(rw http.ResponseWriter, r *http.Request) {
+	atime, err := time.Parse(time.RFC3339Nano, r.FormValue("atime"))
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+
+	mtime, err := time.Parse(time.RFC3339Nano, r.FormValue("mtime"))
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+
+	t.result(rw, os.Chtimes(r.FormValue("path"), atime, mtime))
+}
+
+func (t *testFilesystemAgent) stat(rw http.ResponseWriter, r *http.Request) {
+	info, err := os.Stat(r.FormValue("path"))
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+
+	t.json(rw, newTestFileInfo(info))
+}
+
+func (t *testFilesystemAgent) readdir(rw http.ResponseWriter, r *http.Request) {
+	infos, err := ioutil.ReadDir(r.FormValue("path"))
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+
+	entries := []*deviceFileInfo{}
+
+	for _, info := range infos {
+		entries = append(entries, newTestFileInfo(info))
+	}
+
+	t.json(rw, entries)
+}
+
+func (t *testFilesystemAgent) rename(rw http.ResponseWriter, r *http.Request) {
+	// the hash check and the rename have to be atomic for compare and swap
+	t.renamemu.Lock()
+	defer t.renamemu.Unlock()
+
+	newpath := r.FormValue("newpath")
+
+	if expect := r.FormValue("expect"); expect != "" {
+		data, _ := ioutil.ReadFile(newpath)
+		sum := sha256.Sum256(data)
+
+		if expect != "sha256:"+hex.EncodeToString(sum[:]) {
+			rw.WriteHeader(http.StatusPreconditionFailed)
+			rw.Write([]byte("hash mismatch"))
+			return
+		}
+	}
+
+	if backup := r.FormValue("backup"); backup != "" {
+		if err := os.Link(newpath, backup); err != nil && !os.IsNotExist(err) {
+			t.fail(rw, err)
+			return
+		}
+	}
+
+	t.result(rw, os.Rename(r.FormValue("path"), newpath))
+}
+
+func (t *testFilesystemAgent) remove(rw http.ResponseWriter, r *http.Request) {
+	if r.FormValue("recursive") == "true" {
+		t.result(rw, os.RemoveAll(r.FormValue("path")))
+		return
+	}
+
+	t.result(rw, os.Remove(r.FormValue("path")))
+}
+
+func (t *testFilesystemAgent) mkdir(rw http.ResponseWriter, r *http.Request) {
+	mode, _ := strconv.ParseUint(r.FormValue("mode"), 10, 32)
+	t.result(rw, os.MkdirAll(r.FormValue("path"), os.FileMode(mode)))
+}
+
+func (t *testFilesystemAgent) signature(rw http.ResponseWriter, r *http.Request) {
+	blocksize, _ := strconv.Atoi(r.FormValue("blocksize"))
+	file, err := os.Open(r.FormValue("path"))
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+	defer file.Close()
+
+	signature, err := computeSignature(file, blocksize)
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+
+	t.json(rw, signature)
+}
+
+func (t *testFilesystemAgent) patch(rw http.ResponseWriter, r *http.Request) {
+	path := r.FormValue("path")
+	blocksize, _ := strconv.Atoi(r.FormValue("blocksize"))
+
+	delta := strings.NewReader(r.FormValue("delta"))
+
+	basis, err := os.Open(path)
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+	defer basis.Close()
+
+	signature, _ := computeSignature(basis, blocksize)
+	out, _ := os.Create(path + ".patched")
+
+	if err := applyDelta(basis, signature, delta, out); err != nil {
+		out.Close()
+		t.fail(rw, err)
+		return
+	}
+
+	out.Close()
+	t.result(rw, os.Rename(path+".patched", path))
+}
+
+func (t *testFilesystemAgent) delta(rw http.ResponseWriter, r *http.Request) {
+	var signature *deltaSignature
+
+	if err := json.Unmarshal([]byte(r.FormValue("signature")), &signature); err != nil {
+		t.fail(rw, err)
+		return
+	}
+
+	file, err := os.Open(r.FormValue("path"))
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+	defer file.Close()
+
+	rw.WriteHeader(http.StatusOK)
+	writeDelta(signature, file, rw)
+}
+
+func (t *testFilesystemAgent) hash(rw http.ResponseWriter, r *http.Request) {
+	file, err := os.Open(r.FormValue("path"))
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+	defer file.Close()
+
+	offset, _ := strconv.ParseInt(r.FormValue("offset"), 10, 64)
+	count, err := strconv.ParseInt(r.FormValue("count"), 10, 64)
+
+	if err != nil {
+		count = -1
+	}
+
+	var reader io.Reader = io.NewSectionReader(file, offset, 1<<62)
+
+	if count >= 0 {
+		reader = io.LimitReader(reader, count)
+	}
+
+	hash, err := NewHash(HashAlgorithm(r.FormValue("algorithm")))
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+
+	io.Copy(hash, reader)
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte(hex.EncodeToString(hash.Sum(nil))))
+}
+
+func (t *testFilesystemAgent) manifest(rw http.ResponseWriter, r *http.Request) {
+	manifest, err := LocalManifest(r.FormValue("path"), HashAlgorithm(r.FormValue("algorithm")))
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+
+	rw.Header().Set("Trailer", "Error")
+	rw.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(rw)
+
+	for _, entry := range manifest {
+		encoder.Encode(entry)
+	}
+}
+
+func (t *testFilesystemAgent) extract(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Trailer", "Error")
+	rw.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(rw)
+	archive := strings.NewReader(r.FormValue("archive"))
+	dst := &localSyncTree{root: r.FormValue("path")}
+
+	err := extractArchive(r.Context(), archive, ArchiveFormat(r.FormValue("format")), dst, func(rel string, err error) {
+		report := &archiveEntryReport{Path: rel}
+
+		if err != nil {
+			report.Error = err.Error()
+		}
+
+		encoder.Encode(report)
+	})
+
+	if err != nil {
+		rw.Header().Set("Error", err.Error())
+	}
+}
+
+func (t *testFilesystemAgent) archive(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Trailer", "Error, Entries, Entry-Errors")
+	rw.WriteHeader(http.StatusOK)
+
+	result := &ArchiveResult{}
+	err := writeArchive(rw, ArchiveFormat(r.FormValue("format")), os.DirFS(r.FormValue("path")), result.report)
+
+	if err != nil {
+		rw.Header().Set("Error", err.Error())
+	}
+
+	entryErrors, _ := json.Marshal(result.Errors)
+
+	rw.Header().Set("Entries", strconv.Itoa(result.Entries))
+	rw.Header().Set("Entry-Errors", string(entryErrors))
+}
+
+func (t *testFilesystemAgent) follow(rw http.ResponseWriter, r *http.Request) {
+	path := r.FormValue("path")
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+
+	offset := len(data)
+	lines, _ := strconv.Atoi(r.FormValue("lines"))
+
+	if r.FormValue("fromstart") == "true" {
+		offset = 0
+	} else if lines > 0 {
+		offset = lastLines(data, lines)
+	}
+
+	rw.Header().Set("Trailer", "Error")
+	rw.WriteHeader(http.StatusOK)
+
+	for {
+		if data, err = ioutil.ReadFile(path); err == nil && len(data) > offset {
+			rw.Write(data[offset:])
+			rw.(http.Flusher).Flush()
+			offset = len(data)
+		}
+
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (t *testFilesystemAgent) watch(rw http.ResponseWriter, r *http.Request) {
+	fsys := os.DirFS(r.FormValue("path"))
+	opts := WatchOptions{
+		Recursive:    r.FormValue("recursive") == "true",
+		PollInterval: 10 * time.Millisecond,
+	}
+
+	snapshot, err := watchSnapshot(fsys, opts.Recursive)
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+
+	rw.Header().Set("Trailer", "Error")
+	rw.WriteHeader(http.StatusOK)
+	rw.(http.Flusher).Flush()
+
+	encoder := json.NewEncoder(rw)
+
+	pollWatch(r.Context(), fsys, snapshot, opts, func(event WatchEvent) bool {
+		encoder.Encode(event)
+		rw.(http.Flusher).Flush()
+		return true
+	})
+}
+
+func (t *testFilesystemAgent) find(rw http.ResponseWriter, r *http.Request) {
+	var query FindQuery
+
+	if err := json.Unmarshal([]byte(r.FormValue("query")), &query); err != nil {
+		t.fail(rw, err)
+		return
+	}
+
+	rw.Header().Set("Trailer", "Error")
+	rw.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(rw)
+
+	err := findWalk(r.Context(), os.DirFS(r.FormValue("path")), query, func(match *FindMatch) error {
+		return encoder.Encode(&findMatchMessage{
+			Path: match.Path,
+			Info: newTestFileInfo(match.Info),
+		})
+	})
+
+	if err != nil {
+		rw.Header().Set("Error", err.Error())
+	}
+}
+
+func (t *testFilesystemAgent) grep(rw http.ResponseWriter, r *http.Request) {
+	var opts GrepOptions
+
+	if err := json.Unmarshal([]byte(r.FormValue("options")), &opts); err != nil {
+		t.fail(rw, err)
+		return
+	}
+
+	re, err := opts.compile(r.FormValue("pattern"))
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+
+	rw.Header().Set("Trailer", "Error")
+	rw.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(rw)
+
+	if err := grepWalk(r.Context(), os.DirFS(r.FormValue("path")), re, opts, func(match *GrepMatch) error {
+		return encoder.Encode(match)
+	}); err != nil {
+		rw.Header().Set("Error", err.Error())
+	}
+}
+
+// diskfree reports the configured usage rather than that of the real disk
+// so tests can simulate a full device.
+func (t *testFilesystemAgent) diskfree(rw http.ResponseWriter, r *http.Request) {
+	t.json(rw, &t.usage)
+}
+
+func (t *testFilesystemAgent) du(rw http.ResponseWriter, r *http.Request) {
+	usage, err := diskUsageWalk(r.Context(), os.DirFS(r.FormValue("path")))
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+
+	usage.Path = r.FormValue("path")
+
+	t.json(rw, usage)
+}
+
+// fetch copies from the local disk, standing in for a pull from another
+// device. Devices named offline cannot be reached.
+func (t *testFilesystemAgent) fetch(rw http.ResponseWriter, r *http.Request) {
+	if r.FormValue("device") == "offline" {
+		rw.WriteHeader(http.StatusBadGateway)
+		rw.Write([]byte("device offline is not reachable"))
+		return
+	}
+
+	t.fetched = append(t.fetched, r.FormValue("device"))
+
+	src, err := os.Open(r.FormValue("source"))
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+	defer src.Close()
+
+	info, _ := src.Stat()
+	dst, err := os.Create(r.FormValue("path"))
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+	defer dst.Close()
+
+	rw.Header().Set("Trailer", "Error, Hash")
+	rw.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(rw)
+	hash := sha256.New()
+	buf := make([]byte, 64*1024)
+	transferred := int64(0)
+
+	for {
+		n, err := src.Read(buf)
+
+		if n > 0 {
+			dst.Write(buf[:n])
+			hash.Write(buf[:n])
+			transferred += int64(n)
+			encoder.Encode(&copyProgressMessage{Transferred: transferred, Total: info.Size()})
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			rw.Header().Set("Error", err.Error())
+			return
+		}
+	}
+
+	rw.Header().Set("Hash", hex.EncodeToString(hash.Sum(nil)))
+}
+
+func (t *testFilesystemAgent) mktemp(rw http.ResponseWriter, r *http.Request) {
+	var path string
+	var err error
+
+	if r.FormValue("dir") == "true" {
+		path, err = ioutil.TempDir("", r.FormValue("pattern"))
+	} else {
+		var file *os.File
+
+		if file, err = ioutil.TempFile("", r.FormValue("pattern")); err == nil {
+			path = file.Name()
+			file.Close()
+		}
+	}
+
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte(path))
+}
+
+// lastLines returns the offset in data where its last n lines start.
+func lastLines(data []byte, n int) int {
+	end := len(data)
+
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+
+	for i := 0; i < n; i++ {
+		if end = bytes.LastIndexByte(data[:end], '\n'); end < 0 {
+			return 0
+		}
+	}
+
+	return end + 1
+}
+
+func newTestFileInfo(info os.FileInfo) *deviceFileInfo {
+	return &deviceFileInfo{
+		FileName:    info.Name(),
+		FileSize:    info.Size(),
+		FileMode:    info.Mode(),
+		FileModTime: info.ModTime(),
+	}
+}
+
+func (t *testFilesystemAgent) json(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", hmapi.MediaTypeJSON.String())
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(v)
+}
+
+func (t *testFilesystemAgent) result(rw http.ResponseWriter, err error) {
+	if err != nil {
+		t.fail(rw, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+}
+
+// streamKey returns the stream key of the named form in the given field
+// when the client the agent trusts signed it for the path of the request
+// recently, and only the first time it is presented.
+func (t *testFilesystemAgent) streamKey(r *http.Request, name, field string) (*[32]byte, error) {
+	key, _ := base64.StdEncoding.DecodeString(r.FormValue(field))
+	signature, _ := base64.StdEncoding.DecodeString(r.FormValue("signature"))
+	timestamp, err := strconv.ParseInt(r.FormValue("timestamp"), 10, 64)
+
+	if err != nil || len(key) != 32 || !ed25519.Verify(t.clientKey, streamKeyMessage(name, r.FormValue("path"), timestamp, key), signature) {
+		return nil, fmt.Errorf("%v key is not signed by a trusted client", field)
+	}
+
+	if age := time.Since(time.Unix(timestamp, 0)); age > e2eKeyMaxAge || age < -e2eKeyMaxAge {
+		return nil, fmt.Errorf("%v key was signed %v ago", field, age)
+	}
+
+	t.keysmu.Lock()
+	defer t.keysmu.Unlock()
+
+	if t.keys[string(key)] {
+		return nil, fmt.Errorf("%v key was presented before", field)
+	}
+
+	t.keys[string(key)] = true
+
+	stream := &[32]byte{}
+	copy(stream[:], key)
+
+	return stream, nil
+}
+
+func (t *testFilesystemAgent) fail(rw http.ResponseWriter, err error) {
+	if os.IsNotExist(err) {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	rw.WriteHeader(http.StatusBadRequest)
+	rw.Write([]byte(err.Error()))
+}
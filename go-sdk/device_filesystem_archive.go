@@ -0,0 +1,563 @@
+package sdk
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+type ArchiveFormat string
+
+const (
+	ArchiveTar     = ArchiveFormat("tar")
+	ArchiveTarGzip = ArchiveFormat("tar.gz")
+	ArchiveZip     = ArchiveFormat("zip")
+)
+
+func (t ArchiveFormat) validate() error {
+	switch t {
+	case ArchiveTar, ArchiveTarGzip, ArchiveZip:
+		return nil
+	default:
+		return stacktrace.NewError("unsupported archive format '%v'", t)
+	}
+}
+
+// ArchiveEntryError reports an archive entry that was skipped, for example
+// because its path escapes the destination or it could not be read.
+type ArchiveEntryError struct {
+	Path    string `json:"path"`
+	Message string `json:"error"`
+}
+
+func (t *ArchiveEntryError) Error() string {
+	return fmt.Sprintf("archive entry '%v': %v", t.Path, t.Message)
+}
+
+type ArchiveResult struct {
+	Entries int
+	Errors  []*ArchiveEntryError
+}
+
+func (t *ArchiveResult) report(rel string, err error) {
+	if err == nil {
+		t.Entries++
+		return
+	}
+
+	t.Errors = append(t.Errors, &ArchiveEntryError{
+		Path:    rel,
+		Message: err.Error(),
+	})
+}
+
+// ArchiveReader streams an archive produced by GetArchive. Result is complete
+// once Read has returned io.EOF.
+type ArchiveReader interface {
+	io.ReadCloser
+	Result() *ArchiveResult
+}
+
+// archiveEntryReport is streamed by the extract form once per entry.
+type archiveEntryReport struct {
+	Path  string `json:"path"`
+	Error string `json:"error,omitempty"`
+}
+
+// PutArchive streams an archive to the device which extracts it below dst in
+// a single submission. Entries with absolute paths or paths that escape dst
+// are skipped and reported in the result along with any other entry that
+// could not be written.
+func (t *deviceFilesystem) PutArchive(ctx context.Context, dst string, r io.Reader, format ArchiveFormat) (*ArchiveResult, error) {
+	if err := format.validate(); err != nil {
+		return nil, err
+	}
+
+	ok, err := t.supportsUnsealed(ctx, "extract")
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ArchiveResult{}
+
+	// older agents only accept single file writes so the archive is
+	// extracted here and written entry by entry
+	if !ok {
+		err := extractArchive(ctx, r, format, &remoteSyncTree{root: dst, generics: t}, result.report)
+		return result, err
+	}
+
+	resp, err := t.device.submit(ctx, t.form("extract").
+		AddFieldAsString("path", dst).
+		AddFieldAsString("format", string(format)).
+		AddFieldAsOctetStream("archive", r))
+
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+
+	for {
+		var report *archiveEntryReport
+
+		if err := decoder.Decode(&report); err == io.EOF {
+			break
+		} else if err != nil {
+			return result, stacktrace.Propagate(err, "failed decoding extraction of '%v'", dst)
+		}
+
+		if report.Error == "" {
+			result.Entries++
+			continue
+		}
+
+		result.Errors = append(result.Errors, &ArchiveEntryError{
+			Path:    report.Path,
+			Message: report.Error,
+		})
+	}
+
+	if trailerError := resp.Trailer.Get("Error"); trailerError != "" {
+		return result, stacktrace.NewError("failed extracting archive to '%v': %v", dst, trailerError)
+	}
+
+	return result, nil
+}
+
+// GetArchive streams the directory src from the device as an archive.
+// Entries that cannot be read are left out and reported in the result.
+func (t *deviceFilesystem) GetArchive(ctx context.Context, src string, format ArchiveFormat) (ArchiveReader, error) {
+	if err := format.validate(); err != nil {
+		return nil, err
+	}
+
+	ok, err := t.supportsUnsealed(ctx, "archive")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		info, err := t.Stat(ctx, src)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			return nil, stacktrace.NewError("'%v' is not a directory", src)
+		}
+
+		return newLocalArchiveReader(format, &deviceFS{ctx: ctx, fs: t, root: src}), nil
+	}
+
+	resp, err := t.device.submit(ctx, t.form("archive").
+		AddFieldAsString("path", src).
+		AddFieldAsString("format", string(format)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &deviceArchiveReader{
+		resp:   resp.Body,
+		result: &ArchiveResult{},
+		src:    src,
+		trailer: func(name string) string {
+			return resp.Trailer.Get(name)
+		},
+	}, nil
+}
+
+// deviceArchiveReader reads an archive produced by the agent. The agent
+// reports the entry count and skipped entries in the Entries and
+// Entry-Errors trailers.
+type deviceArchiveReader struct {
+	resp    io.ReadCloser
+	result  *ArchiveResult
+	src     string
+	trailer func(name string) string
+}
+
+func (t *deviceArchiveReader) Read(p []byte) (int, error) {
+	n, err := t.resp.Read(p)
+
+	if err != io.EOF {
+		return n, err
+	}
+
+	if trailerError := t.trailer("Error"); trailerError != "" {
+		return n, stacktrace.NewError("failed archiving '%v': %v", t.src, trailerError)
+	}
+
+	t.result.Entries, _ = strconv.Atoi(t.trailer("Entries"))
+
+	if entryErrors := t.trailer("Entry-Errors"); entryErrors != "" {
+		if err := json.Unmarshal([]byte(entryErrors), &t.result.Errors); err != nil {
+			return n, stacktrace.Propagate(err, "failed decoding entry errors of '%v'", t.src)
+		}
+	}
+
+	return n, io.EOF
+}
+
+func (t *deviceArchiveReader) Close() error {
+	return t.resp.Close()
+}
+
+func (t *deviceArchiveReader) Result() *ArchiveResult {
+	return t.result
+}
+
+// localArchiveReader builds the archive on this side of the connection by
+// walking fsys. Closing it fails the next write so the walk stops.
+type localArchiveReader struct {
+	*io.PipeReader
+	result *ArchiveResult
+}
+
+func newLocalArchiveReader(format ArchiveFormat, fsys fs.FS) *localArchiveReader {
+	pr, pw := io.Pipe()
+
+	t := &localArchiveReader{
+		PipeReader: pr,
+		result:     &ArchiveResult{},
+	}
+
+	go func() {
+		pw.CloseWithError(writeArchive(pw, format, fsys, t.result.report))
+	}()
+
+	return t
+}
+
+func (t *localArchiveReader) Result() *ArchiveResult {
+	return t.result
+}
+
+// cleanArchivePath validates an entry name and returns it as a clean slash
+// separated path relative to the extraction root.
+func cleanArchivePath(name string) (string, error) {
+	name = strings.Replace(name, `\`, "/", -1)
+
+	if strings.HasPrefix(name, "/") || (len(name) >= 2 && name[1] == ':') {
+		return "", errors.New("absolute path")
+	}
+
+	rel := path.Clean(name)
+
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", errors.New("path escapes the destination")
+	}
+
+	return rel, nil
+}
+
+// extractArchive writes the entries of r to dst and reports every entry.
+// Errors that make the rest of the archive unreadable are returned.
+func extractArchive(ctx context.Context, r io.Reader, format ArchiveFormat, dst syncTree, report func(rel string, err error)) error {
+	// like the extract form, a missing destination is created
+	if err := dst.mkdir(ctx, ".", 0755); err != nil {
+		return err
+	}
+
+	dirs := map[string]bool{".": true}
+
+	mkdir := func(rel string, mode os.FileMode) error {
+		if dirs[rel] {
+			return nil
+		}
+
+		if err := dst.mkdir(ctx, rel, mode); err != nil {
+			return err
+		}
+
+		for dir := rel; dir != "."; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+
+		return nil
+	}
+
+	entry := func(name string, mode os.FileMode, body io.Reader) {
+		rel, err := cleanArchivePath(name)
+
+		if err != nil {
+			report(name, err)
+			return
+		}
+
+		switch {
+		case mode.IsDir():
+			err = mkdir(rel, mode.Perm())
+
+		case mode.IsRegular():
+			if err = mkdir(path.Dir(rel), 0755); err == nil {
+				err = dst.create(ctx, rel, body, mode.Perm())
+			}
+
+		default:
+			err = fmt.Errorf("unsupported entry type %v", mode.Type())
+		}
+
+		if rel != "." {
+			report(rel, err)
+		}
+	}
+
+	switch format {
+	case ArchiveTar, ArchiveTarGzip:
+		if format == ArchiveTarGzip {
+			gz, err := gzip.NewReader(r)
+
+			if err != nil {
+				return stacktrace.Propagate(err, "failed reading gzip stream")
+			}
+			defer gz.Close()
+
+			r = gz
+		}
+
+		reader := tar.NewReader(r)
+
+		for {
+			header, err := reader.Next()
+
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return stacktrace.Propagate(err, "failed reading tar stream")
+			}
+
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			if header.Typeflag == tar.TypeLink {
+				report(header.Name, errors.New("unsupported entry type hardlink"))
+				continue
+			}
+
+			entry(header.Name, header.FileInfo().Mode(), reader)
+		}
+
+	case ArchiveZip:
+		// zip keeps its directory at the end so the stream is spooled to a
+		// temp file for random access
+		spool, err := ioutil.TempFile("", "deviceio-archive")
+
+		if err != nil {
+			return err
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+
+		size, err := io.Copy(spool, r)
+
+		if err != nil {
+			return stacktrace.Propagate(err, "failed reading zip stream")
+		}
+
+		reader, err := zip.NewReader(spool, size)
+
+		if err != nil {
+			return stacktrace.Propagate(err, "failed reading zip stream")
+		}
+
+		for _, file := range reader.File {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			if file.Mode().IsDir() {
+				entry(file.Name, file.Mode(), nil)
+				continue
+			}
+
+			body, err := file.Open()
+
+			if err != nil {
+				report(file.Name, err)
+				continue
+			}
+
+			entry(file.Name, file.Mode(), body)
+			body.Close()
+		}
+
+		return nil
+
+	default:
+		return format.validate()
+	}
+}
+
+// writeArchive walks fsys and writes every directory and regular file to w.
+// Entries that cannot be read are reported and left out.
+func writeArchive(w io.Writer, format ArchiveFormat, fsys fs.FS, report func(rel string, err error)) error {
+	var add func(rel string, info fs.FileInfo, body io.Reader) error
+	var finish func() error
+
+	switch format {
+	case ArchiveTar, ArchiveTarGzip:
+		out := w
+		var gz *gzip.Writer
+
+		if format == ArchiveTarGzip {
+			gz = gzip.NewWriter(w)
+			out = gz
+		}
+
+		writer := tar.NewWriter(out)
+
+		add = func(rel string, info fs.FileInfo, body io.Reader) error {
+			header, err := tar.FileInfoHeader(info, "")
+
+			if err != nil {
+				return err
+			}
+
+			header.Name = rel
+
+			if info.IsDir() {
+				header.Name += "/"
+			}
+
+			if stat, ok := info.Sys().(*FileStat); ok && stat != nil {
+				header.Uid = stat.UID
+				header.Gid = stat.GID
+				header.Uname = stat.Owner
+				header.Gname = stat.Group
+			}
+
+			if err := writer.WriteHeader(header); err != nil {
+				return err
+			}
+
+			if body != nil {
+				_, err = io.Copy(writer, body)
+			}
+
+			return err
+		}
+
+		finish = func() error {
+			if err := writer.Close(); err != nil || gz == nil {
+				return err
+			}
+
+			return gz.Close()
+		}
+
+	case ArchiveZip:
+		writer := zip.NewWriter(w)
+
+		add = func(rel string, info fs.FileInfo, body io.Reader) error {
+			header, err := zip.FileInfoHeader(info)
+
+			if err != nil {
+				return err
+			}
+
+			header.Name = rel
+
+			if info.IsDir() {
+				header.Name += "/"
+			} else {
+				header.Method = zip.Deflate
+			}
+
+			entry, err := writer.CreateHeader(header)
+
+			if err != nil || body == nil {
+				return err
+			}
+
+			_, err = io.Copy(entry, body)
+
+			return err
+		}
+
+		finish = writer.Close
+
+	default:
+		return format.validate()
+	}
+
+	err := fs.WalkDir(fsys, ".", func(rel string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if rel == "." {
+				return err
+			}
+
+			// unreadable directories are reported and their contents skipped
+			report(rel, err)
+			return nil
+		}
+
+		if rel == "." {
+			return nil
+		}
+
+		info, err := d.Info()
+
+		if err != nil {
+			report(rel, err)
+			return nil
+		}
+
+		if info.IsDir() {
+			if err := add(rel, info, nil); err != nil {
+				return err
+			}
+
+			report(rel, nil)
+			return nil
+		}
+
+		if !info.Mode().IsRegular() {
+			report(rel, fmt.Errorf("unsupported entry type %v", info.Mode().Type()))
+			return nil
+		}
+
+		// files are opened before the header is written so an unreadable
+		// file leaves no partial entry behind
+		file, err := fsys.Open(rel)
+
+		if err != nil {
+			report(rel, err)
+			return nil
+		}
+		defer file.Close()
+
+		if err := add(rel, info, file); err != nil {
+			return err
+		}
+
+		report(rel, nil)
+
+		return nil
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed writing archive")
+	}
+
+	return finish()
+}
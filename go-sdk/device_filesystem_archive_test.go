@@ -0,0 +1,174 @@
+package sdk
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_put_archive_rejects_traversal() {
+	for _, fallback := range []bool{false, true} {
+		objects := t.getTestObjects()
+
+		agent := newTestFilesystemAgent()
+
+		if fallback {
+			delete(agent.handlers, "extract")
+		}
+
+		agent.register(objects.mux)
+
+		parent, _ := ioutil.TempDir("", "go-sdk-archive")
+		dst := filepath.Join(parent, "dst")
+
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		writer := tar.NewWriter(gz)
+
+		for _, entry := range []struct {
+			name string
+			body string
+			kind byte
+		}{
+			{"dir/", "", tar.TypeDir},
+			{"dir/a.txt", "a", tar.TypeReg},
+			{"nested/deeper/b.txt", "bb", tar.TypeReg},
+			{"../evil.txt", "evil", tar.TypeReg},
+			{"/abs.txt", "abs", tar.TypeReg},
+			{"link", "", tar.TypeSymlink},
+		} {
+			writer.WriteHeader(&tar.Header{
+				Name:     entry.name,
+				Mode:     0644,
+				Size:     int64(len(entry.body)),
+				Typeflag: entry.kind,
+				Linkname: "/etc/passwd",
+			})
+			writer.Write([]byte(entry.body))
+		}
+
+		writer.Close()
+		gz.Close()
+
+		result, err := objects.client.Device("whatever").Filesystem().PutArchive(context.Background(), dst, &buf, ArchiveTarGzip)
+
+		assert.Nil(t.T(), err)
+		assert.Equal(t.T(), 3, result.Entries)
+
+		failed := []string{}
+
+		for _, entryErr := range result.Errors {
+			failed = append(failed, entryErr.Path)
+		}
+
+		assert.Equal(t.T(), []string{"../evil.txt", "/abs.txt", "link"}, failed)
+
+		data, _ := ioutil.ReadFile(filepath.Join(dst, "nested", "deeper", "b.txt"))
+
+		assert.Equal(t.T(), "bb", string(data))
+
+		_, err = os.Stat(filepath.Join(parent, "evil.txt"))
+
+		assert.True(t.T(), os.IsNotExist(err))
+
+		os.RemoveAll(parent)
+		objects.server.Close()
+	}
+}
+
+func (t *Test_DeviceFilesystem) Test_get_archive_round_trip() {
+	for _, fallback := range []bool{false, true} {
+		objects := t.getTestObjects()
+
+		agent := newTestFilesystemAgent()
+
+		if fallback {
+			delete(agent.handlers, "archive")
+		}
+
+		agent.register(objects.mux)
+
+		dir := t.makeTree()
+		os.Symlink("/etc/passwd", filepath.Join(dir, "link"))
+
+		fs := objects.client.Device("whatever").Filesystem()
+
+		for _, format := range []ArchiveFormat{ArchiveTar, ArchiveTarGzip, ArchiveZip} {
+			reader, err := fs.GetArchive(context.Background(), dir, format)
+
+			assert.Nil(t.T(), err)
+
+			data, err := ioutil.ReadAll(reader)
+			reader.Close()
+
+			assert.Nil(t.T(), err)
+			assert.Equal(t.T(), 5, reader.Result().Entries, string(format))
+			assert.Len(t.T(), reader.Result().Errors, 1)
+
+			files := t.readArchive(data, format)
+
+			assert.Equal(t.T(), map[string]string{
+				"a.txt":            "a",
+				"sub/":             "",
+				"sub/b.txt":        "bb",
+				"sub/deeper/":      "",
+				"sub/deeper/c.txt": "ccc",
+			}, files, string(format))
+		}
+
+		os.RemoveAll(dir)
+		objects.server.Close()
+	}
+}
+
+func (t *Test_DeviceFilesystem) readArchive(data []byte, format ArchiveFormat) map[string]string {
+	files := map[string]string{}
+
+	if format == ArchiveZip {
+		reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+
+		if err != nil {
+			t.T().Error("Error reading zip", err.Error())
+			t.T().FailNow()
+		}
+
+		for _, file := range reader.File {
+			body, _ := file.Open()
+			content, _ := ioutil.ReadAll(body)
+			body.Close()
+
+			files[file.Name] = string(content)
+		}
+
+		return files
+	}
+
+	var r io.Reader = bytes.NewReader(data)
+
+	if format == ArchiveTarGzip {
+		r, _ = gzip.NewReader(r)
+	}
+
+	reader := tar.NewReader(r)
+
+	for {
+		header, err := reader.Next()
+
+		if err != nil {
+			break
+		}
+
+		content, _ := ioutil.ReadAll(reader)
+		files[header.Name] = string(content)
+	}
+
+	return files
+}
@@ -0,0 +1,124 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/deviceio/hmapi"
+	"github.com/palantir/stacktrace"
+)
+
+func (t *deviceFilesystem) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	return t.submitAndClose(ctx, t.form("chmod").
+		AddFieldAsString("path", path).
+		AddFieldAsInt("mode", int(mode)))
+}
+
+func (t *deviceFilesystem) Chown(ctx context.Context, path string, uid, gid int) error {
+	form := t.form("chown").AddFieldAsString("path", path)
+	addOwnerFields(form, uid, gid, "", "")
+
+	return t.submitAndClose(ctx, form)
+}
+
+func (t *deviceFilesystem) ChownName(ctx context.Context, path string, owner, group string) error {
+	if owner == "" && group == "" {
+		return stacktrace.NewError("owner or group must be supplied")
+	}
+
+	form := t.form("chown").AddFieldAsString("path", path)
+	addOwnerFields(form, -1, -1, owner, group)
+
+	return t.submitAndClose(ctx, form)
+}
+
+func (t *deviceFilesystem) Chtimes(ctx context.Context, path string, atime, mtime time.Time) error {
+	return t.submitAndClose(ctx, t.form("chtimes").
+		AddFieldAsString("path", path).
+		AddFieldAsString("atime", atime.UTC().Format(time.RFC3339Nano)).
+		AddFieldAsString("mtime", mtime.UTC().Format(time.RFC3339Nano)))
+}
+
+func (t *deviceFilesystem) GetXattr(ctx context.Context, path, name string) ([]byte, error) {
+	resp, err := t.device.submit(ctx, t.form("getxattr").
+		AddFieldAsString("path", path).
+		AddFieldAsString("name", name))
+
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	value, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed reading xattr '%v' of '%v'", name, path)
+	}
+
+	return value, nil
+}
+
+func (t *deviceFilesystem) SetXattr(ctx context.Context, path, name string, value []byte) error {
+	return t.submitAndClose(ctx, t.form("setxattr").
+		AddFieldAsString("path", path).
+		AddFieldAsString("name", name).
+		AddFieldAsOctetStream("value", bytes.NewReader(value)))
+}
+
+func (t *deviceFilesystem) ListXattr(ctx context.Context, path string) ([]string, error) {
+	resp, err := t.device.submit(ctx, t.form("listxattr").
+		AddFieldAsString("path", path))
+
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var names []string
+
+	if err = json.NewDecoder(resp.Body).Decode(&names); err != nil {
+		return nil, stacktrace.Propagate(err, "failed decoding xattr list of '%v'", path)
+	}
+
+	return names, nil
+}
+
+func (t *deviceFilesystem) RemoveXattr(ctx context.Context, path, name string) error {
+	return t.submitAndClose(ctx, t.form("removexattr").
+		AddFieldAsString("path", path).
+		AddFieldAsString("name", name))
+}
+
+func (t *deviceFilesystem) submitAndClose(ctx context.Context, form hmapi.FormRequest) error {
+	resp, err := t.device.submit(ctx, form)
+
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// addOwnerFields only adds the fields that change ownership so agents that
+// predate ownership support keep accepting plain requests.
+func addOwnerFields(form hmapi.FormRequest, uid, gid int, user, group string) {
+	if uid >= 0 && user == "" {
+		form.AddFieldAsInt("uid", uid)
+	}
+
+	if gid >= 0 && group == "" {
+		form.AddFieldAsInt("gid", gid)
+	}
+
+	if user != "" {
+		form.AddFieldAsString("owner", user)
+	}
+
+	if group != "" {
+		form.AddFieldAsString("group", group)
+	}
+}
@@ -0,0 +1,75 @@
+package sdk
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_chmod_and_chtimes() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	tmpfile, err := ioutil.TempFile("", "go-sdk-device-filesystem-attr")
+
+	if err != nil {
+		t.T().Error("Error creating temp file", err.Error())
+		t.T().FailNow()
+	}
+
+	tmpfile.Close()
+	defer func() {
+		os.Remove(tmpfile.Name())
+	}()
+
+	fs := objects.client.Device("whatever").Filesystem()
+	mtime := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.Nil(t.T(), fs.Chmod(context.Background(), tmpfile.Name(), 0600))
+	assert.Nil(t.T(), fs.Chtimes(context.Background(), tmpfile.Name(), mtime, mtime))
+
+	info, err := os.Stat(tmpfile.Name())
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), os.FileMode(0600), info.Mode().Perm())
+	assert.True(t.T(), mtime.Equal(info.ModTime()))
+}
+
+func (t *Test_DeviceFilesystem) Test_xattrs() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	tmpfile, _ := ioutil.TempFile("", "go-sdk-device-filesystem-xattr")
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+
+	fs := objects.client.Device("whatever").Filesystem()
+
+	assert.Nil(t.T(), fs.SetXattr(context.Background(), tmpfile.Name(), "user.checksum", []byte("abc")))
+	assert.Nil(t.T(), fs.SetXattr(context.Background(), tmpfile.Name(), "user.origin", []byte("build-7")))
+
+	value, err := fs.GetXattr(context.Background(), tmpfile.Name(), "user.checksum")
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "abc", string(value))
+
+	names, err := fs.ListXattr(context.Background(), tmpfile.Name())
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), []string{"user.checksum", "user.origin"}, names)
+
+	assert.Nil(t.T(), fs.RemoveXattr(context.Background(), tmpfile.Name(), "user.checksum"))
+
+	_, err = fs.GetXattr(context.Background(), tmpfile.Name(), "user.checksum")
+	assert.IsType(t.T(), &ErrInvalidAPIResponse{}, err)
+
+	err = fs.SetXattr(context.Background(), "/nonexistent/go-sdk-test", "user.origin", []byte("x"))
+	assert.NotNil(t.T(), err)
+}
@@ -0,0 +1,80 @@
+//go:build !windows
+// +build !windows
+
+package sdk
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"syscall"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_chown_leaves_unset_parts() {
+	if os.Geteuid() != 0 {
+		t.T().Skip("changing ownership requires root")
+	}
+
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	agent := newTestFilesystemAgent()
+	sent := map[string][]string{}
+
+	agent.handlers["write"] = func(rw http.ResponseWriter, r *http.Request) {
+		r.ParseMultipartForm(1 << 20)
+		sent = r.MultipartForm.Value
+		agent.write(rw, r)
+	}
+
+	agent.register(objects.mux)
+
+	tmpfile, _ := ioutil.TempFile("", "go-sdk-device-filesystem-chown")
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+
+	fs := objects.client.Device("whatever").Filesystem()
+	owner := func() (uint32, uint32) {
+		info, _ := os.Stat(tmpfile.Name())
+		stat := info.Sys().(*syscall.Stat_t)
+		return stat.Uid, stat.Gid
+	}
+
+	assert.Nil(t.T(), fs.Chown(context.Background(), tmpfile.Name(), 65534, 65534))
+
+	uid, gid := owner()
+	assert.Equal(t.T(), uint32(65534), uid)
+	assert.Equal(t.T(), uint32(65534), gid)
+
+	assert.Nil(t.T(), fs.ChownName(context.Background(), tmpfile.Name(), "root", ""))
+
+	uid, gid = owner()
+	assert.Equal(t.T(), uint32(0), uid)
+	assert.Equal(t.T(), uint32(65534), gid)
+
+	assert.Nil(t.T(), fs.Chown(context.Background(), tmpfile.Name(), -1, 0))
+
+	uid, gid = owner()
+	assert.Equal(t.T(), uint32(0), uid)
+	assert.Equal(t.T(), uint32(0), gid)
+
+	err := fs.WriteFile(context.Background(), tmpfile.Name(), []byte("x"), WriterOptions{
+		Owner: &FileOwner{User: "root"},
+	})
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), []string{"root"}, sent["owner"])
+	assert.NotContains(t.T(), sent, "uid")
+	assert.NotContains(t.T(), sent, "gid")
+
+	err = fs.WriteFile(context.Background(), tmpfile.Name(), []byte("x"), WriterOptions{
+		Owner: OwnerID(-1, 65534),
+	})
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), []string{"65534"}, sent["gid"])
+	assert.NotContains(t.T(), sent, "uid")
+}
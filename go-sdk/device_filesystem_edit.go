@@ -0,0 +1,349 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+const (
+	defaultEditRetries = 5
+	defaultBlockMarker = "# {mark} DEVICEIO MANAGED BLOCK"
+)
+
+// EditResult reports the outcome of an edit. Diff is a unified diff of the
+// change and empty when the file was already in the desired state.
+type EditResult struct {
+	Changed bool
+	Diff    string
+}
+
+// LineOptions controls EnsureLine and EnsureLineAbsent. Match is a regular
+// expression selecting the line to replace, or the lines to remove, instead
+// of comparing lines with the given one. InsertAfter is a regular expression
+// after whose last match a missing line is inserted, the line is appended
+// when it is empty or does not match. Create creates a missing file.
+type LineOptions struct {
+	Match       string
+	InsertAfter string
+	Create      bool
+}
+
+// BlockOptions controls EnsureBlock. Marker is the line surrounding the
+// block with "{mark}" replaced by BEGIN and END, different blocks in one file
+// need different markers. Create creates a missing file.
+type BlockOptions struct {
+	Marker string
+	Create bool
+}
+
+// EnsureLine makes sure line is present in path. With Match set the last
+// matching line is replaced by line, otherwise line is added unless an
+// identical line exists.
+//
+// Like all edits it reads the file, applies the change locally and writes
+// the result back atomically on the condition that the file still has the
+// content that was read, so concurrent edits are retried instead of being
+// lost.
+func (t *deviceFilesystem) EnsureLine(ctx context.Context, path, line string, opts LineOptions) (*EditResult, error) {
+	match, err := compileEditPattern(opts.Match)
+
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := compileEditPattern(opts.InsertAfter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return t.edit(ctx, path, opts.Create, func(lines []string) []string {
+		if match != nil {
+			for i := len(lines) - 1; i >= 0; i-- {
+				if match.MatchString(lines[i]) {
+					lines[i] = line
+					return lines
+				}
+			}
+		}
+
+		for _, existing := range lines {
+			if existing == line {
+				return lines
+			}
+		}
+
+		if after != nil {
+			for i := len(lines) - 1; i >= 0; i-- {
+				if after.MatchString(lines[i]) {
+					return append(lines[:i+1], append([]string{line}, lines[i+1:]...)...)
+				}
+			}
+		}
+
+		return append(lines, line)
+	})
+}
+
+// EnsureLineAbsent removes every line of path equal to line, or matching
+// Match when it is set. A missing file is left missing.
+func (t *deviceFilesystem) EnsureLineAbsent(ctx context.Context, path, line string, opts LineOptions) (*EditResult, error) {
+	match, err := compileEditPattern(opts.Match)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := t.edit(ctx, path, false, func(lines []string) []string {
+		kept := lines[:0]
+
+		for _, existing := range lines {
+			if existing == line || (match != nil && match.MatchString(existing)) {
+				continue
+			}
+
+			kept = append(kept, existing)
+		}
+
+		return kept
+	})
+
+	if errors.Is(err, os.ErrNotExist) {
+		return &EditResult{}, nil
+	}
+
+	return result, err
+}
+
+// ReplaceRegexp replaces every match of pattern in path with replacement,
+// which can refer to submatches as with regexp.ReplaceAllString. The pattern
+// is applied to the whole content, use the (?m) flag to anchor ^ and $ at
+// lines. The edit is only idempotent when replacement does not match pattern
+// itself.
+func (t *deviceFilesystem) ReplaceRegexp(ctx context.Context, path, pattern, replacement string) (*EditResult, error) {
+	re, err := regexp.Compile(pattern)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "invalid pattern '%v'", pattern)
+	}
+
+	return editContent(ctx, t, path, false, func(data []byte) []byte {
+		return re.ReplaceAll(data, []byte(replacement))
+	})
+}
+
+// EnsureBlock makes sure path contains block between a pair of marker lines,
+// replacing the content of an existing pair or appending a new one. An
+// empty block removes the markers along with their content. A begin marker
+// without an end marker fails the edit rather than adding a second block.
+func (t *deviceFilesystem) EnsureBlock(ctx context.Context, path, block string, opts BlockOptions) (*EditResult, error) {
+	if opts.Marker == "" {
+		opts.Marker = defaultBlockMarker
+	}
+
+	begin := strings.Replace(opts.Marker, "{mark}", "BEGIN", -1)
+	end := strings.Replace(opts.Marker, "{mark}", "END", -1)
+
+	if begin == end {
+		return nil, stacktrace.NewError("block marker '%v' does not contain {mark}", opts.Marker)
+	}
+
+	managed := []string{}
+
+	if block != "" {
+		managed = append(managed, begin)
+		managed = append(managed, splitEditLines(strings.TrimSuffix(block, "\n"), "\n")...)
+		managed = append(managed, end)
+	}
+
+	unterminated := false
+
+	result, err := t.edit(ctx, path, opts.Create && block != "", func(lines []string) []string {
+		start, stop := -1, -1
+
+		for i, line := range lines {
+			if start < 0 && line == begin {
+				start = i
+			} else if start >= 0 && line == end {
+				stop = i
+				break
+			}
+		}
+
+		unterminated = start >= 0 && stop < 0
+
+		if unterminated {
+			return lines
+		}
+
+		if start < 0 {
+			return append(lines, managed...)
+		}
+
+		updated := append([]string{}, lines[:start]...)
+		updated = append(updated, managed...)
+
+		return append(updated, lines[stop+1:]...)
+	})
+
+	if block == "" && errors.Is(err, os.ErrNotExist) {
+		return &EditResult{}, nil
+	}
+
+	if err == nil && unterminated {
+		return nil, stacktrace.NewError("'%v' has no '%v' after '%v'", path, end, begin)
+	}
+
+	return result, err
+}
+
+// edit applies a line based edit, preserving the line endings of the file.
+func (t *deviceFilesystem) edit(ctx context.Context, path string, create bool, fn func([]string) []string) (*EditResult, error) {
+	return editContent(ctx, t, path, create, func(data []byte) []byte {
+		eol := "\n"
+
+		if bytes.Contains(data, []byte("\r\n")) {
+			eol = "\r\n"
+		}
+
+		content := string(data)
+		original := splitEditLines(strings.TrimSuffix(content, eol), eol)
+		lines := fn(append([]string{}, original...))
+
+		if equalLines(original, lines) {
+			return data
+		}
+
+		if len(lines) == 0 {
+			return nil
+		}
+
+		joined := strings.Join(lines, eol)
+
+		// a file without a final line ending keeps it that way unless its
+		// last line changed
+		if content == "" || strings.HasSuffix(content, eol) || lines[len(lines)-1] != original[len(original)-1] {
+			joined += eol
+		}
+
+		return []byte(joined)
+	})
+}
+
+// editContent reads path, applies fn and writes the result back with the
+// hash of the content read as the expected hash, retrying the whole edit
+// when another writer got in between, including one that created the file.
+func editContent(ctx context.Context, fs DeviceFilesystem, path string, create bool, fn func([]byte) []byte) (*EditResult, error) {
+	var lasterr error
+
+	for attempt := 0; attempt < defaultEditRetries; attempt++ {
+		data, exists, err := readEditable(ctx, fs, path, create)
+
+		if err != nil {
+			return nil, err
+		}
+
+		updated := fn(append([]byte{}, data...))
+
+		if exists && bytes.Equal(data, updated) {
+			return &EditResult{}, nil
+		}
+
+		// a missing file hashes as empty content, so a file created by
+		// another writer since it was read fails the precondition as well
+		opts := WriterOptions{
+			Atomic:       true,
+			ExpectedHash: hashBytes(data),
+		}
+
+		diff, err := unifiedDiff(string(data), string(updated), path, path)
+
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed diffing '%v'", path)
+		}
+
+		err = fs.WriteFile(ctx, path, updated, opts)
+
+		if _, ok := err.(*ErrPreconditionFailed); ok {
+			lasterr = err
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &EditResult{
+			Changed: true,
+			Diff:    diff,
+		}, nil
+	}
+
+	return nil, lasterr
+}
+
+// readEditable reads path, treating a missing file as empty when create is
+// set.
+func readEditable(ctx context.Context, fs DeviceFilesystem, path string, create bool) ([]byte, bool, error) {
+	file, err := fs.Open(ctx, path)
+
+	if errors.Is(err, os.ErrNotExist) && create {
+		return nil, false, nil
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+
+	if err != nil {
+		return nil, false, stacktrace.Propagate(err, "failed reading '%v'", path)
+	}
+
+	return data, true, nil
+}
+
+func splitEditLines(content, eol string) []string {
+	if content == "" {
+		return []string{}
+	}
+
+	return strings.Split(content, eol)
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func compileEditPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "invalid pattern '%v'", pattern)
+	}
+
+	return re, nil
+}
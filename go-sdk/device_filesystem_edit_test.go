@@ -0,0 +1,262 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_ensure_line() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-edit")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hosts")
+	ioutil.WriteFile(path, []byte("127.0.0.1 localhost\n10.0.0.1 gateway\n"), 0644)
+
+	fs := objects.client.Device("whatever").Filesystem()
+
+	result, err := fs.EnsureLine(context.Background(), path, "10.0.0.2 hub", LineOptions{})
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), result.Changed)
+	assert.Contains(t.T(), result.Diff, "+10.0.0.2 hub\n")
+
+	result, err = fs.EnsureLine(context.Background(), path, "10.0.0.2 hub", LineOptions{})
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), &EditResult{}, result)
+
+	result, err = fs.EnsureLine(context.Background(), path, "10.0.0.9 gateway", LineOptions{Match: `\sgateway$`})
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), result.Changed)
+	assert.Contains(t.T(), result.Diff, "-10.0.0.1 gateway\n+10.0.0.9 gateway\n")
+
+	_, err = fs.EnsureLine(context.Background(), path, "::1 localhost", LineOptions{InsertAfter: `localhost$`})
+
+	assert.Nil(t.T(), err)
+
+	result, err = fs.EnsureLineAbsent(context.Background(), path, "", LineOptions{Match: `hub$`})
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), result.Changed)
+
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t.T(), "127.0.0.1 localhost\n::1 localhost\n10.0.0.9 gateway\n", string(data))
+
+	info, _ := os.Stat(path)
+	assert.Equal(t.T(), os.FileMode(0644), info.Mode().Perm())
+
+	_, err = fs.EnsureLine(context.Background(), filepath.Join(dir, "missing"), "line", LineOptions{})
+	assert.True(t.T(), errors.Is(err, os.ErrNotExist))
+
+	result, err = fs.EnsureLine(context.Background(), filepath.Join(dir, "created"), "line", LineOptions{Create: true})
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), result.Changed)
+
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "created"))
+	assert.Equal(t.T(), "line\n", string(data))
+
+	result, err = fs.EnsureLineAbsent(context.Background(), filepath.Join(dir, "missing"), "line", LineOptions{})
+
+	assert.Nil(t.T(), err)
+	assert.False(t.T(), result.Changed)
+}
+
+func (t *Test_DeviceFilesystem) Test_edit_preserves_line_endings() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-edit")
+	defer os.RemoveAll(dir)
+
+	fs := objects.client.Device("whatever").Filesystem()
+
+	crlf := filepath.Join(dir, "crlf.ini")
+	ioutil.WriteFile(crlf, []byte("[main]\r\nport=80\r\n"), 0644)
+
+	_, err := fs.EnsureLine(context.Background(), crlf, "debug=true", LineOptions{})
+	assert.Nil(t.T(), err)
+
+	data, _ := ioutil.ReadFile(crlf)
+	assert.Equal(t.T(), "[main]\r\nport=80\r\ndebug=true\r\n", string(data))
+
+	unterminated := filepath.Join(dir, "unterminated")
+	ioutil.WriteFile(unterminated, []byte("a\nb"), 0644)
+
+	result, err := fs.EnsureLineAbsent(context.Background(), unterminated, "a", LineOptions{})
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), result.Changed)
+
+	data, _ = ioutil.ReadFile(unterminated)
+	assert.Equal(t.T(), "b", string(data))
+}
+
+func (t *Test_DeviceFilesystem) Test_replace_regexp_and_block() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-edit")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.conf")
+	ioutil.WriteFile(path, []byte("listen 80\nworkers 2\n"), 0644)
+
+	fs := objects.client.Device("whatever").Filesystem()
+
+	result, err := fs.ReplaceRegexp(context.Background(), path, `(?m)^workers \d+$`, "workers 8")
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), result.Changed)
+
+	result, err = fs.ReplaceRegexp(context.Background(), path, `(?m)^listen (\d+)$`, "listen $1")
+
+	assert.Nil(t.T(), err)
+	assert.False(t.T(), result.Changed)
+
+	result, err = fs.EnsureBlock(context.Background(), path, "upstream a\nupstream b\n", BlockOptions{})
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), result.Changed)
+
+	result, err = fs.EnsureBlock(context.Background(), path, "upstream c", BlockOptions{})
+
+	assert.Nil(t.T(), err)
+	assert.Contains(t.T(), result.Diff, "-upstream a\n-upstream b\n+upstream c\n")
+
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t.T(), strings.Join([]string{
+		"listen 80",
+		"workers 8",
+		"# BEGIN DEVICEIO MANAGED BLOCK",
+		"upstream c",
+		"# END DEVICEIO MANAGED BLOCK",
+		"",
+	}, "\n"), string(data))
+
+	result, err = fs.EnsureBlock(context.Background(), path, "", BlockOptions{})
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), result.Changed)
+
+	data, _ = ioutil.ReadFile(path)
+	assert.Equal(t.T(), "listen 80\nworkers 8\n", string(data))
+
+	_, err = fs.EnsureBlock(context.Background(), path, "x", BlockOptions{Marker: "# managed"})
+	assert.NotNil(t.T(), err)
+
+	unterminated := "listen 80\n# BEGIN DEVICEIO MANAGED BLOCK\nupstream a\n"
+	ioutil.WriteFile(path, []byte(unterminated), 0644)
+
+	for _, block := range []string{"upstream c", ""} {
+		_, err = fs.EnsureBlock(context.Background(), path, block, BlockOptions{})
+		assert.NotNil(t.T(), err)
+
+		data, _ = ioutil.ReadFile(path)
+		assert.Equal(t.T(), unterminated, string(data))
+	}
+}
+
+func (t *Test_DeviceFilesystem) Test_concurrent_edits_do_not_interleave() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-edit")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hosts")
+	ioutil.WriteFile(path, []byte("127.0.0.1 localhost\n"), 0644)
+
+	fs := objects.client.Device("whatever").Filesystem()
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			_, err := fs.EnsureLine(context.Background(), path, fmt.Sprintf("10.0.0.%v edge%v", i, i), LineOptions{})
+			assert.Nil(t.T(), err)
+		}(i)
+	}
+
+	wg.Wait()
+
+	data, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+
+	assert.Len(t.T(), lines, 5)
+}
+
+func (t *Test_DeviceFilesystem) Test_create_does_not_clobber_a_concurrent_create() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	dir, _ := ioutil.TempDir("", "go-sdk-edit")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hosts")
+
+	agent := newTestFilesystemAgent()
+	rename := agent.handlers["rename"]
+	raced := false
+	agent.handlers["rename"] = func(rw http.ResponseWriter, r *http.Request) {
+		if !raced && r.FormValue("newpath") == path {
+			raced = true
+			ioutil.WriteFile(path, []byte("127.0.0.1 localhost\n"), 0644)
+		}
+
+		rename(rw, r)
+	}
+	agent.register(objects.mux)
+
+	result, err := objects.client.Device("whatever").Filesystem().EnsureLine(context.Background(), path, "10.0.0.2 hub", LineOptions{Create: true})
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), raced)
+	assert.True(t.T(), result.Changed)
+
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t.T(), "127.0.0.1 localhost\n10.0.0.2 hub\n", string(data))
+}
+
+func (t *Test_DeviceFilesystem) Test_edit_diff_without_final_newline() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-edit")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hosts")
+	ioutil.WriteFile(path, []byte("127.0.0.1 localhost\n10.0.0.1 gateway"), 0644)
+
+	result, err := objects.client.Device("whatever").Filesystem().EnsureLine(context.Background(), path, "10.0.0.2 hub", LineOptions{})
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), result.Changed)
+	assert.Contains(t.T(), result.Diff, "-10.0.0.1 gateway\n\\ No newline at end of file\n+10.0.0.1 gateway\n+10.0.0.2 hub\n")
+}
@@ -0,0 +1,363 @@
+package sdk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+type File interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+	Name() string
+	Stat() (os.FileInfo, error)
+}
+
+// FileStat is returned by the Sys method of a remote os.FileInfo and carries
+// the platform specific details reported by the agent.
+type FileStat struct {
+	UID        int       `json:"uid"`
+	GID        int       `json:"gid"`
+	Owner      string    `json:"owner,omitempty"`
+	Group      string    `json:"group,omitempty"`
+	AccessTime time.Time `json:"accessTime"`
+}
+
+type deviceFileInfo struct {
+	FileName    string      `json:"name"`
+	FileSize    int64       `json:"size"`
+	FileMode    os.FileMode `json:"mode"`
+	FileModTime time.Time   `json:"modTime"`
+	FileStat    *FileStat   `json:"stat,omitempty"`
+}
+
+func (t *deviceFileInfo) Name() string       { return t.FileName }
+func (t *deviceFileInfo) Size() int64        { return t.FileSize }
+func (t *deviceFileInfo) Mode() os.FileMode  { return t.FileMode }
+func (t *deviceFileInfo) ModTime() time.Time { return t.FileModTime }
+func (t *deviceFileInfo) IsDir() bool        { return t.FileMode.IsDir() }
+func (t *deviceFileInfo) Sys() interface{}   { return t.FileStat }
+
+func (t *deviceFilesystem) Stat(ctx context.Context, path string) (os.FileInfo, error) {
+	resp, err := t.device.submit(ctx, t.form("stat").
+		AddFieldAsString("path", path))
+
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var info *deviceFileInfo
+
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, stacktrace.Propagate(err, "failed decoding stat of '%v'", path)
+	}
+
+	return info, nil
+}
+
+func (t *deviceFilesystem) ReadDir(ctx context.Context, path string) ([]os.FileInfo, error) {
+	resp, err := t.device.submit(ctx, t.form("readdir").
+		AddFieldAsString("path", path))
+
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var entries []*deviceFileInfo
+
+	if err = json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, stacktrace.Propagate(err, "failed decoding directory listing of '%v'", path)
+	}
+
+	infos := make([]os.FileInfo, len(entries))
+
+	for i, entry := range entries {
+		infos[i] = entry
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+
+	return infos, nil
+}
+
+func (t *deviceFilesystem) Open(ctx context.Context, path string) (File, error) {
+	info, err := t.Stat(ctx, path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return nil, stacktrace.NewError("'%v' is a directory", path)
+	}
+
+	return &deviceFile{
+		ctx:  ctx,
+		fs:   t,
+		path: path,
+		info: info,
+	}, nil
+}
+
+// openRange submits the read form for count bytes starting at offset. A
+// negative count reads to the end of the file. The agent sends whole buffers
+// before checking count, so the body is limited on this side as well.
+func (t *deviceFilesystem) openRange(ctx context.Context, path string, offset int64, count int64) (io.ReadCloser, error) {
+	encoding, err := t.device.formEncoding(ctx, t.resourcePath, "read")
+
+	if err != nil {
+		return nil, err
+	}
+
+	devicekey, err := t.device.endToEndKey(ctx, t.resourcePath, "read")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if devicekey != nil {
+		encoding = EncodingIdentity
+	}
+
+	form := t.form("read").
+		AddFieldAsString("path", path)
+
+	addInt64Field(form, "offset", offset)
+	addInt64Field(form, "count", count)
+
+	if encoding != EncodingIdentity {
+		form.AddFieldAsString("encoding", string(encoding))
+	}
+
+	var private *[32]byte
+
+	if devicekey != nil {
+		if _, private, err = t.device.streamKey(form, "read", path, "recipient"); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := t.device.submit(ctx, form)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &deviceFileRangeReader{
+		body:    resp.Body,
+		trailer: resp.Trailer,
+	}
+
+	reader.stream = decodeStream(resp.Body, encoding, &reader.stats, t.device.meter(ctx, count))
+
+	if devicekey != nil {
+		reader.stream = openStream(reader.stream, private, devicekey)
+	}
+
+	reader.reader = reader.stream
+
+	if count >= 0 {
+		reader.reader = io.LimitReader(reader.stream, count)
+	}
+
+	return reader, nil
+}
+
+type deviceFileRangeReader struct {
+	body    io.ReadCloser
+	trailer http.Header
+	stream  io.Reader
+	reader  io.Reader
+	stats   streamStats
+}
+
+func (t *deviceFileRangeReader) Read(p []byte) (int, error) {
+	n, err := t.reader.Read(p)
+
+	if err != io.EOF {
+		return n, err
+	}
+
+	// the trailer only arrives with the end of the body, which a range
+	// cut off at its count has not reached yet
+	if _, err := io.Copy(ioutil.Discard, t.stream); err != nil {
+		return n, err
+	}
+
+	if trailerError := t.trailer.Get("Error"); trailerError != "" {
+		return n, errors.New(trailerError)
+	}
+
+	return n, io.EOF
+}
+
+func (t *deviceFileRangeReader) Stats() StreamStats {
+	return t.stats.Stats()
+}
+
+func (t *deviceFileRangeReader) Close() error {
+	return t.body.Close()
+}
+
+type deviceFile struct {
+	ctx    context.Context
+	fs     *deviceFilesystem
+	path   string
+	info   os.FileInfo
+	mu     sync.Mutex
+	offset int64
+	stream io.ReadCloser
+	closed bool
+}
+
+func (t *deviceFile) Name() string {
+	return t.path
+}
+
+func (t *deviceFile) Stat() (os.FileInfo, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, os.ErrClosed
+	}
+
+	info, err := t.fs.Stat(t.ctx, t.path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t.info = info
+
+	return info, nil
+}
+
+func (t *deviceFile) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return 0, os.ErrClosed
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if t.stream == nil {
+		stream, err := t.fs.openRange(t.ctx, t.path, t.offset, -1)
+
+		if err != nil {
+			return 0, err
+		}
+
+		t.stream = stream
+	}
+
+	n, err := t.stream.Read(p)
+	t.offset += int64(n)
+
+	return n, err
+}
+
+func (t *deviceFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, stacktrace.NewError("negative offset %v", off)
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	t.mu.Lock()
+	closed := t.closed
+	t.mu.Unlock()
+
+	if closed {
+		return 0, os.ErrClosed
+	}
+
+	stream, err := t.fs.openRange(t.ctx, t.path, off, int64(len(p)))
+
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+
+	n, err := io.ReadFull(stream, p)
+
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	// reading on to the end of the range reports an error the agent only
+	// sent in the trailer
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, stream)
+	}
+
+	return n, err
+}
+
+func (t *deviceFile) Seek(offset int64, whence int) (int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return 0, os.ErrClosed
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += t.offset
+	case io.SeekEnd:
+		offset += t.info.Size()
+	default:
+		return 0, stacktrace.NewError("invalid whence %v", whence)
+	}
+
+	if offset < 0 {
+		return 0, stacktrace.NewError("negative position %v", offset)
+	}
+
+	if offset != t.offset && t.stream != nil {
+		t.stream.Close()
+		t.stream = nil
+	}
+
+	t.offset = offset
+
+	return offset, nil
+}
+
+func (t *deviceFile) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return os.ErrClosed
+	}
+
+	t.closed = true
+
+	if t.stream != nil {
+		return t.stream.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,364 @@
+package sdk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/deviceio/hmapi"
+	"github.com/palantir/stacktrace"
+)
+
+const grepMaxLineSize = 1024 * 1024
+
+type FindType string
+
+const (
+	FindAny     = FindType("")
+	FindFile    = FindType("file")
+	FindDir     = FindType("dir")
+	FindSymlink = FindType("symlink")
+)
+
+// FindQuery selects entries below a root. Name holds path.Match patterns of
+// which the base name must match at least one. A zero MaxSize or MaxDepth
+// is unlimited, a MaxDepth of 1 only considers direct children of the root.
+// Zero times leave the modification time unchecked.
+type FindQuery struct {
+	Name           []string  `json:"name,omitempty"`
+	Type           FindType  `json:"type,omitempty"`
+	MinSize        int64     `json:"minSize,omitempty"`
+	MaxSize        int64     `json:"maxSize,omitempty"`
+	ModifiedAfter  time.Time `json:"modifiedAfter,omitempty"`
+	ModifiedBefore time.Time `json:"modifiedBefore,omitempty"`
+	MaxDepth       int       `json:"maxDepth,omitempty"`
+}
+
+// FindMatch is an entry matched by Find. Path is slash separated and
+// relative to the root of the search.
+type FindMatch struct {
+	Path string
+	Info os.FileInfo
+}
+
+// GrepOptions controls Grep. Files selects the files that are searched, only
+// regular files are ever searched and files that look binary are skipped.
+type GrepOptions struct {
+	Files      FindQuery `json:"files"`
+	IgnoreCase bool      `json:"ignoreCase,omitempty"`
+}
+
+// GrepMatch is a line matched by Grep. Line and Column are one based, Column
+// counts bytes to the start of the first match on the line.
+type GrepMatch struct {
+	Path   string `json:"path"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+	Text   string `json:"text"`
+}
+
+type findMatchMessage struct {
+	Path string          `json:"path"`
+	Info *deviceFileInfo `json:"info"`
+}
+
+// Find streams the entries below root matching query to fn, which can stop
+// the search by returning an error. The walk runs on the device, agents
+// without a find form are walked through ReadDir instead. Subdirectories
+// that cannot be read are skipped.
+func (t *deviceFilesystem) Find(ctx context.Context, root string, query FindQuery, fn func(*FindMatch) error) error {
+	if err := query.validate(); err != nil {
+		return err
+	}
+
+	ok, err := t.supports(ctx, "find")
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return findWalk(ctx, &deviceFS{ctx: ctx, fs: t, root: root}, query, fn)
+	}
+
+	data, err := json.Marshal(query)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed encoding find query")
+	}
+
+	return t.search(ctx, t.form("find").
+		AddFieldAsString("path", root).
+		AddFieldAsString("query", string(data)), root, func(decoder *json.Decoder) error {
+		var message *findMatchMessage
+
+		if err := decoder.Decode(&message); err != nil {
+			return err
+		}
+
+		return fn(&FindMatch{
+			Path: message.Path,
+			Info: message.Info,
+		})
+	})
+}
+
+// Grep streams the lines of the files below root matching the regular
+// expression pattern to fn, which can stop the search by returning an
+// error. The pattern uses the syntax of the go regexp package.
+func (t *deviceFilesystem) Grep(ctx context.Context, root, pattern string, opts GrepOptions, fn func(*GrepMatch) error) error {
+	re, err := opts.compile(pattern)
+
+	if err != nil {
+		return err
+	}
+
+	if err := opts.Files.validate(); err != nil {
+		return err
+	}
+
+	ok, err := t.supportsUnsealed(ctx, "grep")
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return grepWalk(ctx, &deviceFS{ctx: ctx, fs: t, root: root}, re, opts, fn)
+	}
+
+	data, err := json.Marshal(opts)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed encoding grep options")
+	}
+
+	return t.search(ctx, t.form("grep").
+		AddFieldAsString("path", root).
+		AddFieldAsString("pattern", pattern).
+		AddFieldAsString("options", string(data)), root, func(decoder *json.Decoder) error {
+		var match *GrepMatch
+
+		if err := decoder.Decode(&match); err != nil {
+			return err
+		}
+
+		return fn(match)
+	})
+}
+
+// search submits a form answered with a stream of json objects and hands
+// the decoder to next until the stream ends.
+func (t *deviceFilesystem) search(ctx context.Context, form hmapi.FormRequest, root string, next func(*json.Decoder) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resp, err := t.device.submit(ctx, form)
+
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+
+	for decoder.More() {
+		if err := next(decoder); err != nil {
+			return err
+		}
+	}
+
+	// drain the stream so the trailer is available
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return stacktrace.Propagate(err, "failed searching '%v'", root)
+	}
+
+	if trailerError := resp.Trailer.Get("Error"); trailerError != "" {
+		return stacktrace.NewError("failed searching '%v': %v", root, trailerError)
+	}
+
+	return nil
+}
+
+func (t *FindQuery) validate() error {
+	for _, pattern := range t.Name {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return stacktrace.Propagate(err, "invalid name pattern '%v'", pattern)
+		}
+	}
+
+	switch t.Type {
+	case FindAny, FindFile, FindDir, FindSymlink:
+		return nil
+	default:
+		return stacktrace.NewError("unsupported find type '%v'", t.Type)
+	}
+}
+
+func (t *FindQuery) matches(rel string, info fs.FileInfo) bool {
+	if len(t.Name) > 0 {
+		matched := false
+
+		for _, pattern := range t.Name {
+			if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	switch t.Type {
+	case FindFile:
+		if !info.Mode().IsRegular() {
+			return false
+		}
+	case FindDir:
+		if !info.IsDir() {
+			return false
+		}
+	case FindSymlink:
+		if info.Mode()&os.ModeSymlink == 0 {
+			return false
+		}
+	}
+
+	if info.Size() < t.MinSize || (t.MaxSize > 0 && info.Size() > t.MaxSize) {
+		return false
+	}
+
+	if !t.ModifiedAfter.IsZero() && !info.ModTime().After(t.ModifiedAfter) {
+		return false
+	}
+
+	if !t.ModifiedBefore.IsZero() && !info.ModTime().Before(t.ModifiedBefore) {
+		return false
+	}
+
+	return true
+}
+
+func (t *GrepOptions) compile(pattern string) (*regexp.Regexp, error) {
+	if t.IgnoreCase {
+		pattern = "(?i)" + pattern
+	}
+
+	re, err := regexp.Compile(pattern)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "invalid grep pattern '%v'", pattern)
+	}
+
+	return re, nil
+}
+
+// findWalk walks fsys and passes the entries matching query to fn.
+func findWalk(ctx context.Context, fsys fs.FS, query FindQuery, fn func(*FindMatch) error) error {
+	return fs.WalkDir(fsys, ".", func(rel string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if rel == "." {
+				return err
+			}
+
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if rel == "." {
+			return nil
+		}
+
+		depth := strings.Count(rel, "/") + 1
+
+		if query.MaxDepth > 0 && depth > query.MaxDepth {
+			return fs.SkipDir
+		}
+
+		info, err := d.Info()
+
+		if err != nil {
+			return nil
+		}
+
+		if query.matches(rel, info) {
+			if err := fn(&FindMatch{Path: rel, Info: info}); err != nil {
+				return err
+			}
+		}
+
+		if d.IsDir() && query.MaxDepth > 0 && depth == query.MaxDepth {
+			return fs.SkipDir
+		}
+
+		return nil
+	})
+}
+
+// grepWalk searches the files of fsys selected by opts line by line. Lines
+// longer than grepMaxLineSize end the search of their file.
+func grepWalk(ctx context.Context, fsys fs.FS, re *regexp.Regexp, opts GrepOptions, fn func(*GrepMatch) error) error {
+	files := opts.Files
+
+	if files.Type == FindAny {
+		files.Type = FindFile
+	}
+
+	if files.Type != FindFile {
+		return nil
+	}
+
+	return findWalk(ctx, fsys, files, func(match *FindMatch) error {
+		file, err := fsys.Open(match.Path)
+
+		if err != nil {
+			return nil
+		}
+		defer file.Close()
+
+		reader := bufio.NewReaderSize(file, 64*1024)
+
+		// like grep, files with a nul byte early on are treated as binary
+		if head, _ := reader.Peek(8000); bytes.IndexByte(head, 0) >= 0 {
+			return nil
+		}
+
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), grepMaxLineSize)
+
+		for line := 1; scanner.Scan(); line++ {
+			loc := re.FindIndex(scanner.Bytes())
+
+			if loc == nil {
+				continue
+			}
+
+			err := fn(&GrepMatch{
+				Path:   match.Path,
+				Line:   line,
+				Column: loc[0] + 1,
+				Text:   scanner.Text(),
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return ctx.Err()
+	})
+}
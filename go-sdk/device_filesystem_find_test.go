@@ -0,0 +1,121 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_find_predicates() {
+	for _, native := range []bool{true, false} {
+		objects := t.getTestObjects()
+
+		agent := newTestFilesystemAgent()
+
+		if !native {
+			delete(agent.handlers, "find")
+		}
+
+		agent.register(objects.mux)
+
+		dir := t.makeTree()
+		old := time.Now().Add(-time.Hour)
+		os.Chtimes(filepath.Join(dir, "a.txt"), old, old)
+
+		fs := objects.client.Device("whatever").Filesystem()
+
+		find := func(query FindQuery) []string {
+			found := []string{}
+
+			err := fs.Find(context.Background(), dir, query, func(match *FindMatch) error {
+				found = append(found, match.Path)
+				return nil
+			})
+
+			assert.Nil(t.T(), err)
+
+			return found
+		}
+
+		assert.Equal(t.T(), []string{"a.txt", "sub/b.txt", "sub/deeper/c.txt"}, find(FindQuery{Name: []string{"*.txt"}}))
+		assert.Equal(t.T(), []string{"sub", "sub/deeper"}, find(FindQuery{Type: FindDir}))
+		assert.Equal(t.T(), []string{"a.txt", "sub"}, find(FindQuery{MaxDepth: 1}))
+		assert.Equal(t.T(), []string{"sub/b.txt", "sub/deeper/c.txt"}, find(FindQuery{Type: FindFile, MinSize: 2}))
+		assert.Equal(t.T(), []string{"a.txt"}, find(FindQuery{Type: FindFile, ModifiedBefore: time.Now().Add(-time.Minute)}))
+
+		stop := errors.New("stop")
+		calls := 0
+
+		err := fs.Find(context.Background(), dir, FindQuery{}, func(match *FindMatch) error {
+			calls++
+			return stop
+		})
+
+		assert.Equal(t.T(), stop, err)
+		assert.Equal(t.T(), 1, calls)
+
+		err = fs.Find(context.Background(), dir, FindQuery{Name: []string{"["}}, func(match *FindMatch) error {
+			return nil
+		})
+
+		assert.NotNil(t.T(), err)
+
+		os.RemoveAll(dir)
+		objects.server.Close()
+	}
+}
+
+func (t *Test_DeviceFilesystem) Test_grep_matches() {
+	for _, native := range []bool{true, false} {
+		objects := t.getTestObjects()
+
+		agent := newTestFilesystemAgent()
+
+		if !native {
+			delete(agent.handlers, "grep")
+		}
+
+		agent.register(objects.mux)
+
+		dir := t.makeTree()
+		ioutil.WriteFile(filepath.Join(dir, "sub", "app.log"), []byte("started\nERROR disk full\nok\nretry: error again\n"), 0644)
+		ioutil.WriteFile(filepath.Join(dir, "sub", "blob.bin"), []byte("error\x00binary"), 0644)
+
+		matches := []GrepMatch{}
+
+		err := objects.client.Device("whatever").Filesystem().Grep(context.Background(), dir, "error", GrepOptions{
+			IgnoreCase: true,
+		}, func(match *GrepMatch) error {
+			matches = append(matches, *match)
+			return nil
+		})
+
+		assert.Nil(t.T(), err)
+		assert.Equal(t.T(), []GrepMatch{
+			{Path: "sub/app.log", Line: 2, Column: 1, Text: "ERROR disk full"},
+			{Path: "sub/app.log", Line: 4, Column: 8, Text: "retry: error again"},
+		}, matches)
+
+		matches = matches[:0]
+
+		err = objects.client.Device("whatever").Filesystem().Grep(context.Background(), dir, "c+", GrepOptions{
+			Files: FindQuery{Name: []string{"*.txt"}},
+		}, func(match *GrepMatch) error {
+			matches = append(matches, *match)
+			return nil
+		})
+
+		assert.Nil(t.T(), err)
+		assert.Equal(t.T(), []GrepMatch{
+			{Path: "sub/deeper/c.txt", Line: 1, Column: 1, Text: "ccc"},
+		}, matches)
+
+		os.RemoveAll(dir)
+		objects.server.Close()
+	}
+}
@@ -0,0 +1,374 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+const (
+	defaultFollowPollInterval = time.Second
+	followPrefixSize          = 4096
+	followTailChunkSize       = 64 * 1024
+)
+
+// FollowOptions controls where Follow starts. By default only bytes
+// appended after the call are streamed, Lines starts that many lines before
+// the current end and FromStart streams the whole file first.
+type FollowOptions struct {
+	Lines        int
+	FromStart    bool
+	PollInterval time.Duration
+}
+
+// Follow streams path as it grows, like tail -f. When the file is truncated,
+// or renamed away and recreated, streaming continues from the start of the
+// new file. Agents without a follow form are polled every PollInterval.
+func (t *deviceFilesystem) Follow(ctx context.Context, path string, opts FollowOptions) (io.ReadCloser, error) {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultFollowPollInterval
+	}
+
+	ok, err := t.supportsUnsealed(ctx, "follow")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ok {
+		return t.followStream(ctx, path, opts)
+	}
+
+	info, err := t.Stat(ctx, path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return nil, stacktrace.NewError("'%v' is a directory", path)
+	}
+
+	verify, err := t.supports(ctx, "hash")
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	follower := &deviceFileFollower{
+		ctx:      ctx,
+		cancel:   cancel,
+		fs:       t,
+		path:     path,
+		interval: opts.PollInterval,
+		verify:   verify,
+		offset:   info.Size(),
+		modTime:  info.ModTime(),
+	}
+
+	if err := follower.updatePrefix(info.Size()); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	switch {
+	case opts.FromStart:
+		follower.offset = 0
+	case opts.Lines > 0:
+		if follower.offset, err = t.tailOffset(ctx, path, info.Size(), opts.Lines); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	return follower, nil
+}
+
+func (t *deviceFilesystem) followStream(ctx context.Context, path string, opts FollowOptions) (io.ReadCloser, error) {
+	encoding, err := t.device.formEncoding(ctx, t.resourcePath, "follow")
+
+	if err != nil {
+		return nil, err
+	}
+
+	form := t.form("follow").
+		AddFieldAsString("path", path).
+		AddFieldAsInt("lines", opts.Lines).
+		AddFieldAsBool("fromstart", opts.FromStart)
+
+	if encoding != EncodingIdentity {
+		form.AddFieldAsString("encoding", string(encoding))
+	}
+
+	resp, err := t.device.submit(ctx, form)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &deviceFileRangeReader{
+		body:    resp.Body,
+		trailer: resp.Trailer,
+	}
+
+	reader.reader = decodeStream(resp.Body, encoding, &reader.stats, t.device.meter(ctx, 0))
+
+	return reader, nil
+}
+
+// tailOffset returns the offset of the start of the last lines lines of
+// path by reading backwards from size in chunks.
+func (t *deviceFilesystem) tailOffset(ctx context.Context, path string, size int64, lines int) (int64, error) {
+	found := 0
+	end := size
+
+	for end > 0 {
+		start := end - followTailChunkSize
+
+		if start < 0 {
+			start = 0
+		}
+
+		stream, err := t.openRange(ctx, path, start, end-start)
+
+		if err != nil {
+			return 0, err
+		}
+
+		data, err := ioutil.ReadAll(stream)
+		stream.Close()
+
+		if err != nil {
+			return 0, stacktrace.Propagate(err, "failed reading '%v' at offset %v", path, start)
+		}
+
+		for i := len(data) - 1; i >= 0; i-- {
+			// a trailing newline ends the last line rather than starting one
+			if data[i] != '\n' || start+int64(i) == size-1 {
+				continue
+			}
+
+			if found++; found == lines {
+				return start + int64(i) + 1, nil
+			}
+		}
+
+		end = start
+	}
+
+	return 0, nil
+}
+
+// deviceFileFollower polls the size of a file and reads appended ranges.
+// Rotation is detected by the size shrinking below the read offset or, when
+// the agent can hash ranges, by the leading bytes of the file changing. Close
+// may be called while a Read is in progress, mu guards the stream the two
+// share.
+type deviceFileFollower struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	fs        *deviceFilesystem
+	path      string
+	interval  time.Duration
+	verify    bool
+	offset    int64
+	modTime   time.Time
+	prefix    string
+	prefixLen int64
+	mu        sync.Mutex
+	stream    io.ReadCloser
+	closed    bool
+}
+
+func (t *deviceFileFollower) Read(p []byte) (int, error) {
+	for {
+		stream, err := t.current()
+
+		if err != nil {
+			return 0, err
+		}
+
+		if stream == nil {
+			if err := t.poll(); err != nil {
+				return 0, t.closedOr(err)
+			}
+
+			if stream, err = t.current(); err != nil {
+				return 0, err
+			}
+		}
+
+		if stream != nil {
+			n, err := stream.Read(p)
+			t.offset += int64(n)
+
+			if err == io.EOF {
+				t.release(stream)
+				err = nil
+			}
+
+			if n > 0 || err != nil {
+				return n, t.closedOr(err)
+			}
+
+			continue
+		}
+
+		select {
+		case <-time.After(t.interval):
+		case <-t.ctx.Done():
+			return 0, t.closedOr(t.ctx.Err())
+		}
+	}
+}
+
+// current returns the range being read, nil between polls.
+func (t *deviceFileFollower) current() (io.ReadCloser, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, os.ErrClosed
+	}
+
+	return t.stream, nil
+}
+
+// release closes a range read to its end unless Close already did.
+func (t *deviceFileFollower) release(stream io.ReadCloser) {
+	t.mu.Lock()
+	owned := t.stream == stream
+	if owned {
+		t.stream = nil
+	}
+	t.mu.Unlock()
+
+	if owned {
+		stream.Close()
+	}
+}
+
+// closedOr reports reads cut short by Close as os.ErrClosed rather than
+// whatever error the cancelled request surfaced.
+func (t *deviceFileFollower) closedOr(err error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed && err != nil {
+		return os.ErrClosed
+	}
+
+	return err
+}
+
+func (t *deviceFileFollower) poll() error {
+	info, err := t.fs.Stat(t.ctx, t.path)
+
+	// the file is between being renamed away and recreated
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	changed := info.Size() != t.offset || !info.ModTime().Equal(t.modTime)
+	rotated := info.Size() < t.offset
+
+	if !rotated && changed && t.prefixLen > 0 {
+		prefix, err := t.fs.hash(t.ctx, t.path, HashSHA256, 0, t.prefixLen)
+
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		rotated = prefix != t.prefix
+	}
+
+	if rotated {
+		t.offset = 0
+		t.prefixLen = 0
+	}
+
+	t.modTime = info.ModTime()
+
+	if info.Size() == t.offset {
+		return nil
+	}
+
+	if err := t.updatePrefix(info.Size()); err != nil {
+		return err
+	}
+
+	stream, err := t.fs.openRange(t.ctx, t.path, t.offset, info.Size()-t.offset)
+
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		stream.Close()
+		return os.ErrClosed
+	}
+
+	t.stream = stream
+
+	return nil
+}
+
+// updatePrefix remembers the hash of up to followPrefixSize leading bytes
+// of a file of size bytes.
+func (t *deviceFileFollower) updatePrefix(size int64) error {
+	if !t.verify || t.prefixLen >= followPrefixSize || t.prefixLen >= size {
+		return nil
+	}
+
+	prefixLen := size
+
+	if prefixLen > followPrefixSize {
+		prefixLen = followPrefixSize
+	}
+
+	prefix, err := t.fs.hash(t.ctx, t.path, HashSHA256, 0, prefixLen)
+
+	if err != nil {
+		return err
+	}
+
+	t.prefix = prefix
+	t.prefixLen = prefixLen
+
+	return nil
+}
+
+func (t *deviceFileFollower) Close() error {
+	t.cancel()
+
+	t.mu.Lock()
+	stream := t.stream
+	t.stream = nil
+	t.closed = true
+	t.mu.Unlock()
+
+	if stream != nil {
+		return stream.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package sdk
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_follow_polling_handles_rotation() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	agent := newTestFilesystemAgent()
+	delete(agent.handlers, "follow")
+	agent.register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-follow")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(path, []byte("one\ntwo\nthree\n"), 0644)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	reader, err := objects.client.Device("whatever").Filesystem().Follow(ctx, path, FollowOptions{
+		Lines:        2,
+		PollInterval: 10 * time.Millisecond,
+	})
+
+	assert.Nil(t.T(), err)
+	defer reader.Close()
+
+	assert.Equal(t.T(), "two\nthree\n", t.readFollowed(reader, 10))
+
+	t.appendFile(path, "four\n")
+
+	assert.Equal(t.T(), "four\n", t.readFollowed(reader, 5))
+
+	// truncated in place
+	ioutil.WriteFile(path, []byte("new\n"), 0644)
+
+	assert.Equal(t.T(), "new\n", t.readFollowed(reader, 4))
+
+	// renamed away and recreated larger than the read offset
+	os.Rename(path, path+".1")
+	ioutil.WriteFile(path, []byte("rotated file\n"), 0644)
+
+	assert.Equal(t.T(), "rotated file\n", t.readFollowed(reader, 13))
+}
+
+func (t *Test_DeviceFilesystem) Test_follow_stream() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-follow")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(path, []byte("one\ntwo\n"), 0644)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	reader, err := objects.client.Device("whatever").Filesystem().Follow(ctx, path, FollowOptions{
+		FromStart: true,
+	})
+
+	assert.Nil(t.T(), err)
+	defer reader.Close()
+
+	assert.Equal(t.T(), "one\ntwo\n", t.readFollowed(reader, 8))
+
+	t.appendFile(path, "three\n")
+
+	assert.Equal(t.T(), "three\n", t.readFollowed(reader, 6))
+}
+
+func (t *Test_DeviceFilesystem) Test_follow_close_during_read() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	agent := newTestFilesystemAgent()
+	delete(agent.handlers, "follow")
+
+	// the range arrives partly, then stalls until the request is cancelled
+	agent.handlers["read"] = func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte("x"))
+		rw.(http.Flusher).Flush()
+
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}
+	agent.register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-follow")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(path, []byte("xy"), 0644)
+
+	reader, err := objects.client.Device("whatever").Filesystem().Follow(context.Background(), path, FollowOptions{
+		FromStart:    true,
+		PollInterval: 10 * time.Millisecond,
+	})
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "x", t.readFollowed(reader, 1))
+
+	done := make(chan error)
+
+	go func() {
+		_, err := reader.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	reader.Close()
+
+	select {
+	case err := <-done:
+		assert.Equal(t.T(), os.ErrClosed, err)
+	case <-time.After(5 * time.Second):
+		t.T().Error("Read did not return after Close")
+	}
+
+	_, err = reader.Read(make([]byte, 1))
+
+	assert.Equal(t.T(), os.ErrClosed, err)
+	assert.Nil(t.T(), reader.Close())
+}
+
+func (t *Test_DeviceFilesystem) readFollowed(r io.Reader, n int) string {
+	data := make([]byte, n)
+
+	if _, err := io.ReadFull(r, data); err != nil {
+		t.T().Error("Error reading followed file", err.Error())
+	}
+
+	return string(data)
+}
+
+func (t *Test_DeviceFilesystem) appendFile(path, data string) {
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte(data))
+	file.Close()
+}
@@ -0,0 +1,205 @@
+package sdk
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+)
+
+// DeviceFS exposes a device filesystem through io/fs so standard library
+// consumers such as fs.WalkDir, template.ParseFS and http.FS can work against
+// a remote device unchanged.
+type DeviceFS interface {
+	fs.StatFS
+	fs.ReadDirFS
+	fs.ReadFileFS
+	fs.SubFS
+	WithContext(ctx context.Context) DeviceFS
+	WithRoot(root string) DeviceFS
+}
+
+// FS returns a DeviceFS rooted at "/" on the device. Use WithRoot to root it
+// elsewhere, for example at "C:/" on windows agents.
+func FS(device Device) DeviceFS {
+	return &deviceFS{
+		ctx:  context.Background(),
+		fs:   device.Filesystem(),
+		root: "/",
+	}
+}
+
+type deviceFS struct {
+	ctx  context.Context
+	fs   DeviceFilesystem
+	root string
+}
+
+func (t *deviceFS) WithContext(ctx context.Context) DeviceFS {
+	return &deviceFS{
+		ctx:  ctx,
+		fs:   t.fs,
+		root: t.root,
+	}
+}
+
+func (t *deviceFS) WithRoot(root string) DeviceFS {
+	return &deviceFS{
+		ctx:  t.ctx,
+		fs:   t.fs,
+		root: root,
+	}
+}
+
+func (t *deviceFS) Sub(dir string) (fs.FS, error) {
+	if !fs.ValidPath(dir) {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: fs.ErrInvalid}
+	}
+
+	return t.WithRoot(t.remotePath(dir)), nil
+}
+
+func (t *deviceFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	info, err := t.fs.Stat(t.ctx, t.remotePath(name))
+
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if info.IsDir() {
+		return &deviceFSDir{
+			fsys: t,
+			name: name,
+			info: info,
+		}, nil
+	}
+
+	file, err := t.fs.Open(t.ctx, t.remotePath(name))
+
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return file, nil
+}
+
+func (t *deviceFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	info, err := t.fs.Stat(t.ctx, t.remotePath(name))
+
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	return info, nil
+}
+
+func (t *deviceFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	infos, err := t.fs.ReadDir(t.ctx, t.remotePath(name))
+
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	entries := make([]fs.DirEntry, len(infos))
+
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+
+	return entries, nil
+}
+
+func (t *deviceFS) ReadFile(name string) ([]byte, error) {
+	file, err := t.Open(name)
+
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, ok := file.(*deviceFSDir); ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+
+	data, err := ioutil.ReadAll(file)
+
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+
+	return data, nil
+}
+
+func (t *deviceFS) remotePath(name string) string {
+	if name == "." {
+		return t.root
+	}
+
+	return path.Join(t.root, name)
+}
+
+type deviceFSDir struct {
+	fsys    *deviceFS
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	read    bool
+	offset  int
+}
+
+func (t *deviceFSDir) Stat() (fs.FileInfo, error) {
+	return t.info, nil
+}
+
+func (t *deviceFSDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: t.name, Err: fs.ErrInvalid}
+}
+
+func (t *deviceFSDir) Close() error {
+	return nil
+}
+
+func (t *deviceFSDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !t.read {
+		entries, err := t.fsys.ReadDir(t.name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		t.entries = entries
+		t.read = true
+	}
+
+	remaining := t.entries[t.offset:]
+
+	if n <= 0 {
+		t.offset = len(t.entries)
+		return remaining, nil
+	}
+
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+
+	t.offset += n
+
+	return remaining[:n], nil
+}
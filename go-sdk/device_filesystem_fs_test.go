@@ -0,0 +1,85 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_fs_conformance() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir := t.makeTree()
+	defer os.RemoveAll(dir)
+
+	fsys := FS(objects.client.Device("whatever")).WithRoot(dir)
+
+	assert.Nil(t.T(), fstest.TestFS(fsys, "a.txt", "sub/b.txt", "sub/deeper/c.txt"))
+}
+
+func (t *Test_DeviceFilesystem) Test_fs_walk_sub_and_missing() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir := t.makeTree()
+	defer os.RemoveAll(dir)
+
+	fsys, err := fs.Sub(FS(objects.client.Device("whatever")).WithRoot(dir), "sub")
+
+	assert.Nil(t.T(), err)
+
+	var walked []string
+
+	err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		walked = append(walked, path)
+		return err
+	})
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), []string{".", "b.txt", "deeper", "deeper/c.txt"}, walked)
+
+	_, err = fs.ReadFile(fsys, "nope.txt")
+
+	assert.True(t.T(), errors.Is(err, fs.ErrNotExist))
+}
+
+func (t *Test_DeviceFilesystem) Test_fs_cancelled_context() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := FS(objects.client.Device("whatever")).WithContext(ctx).Stat("tmp")
+
+	assert.NotNil(t.T(), err)
+}
+
+func (t *Test_DeviceFilesystem) makeTree() string {
+	dir, err := ioutil.TempDir("", "go-sdk-device-fs")
+
+	if err != nil {
+		t.T().Error("Error creating temp dir", err.Error())
+		t.T().FailNow()
+	}
+
+	os.MkdirAll(filepath.Join(dir, "sub", "deeper"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "b.txt"), []byte("bb"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "deeper", "c.txt"), []byte("ccc"), 0644)
+
+	return dir
+}
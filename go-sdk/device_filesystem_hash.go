@@ -0,0 +1,248 @@
+package sdk
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+type HashAlgorithm string
+
+const (
+	HashSHA256   = HashAlgorithm("sha256")
+	HashSHA512   = HashAlgorithm("sha512")
+	HashSHA3_256 = HashAlgorithm("sha3-256")
+	HashBLAKE2b  = HashAlgorithm("blake2b-256")
+	HashMD5      = HashAlgorithm("md5")
+)
+
+// NewHash returns a local hash.Hash producing the same digest the agent
+// computes for algorithm, so remote hashes can be checked against local data.
+func NewHash(algorithm HashAlgorithm) (hash.Hash, error) {
+	switch algorithm {
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashSHA512:
+		return sha512.New(), nil
+	case HashSHA3_256:
+		return sha3.New256(), nil
+	case HashBLAKE2b:
+		return blake2b.New256(nil)
+	case HashMD5:
+		return md5.New(), nil
+	default:
+		return nil, stacktrace.NewError("unsupported hash algorithm '%v'", algorithm)
+	}
+}
+
+// Manifest maps slash separated paths relative to the manifest root to the
+// state of the entry. Directories are listed with an empty hash.
+type Manifest map[string]*ManifestEntry
+
+type ManifestEntry struct {
+	Path    string      `json:"path"`
+	Hash    string      `json:"hash,omitempty"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"modTime"`
+}
+
+// ManifestDiff lists the paths that differ between two manifests. Paths are
+// sorted.
+type ManifestDiff struct {
+	Added    []string
+	Removed  []string
+	Modified []string
+}
+
+func (t *ManifestDiff) Empty() bool {
+	return len(t.Added) == 0 && len(t.Removed) == 0 && len(t.Modified) == 0
+}
+
+// Compare reports how target differs from t. An entry counts as modified
+// when its type, hash or permissions differ.
+func (t Manifest) Compare(target Manifest) *ManifestDiff {
+	diff := &ManifestDiff{}
+
+	for path, entry := range target {
+		current, ok := t[path]
+
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, path)
+		case current.Mode != entry.Mode || current.Hash != entry.Hash:
+			diff.Modified = append(diff.Modified, path)
+		}
+	}
+
+	for path := range t {
+		if _, ok := target[path]; !ok {
+			diff.Removed = append(diff.Removed, path)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Modified)
+
+	return diff
+}
+
+func (t *deviceFilesystem) Hash(ctx context.Context, path string, algorithm HashAlgorithm) (string, error) {
+	return t.hash(ctx, path, algorithm, 0, -1)
+}
+
+// hash has the agent compute a hex encoded digest of count bytes of path
+// starting at offset, a negative count hashes to the end of the file.
+func (t *deviceFilesystem) hash(ctx context.Context, path string, algorithm HashAlgorithm, offset, count int64) (string, error) {
+	form := t.form("hash").
+		AddFieldAsString("path", path).
+		AddFieldAsString("algorithm", string(algorithm))
+
+	if offset != 0 || count >= 0 {
+		addInt64Field(form, "offset", offset)
+		addInt64Field(form, "count", count)
+	}
+
+	resp, err := t.device.submit(ctx, form)
+
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return "", stacktrace.Propagate(err, "failed reading hash of '%v'", path)
+	}
+
+	return strings.ToLower(strings.TrimSpace(string(body))), nil
+}
+
+// Manifest has the agent walk dir and hash every regular file with
+// algorithm. Entries are streamed by the agent as a sequence of json
+// objects so large trees are never buffered as a single document.
+func (t *deviceFilesystem) Manifest(ctx context.Context, dir string, algorithm HashAlgorithm) (Manifest, error) {
+	resp, err := t.device.submit(ctx, t.form("manifest").
+		AddFieldAsString("path", dir).
+		AddFieldAsString("algorithm", string(algorithm)))
+
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	manifest := Manifest{}
+	decoder := json.NewDecoder(resp.Body)
+
+	for {
+		var entry *ManifestEntry
+
+		if err := decoder.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, stacktrace.Propagate(err, "failed decoding manifest of '%v'", dir)
+		}
+
+		if entry == nil {
+			return nil, stacktrace.NewError("empty entry in manifest of '%v'", dir)
+		}
+
+		// entries are joined onto local and remote roots by sync and diff,
+		// so a path that is not a clean relative path below dir would let
+		// the agent direct writes and deletes outside of the tree
+		if rel, err := cleanArchivePath(entry.Path); err != nil || rel != entry.Path || rel == "." {
+			return nil, stacktrace.NewError("invalid path '%v' in manifest of '%v'", entry.Path, dir)
+		}
+
+		manifest[entry.Path] = entry
+	}
+
+	if trailerError := resp.Trailer.Get("Error"); trailerError != "" {
+		return nil, stacktrace.NewError("failed building manifest of '%v': %v", dir, trailerError)
+	}
+
+	return manifest, nil
+}
+
+// LocalManifest builds a Manifest of a local directory in the same shape the
+// agent reports, for comparison against a device.
+func LocalManifest(dir string, algorithm HashAlgorithm) (Manifest, error) {
+	manifest := Manifest{}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+
+		if err != nil || rel == "." {
+			return err
+		}
+
+		entry := &ManifestEntry{
+			Path:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+		}
+
+		if info.Mode().IsRegular() {
+			if entry.Hash, err = hashFile(path, algorithm); err != nil {
+				return err
+			}
+		}
+
+		if info.IsDir() {
+			entry.Size = 0
+		}
+
+		manifest[entry.Path] = entry
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed building manifest of '%v'", dir)
+	}
+
+	return manifest, nil
+}
+
+func hashFile(path string, algorithm HashAlgorithm) (string, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash, err := NewHash(algorithm)
+
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
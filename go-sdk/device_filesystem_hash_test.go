@@ -0,0 +1,84 @@
+package sdk
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_remote_hash_matches_local() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	tmpfile, err := ioutil.TempFile("", "go-sdk-device-filesystem-hash")
+
+	if err != nil {
+		t.T().Error("Error creating temp file", err.Error())
+		t.T().FailNow()
+	}
+
+	defer func() {
+		os.Remove(tmpfile.Name())
+	}()
+
+	tmpfile.Write([]byte("hello"))
+	tmpfile.Close()
+
+	fs := objects.client.Device("whatever").Filesystem()
+
+	for _, algorithm := range []HashAlgorithm{HashSHA256, HashSHA512, HashSHA3_256, HashBLAKE2b, HashMD5} {
+		hash, _ := NewHash(algorithm)
+		hash.Write([]byte("hello"))
+
+		remote, err := fs.Hash(context.Background(), tmpfile.Name(), algorithm)
+
+		assert.Nil(t.T(), err)
+		assert.Equal(t.T(), hex.EncodeToString(hash.Sum(nil)), remote, string(algorithm))
+	}
+
+	_, err = fs.Hash(context.Background(), tmpfile.Name(), HashAlgorithm("crc32"))
+
+	assert.NotNil(t.T(), err)
+}
+
+func (t *Test_DeviceFilesystem) Test_manifest_detects_drift() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir := t.makeTree()
+	defer os.RemoveAll(dir)
+
+	fs := objects.client.Device("whatever").Filesystem()
+
+	local, err := LocalManifest(dir, HashSHA256)
+
+	assert.Nil(t.T(), err)
+
+	remote, err := fs.Manifest(context.Background(), dir, HashSHA256)
+
+	assert.Nil(t.T(), err)
+	assert.Len(t.T(), remote, 5)
+	assert.True(t.T(), local.Compare(remote).Empty())
+
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("changed"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "new.txt"), []byte("new"), 0644)
+	os.Remove(filepath.Join(dir, "sub", "b.txt"))
+
+	remote, err = fs.Manifest(context.Background(), dir, HashSHA256)
+
+	assert.Nil(t.T(), err)
+
+	diff := local.Compare(remote)
+
+	assert.Equal(t.T(), []string{"new.txt"}, diff.Added)
+	assert.Equal(t.T(), []string{"sub/b.txt"}, diff.Removed)
+	assert.Equal(t.T(), []string{"a.txt"}, diff.Modified)
+}
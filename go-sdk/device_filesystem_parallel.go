@@ -0,0 +1,236 @@
+package sdk
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/palantir/stacktrace"
+)
+
+const (
+	defaultParallelConcurrency = 4
+	defaultParallelChunkSize   = 4 * 1024 * 1024
+	defaultParallelRetries     = 3
+)
+
+// ParallelOptions tunes ParallelRead and ParallelReadAt. The file is split
+// into ChunkSize ranges that are fetched by Concurrency concurrent read form
+// submissions. Verify additionally compares every range against a hash
+// computed on the device.
+type ParallelOptions struct {
+	Concurrency int
+	ChunkSize   int64
+	Retries     int
+	Verify      bool
+}
+
+func (t ParallelOptions) withDefaults() ParallelOptions {
+	if t.Concurrency <= 0 {
+		t.Concurrency = defaultParallelConcurrency
+	}
+
+	if t.ChunkSize <= 0 {
+		t.ChunkSize = defaultParallelChunkSize
+	}
+
+	if t.Retries <= 0 {
+		t.Retries = defaultParallelRetries
+	}
+
+	return t
+}
+
+type parallelRange struct {
+	offset int64
+	count  int64
+}
+
+type parallelResult struct {
+	data []byte
+	err  error
+}
+
+// ParallelRead fetches path in concurrent ranges and writes them to w in
+// order. At most twice the concurrency of ranges are buffered while waiting
+// for an earlier range to complete.
+func (t *deviceFilesystem) ParallelRead(ctx context.Context, path string, w io.Writer, opts ParallelOptions) (int64, error) {
+	opts = opts.withDefaults()
+
+	size, ranges, err := t.parallelRanges(ctx, path, opts)
+
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]chan parallelResult, len(ranges))
+	sem := make(chan struct{}, opts.Concurrency)
+	window := opts.Concurrency * 2
+	launched := 0
+
+	var written int64
+
+	for next := range ranges {
+		for ; launched < len(ranges) && launched-next < window; launched++ {
+			results[launched] = make(chan parallelResult, 1)
+
+			go func(r parallelRange, result chan parallelResult) {
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				data, err := t.fetchRange(ctx, path, r, opts)
+				result <- parallelResult{data: data, err: err}
+			}(ranges[launched], results[launched])
+		}
+
+		result := <-results[next]
+
+		if result.err != nil {
+			return written, result.err
+		}
+
+		nw, err := w.Write(result.data)
+		written += int64(nw)
+
+		if err != nil {
+			return written, stacktrace.Propagate(err, "failed writing range at offset %v", ranges[next].offset)
+		}
+	}
+
+	if written != size {
+		return written, stacktrace.NewError("read %v bytes of '%v', expected %v", written, path, size)
+	}
+
+	return written, nil
+}
+
+// ParallelReadAt fetches path in concurrent ranges and writes each range to
+// w at its offset as soon as it arrives.
+func (t *deviceFilesystem) ParallelReadAt(ctx context.Context, path string, w io.WriterAt, opts ParallelOptions) (int64, error) {
+	opts = opts.withDefaults()
+
+	size, ranges, err := t.parallelRanges(ctx, path, opts)
+
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var written int64
+	var firsterr error
+
+	sem := make(chan struct{}, opts.Concurrency)
+
+	for _, r := range ranges {
+		wg.Add(1)
+
+		go func(r parallelRange) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			data, err := t.fetchRange(ctx, path, r, opts)
+
+			if err == nil {
+				if _, werr := w.WriteAt(data, r.offset); werr != nil {
+					err = stacktrace.Propagate(werr, "failed writing range at offset %v", r.offset)
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				if firsterr == nil {
+					firsterr = err
+					cancel()
+				}
+				return
+			}
+
+			written += int64(len(data))
+		}(r)
+	}
+
+	wg.Wait()
+
+	if firsterr != nil {
+		return written, firsterr
+	}
+
+	if written != size {
+		return written, stacktrace.NewError("read %v bytes of '%v', expected %v", written, path, size)
+	}
+
+	return written, nil
+}
+
+func (t *deviceFilesystem) parallelRanges(ctx context.Context, path string, opts ParallelOptions) (int64, []parallelRange, error) {
+	info, err := t.Stat(ctx, path)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if info.IsDir() {
+		return 0, nil, stacktrace.NewError("'%v' is a directory", path)
+	}
+
+	ranges := []parallelRange{}
+
+	for offset := int64(0); offset < info.Size(); offset += opts.ChunkSize {
+		count := opts.ChunkSize
+
+		if remaining := info.Size() - offset; remaining < count {
+			count = remaining
+		}
+
+		ranges = append(ranges, parallelRange{
+			offset: offset,
+			count:  count,
+		})
+	}
+
+	return info.Size(), ranges, nil
+}
+
+func (t *deviceFilesystem) fetchRange(ctx context.Context, path string, r parallelRange, opts ParallelOptions) ([]byte, error) {
+	var data []byte
+
+	err := retryTransfer(ctx, opts.Retries, func() error {
+		var err error
+
+		if opts.Verify {
+			data, err = t.downloadChunk(ctx, path, r.offset, r.count)
+			return err
+		}
+
+		stream, err := t.openRange(ctx, path, r.offset, r.count)
+
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+
+		if data, err = ioutil.ReadAll(stream); err != nil {
+			return stacktrace.Propagate(err, "failed reading '%v' at offset %v", path, r.offset)
+		}
+
+		if int64(len(data)) != r.count {
+			return stacktrace.NewError("short read of '%v' at offset %v: %v of %v bytes", path, r.offset, len(data), r.count)
+		}
+
+		return nil
+	})
+
+	return data, err
+}
@@ -0,0 +1,68 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_parallel_read() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	tmpfile, err := ioutil.TempFile("", "go-sdk-device-filesystem-parallel")
+
+	if err != nil {
+		t.T().Error("Error creating temp file", err.Error())
+		t.T().FailNow()
+	}
+
+	defer func() {
+		os.Remove(tmpfile.Name())
+	}()
+
+	data := make([]byte, 1000*1000+17)
+	rand.Read(data)
+	tmpfile.Write(data)
+	tmpfile.Close()
+
+	fs := objects.client.Device("whatever").Filesystem()
+	opts := ParallelOptions{
+		Concurrency: 3,
+		ChunkSize:   64 * 1024,
+	}
+
+	ordered := &bytes.Buffer{}
+	n, err := fs.ParallelRead(context.Background(), tmpfile.Name(), ordered, opts)
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), int64(len(data)), n)
+	assert.True(t.T(), bytes.Equal(data, ordered.Bytes()))
+
+	target, err := ioutil.TempFile("", "go-sdk-device-filesystem-parallel-at")
+
+	if err != nil {
+		t.T().Error("Error creating temp file", err.Error())
+		t.T().FailNow()
+	}
+
+	defer func() {
+		target.Close()
+		os.Remove(target.Name())
+	}()
+
+	opts.Verify = true
+	n, err = fs.ParallelReadAt(context.Background(), tmpfile.Name(), target, opts)
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), int64(len(data)), n)
+
+	targetdata, _ := ioutil.ReadFile(target.Name())
+	assert.True(t.T(), bytes.Equal(data, targetdata))
+}
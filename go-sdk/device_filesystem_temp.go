@@ -0,0 +1,250 @@
+package sdk
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+const tempCleanupTimeout = 30 * time.Second
+
+// tempRoots are probed in order on agents that can neither create temporary
+// files themselves nor report their temp directory.
+var tempRoots = []string{
+	"/tmp",
+	"/var/tmp",
+	"/data/local/tmp",
+	`C:\Windows\Temp`,
+}
+
+// TempHandle is a temporary file or directory on a device. Close and
+// Cleanup remove it, and can be called more than once.
+type TempHandle interface {
+	io.Closer
+	Path() string
+	Cleanup() error
+}
+
+// TempFile creates an empty file in the temp directory of the device. The
+// name is built like os.CreateTemp, a random string replaces the last "*"
+// of pattern or is appended to it. The file is removed when the handle is
+// closed, when ctx is done or when the client is closed, whichever happens
+// first.
+func (t *deviceFilesystem) TempFile(ctx context.Context, pattern string) (TempHandle, error) {
+	return t.temp(ctx, pattern, false)
+}
+
+// TempDir creates a directory in the temp directory of the device like
+// TempFile. The directory is removed with everything in it.
+func (t *deviceFilesystem) TempDir(ctx context.Context, pattern string) (TempHandle, error) {
+	return t.temp(ctx, pattern, true)
+}
+
+func (t *deviceFilesystem) temp(ctx context.Context, pattern string, dir bool) (TempHandle, error) {
+	if strings.ContainsAny(pattern, `/\`) {
+		return nil, stacktrace.NewError("temp pattern '%v' contains a path separator", pattern)
+	}
+
+	ok, err := t.supports(ctx, "mktemp")
+
+	if err != nil {
+		return nil, err
+	}
+
+	var path string
+
+	if ok {
+		path, err = t.mktemp(ctx, pattern, dir)
+	} else {
+		path, err = t.probeTemp(ctx, pattern, dir)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	handle := &deviceTempHandle{
+		fs:   t,
+		path: path,
+		dir:  dir,
+		done: make(chan struct{}),
+	}
+
+	t.device.client.track(handle)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			handle.Cleanup()
+		case <-handle.done:
+		}
+	}()
+
+	return handle, nil
+}
+
+// mktemp has the agent create the temporary entry in its own temp root and
+// report the path in the response body.
+func (t *deviceFilesystem) mktemp(ctx context.Context, pattern string, dir bool) (string, error) {
+	resp, err := t.device.submit(ctx, t.form("mktemp").
+		AddFieldAsString("pattern", pattern).
+		AddFieldAsBool("dir", dir))
+
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return "", stacktrace.Propagate(err, "failed reading temp path")
+	}
+
+	path := strings.TrimSpace(string(body))
+
+	if path == "" {
+		return "", stacktrace.NewError("agent did not report a temp path")
+	}
+
+	return path, nil
+}
+
+// probeTemp creates the temporary entry in the temp directory the agent
+// reports, or else in the first of tempRoots that exists on the device. Files
+// are only readable by their owner, directories only accessible to it.
+func (t *deviceFilesystem) probeTemp(ctx context.Context, pattern string, dir bool) (string, error) {
+	facts, err := t.device.Facts(ctx)
+
+	if err != nil {
+		return "", err
+	}
+
+	roots := tempRoots
+
+	if facts.TempDir != "" {
+		roots = []string{facts.TempDir}
+	}
+
+	for _, root := range roots {
+		info, err := t.Stat(ctx, root)
+
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		if !info.IsDir() {
+			continue
+		}
+
+		random := make([]byte, 8)
+
+		if _, err := rand.Read(random); err != nil {
+			return "", stacktrace.Propagate(err, "failed generating temp name")
+		}
+
+		name := pattern + hex.EncodeToString(random)
+
+		if i := strings.LastIndex(pattern, "*"); i >= 0 {
+			name = pattern[:i] + hex.EncodeToString(random) + pattern[i+1:]
+		}
+
+		separator := "/"
+
+		if strings.Contains(root, `\`) {
+			separator = `\`
+		}
+
+		path := strings.TrimRight(root, separator) + separator + name
+		mode := os.FileMode(0600)
+
+		if dir {
+			mode = 0700
+			err = t.MkdirAll(ctx, path, mode)
+		} else {
+			err = t.createPrivate(ctx, path, mode)
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		// agents predating the mode field create entries with their umask
+		if err := t.Chmod(ctx, path, mode); err != nil {
+			t.RemoveAll(ctx, path)
+			return "", err
+		}
+
+		return path, nil
+	}
+
+	return "", stacktrace.NewError("no temp directory found on the device")
+}
+
+// createPrivate creates an empty file with mode on agents whose write form
+// takes a mode, and with their umask otherwise.
+func (t *deviceFilesystem) createPrivate(ctx context.Context, path string, mode os.FileMode) error {
+	ok, err := t.supportsField(ctx, "write", "mode")
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		mode = 0
+	}
+
+	return t.WriteFile(ctx, path, nil, WriterOptions{Mode: mode})
+}
+
+type deviceTempHandle struct {
+	fs   *deviceFilesystem
+	path string
+	dir  bool
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func (t *deviceTempHandle) Path() string {
+	return t.path
+}
+
+func (t *deviceTempHandle) Close() error {
+	return t.Cleanup()
+}
+
+func (t *deviceTempHandle) Cleanup() error {
+	t.once.Do(func() {
+		close(t.done)
+		t.fs.device.client.untrack(t)
+
+		ctx, cancel := context.WithTimeout(context.Background(), tempCleanupTimeout)
+		defer cancel()
+
+		if t.dir {
+			t.err = t.fs.RemoveAll(ctx, t.path)
+		} else {
+			t.err = t.fs.Remove(ctx, t.path)
+		}
+
+		if errors.Is(t.err, os.ErrNotExist) {
+			t.err = nil
+		}
+	})
+
+	return t.err
+}
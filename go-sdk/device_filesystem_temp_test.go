@@ -0,0 +1,141 @@
+package sdk
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_temp_file_and_dir() {
+	for _, native := range []bool{true, false} {
+		objects := t.getTestObjects()
+
+		agent := newTestFilesystemAgent()
+
+		if !native {
+			delete(agent.handlers, "mktemp")
+		}
+
+		agent.register(objects.mux)
+
+		fs := objects.client.Device("whatever").Filesystem()
+
+		file, err := fs.TempFile(context.Background(), "helper-*.bin")
+
+		assert.Nil(t.T(), err)
+		assert.True(t.T(), strings.HasPrefix(filepath.Base(file.Path()), "helper-"))
+		assert.True(t.T(), strings.HasSuffix(file.Path(), ".bin"))
+
+		assert.Nil(t.T(), fs.WriteFile(context.Background(), file.Path(), []byte("#!/bin/sh"), WriterOptions{}))
+
+		data, _ := ioutil.ReadFile(file.Path())
+		assert.Equal(t.T(), "#!/bin/sh", string(data))
+
+		assert.Nil(t.T(), file.Close())
+		assert.Nil(t.T(), file.Cleanup())
+
+		_, err = os.Stat(file.Path())
+		assert.True(t.T(), os.IsNotExist(err))
+
+		dir, err := fs.TempDir(context.Background(), "work")
+
+		assert.Nil(t.T(), err)
+
+		info, err := os.Stat(dir.Path())
+
+		assert.Nil(t.T(), err)
+		assert.True(t.T(), info.IsDir())
+
+		ioutil.WriteFile(filepath.Join(dir.Path(), "out.log"), []byte("done"), 0644)
+
+		assert.Nil(t.T(), dir.Cleanup())
+
+		_, err = os.Stat(dir.Path())
+		assert.True(t.T(), os.IsNotExist(err))
+
+		objects.server.Close()
+	}
+}
+
+func (t *Test_DeviceFilesystem) Test_temp_cleanup_on_cancel_and_client_close() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	fs := objects.client.Device("whatever").Filesystem()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cancelled, err := fs.TempDir(ctx, "cancelled")
+	assert.Nil(t.T(), err)
+
+	leftover, err := fs.TempFile(context.Background(), "leftover")
+	assert.Nil(t.T(), err)
+
+	cancel()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(cancelled.Path()); os.IsNotExist(err) {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, err = os.Stat(cancelled.Path())
+	assert.True(t.T(), os.IsNotExist(err))
+
+	_, err = os.Stat(leftover.Path())
+	assert.Nil(t.T(), err)
+
+	assert.Nil(t.T(), objects.client.Close())
+
+	_, err = os.Stat(leftover.Path())
+	assert.True(t.T(), os.IsNotExist(err))
+}
+
+func (t *Test_DeviceFilesystem) Test_temp_uses_reported_temp_dir() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	root, _ := ioutil.TempDir("", "go-sdk-tmpdir")
+	defer os.RemoveAll(root)
+
+	agent := newTestFilesystemAgent()
+	agent.facts["tempDir"] = root + string(filepath.Separator)
+	delete(agent.handlers, "mktemp")
+	agent.register(objects.mux)
+
+	fs := objects.client.Device("whatever").Filesystem()
+
+	file, err := fs.TempFile(context.Background(), "helper-*")
+
+	assert.Nil(t.T(), err)
+	defer file.Close()
+
+	dir, err := fs.TempDir(context.Background(), "work")
+
+	assert.Nil(t.T(), err)
+	defer dir.Close()
+
+	for handle, mode := range map[TempHandle]os.FileMode{file: 0600, dir: 0700} {
+		assert.Equal(t.T(), root, filepath.Dir(handle.Path()))
+
+		info, err := os.Stat(handle.Path())
+
+		assert.Nil(t.T(), err)
+
+		if runtime.GOOS != "windows" {
+			assert.Equal(t.T(), mode, info.Mode().Perm())
+		}
+	}
+}
@@ -1,7 +1,13 @@
 package sdk
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -9,6 +15,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
@@ -89,9 +96,8 @@ func (t *Test_DeviceFilesystem) Test_successfull_write() {
 	writer := objects.client.Device("/whatever").Filesystem().Writer(
 		context.Background(),
 		tmpfile.Name(),
-		false,
+		WriterOptions{},
 	)
-	defer writer.Close()
 
 	data := strings.NewReader("hello")
 
@@ -99,8 +105,10 @@ func (t *Test_DeviceFilesystem) Test_successfull_write() {
 
 	assert.Equal(t.T(), int64(5), nw)
 	assert.Nil(t.T(), err)
+	assert.Nil(t.T(), writer.Close())
 
-	<-time.After(250 * time.Millisecond) //allow some time for the fs to catch up
+	// the vendored agent neither reports a count nor offers stat
+	assert.Equal(t.T(), int64(-1), writer.Committed())
 
 	filedata, err := ioutil.ReadFile(tmpfile.Name())
 
@@ -108,6 +116,416 @@ func (t *Test_DeviceFilesystem) Test_successfull_write() {
 	assert.Nil(t.T(), err)
 }
 
+func (t *Test_DeviceFilesystem) Test_chmod_missing_file() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	err := objects.client.Device("whatever").Filesystem().Chmod(
+		context.Background(),
+		"/nonexistent/go-sdk-test",
+		0600,
+	)
+
+	assert.IsType(t.T(), &ErrInvalidAPIResponse{}, err)
+}
+
+func (t *Test_DeviceFilesystem) Test_open_random_access() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	tmpfile, err := ioutil.TempFile("", "go-sdk-device-filesystem-open")
+
+	if err != nil {
+		t.T().Error("Error creating temp file", err.Error())
+		t.T().FailNow()
+	}
+
+	defer func() {
+		os.Remove(tmpfile.Name())
+	}()
+
+	archive := zip.NewWriter(tmpfile)
+	entry, _ := archive.Create("hello.txt")
+	entry.Write([]byte("hello world"))
+	archive.Close()
+	tmpfile.Close()
+
+	file, err := objects.client.Device("whatever").Filesystem().Open(
+		context.Background(),
+		tmpfile.Name(),
+	)
+
+	if err != nil {
+		t.T().Error("Error opening remote file", err.Error())
+		t.T().FailNow()
+	}
+
+	info, err := file.Stat()
+
+	assert.Nil(t.T(), err)
+
+	zipreader, err := zip.NewReader(file, info.Size())
+
+	assert.Nil(t.T(), err)
+	assert.Len(t.T(), zipreader.File, 1)
+
+	entryr, err := zipreader.File[0].Open()
+
+	assert.Nil(t.T(), err)
+
+	entrydata, err := ioutil.ReadAll(entryr)
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "hello world", string(entrydata))
+
+	pos, err := file.Seek(-4, io.SeekEnd)
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), info.Size()-4, pos)
+
+	tail, err := ioutil.ReadAll(file)
+
+	assert.Nil(t.T(), err)
+	assert.Len(t.T(), tail, 4)
+	assert.Nil(t.T(), file.Close())
+	assert.Equal(t.T(), os.ErrClosed, file.Close())
+}
+
+func (t *Test_DeviceFilesystem) Test_staged_write_and_abort() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir, err := ioutil.TempDir("", "go-sdk-device-filesystem-staged")
+
+	if err != nil {
+		t.T().Error("Error creating temp dir", err.Error())
+		t.T().FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "config")
+	ioutil.WriteFile(target, []byte("original"), 0640)
+
+	fs := objects.client.Device("whatever").Filesystem()
+
+	aborted := fs.Writer(context.Background(), target, WriterOptions{Atomic: true})
+	aborted.Write([]byte("partial"))
+
+	assert.Nil(t.T(), aborted.Abort())
+	assert.Nil(t.T(), aborted.Close())
+	assert.Equal(t.T(), int64(0), aborted.Committed())
+
+	_, err = aborted.Write([]byte("more"))
+	assert.Equal(t.T(), ErrWriterAborted, err)
+
+	filedata, _ := ioutil.ReadFile(target)
+	assert.Equal(t.T(), "original", string(filedata))
+
+	// a staging file left behind by a client that crashed
+	stale := filepath.Join(dir, ".config.deviceio-0123456789abcdef")
+	ioutil.WriteFile(stale, []byte("stale"), 0600)
+	os.Chtimes(stale, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour))
+
+	writer := fs.Writer(context.Background(), target, WriterOptions{Atomic: true})
+	writer.Write([]byte("replaced"))
+
+	assert.Nil(t.T(), writer.Close())
+	assert.Equal(t.T(), int64(8), writer.Committed())
+
+	filedata, _ = ioutil.ReadFile(target)
+	assert.Equal(t.T(), "replaced", string(filedata))
+
+	info, _ := os.Stat(target)
+	assert.Equal(t.T(), os.FileMode(0640), info.Mode().Perm())
+
+	// the vendored agent cannot fsync the staged file
+	err = fs.WriteFile(context.Background(), target, []byte("durable"), WriterOptions{Durable: true})
+	assert.IsType(t.T(), &ErrUnsupportedOperation{}, err)
+
+	filedata, _ = ioutil.ReadFile(target)
+	assert.Equal(t.T(), "replaced", string(filedata))
+
+	entries, _ := ioutil.ReadDir(dir)
+	assert.Len(t.T(), entries, 1)
+}
+
+func (t *Test_DeviceFilesystem) Test_stale_staging_is_swept_once_per_directory() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	agent := newTestFilesystemAgent()
+	readdir := agent.handlers["readdir"]
+	listings := 0
+	agent.handlers["readdir"] = func(rw http.ResponseWriter, r *http.Request) {
+		listings++
+		readdir(rw, r)
+	}
+	agent.register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-device-filesystem-sweep")
+	defer os.RemoveAll(dir)
+
+	fs := objects.client.Device("whatever").Filesystem()
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t.T(), fs.WriteFile(context.Background(), filepath.Join(dir, fmt.Sprintf("file%v", i)), []byte("data"), WriterOptions{}))
+	}
+
+	assert.Equal(t.T(), 1, listings)
+}
+
+func (t *Test_DeviceFilesystem) Test_atomic_write_with_backup_and_expected_hash() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().withSyncedWrites().register(objects.mux)
+
+	dir, err := ioutil.TempDir("", "go-sdk-device-filesystem-atomic")
+
+	if err != nil {
+		t.T().Error("Error creating temp dir", err.Error())
+		t.T().FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "config")
+	ioutil.WriteFile(target, []byte("v1"), 0644)
+
+	fs := objects.client.Device("whatever").Filesystem()
+
+	err = fs.WriteFile(context.Background(), target, []byte("v2"), WriterOptions{
+		ExpectedHash: "0000",
+	})
+
+	assert.IsType(t.T(), &ErrPreconditionFailed{}, err)
+
+	sum := sha256.Sum256([]byte("v1"))
+
+	err = fs.WriteFile(context.Background(), target, []byte("v2"), WriterOptions{
+		Durable:      true,
+		Backup:       ".bak",
+		ExpectedHash: hex.EncodeToString(sum[:]),
+	})
+
+	assert.Nil(t.T(), err)
+
+	filedata, _ := ioutil.ReadFile(target)
+	assert.Equal(t.T(), "v2", string(filedata))
+
+	backupdata, _ := ioutil.ReadFile(target + ".bak")
+	assert.Equal(t.T(), "v1", string(backupdata))
+
+	entries, _ := ioutil.ReadDir(dir)
+	assert.Len(t.T(), entries, 2)
+}
+
+func (t *Test_DeviceFilesystem) Test_atomic_write_syncs_staged_file() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	agent := newTestFilesystemAgent().withSyncedWrites()
+	agent.register(objects.mux)
+
+	dir, err := ioutil.TempDir("", "go-sdk-device-filesystem-sync")
+
+	if err != nil {
+		t.T().Error("Error creating temp dir", err.Error())
+		t.T().FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "config")
+	fs := objects.client.Device("whatever").Filesystem()
+
+	assert.Nil(t.T(), fs.WriteFile(context.Background(), target, []byte("plain"), WriterOptions{}))
+	assert.Empty(t.T(), agent.synced)
+
+	assert.Nil(t.T(), fs.WriteFile(context.Background(), target, []byte("durable"), WriterOptions{Durable: true}))
+
+	if assert.Len(t.T(), agent.synced, 1) {
+		assert.True(t.T(), strings.HasPrefix(agent.synced[0], filepath.Join(dir, ".config.deviceio-")))
+	}
+
+	filedata, _ := ioutil.ReadFile(target)
+	assert.Equal(t.T(), "durable", string(filedata))
+}
+
+func (t *Test_DeviceFilesystem) Test_failed_write_reported_on_close() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	writer := objects.client.Device("whatever").Filesystem().Writer(
+		context.Background(),
+		"/nonexistent/go-sdk-test/file",
+		WriterOptions{},
+	)
+	writer.Write([]byte("hello"))
+
+	assert.NotNil(t.T(), writer.Close())
+}
+
+func (t *Test_DeviceFilesystem) Test_plain_write_round_trips() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	agent := newTestFilesystemAgent()
+	agent.handlers["write"] = agent.write
+	requests := []string{}
+
+	for name, handler := range agent.handlers {
+		name, handler := name, handler
+		agent.handlers[name] = func(rw http.ResponseWriter, r *http.Request) {
+			requests = append(requests, name)
+			handler(rw, r)
+		}
+	}
+
+	agent.register(objects.mux)
+
+	tmpfile, _ := ioutil.TempFile("", "go-sdk-device-filesystem-plain")
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+
+	fs := objects.client.Device("whatever").Filesystem()
+
+	writer := fs.Writer(context.Background(), tmpfile.Name(), WriterOptions{})
+	writer.Write([]byte("hello"))
+
+	assert.Nil(t.T(), writer.Close())
+	assert.Equal(t.T(), int64(5), writer.Committed())
+	assert.Contains(t.T(), requests, "rename")
+
+	// appends cannot be staged and stay a single write request
+	requests = requests[:0]
+
+	appender := fs.Writer(context.Background(), tmpfile.Name(), WriterOptions{Append: true})
+	appender.Write([]byte(" world"))
+
+	assert.Nil(t.T(), appender.Close())
+	assert.Equal(t.T(), int64(6), appender.Committed())
+	assert.Equal(t.T(), []string{"write"}, requests)
+
+	filedata, _ := ioutil.ReadFile(tmpfile.Name())
+	assert.Equal(t.T(), "hello world", string(filedata))
+}
+
+func (t *Test_DeviceFilesystem) Test_abort_of_default_writer_keeps_target() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir, err := ioutil.TempDir("", "go-sdk-device-filesystem-abort")
+
+	if err != nil {
+		t.T().Error("Error creating temp dir", err.Error())
+		t.T().FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "config")
+	ioutil.WriteFile(target, []byte("original"), 0644)
+
+	writer := objects.client.Device("whatever").Filesystem().Writer(context.Background(), target, WriterOptions{})
+	writer.Write([]byte("partial"))
+
+	assert.Nil(t.T(), writer.Abort())
+	assert.Equal(t.T(), int64(0), writer.Committed())
+
+	filedata, _ := ioutil.ReadFile(target)
+	assert.Equal(t.T(), "original", string(filedata))
+
+	entries, _ := ioutil.ReadDir(dir)
+	assert.Len(t.T(), entries, 1)
+}
+
+func (t *Test_DeviceFilesystem) Test_atomic_write_fails_when_ownership_is_lost() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	agent := newTestFilesystemAgent()
+	agent.handlers["chown"] = func(rw http.ResponseWriter, r *http.Request) {
+		agent.fail(rw, os.ErrPermission)
+	}
+	agent.handlers["stat"] = func(rw http.ResponseWriter, r *http.Request) {
+		info, err := os.Stat(r.FormValue("path"))
+
+		if err != nil {
+			agent.fail(rw, err)
+			return
+		}
+
+		fi := newTestFileInfo(info)
+		fi.FileStat = &FileStat{UID: 1000, GID: 1000}
+		agent.json(rw, fi)
+	}
+
+	agent.register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-device-filesystem-owner")
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "config")
+	ioutil.WriteFile(target, []byte("original"), 0644)
+
+	err := objects.client.Device("whatever").Filesystem().WriteFile(context.Background(), target, []byte("replaced"), WriterOptions{Atomic: true})
+	assert.NotNil(t.T(), err)
+
+	filedata, _ := ioutil.ReadFile(target)
+	assert.Equal(t.T(), "original", string(filedata))
+
+	entries, _ := ioutil.ReadDir(dir)
+	assert.Len(t.T(), entries, 1)
+}
+
+func (t *Test_DeviceFilesystem) Test_open_reports_range_errors_past_2gib() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	agent := newTestFilesystemAgent()
+	offsets := []string{}
+
+	// the agent fails after sending the whole range
+	agent.handlers["read"] = func(rw http.ResponseWriter, r *http.Request) {
+		offsets = append(offsets, r.FormValue("offset"))
+		count, _ := strconv.Atoi(r.FormValue("count"))
+
+		rw.Header().Set("Trailer", "Error")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(bytes.Repeat([]byte("x"), count))
+		rw.Header().Set("Error", "disk read failed")
+	}
+	agent.register(objects.mux)
+
+	tmpfile, _ := ioutil.TempFile("", "go-sdk-device-filesystem-large")
+	tmpfile.Truncate(5 << 30)
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+
+	file, err := objects.client.Device("whatever").Filesystem().Open(context.Background(), tmpfile.Name())
+	assert.Nil(t.T(), err)
+
+	n, err := file.ReadAt(make([]byte, 16), 3<<30)
+
+	assert.Equal(t.T(), 16, n)
+
+	if assert.NotNil(t.T(), err) {
+		assert.Contains(t.T(), err.Error(), "disk read failed")
+	}
+
+	assert.Equal(t.T(), []string{"3221225472"}, offsets)
+
+	file.Close()
+}
+
 func (t *Test_DeviceFilesystem) getTestObjects() (objects struct {
 	server *httptest.Server
 	client Client
@@ -124,18 +542,16 @@ func (t *Test_DeviceFilesystem) getTestObjects() (objects struct {
 	hoststr, portstr, _ := net.SplitHostPort(url.Host)
 	port, _ := strconv.ParseInt(portstr, 10, 0)
 
-	client := NewClient(ClientConfig{
-		HMClient: hmapi.NewClient(&hmapi.ClientConfig{
-			Auth:   &hmapi.AuthNone{},
-			Host:   hoststr,
-			Port:   int(port),
-			Scheme: hmapi.HTTP,
-		}),
+	objects.client = NewClient(ClientConfig{
+		HubHost:      hoststr,
+		HubPort:      int(port),
+		HubPlainHTTP: true,
+		HubAuth:      &hmapi.AuthNone{},
+		PrivateKey:   base64.StdEncoding.EncodeToString(testClientKey),
 	})
 
 	objects.mux = mux
 	objects.server = svr
-	objects.client = client
 
 	return
 }
@@ -0,0 +1,576 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/palantir/stacktrace"
+)
+
+const (
+	defaultTransferChunkSize = 8 * 1024 * 1024
+	defaultTransferRetries   = 5
+	transferPartialSuffix    = ".deviceio-partial"
+)
+
+var errPartialDiverged = errors.New("partial upload diverged from the confirmed offset")
+
+// TransferOptions tunes Upload and Download. Each chunk is verified against
+// a hash computed on the device before the resume state is advanced, so an
+// interrupted transfer continues from the last confirmed offset the next
+// time it is started with the same source and destination. CheckSpace makes
+// Upload fail with ErrInsufficientSpace before sending anything when the
+// destination filesystem cannot take the remaining bytes. BandwidthLimit
+// caps the bytes per second of the transfer on top of the device and client
+// limits.
+//
+// The resume state is kept in StatePath, by default a file under the user
+// cache directory named after the source and destination, so transfers from
+// read-only directories resume as well. A transfer whose state cannot be
+// saved goes on without being resumable.
+type TransferOptions struct {
+	ChunkSize      int64
+	Retries        int
+	StatePath      string
+	CheckSpace     bool
+	BandwidthLimit int64
+	Progress       func(TransferProgress)
+}
+
+// TransferProgress reports the bytes moved so far out of Total, which is
+// zero when the size is not known up front. Rate is the average number of
+// bytes per second since the transfer started and ETA the estimated time
+// left at that rate, zero while it cannot be estimated.
+type TransferProgress struct {
+	Transferred int64
+	Total       int64
+	Rate        float64
+	ETA         time.Duration
+}
+
+type transferState struct {
+	Source  string    `json:"source"`
+	Dest    string    `json:"dest"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	SHA256  string    `json:"sha256"`
+	Offset  int64     `json:"offset"`
+}
+
+func (t TransferOptions) withDefaults(source, dest string) TransferOptions {
+	if t.ChunkSize <= 0 {
+		t.ChunkSize = defaultTransferChunkSize
+	}
+
+	if t.Retries <= 0 {
+		t.Retries = defaultTransferRetries
+	}
+
+	if t.StatePath == "" {
+		t.StatePath = defaultTransferStatePath(source, dest)
+	}
+
+	return t
+}
+
+// defaultTransferStatePath returns the path of the resume state of the
+// transfer from source to dest.
+func defaultTransferStatePath(source, dest string) string {
+	dir, err := os.UserCacheDir()
+
+	if err != nil {
+		dir = os.TempDir()
+	}
+
+	key := sha256.Sum256([]byte(source + "\x00" + dest))
+
+	return filepath.Join(dir, "deviceio", "transfers", hex.EncodeToString(key[:]))
+}
+
+func (t *deviceFilesystem) Upload(ctx context.Context, local, remote string, opts TransferOptions) error {
+	opts = opts.withDefaults(local, remote)
+	ctx = opts.streamContext(ctx)
+
+	file, err := os.Open(local)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed opening '%v'", local)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed stat of '%v'", local)
+	}
+
+	sum, err := hashReader(file)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed hashing '%v'", local)
+	}
+
+	state := &transferState{
+		Source:  local,
+		Dest:    remote,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		SHA256:  sum,
+	}
+
+	partial := remote + transferPartialSuffix
+
+	if saved := loadTransferState(opts.StatePath); saved != nil && saved.matches(state) {
+		state.Offset = saved.Offset
+
+		if remoteinfo, err := t.Stat(ctx, partial); err != nil || remoteinfo.Size() < state.Offset {
+			state.Offset = 0
+		}
+	}
+
+	if opts.CheckSpace {
+		if err := t.checkSpace(ctx, remote, state.Size-state.Offset); err != nil {
+			return err
+		}
+	}
+
+	positioned, err := t.supportsField(ctx, "write", "offset")
+
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, opts.ChunkSize)
+	restarts := 0
+	tracker := newProgressTracker(state.Offset, state.Size, opts.Progress)
+
+	for state.Offset < state.Size {
+		want := int64(len(buf))
+
+		if remaining := state.Size - state.Offset; remaining < want {
+			want = remaining
+		}
+
+		n, err := file.ReadAt(buf[:want], state.Offset)
+
+		if err != nil && err != io.EOF {
+			return stacktrace.Propagate(err, "failed reading '%v'", local)
+		}
+
+		// a short read means the file shrank since it was hashed, and
+		// uploading nothing would never advance the offset
+		if int64(n) != want {
+			return stacktrace.NewError("'%v' changed during the upload: short read at offset %v: %v of %v bytes", local, state.Offset, n, want)
+		}
+
+		chunk := buf[:n]
+
+		err = retryTransfer(ctx, opts.Retries, func() error {
+			return t.uploadChunk(ctx, partial, state.Offset, chunk, positioned)
+		})
+
+		// agents without positioned writes cannot truncate the partial file,
+		// so when it holds something else than the chunk being retried the
+		// upload starts over
+		if err == errPartialDiverged && restarts < opts.Retries {
+			restarts++
+			state.Offset = 0
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		state.Offset += int64(n)
+
+		// resuming is best effort, the transfer itself does not need it
+		if err := state.save(opts.StatePath); err != nil {
+			opts.removeState()
+			opts.StatePath = ""
+		}
+
+		tracker.report(state.Offset)
+	}
+
+	if state.Size == 0 {
+		if err := t.WriteFile(ctx, partial, nil, WriterOptions{}); err != nil {
+			return err
+		}
+	}
+
+	remotesum, err := t.hash(ctx, partial, HashSHA256, 0, -1)
+
+	if err != nil {
+		return err
+	}
+
+	if remotesum != state.SHA256 {
+		t.Remove(ctx, partial)
+		opts.removeState()
+
+		return &ErrChecksumMismatch{
+			Path:     remote,
+			Expected: state.SHA256,
+			Actual:   remotesum,
+		}
+	}
+
+	if err := t.Rename(ctx, partial, remote); err != nil {
+		return err
+	}
+
+	opts.removeState()
+
+	return nil
+}
+
+// uploadChunk writes chunk to the partial file at offset and confirms it
+// landed by comparing the hash the agent computes over the same range.
+// Agents with positioned writes overwrite whatever an interrupted attempt
+// left past offset. Otherwise the chunk is appended, skipping the part of it
+// an interrupted attempt already appended, and a chunk that starts at zero
+// truncates whatever was left from earlier runs.
+func (t *deviceFilesystem) uploadChunk(ctx context.Context, partial string, offset int64, chunk []byte, positioned bool) error {
+	opts := WriterOptions{Append: offset > 0}
+	data := chunk
+
+	if positioned {
+		opts = WriterOptions{offset: offset, positioned: true}
+	} else if offset > 0 {
+		info, err := t.Stat(ctx, partial)
+
+		if err != nil {
+			return err
+		}
+
+		landed := info.Size() - offset
+
+		if landed < 0 || landed > int64(len(chunk)) {
+			return errPartialDiverged
+		}
+
+		if landed > 0 {
+			remotesum, err := t.hash(ctx, partial, HashSHA256, offset, landed)
+
+			if err != nil {
+				return err
+			}
+
+			if remotesum != hashBytes(chunk[:landed]) {
+				return errPartialDiverged
+			}
+
+			data = chunk[landed:]
+		}
+	}
+
+	if len(data) > 0 || offset == 0 {
+		if err := t.WriteFile(ctx, partial, data, opts); err != nil {
+			return err
+		}
+	}
+
+	remotesum, err := t.hash(ctx, partial, HashSHA256, offset, int64(len(chunk)))
+
+	if err != nil {
+		return err
+	}
+
+	if localsum := hashBytes(chunk); remotesum != localsum {
+		return &ErrChecksumMismatch{
+			Path:     partial,
+			Expected: localsum,
+			Actual:   remotesum,
+		}
+	}
+
+	return nil
+}
+
+func (t *deviceFilesystem) Download(ctx context.Context, remote, local string, opts TransferOptions) error {
+	opts = opts.withDefaults(remote, local)
+	ctx = opts.streamContext(ctx)
+
+	info, err := t.Stat(ctx, remote)
+
+	if err != nil {
+		return err
+	}
+
+	sum, err := t.hash(ctx, remote, HashSHA256, 0, -1)
+
+	if err != nil {
+		return err
+	}
+
+	state := &transferState{
+		Source:  remote,
+		Dest:    local,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		SHA256:  sum,
+	}
+
+	partial := local + transferPartialSuffix
+
+	if saved := loadTransferState(opts.StatePath); saved != nil && saved.matches(state) {
+		state.Offset = saved.Offset
+	}
+
+	file, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0666)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed opening '%v'", partial)
+	}
+	defer file.Close()
+
+	if localinfo, err := file.Stat(); err != nil || localinfo.Size() < state.Offset {
+		state.Offset = 0
+	}
+
+	if err := file.Truncate(state.Offset); err != nil {
+		return stacktrace.Propagate(err, "failed truncating '%v'", partial)
+	}
+
+	tracker := newProgressTracker(state.Offset, state.Size, opts.Progress)
+
+	for state.Offset < state.Size {
+		count := opts.ChunkSize
+
+		if remaining := state.Size - state.Offset; remaining < count {
+			count = remaining
+		}
+
+		var chunk []byte
+
+		err = retryTransfer(ctx, opts.Retries, func() error {
+			chunk, err = t.downloadChunk(ctx, remote, state.Offset, count)
+			return err
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if _, err := file.WriteAt(chunk, state.Offset); err != nil {
+			return stacktrace.Propagate(err, "failed writing '%v'", partial)
+		}
+
+		if err := file.Sync(); err != nil {
+			return stacktrace.Propagate(err, "failed syncing '%v'", partial)
+		}
+
+		state.Offset += int64(len(chunk))
+
+		// resuming is best effort, the transfer itself does not need it
+		if err := state.save(opts.StatePath); err != nil {
+			opts.removeState()
+			opts.StatePath = ""
+		}
+
+		tracker.report(state.Offset)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return stacktrace.Propagate(err, "failed seeking '%v'", partial)
+	}
+
+	localsum, err := hashReader(file)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed hashing '%v'", partial)
+	}
+
+	if localsum != state.SHA256 {
+		file.Close()
+		os.Remove(partial)
+		opts.removeState()
+
+		return &ErrChecksumMismatch{
+			Path:     local,
+			Expected: state.SHA256,
+			Actual:   localsum,
+		}
+	}
+
+	file.Close()
+
+	if err := os.Rename(partial, local); err != nil {
+		return stacktrace.Propagate(err, "failed renaming '%v' to '%v'", partial, local)
+	}
+
+	opts.removeState()
+
+	return nil
+}
+
+func (t *deviceFilesystem) downloadChunk(ctx context.Context, remote string, offset, count int64) ([]byte, error) {
+	stream, err := t.openRange(ctx, remote, offset, count)
+
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	chunk, err := ioutil.ReadAll(stream)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed reading '%v' at offset %v", remote, offset)
+	}
+
+	if int64(len(chunk)) != count {
+		return nil, stacktrace.NewError("short read of '%v' at offset %v: %v of %v bytes", remote, offset, len(chunk), count)
+	}
+
+	remotesum, err := t.hash(ctx, remote, HashSHA256, offset, count)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if localsum := hashBytes(chunk); remotesum != localsum {
+		return nil, &ErrChecksumMismatch{
+			Path:     remote,
+			Expected: remotesum,
+			Actual:   localsum,
+		}
+	}
+
+	return chunk, nil
+}
+
+// streamContext applies the bandwidth limit of the transfer to the chunk
+// streams and keeps progress callbacks of ctx from firing per chunk.
+func (t TransferOptions) streamContext(ctx context.Context) context.Context {
+	return WithStreamOptions(ctx, StreamOptions{
+		BandwidthLimit: t.BandwidthLimit,
+	})
+}
+
+func (t *transferState) matches(other *transferState) bool {
+	return t.Source == other.Source &&
+		t.Dest == other.Dest &&
+		t.Size == other.Size &&
+		t.ModTime.Equal(other.ModTime) &&
+		t.SHA256 == other.SHA256
+}
+
+// removeState removes the resume state of a finished transfer.
+func (t TransferOptions) removeState() {
+	if t.StatePath != "" {
+		os.Remove(t.StatePath)
+	}
+}
+
+func (t *transferState) save(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(t)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed encoding transfer state")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return stacktrace.Propagate(err, "failed creating transfer state directory for '%v'", path)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return stacktrace.Propagate(err, "failed saving transfer state to '%v'", path)
+	}
+
+	return nil
+}
+
+func loadTransferState(path string) *transferState {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil
+	}
+
+	var state *transferState
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil
+	}
+
+	return state
+}
+
+func retryTransfer(ctx context.Context, retries int, fn func() error) error {
+	b := &backoff.Backoff{
+		Min:    250 * time.Millisecond,
+		Max:    30 * time.Second,
+		Jitter: true,
+	}
+
+	var err error
+
+	for attempt := 0; attempt <= retries; attempt++ {
+		if err = fn(); err == nil || !retryableTransfer(err) {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if attempt == retries {
+			break
+		}
+
+		select {
+		case <-time.After(b.Duration()):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return err
+}
+
+// retryableTransfer reports whether err is worth retrying: transport errors,
+// server side failures and chunks that did not land intact. Requests the
+// agent refused fail the same way when repeated.
+func retryableTransfer(err error) bool {
+	switch cause := stacktrace.RootCause(err).(type) {
+	case *ErrInvalidAPIResponse:
+		return cause.StatusCode >= 500 || cause.StatusCode == http.StatusRequestTimeout || cause.StatusCode == http.StatusTooManyRequests
+	case *ErrChecksumMismatch:
+		return true
+	case *ErrUnsupportedOperation, *ErrInsufficientSpace:
+		return false
+	}
+
+	return err != errPartialDiverged && err != context.Canceled && err != context.DeadlineExceeded
+}
+
+func hashReader(r io.Reader) (string, error) {
+	hash := sha256.New()
+
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func hashBytes(data []byte) string {
+	sum, _ := hashReader(bytes.NewReader(data))
+	return sum
+}
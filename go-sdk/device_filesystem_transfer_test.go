@@ -0,0 +1,294 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_upload_download_round_trip() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir, err := ioutil.TempDir("", "go-sdk-device-filesystem-transfer")
+
+	if err != nil {
+		t.T().Error("Error creating temp dir", err.Error())
+		t.T().FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 300*1024)
+	rand.Read(data)
+
+	local := filepath.Join(dir, "image.bin")
+	remote := filepath.Join(dir, "remote.bin")
+	roundtrip := filepath.Join(dir, "roundtrip.bin")
+
+	ioutil.WriteFile(local, data, 0644)
+
+	fs := objects.client.Device("whatever").Filesystem()
+
+	var progress []TransferProgress
+
+	err = fs.Upload(context.Background(), local, remote, TransferOptions{
+		ChunkSize: 64 * 1024,
+		Progress: func(p TransferProgress) {
+			progress = append(progress, p)
+		},
+	})
+
+	assert.Nil(t.T(), err)
+	assert.Len(t.T(), progress, 5)
+	assert.Equal(t.T(), int64(len(data)), progress[4].Transferred)
+	assert.Equal(t.T(), int64(len(data)), progress[4].Total)
+	assert.True(t.T(), progress[4].Rate > 0)
+
+	err = fs.Download(context.Background(), remote, roundtrip, TransferOptions{
+		ChunkSize: 100 * 1024,
+	})
+
+	assert.Nil(t.T(), err)
+
+	roundtripdata, _ := ioutil.ReadFile(roundtrip)
+	assert.True(t.T(), bytes.Equal(data, roundtripdata))
+
+	entries, _ := ioutil.ReadDir(dir)
+	assert.Len(t.T(), entries, 3)
+}
+
+func (t *Test_DeviceFilesystem) Test_upload_resumes_from_confirmed_offset() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir, err := ioutil.TempDir("", "go-sdk-device-filesystem-resume")
+
+	if err != nil {
+		t.T().Error("Error creating temp dir", err.Error())
+		t.T().FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+
+	local := filepath.Join(dir, "image.bin")
+	remote := filepath.Join(dir, "remote.bin")
+
+	ioutil.WriteFile(local, data, 0644)
+
+	fs := objects.client.Device("whatever").Filesystem()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	err = fs.Upload(ctx, local, remote, TransferOptions{
+		ChunkSize: 64 * 1024,
+		Progress: func(p TransferProgress) {
+			if p.Transferred >= 128*1024 {
+				cancel()
+			}
+		},
+	})
+
+	assert.NotNil(t.T(), err)
+
+	var first *TransferProgress
+
+	err = fs.Upload(context.Background(), local, remote, TransferOptions{
+		ChunkSize: 64 * 1024,
+		Progress: func(p TransferProgress) {
+			if first == nil {
+				first = &p
+			}
+		},
+	})
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), int64(192*1024), first.Transferred)
+
+	remotedata, _ := ioutil.ReadFile(remote)
+	assert.True(t.T(), bytes.Equal(data, remotedata))
+}
+
+func (t *Test_DeviceFilesystem) Test_upload_resumes_partly_landed_chunk() {
+	for _, positioned := range []bool{false, true} {
+		objects := t.getTestObjects()
+
+		agent := newTestFilesystemAgent()
+
+		if positioned {
+			agent.withPositionedWrites()
+		}
+
+		writes := 0
+		restarts := 0
+
+		// the third chunk is cut off by the hub half way through
+		agent.handlers["write"] = func(rw http.ResponseWriter, r *http.Request) {
+			writes++
+
+			if r.FormValue("append") != "true" && r.FormValue("offset") == "" || r.FormValue("offset") == "0" {
+				restarts++
+			}
+
+			if writes == 3 {
+				file, _ := os.OpenFile(r.FormValue("path"), os.O_WRONLY|os.O_APPEND, 0666)
+				file.Write([]byte(r.FormValue("data"))[:32*1024])
+				file.Close()
+
+				rw.WriteHeader(http.StatusBadGateway)
+				return
+			}
+
+			agent.write(rw, r)
+		}
+
+		agent.register(objects.mux)
+
+		dir, _ := ioutil.TempDir("", "go-sdk-device-filesystem-blip")
+
+		data := make([]byte, 256*1024)
+		rand.Read(data)
+
+		local := filepath.Join(dir, "image.bin")
+		remote := filepath.Join(dir, "remote.bin")
+
+		ioutil.WriteFile(local, data, 0644)
+
+		err := objects.client.Device("whatever").Filesystem().Upload(context.Background(), local, remote, TransferOptions{
+			ChunkSize: 64 * 1024,
+		})
+
+		assert.Nil(t.T(), err)
+		assert.Equal(t.T(), 1, restarts)
+		assert.Equal(t.T(), 5, writes)
+
+		remotedata, _ := ioutil.ReadFile(remote)
+		assert.True(t.T(), bytes.Equal(data, remotedata))
+
+		objects.server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func (t *Test_DeviceFilesystem) Test_upload_does_not_retry_refused_requests() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	agent := newTestFilesystemAgent()
+	writes := 0
+
+	agent.handlers["write"] = func(rw http.ResponseWriter, r *http.Request) {
+		writes++
+		rw.WriteHeader(http.StatusForbidden)
+	}
+
+	agent.register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-device-filesystem-refused")
+	defer os.RemoveAll(dir)
+
+	local := filepath.Join(dir, "image.bin")
+	ioutil.WriteFile(local, []byte("firmware"), 0644)
+
+	err := objects.client.Device("whatever").Filesystem().Upload(context.Background(), local, filepath.Join(dir, "remote.bin"), TransferOptions{})
+
+	assert.IsType(t.T(), &ErrInvalidAPIResponse{}, err)
+	assert.Equal(t.T(), 1, writes)
+}
+
+func (t *Test_DeviceFilesystem) Test_upload_fails_when_the_file_shrinks() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-device-filesystem-shrink")
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+
+	local := filepath.Join(dir, "image.bin")
+	ioutil.WriteFile(local, data, 0644)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := objects.client.Device("whatever").Filesystem().Upload(ctx, local, filepath.Join(dir, "remote.bin"), TransferOptions{
+		ChunkSize: 16 * 1024,
+		Progress: func(p TransferProgress) {
+			os.Truncate(local, 20*1024)
+		},
+	})
+
+	if assert.NotNil(t.T(), err) {
+		assert.Contains(t.T(), err.Error(), "changed during the upload")
+	}
+}
+
+func (t *Test_DeviceFilesystem) Test_upload_keeps_resume_state_out_of_the_source_tree() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-device-filesystem-state")
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "release")
+	os.MkdirAll(source, 0755)
+
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+
+	local := filepath.Join(source, "image.bin")
+	remote := filepath.Join(dir, "remote.bin")
+	ioutil.WriteFile(local, data, 0644)
+
+	fs := objects.client.Device("whatever").Filesystem()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	err := fs.Upload(ctx, local, remote, TransferOptions{
+		ChunkSize: 16 * 1024,
+		Progress: func(p TransferProgress) {
+			cancel()
+		},
+	})
+
+	assert.NotNil(t.T(), err)
+
+	entries, _ := ioutil.ReadDir(source)
+	assert.Len(t.T(), entries, 1)
+
+	state := loadTransferState(defaultTransferStatePath(local, remote))
+
+	if assert.NotNil(t.T(), state) {
+		assert.Equal(t.T(), int64(16*1024), state.Offset)
+	}
+
+	// a state file that cannot be written leaves the upload unresumable
+	// rather than failing it
+	err = fs.Upload(context.Background(), local, remote, TransferOptions{
+		ChunkSize: 16 * 1024,
+		StatePath: filepath.Join(local, "state"),
+	})
+
+	assert.Nil(t.T(), err)
+
+	remotedata, _ := ioutil.ReadFile(remote)
+	assert.True(t.T(), bytes.Equal(data, remotedata))
+
+	assert.Nil(t.T(), fs.Upload(context.Background(), local, remote, TransferOptions{ChunkSize: 16 * 1024}))
+	assert.Nil(t.T(), loadTransferState(defaultTransferStatePath(local, remote)))
+}
@@ -0,0 +1,198 @@
+package sdk
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"sort"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+// FilesystemUsage is the capacity of the filesystem mounted at Mount.
+// Available is what an unprivileged user can still allocate, which is less
+// than Free when blocks are reserved for root. Inode counts are zero on
+// platforms without inodes.
+type FilesystemUsage struct {
+	Mount      string `json:"mount"`
+	Total      int64  `json:"total"`
+	Free       int64  `json:"free"`
+	Available  int64  `json:"available"`
+	Inodes     int64  `json:"inodes"`
+	InodesFree int64  `json:"inodesFree"`
+}
+
+// DiskUsage is the recursive size of a directory. Size sums the apparent
+// size of the regular files below Path. Children holds one entry per direct
+// child of the root, largest first, and is empty for the children
+// themselves.
+type DiskUsage struct {
+	Path     string       `json:"path"`
+	Size     int64        `json:"size"`
+	Files    int64        `json:"files"`
+	Dirs     int64        `json:"dirs"`
+	Children []*DiskUsage `json:"children,omitempty"`
+}
+
+// Usage reports the capacity of the filesystem containing path. Paths that
+// do not exist yet are resolved by the agent to their nearest existing
+// parent, so the destination of an upload can be checked before it starts.
+func (t *deviceFilesystem) Usage(ctx context.Context, path string) (*FilesystemUsage, error) {
+	ok, err := t.supports(ctx, "usage")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, &ErrUnsupportedOperation{Operation: "usage"}
+	}
+
+	resp, err := t.device.submit(ctx, t.form("usage").
+		AddFieldAsString("path", path))
+
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var usage *FilesystemUsage
+
+	if err = json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+		return nil, stacktrace.Propagate(err, "failed decoding usage of '%v'", path)
+	}
+
+	return usage, nil
+}
+
+// DiskUsage totals the size of dir like du. The agent walks the tree when it
+// has a du form, otherwise it is walked through ReadDir. Subdirectories that
+// cannot be read are skipped.
+func (t *deviceFilesystem) DiskUsage(ctx context.Context, dir string) (*DiskUsage, error) {
+	ok, err := t.supports(ctx, "du")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		usage, err := diskUsageWalk(ctx, &deviceFS{ctx: ctx, fs: t, root: dir})
+
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed computing disk usage of '%v'", dir)
+		}
+
+		usage.Path = dir
+
+		return usage, nil
+	}
+
+	resp, err := t.device.submit(ctx, t.form("du").
+		AddFieldAsString("path", dir))
+
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var usage *DiskUsage
+
+	if err = json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+		return nil, stacktrace.Propagate(err, "failed decoding disk usage of '%v'", dir)
+	}
+
+	return usage, nil
+}
+
+// checkSpace fails with ErrInsufficientSpace when the filesystem containing
+// path cannot take another size bytes.
+func (t *deviceFilesystem) checkSpace(ctx context.Context, path string, size int64) error {
+	usage, err := t.Usage(ctx, path)
+
+	if err != nil {
+		return err
+	}
+
+	if usage.Available < size {
+		return &ErrInsufficientSpace{
+			Path:      path,
+			Required:  size,
+			Available: usage.Available,
+		}
+	}
+
+	return nil
+}
+
+// diskUsageWalk totals fsys, attributing every entry to the direct child of
+// the root it lives under.
+func diskUsageWalk(ctx context.Context, fsys fs.FS) (*DiskUsage, error) {
+	total := &DiskUsage{Path: "."}
+	children := map[string]*DiskUsage{}
+
+	err := fs.WalkDir(fsys, ".", func(rel string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if rel == "." {
+				return err
+			}
+
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if rel == "." {
+			return nil
+		}
+
+		name := rel
+
+		if i := strings.IndexByte(rel, '/'); i >= 0 {
+			name = rel[:i]
+		}
+
+		child, ok := children[name]
+
+		if !ok {
+			child = &DiskUsage{Path: name}
+			children[name] = child
+			total.Children = append(total.Children, child)
+		}
+
+		switch {
+		case d.IsDir():
+			total.Dirs++
+			child.Dirs++
+		case d.Type().IsRegular():
+			info, err := d.Info()
+
+			if err != nil {
+				return nil
+			}
+
+			total.Files++
+			total.Size += info.Size()
+			child.Files++
+			child.Size += info.Size()
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(total.Children, func(i, j int) bool {
+		if total.Children[i].Size != total.Children[j].Size {
+			return total.Children[i].Size > total.Children[j].Size
+		}
+
+		return total.Children[i].Path < total.Children[j].Path
+	})
+
+	return total, nil
+}
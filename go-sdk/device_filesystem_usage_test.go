@@ -0,0 +1,111 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_usage() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	agent := newTestFilesystemAgent()
+	agent.register(objects.mux)
+
+	usage, err := objects.client.Device("whatever").Filesystem().Usage(context.Background(), "/does/not/exist/yet")
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), &agent.usage, usage)
+}
+
+func (t *Test_DeviceFilesystem) Test_usage_unsupported() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	agent := newTestFilesystemAgent()
+	delete(agent.handlers, "usage")
+	agent.register(objects.mux)
+
+	_, err := objects.client.Device("whatever").Filesystem().Usage(context.Background(), "/")
+
+	assert.IsType(t.T(), &ErrUnsupportedOperation{}, err)
+}
+
+func (t *Test_DeviceFilesystem) Test_disk_usage() {
+	for _, native := range []bool{true, false} {
+		objects := t.getTestObjects()
+
+		agent := newTestFilesystemAgent()
+
+		if !native {
+			delete(agent.handlers, "du")
+		}
+
+		agent.register(objects.mux)
+
+		dir := t.makeTree()
+		os.Mkdir(filepath.Join(dir, "empty"), 0755)
+
+		usage, err := objects.client.Device("whatever").Filesystem().DiskUsage(context.Background(), dir)
+
+		assert.Nil(t.T(), err)
+		assert.Equal(t.T(), &DiskUsage{
+			Path:  dir,
+			Size:  6,
+			Files: 3,
+			Dirs:  3,
+			Children: []*DiskUsage{
+				{Path: "sub", Size: 5, Files: 2, Dirs: 2},
+				{Path: "a.txt", Size: 1, Files: 1},
+				{Path: "empty", Dirs: 1},
+			},
+		}, usage)
+
+		os.RemoveAll(dir)
+		objects.server.Close()
+	}
+}
+
+func (t *Test_DeviceFilesystem) Test_upload_checks_space() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	agent := newTestFilesystemAgent()
+	agent.usage.Available = 1024
+	agent.register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-device-filesystem-usage")
+	defer os.RemoveAll(dir)
+
+	local := filepath.Join(dir, "image.bin")
+	remote := filepath.Join(dir, "remote.bin")
+
+	ioutil.WriteFile(local, make([]byte, 4096), 0644)
+
+	err := objects.client.Device("whatever").Filesystem().Upload(context.Background(), local, remote, TransferOptions{
+		CheckSpace: true,
+	})
+
+	var space *ErrInsufficientSpace
+
+	assert.True(t.T(), errors.As(err, &space))
+	assert.Equal(t.T(), int64(4096), space.Required)
+	assert.Equal(t.T(), int64(1024), space.Available)
+
+	_, err = os.Stat(remote + transferPartialSuffix)
+
+	assert.True(t.T(), os.IsNotExist(err))
+
+	agent.usage.Available = 4096
+
+	err = objects.client.Device("whatever").Filesystem().Upload(context.Background(), local, remote, TransferOptions{
+		CheckSpace: true,
+	})
+
+	assert.Nil(t.T(), err)
+}
@@ -0,0 +1,323 @@
+package sdk
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+const defaultWatchPollInterval = 2 * time.Second
+
+type WatchOp string
+
+const (
+	WatchCreate = WatchOp("create")
+	WatchModify = WatchOp("modify")
+	WatchDelete = WatchOp("delete")
+	WatchRename = WatchOp("rename")
+)
+
+// WatchEvent describes a change below a watched directory. Paths are slash
+// separated and relative to the directory, OldPath is only set for renames.
+type WatchEvent struct {
+	Op      WatchOp `json:"op"`
+	Path    string  `json:"path"`
+	OldPath string  `json:"oldPath,omitempty"`
+}
+
+// WatchOptions controls Watch. PollInterval only applies to agents that
+// cannot watch natively and are polled instead.
+type WatchOptions struct {
+	Recursive    bool
+	PollInterval time.Duration
+}
+
+// Watcher delivers the events of a Watch. Events is closed when the watch
+// ends, after which Err reports why it ended, or nil when it was closed.
+type Watcher interface {
+	Events() <-chan WatchEvent
+	Err() error
+	Close() error
+}
+
+// Watch streams changes below dir. Agents with a watch form use the native
+// notification mechanism of their platform, such as inotify on linux, other
+// agents are polled by comparing directory listings. Polling cannot tell a
+// rename from a delete and create unless size, mode and modification time of
+// the entry are unchanged.
+func (t *deviceFilesystem) Watch(ctx context.Context, dir string, opts WatchOptions) (Watcher, error) {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultWatchPollInterval
+	}
+
+	ok, err := t.supports(ctx, "watch")
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	watcher := &deviceWatcher{
+		cancel: cancel,
+		events: make(chan WatchEvent),
+		done:   make(chan struct{}),
+	}
+
+	emit := func(event WatchEvent) bool {
+		select {
+		case watcher.events <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	if !ok {
+		fsys := &deviceFS{ctx: ctx, fs: t, root: dir}
+		snapshot, err := watchSnapshot(fsys, opts.Recursive)
+
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+
+		go func() {
+			watcher.finish(pollWatch(ctx, fsys, snapshot, opts, emit))
+		}()
+
+		return watcher, nil
+	}
+
+	resp, err := t.device.submit(ctx, t.form("watch").
+		AddFieldAsString("path", dir).
+		AddFieldAsBool("recursive", opts.Recursive))
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go func() {
+		defer resp.Body.Close()
+
+		decoder := json.NewDecoder(resp.Body)
+
+		for {
+			var event WatchEvent
+
+			if err := decoder.Decode(&event); err == io.EOF {
+				break
+			} else if err != nil {
+				watcher.finish(stacktrace.Propagate(err, "failed decoding watch events of '%v'", dir))
+				return
+			}
+
+			if !emit(event) {
+				break
+			}
+		}
+
+		if trailerError := resp.Trailer.Get("Error"); trailerError != "" {
+			watcher.finish(stacktrace.NewError("failed watching '%v': %v", dir, trailerError))
+			return
+		}
+
+		watcher.finish(ctx.Err())
+	}()
+
+	return watcher, nil
+}
+
+type deviceWatcher struct {
+	cancel context.CancelFunc
+	events chan WatchEvent
+	done   chan struct{}
+	mu     sync.Mutex
+	err    error
+	closed bool
+}
+
+func (t *deviceWatcher) Events() <-chan WatchEvent {
+	return t.events
+}
+
+func (t *deviceWatcher) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.err
+}
+
+func (t *deviceWatcher) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+
+	t.cancel()
+	<-t.done
+
+	return nil
+}
+
+func (t *deviceWatcher) finish(err error) {
+	t.mu.Lock()
+
+	if !t.closed {
+		t.err = err
+	}
+
+	t.mu.Unlock()
+
+	close(t.events)
+	close(t.done)
+}
+
+type watchEntry struct {
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// watchSnapshot lists fsys, descending into subdirectories when recursive.
+func watchSnapshot(fsys fs.FS, recursive bool) (map[string]watchEntry, error) {
+	snapshot := map[string]watchEntry{}
+
+	err := fs.WalkDir(fsys, ".", func(rel string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if rel == "." {
+			return nil
+		}
+
+		info, err := d.Info()
+
+		if err != nil {
+			return err
+		}
+
+		snapshot[rel] = watchEntry{
+			size:    info.Size(),
+			mode:    info.Mode(),
+			modTime: info.ModTime(),
+		}
+
+		if d.IsDir() && !recursive {
+			return fs.SkipDir
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed listing watched directory")
+	}
+
+	return snapshot, nil
+}
+
+// pollWatch compares a fresh snapshot with the previous one every
+// PollInterval and emits the differences until ctx is done or emit refuses
+// an event.
+func pollWatch(ctx context.Context, fsys fs.FS, snapshot map[string]watchEntry, opts WatchOptions, emit func(WatchEvent) bool) error {
+	for {
+		select {
+		case <-time.After(opts.PollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		current, err := watchSnapshot(fsys, opts.Recursive)
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil {
+			return err
+		}
+
+		for _, event := range diffSnapshots(snapshot, current) {
+			if !emit(event) {
+				return ctx.Err()
+			}
+		}
+
+		snapshot = current
+	}
+}
+
+func diffSnapshots(previous, current map[string]watchEntry) []WatchEvent {
+	created := []string{}
+	deleted := []string{}
+	events := []WatchEvent{}
+
+	for rel, entry := range current {
+		old, ok := previous[rel]
+
+		switch {
+		case !ok:
+			created = append(created, rel)
+		case old.mode != entry.mode || old.size != entry.size || !old.modTime.Equal(entry.modTime):
+			if !entry.mode.IsDir() {
+				events = append(events, WatchEvent{Op: WatchModify, Path: rel})
+			}
+		}
+	}
+
+	for rel := range previous {
+		if _, ok := current[rel]; !ok {
+			deleted = append(deleted, rel)
+		}
+	}
+
+	sort.Strings(created)
+	sort.Strings(deleted)
+
+	renamed := map[string]bool{}
+
+	for _, oldrel := range deleted {
+		old := previous[oldrel]
+
+		for _, rel := range created {
+			entry := current[rel]
+
+			if renamed[rel] || entry.mode != old.mode || entry.size != old.size || !entry.modTime.Equal(old.modTime) {
+				continue
+			}
+
+			events = append(events, WatchEvent{Op: WatchRename, Path: rel, OldPath: oldrel})
+			renamed[rel] = true
+			renamed[oldrel] = true
+
+			break
+		}
+	}
+
+	for _, rel := range created {
+		if !renamed[rel] {
+			events = append(events, WatchEvent{Op: WatchCreate, Path: rel})
+		}
+	}
+
+	for _, rel := range deleted {
+		if !renamed[rel] {
+			events = append(events, WatchEvent{Op: WatchDelete, Path: rel})
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Path < events[j].Path
+	})
+
+	return events
+}
@@ -0,0 +1,77 @@
+package sdk
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_watch_events() {
+	for _, native := range []bool{true, false} {
+		objects := t.getTestObjects()
+
+		agent := newTestFilesystemAgent()
+
+		if !native {
+			delete(agent.handlers, "watch")
+		}
+
+		agent.register(objects.mux)
+
+		dir := t.makeTree()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+		watcher, err := objects.client.Device("whatever").Filesystem().Watch(ctx, dir, WatchOptions{
+			Recursive:    true,
+			PollInterval: 10 * time.Millisecond,
+		})
+
+		assert.Nil(t.T(), err)
+
+		ioutil.WriteFile(filepath.Join(dir, "new.txt"), []byte("new"), 0644)
+
+		assert.Equal(t.T(), WatchEvent{Op: WatchCreate, Path: "new.txt"}, t.nextEvent(watcher))
+
+		ioutil.WriteFile(filepath.Join(dir, "sub", "deeper", "c.txt"), []byte("changed"), 0644)
+
+		assert.Equal(t.T(), WatchEvent{Op: WatchModify, Path: "sub/deeper/c.txt"}, t.nextEvent(watcher))
+
+		os.Rename(filepath.Join(dir, "a.txt"), filepath.Join(dir, "renamed.txt"))
+
+		assert.Equal(t.T(), WatchEvent{Op: WatchRename, Path: "renamed.txt", OldPath: "a.txt"}, t.nextEvent(watcher))
+
+		os.Remove(filepath.Join(dir, "sub", "b.txt"))
+
+		assert.Equal(t.T(), WatchEvent{Op: WatchDelete, Path: "sub/b.txt"}, t.nextEvent(watcher))
+
+		assert.Nil(t.T(), watcher.Close())
+		assert.Nil(t.T(), watcher.Err())
+
+		_, open := <-watcher.Events()
+
+		assert.False(t.T(), open)
+
+		cancel()
+		os.RemoveAll(dir)
+		objects.server.Close()
+	}
+}
+
+func (t *Test_DeviceFilesystem) nextEvent(watcher Watcher) WatchEvent {
+	select {
+	case event, ok := <-watcher.Events():
+		if !ok {
+			t.T().Error("watch ended", watcher.Err())
+		}
+
+		return event
+
+	case <-time.After(5 * time.Second):
+		t.T().Error("timed out waiting for watch event")
+		return WatchEvent{}
+	}
+}
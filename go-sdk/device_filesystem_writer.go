@@ -0,0 +1,565 @@
+package sdk
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+var ErrWriterAborted = errors.New("writer aborted")
+
+// FileWriter streams data to a remote file. Close flushes the stream, waits
+// for the agent to commit the upload and returns its final result. Abort
+// cancels a partial upload and leaves the original target untouched, except
+// for appends and agents without a rename form, which write in place. Once
+// closed or aborted, further calls to Close and Abort return the result of
+// the first one and writes fail with ErrWriterAborted or io.ErrClosedPipe.
+// Committed returns the number of bytes the agent confirmed writing, or -1
+// when it cannot tell.
+type FileWriter interface {
+	io.WriteCloser
+	Abort() error
+	Committed() int64
+}
+
+// WriterOptions controls how the agent creates and opens the target of a
+// Writer. Zero values leave the agent defaults in place.
+//
+// Uploads that do not append are staged and renamed over the target when
+// the agent offers a rename form. Atomic requires this instead of falling
+// back to an in place write on older agents, and has agents whose write
+// form takes a sync field fsync the staged file before it is renamed so a
+// crash cannot expose a partial target. Durable, Backup and ExpectedHash
+// imply Atomic. Durable fails on agents that cannot fsync the staged file
+// and also has the agent fsync the parent directory after the rename.
+// Backup keeps the previous target under its path plus the given suffix.
+// ExpectedHash refuses the rename with ErrPreconditionFailed unless the
+// current target has the given hex encoded SHA-256, where a missing target
+// has the hash of empty content.
+type WriterOptions struct {
+	Append       bool
+	Mode         os.FileMode
+	Owner        *FileOwner
+	Atomic       bool
+	Durable      bool
+	Backup       string
+	ExpectedHash string
+
+	// positioned writes at offset and truncates the file after the data,
+	// for agents advertising an "offset" field on their write form
+	positioned bool
+	offset     int64
+
+	// verify checks the staged upload before it is renamed over the target,
+	// failing the write and leaving the target alone when it returns an
+	// error
+	verify func(ctx context.Context, staged string) error
+}
+
+func (t WriterOptions) atomic() bool {
+	return t.Atomic || t.Durable || t.Backup != "" || t.ExpectedHash != ""
+}
+
+// FileOwner identifies the owner of a remote file either numerically or by
+// name. Names take precedence over ids when both are set, and a part left
+// unset keeps its current value, so FileOwner{User: "alice"} does not touch
+// the group.
+type FileOwner struct {
+	UID   *int
+	GID   *int
+	User  string
+	Group string
+}
+
+// OwnerID returns a FileOwner for numeric ids, where an id of -1 leaves that
+// part of the ownership unchanged as with os.Chown.
+func OwnerID(uid, gid int) *FileOwner {
+	owner := &FileOwner{}
+
+	if uid >= 0 {
+		owner.UID = &uid
+	}
+
+	if gid >= 0 {
+		owner.GID = &gid
+	}
+
+	return owner
+}
+
+func (t *FileOwner) ids() (int, int) {
+	uid, gid := -1, -1
+
+	if t.UID != nil {
+		uid = *t.UID
+	}
+
+	if t.GID != nil {
+		gid = *t.GID
+	}
+
+	return uid, gid
+}
+
+// Writer uploads to a hidden staging file next to path and renames it over
+// the target on Close, so neither a failed nor an aborted upload truncates
+// the target. Appends, positioned writes and agents without a rename form
+// write to path in place.
+func (t *deviceFilesystem) Writer(ctx context.Context, path string, opts WriterOptions) FileWriter {
+	reqctx, cancel := context.WithCancel(ctx)
+	datar, dataw := io.Pipe()
+
+	writer := &deviceFilesystemWriter{
+		fs:       t,
+		ctx:      ctx,
+		cancel:   cancel,
+		path:     path,
+		opts:     opts,
+		datar:    datar,
+		dataw:    dataw,
+		done:     make(chan struct{}),
+		reported: -1,
+	}
+
+	go writer.upload(reqctx)
+
+	return writer
+}
+
+func (t *deviceFilesystem) WriteFile(ctx context.Context, path string, data []byte, opts WriterOptions) error {
+	writer := t.Writer(ctx, path, opts)
+
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return err
+	}
+
+	return writer.Close()
+}
+
+type deviceFilesystemWriter struct {
+	fs        *deviceFilesystem
+	ctx       context.Context
+	cancel    context.CancelFunc
+	path      string
+	staging   string
+	opts      WriterOptions
+	datar     *io.PipeReader
+	dataw     *io.PipeWriter
+	done      chan struct{}
+	reqerr    error
+	reported  int64
+	succeeded bool
+	written   int64
+	committed int64
+	mu        sync.Mutex
+	closed    bool
+	aborted   bool
+	closeerr  error
+	stats     streamStats
+}
+
+func (t *deviceFilesystemWriter) upload(ctx context.Context) {
+	defer close(t.done)
+
+	target := t.path
+
+	if t.opts.Append && t.opts.atomic() {
+		t.fail(stacktrace.NewError("atomic writes cannot append"))
+		return
+	}
+
+	if !t.opts.Append && !t.opts.positioned {
+		staging, err := t.stagingPath(ctx)
+
+		if err != nil {
+			t.fail(err)
+			return
+		}
+
+		t.staging = staging
+
+		if staging != "" {
+			target = staging
+		}
+	}
+
+	form := t.fs.form("write").
+		AddFieldAsString("path", target).
+		AddFieldAsBool("append", t.opts.Append)
+
+	if t.opts.positioned {
+		addInt64Field(form, "offset", t.opts.offset)
+	}
+
+	if t.staging != "" && t.opts.atomic() {
+		synced, err := t.fs.supportsField(ctx, "write", "sync")
+
+		if err != nil {
+			t.fail(err)
+			return
+		}
+
+		if !synced && t.opts.Durable {
+			t.fail(&ErrUnsupportedOperation{Operation: "durable write"})
+			return
+		}
+
+		if synced {
+			form.AddFieldAsBool("sync", true)
+		}
+	}
+
+	if t.opts.Mode != 0 {
+		form.AddFieldAsInt("mode", int(t.opts.Mode))
+	}
+
+	if t.opts.Owner != nil {
+		uid, gid := t.opts.Owner.ids()
+		addOwnerFields(form, uid, gid, t.opts.Owner.User, t.opts.Owner.Group)
+	}
+
+	encoding, err := t.fs.device.formEncoding(ctx, t.fs.resourcePath, "write")
+
+	if err != nil {
+		t.fail(err)
+		return
+	}
+
+	devicekey, err := t.fs.device.endToEndKey(ctx, t.fs.resourcePath, "write")
+
+	if err != nil {
+		t.fail(err)
+		return
+	}
+
+	var public, private *[32]byte
+
+	if devicekey != nil {
+		encoding = EncodingIdentity
+
+		if public, private, err = t.fs.device.streamKey(form, "write", target, "sender"); err != nil {
+			t.fail(err)
+			return
+		}
+	}
+
+	if encoding != EncodingIdentity {
+		form.AddFieldAsString("encoding", string(encoding))
+	}
+
+	data := encodeStream(t.datar, encoding, &t.stats, t.fs.device.meter(ctx, 0))
+	defer data.Close()
+
+	if devicekey != nil {
+		if data, err = newSealingReader(data, public, private, devicekey); err != nil {
+			t.fail(err)
+			return
+		}
+	}
+
+	resp, err := t.fs.device.submit(ctx, form.AddFieldAsOctetStream("data", data))
+
+	if err != nil {
+		t.fail(err)
+		return
+	}
+	defer resp.Body.Close()
+
+	// the write form reports the number of bytes committed, older agents
+	// respond with an empty body
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if committed, err := strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64); err == nil {
+		t.reported = committed
+	}
+
+	t.succeeded = true
+
+	t.datar.Close()
+}
+
+func (t *deviceFilesystemWriter) Stats() StreamStats {
+	return t.stats.Stats()
+}
+
+func (t *deviceFilesystemWriter) fail(err error) {
+	t.reqerr = err
+	t.datar.CloseWithError(err)
+}
+
+func (t *deviceFilesystemWriter) stagingPath(ctx context.Context) (string, error) {
+	ok, err := t.fs.supports(ctx, "rename")
+
+	if err != nil {
+		return "", err
+	}
+
+	if !ok && t.opts.atomic() {
+		return "", &ErrUnsupportedOperation{Operation: "atomic write"}
+	}
+
+	if !ok {
+		return "", nil
+	}
+
+	suffix := make([]byte, 8)
+
+	if _, err := rand.Read(suffix); err != nil {
+		return "", stacktrace.Propagate(err, "failed generating staging file name")
+	}
+
+	dir, base := splitRemotePath(t.path)
+
+	return dir + "." + base + ".deviceio-" + hex.EncodeToString(suffix), nil
+}
+
+// splitRemotePath splits a path on the last separator of either the unix or
+// the windows flavour since the agent platform is not known up front.
+func splitRemotePath(path string) (dir, file string) {
+	i := strings.LastIndexAny(path, `/\`)
+	return path[:i+1], path[i+1:]
+}
+
+func (t *deviceFilesystemWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	closed := t.closed
+	t.mu.Unlock()
+
+	if closed {
+		if t.aborted {
+			return 0, ErrWriterAborted
+		}
+
+		return 0, io.ErrClosedPipe
+	}
+
+	n, err := t.dataw.Write(p)
+
+	t.mu.Lock()
+	t.written += int64(n)
+	t.mu.Unlock()
+
+	return n, err
+}
+
+func (t *deviceFilesystemWriter) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return t.closeerr
+	}
+
+	t.closed = true
+	t.dataw.Close()
+	<-t.done
+	t.cancel()
+
+	if t.reqerr != nil {
+		// an in place write may have been partly applied
+		if t.staging == "" {
+			t.committed = t.reported
+		}
+
+		t.discardStaging()
+		t.closeerr = t.reqerr
+		return t.closeerr
+	}
+
+	if t.staging != "" {
+		if t.closeerr = t.commitStaging(); t.closeerr != nil {
+			return t.closeerr
+		}
+	}
+
+	t.committed = t.confirmed()
+
+	return nil
+}
+
+// confirmed returns the number of bytes the agent confirmed. Older agents
+// only confirm that the write succeeded, in which case the size of a
+// replaced target is what was written while appends cannot be told apart
+// from what was already there.
+func (t *deviceFilesystemWriter) confirmed() int64 {
+	if t.reported >= 0 || !t.succeeded {
+		return t.reported
+	}
+
+	if t.opts.Append {
+		return -1
+	}
+
+	info, err := t.fs.Stat(t.ctx, t.path)
+
+	if err != nil {
+		return -1
+	}
+
+	return info.Size()
+}
+
+func (t *deviceFilesystemWriter) commitStaging() error {
+	if t.opts.verify != nil {
+		if err := t.opts.verify(t.ctx, t.staging); err != nil {
+			t.discardStaging()
+			return err
+		}
+	}
+
+	if info, err := t.fs.Stat(t.ctx, t.path); err == nil {
+		if t.opts.Mode == 0 {
+			if err := t.fs.Chmod(t.ctx, t.staging, info.Mode().Perm()); err != nil {
+				t.discardStaging()
+				return err
+			}
+		}
+
+		// an agent that cannot hand the file to its owner fails the write
+		// rather than silently taking the file over
+		if stat, ok := info.Sys().(*FileStat); ok && stat != nil && t.opts.Owner == nil {
+			if err := t.fs.Chown(t.ctx, t.staging, stat.UID, stat.GID); err != nil {
+				t.discardStaging()
+				return stacktrace.Propagate(err, "failed preserving ownership of '%v'", t.path)
+			}
+		}
+	}
+
+	form := t.fs.form("rename").
+		AddFieldAsString("path", t.staging).
+		AddFieldAsString("newpath", t.path)
+
+	if t.opts.Backup != "" {
+		form.AddFieldAsString("backup", t.path+t.opts.Backup)
+	}
+
+	if t.opts.ExpectedHash != "" {
+		form.AddFieldAsString("expect", string(HashSHA256)+":"+t.opts.ExpectedHash)
+	}
+
+	if t.opts.Durable {
+		form.AddFieldAsBool("sync", true)
+	}
+
+	if err := t.fs.submitAndClose(t.ctx, form); err != nil {
+		t.discardStaging()
+
+		if apierr, ok := err.(*ErrInvalidAPIResponse); ok && apierr.StatusCode == http.StatusPreconditionFailed {
+			return &ErrPreconditionFailed{
+				Path:         t.path,
+				ExpectedHash: t.opts.ExpectedHash,
+				Message:      apierr.Message,
+			}
+		}
+
+		return err
+	}
+
+	t.removeStaleStaging()
+
+	return nil
+}
+
+// staleStagingAge is how old a staging file has to be before it is taken as
+// left behind by a client that went away mid upload.
+const staleStagingAge = time.Hour
+
+var stagingName = regexp.MustCompile(`^\..+\.deviceio-[0-9a-f]{16}$`)
+
+// removeStaleStaging removes staging files left behind by crashed clients in
+// the directory of the target, the first time the client writes to it. It is
+// best effort since the write itself succeeded.
+func (t *deviceFilesystemWriter) removeStaleStaging() {
+	dir, _ := splitRemotePath(t.path)
+
+	if !t.fs.device.client.sweep(t.fs.device.id, dir) {
+		return
+	}
+
+	listdir := dir
+
+	if listdir == "" {
+		listdir = "."
+	}
+
+	infos, err := t.fs.ReadDir(t.ctx, listdir)
+
+	if err != nil {
+		return
+	}
+
+	for _, info := range infos {
+		if stagingName.MatchString(info.Name()) && time.Since(info.ModTime()) > staleStagingAge {
+			t.fs.Remove(t.ctx, dir+info.Name())
+		}
+	}
+}
+
+func (t *deviceFilesystemWriter) discardStaging() {
+	if t.staging == "" {
+		return
+	}
+
+	ctx := t.ctx
+
+	if ctx.Err() != nil {
+		ctx = context.Background()
+	}
+
+	t.fs.Remove(ctx, t.staging)
+}
+
+func (t *deviceFilesystemWriter) Abort() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return t.closeerr
+	}
+
+	t.closed = true
+	t.aborted = true
+	t.cancel()
+	t.dataw.CloseWithError(ErrWriterAborted)
+	<-t.done
+
+	t.committed = 0
+
+	if t.staging != "" {
+		ctx := t.ctx
+
+		if ctx.Err() != nil {
+			ctx = context.Background()
+		}
+
+		if err := t.fs.Remove(ctx, t.staging); err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.closeerr = stacktrace.Propagate(err, "failed removing staged upload '%v'", t.staging)
+		}
+	}
+
+	return t.closeerr
+}
+
+func (t *deviceFilesystemWriter) Committed() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.closed {
+		return 0
+	}
+
+	return t.committed
+}
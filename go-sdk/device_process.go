@@ -134,10 +134,26 @@ func (t *deviceProcessInstance) Stdin(ctx context.Context) io.WriteCloser {
 	}
 
 	go func() {
-		resp, err := t.device.client.hmclient.
+		encoding, err := t.device.formEncoding(ctx, t.resourcePath, "stdin")
+
+		if err != nil {
+			writer.reqerr <- err
+			return
+		}
+
+		form := t.device.client.hmclient.
 			Resource(t.resourcePath).
-			Form("stdin").
-			AddFieldAsOctetStream("data", datar).
+			Form("stdin")
+
+		if encoding != EncodingIdentity {
+			form.AddFieldAsString("encoding", string(encoding))
+		}
+
+		data := encodeStream(datar, encoding, &writer.stats, t.device.meter(ctx, 0))
+		defer data.Close()
+
+		resp, err := form.
+			AddFieldAsOctetStream("data", data).
 			Submit(ctx)
 
 		if err != nil {
@@ -154,29 +170,30 @@ func (t *deviceProcessInstance) Stdin(ctx context.Context) io.WriteCloser {
 }
 
 func (t *deviceProcessInstance) Stdout(ctx context.Context) io.Reader {
-	resp, err := t.device.client.hmclient.
-		Resource(t.resourcePath).
-		Link("stdout").
-		Get(ctx)
+	return t.output(ctx, "stdout")
+}
 
-	reader := &deviceProcessOutputReader{
-		ctx:     ctx,
-		resp:    resp,
-		resperr: err,
-	}
+func (t *deviceProcessInstance) Stderr(ctx context.Context) io.Reader {
+	return t.output(ctx, "stderr")
+}
 
-	if resp != nil && resp.StatusCode >= 300 {
-		data, _ := ioutil.ReadAll(resp.Body)
-		reader.resperrbody = string(data)
+func (t *deviceProcessInstance) output(ctx context.Context, name string) io.Reader {
+	encoding, href, err := t.device.linkEncoding(ctx, t.resourcePath, name)
+
+	if err != nil {
+		return &deviceProcessOutputReader{
+			ctx:     ctx,
+			resperr: err,
+		}
 	}
 
-	return reader
-}
+	if t.device.client.linkAuth != nil && href != "" {
+		defer t.device.client.linkAuth.accept(href, encoding)()
+	}
 
-func (t *deviceProcessInstance) Stderr(ctx context.Context) io.Reader {
 	resp, err := t.device.client.hmclient.
 		Resource(t.resourcePath).
-		Link("stderr").
+		Link(name).
 		Get(ctx)
 
 	reader := &deviceProcessOutputReader{
@@ -185,6 +202,16 @@ func (t *deviceProcessInstance) Stderr(ctx context.Context) io.Reader {
 		resperr: err,
 	}
 
+	if resp != nil {
+		encoding, err := responseEncoding(resp.Response)
+
+		if err != nil && reader.resperr == nil {
+			reader.resperr = err
+		}
+
+		reader.body = decodeStream(resp.Body, encoding, &reader.stats, t.device.meter(ctx, 0))
+	}
+
 	if resp != nil && resp.StatusCode >= 300 {
 		data, _ := ioutil.ReadAll(resp.Body)
 		reader.resperrbody = string(data)
@@ -198,6 +225,7 @@ type deviceProcessStdinWriter struct {
 	ctx    context.Context
 	datar  *io.PipeReader
 	dataw  *io.PipeWriter
+	stats  streamStats
 }
 
 func (t *deviceProcessStdinWriter) Write(p []byte) (n int, err error) {
@@ -215,11 +243,17 @@ func (t *deviceProcessStdinWriter) Close() error {
 	return t.datar.Close()
 }
 
+func (t *deviceProcessStdinWriter) Stats() StreamStats {
+	return t.stats.Stats()
+}
+
 type deviceProcessOutputReader struct {
 	ctx         context.Context
 	resp        *hmapi.LinkResponse
 	resperr     error
 	resperrbody string
+	body        io.Reader
+	stats       streamStats
 }
 
 func (t *deviceProcessOutputReader) Read(p []byte) (n int, err error) {
@@ -230,7 +264,7 @@ func (t *deviceProcessOutputReader) Read(p []byte) (n int, err error) {
 	}
 
 	if t.resperr != nil {
-		return 0, err
+		return 0, t.resperr
 	}
 
 	if t.resp != nil && t.resp.StatusCode >= 300 {
@@ -246,7 +280,11 @@ func (t *deviceProcessOutputReader) Read(p []byte) (n int, err error) {
 		return 0, errors.New(trailerError)
 	}
 
-	n, err = t.resp.Body.Read(p)
+	n, err = t.body.Read(p)
 
 	return n, err
 }
+
+func (t *deviceProcessOutputReader) Stats() StreamStats {
+	return t.stats.Stats()
+}
@@ -0,0 +1,290 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/palantir/stacktrace"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// maxTextDiffSize is the largest file shown as a unified diff, larger files
+// are summarized like binary ones.
+const maxTextDiffSize = 1 << 20
+
+type DiffOp string
+
+const (
+	DiffAdd    = DiffOp("add")
+	DiffRemove = DiffOp("remove")
+	DiffModify = DiffOp("modify")
+)
+
+// FileDiff describes how a file differs between two trees. Diff is a unified
+// diff for text files and empty for binary files, large files and changes
+// of the mode only, which are described by the sizes, hashes and modes.
+type FileDiff struct {
+	Op      DiffOp
+	Path    string
+	Binary  bool
+	Diff    string
+	OldSize int64
+	NewSize int64
+	OldHash string
+	NewHash string
+	OldMode os.FileMode
+	NewMode os.FileMode
+}
+
+func (t *FileDiff) String() string {
+	if t.Diff != "" {
+		return t.Diff
+	}
+
+	switch {
+	case t.Op == DiffAdd:
+		return fmt.Sprintf("Only in b: %v (%v bytes, %v)\n", t.Path, t.NewSize, t.NewHash)
+	case t.Op == DiffRemove:
+		return fmt.Sprintf("Only in a: %v (%v bytes, %v)\n", t.Path, t.OldSize, t.OldHash)
+	case t.OldHash == t.NewHash:
+		return fmt.Sprintf("Mode of %v changed from %v to %v\n", t.Path, t.OldMode, t.NewMode)
+	default:
+		return fmt.Sprintf("Files a/%v and b/%v differ (%v bytes, %v -> %v bytes, %v)\n", t.Path, t.Path, t.OldSize, t.OldHash, t.NewSize, t.NewHash)
+	}
+}
+
+// TreeDiff lists the files that differ between two trees, sorted by path.
+type TreeDiff struct {
+	Files []*FileDiff
+}
+
+func (t *TreeDiff) Empty() bool {
+	return len(t.Files) == 0
+}
+
+// String renders the whole diff the way diff -ruN would, with summaries in
+// place of binary files.
+func (t *TreeDiff) String() string {
+	buf := &strings.Builder{}
+
+	for _, file := range t.Files {
+		buf.WriteString(file.String())
+	}
+
+	return buf.String()
+}
+
+// Diff shows what syncing localDir to remoteDir on device would change, the
+// remote tree being the old side of the diff and the local tree the new one.
+func Diff(ctx context.Context, device Device, remoteDir, localDir string) (*TreeDiff, error) {
+	return DiffTrees(ctx, Remote(device, remoteDir), Local(localDir))
+}
+
+// DiffDevices compares the tree at path on device a, usually a known good
+// one, with the tree at the same path on device b.
+func DiffDevices(ctx context.Context, a, b Device, path string) (*TreeDiff, error) {
+	return DiffTrees(ctx, Remote(a, path), Remote(b, path))
+}
+
+// DiffTrees compares the files of the trees at a and b. A missing tree is
+// treated as empty, directories are only compared through their content.
+func DiffTrees(ctx context.Context, a, b SyncEndpoint) (*TreeDiff, error) {
+	atree := newSyncTree(a)
+	btree := newSyncTree(b)
+
+	amanifest, err := diffManifest(ctx, atree)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bmanifest, err := diffManifest(ctx, btree)
+
+	if err != nil {
+		return nil, err
+	}
+
+	compared := amanifest.Compare(bmanifest)
+	diff := &TreeDiff{Files: []*FileDiff{}}
+
+	for _, paths := range []struct {
+		op    DiffOp
+		paths []string
+	}{
+		{DiffAdd, compared.Added},
+		{DiffRemove, compared.Removed},
+		{DiffModify, compared.Modified},
+	} {
+		for _, path := range paths.paths {
+			file := &FileDiff{Op: paths.op, Path: path}
+
+			if entry, ok := amanifest[path]; ok {
+				file.OldSize, file.OldHash, file.OldMode = entry.Size, entry.Hash, entry.Mode
+			}
+
+			if entry, ok := bmanifest[path]; ok {
+				file.NewSize, file.NewHash, file.NewMode = entry.Size, entry.Hash, entry.Mode
+			}
+
+			// directories only show up through the files they contain
+			if (file.OldMode.IsDir() || paths.op == DiffAdd) && (file.NewMode.IsDir() || paths.op == DiffRemove) {
+				continue
+			}
+
+			if err := file.render(ctx, atree, btree); err != nil {
+				return nil, err
+			}
+
+			diff.Files = append(diff.Files, file)
+		}
+	}
+
+	sort.Slice(diff.Files, func(i, j int) bool {
+		return diff.Files[i].Path < diff.Files[j].Path
+	})
+
+	return diff, nil
+}
+
+func diffManifest(ctx context.Context, tree syncTree) (Manifest, error) {
+	manifest, err := tree.manifest(ctx, HashSHA256)
+
+	if err == nil {
+		return manifest, nil
+	}
+
+	// agents do not agree on how they report a missing root
+	if _, staterr := tree.stat(ctx, "."); errors.Is(err, os.ErrNotExist) || errors.Is(staterr, os.ErrNotExist) {
+		return Manifest{}, nil
+	}
+
+	return nil, err
+}
+
+// render fills in the unified diff of text files.
+func (t *FileDiff) render(ctx context.Context, a, b syncTree) error {
+	if t.Op == DiffModify && t.OldHash == t.NewHash {
+		return nil
+	}
+
+	before, beforetext, err := readDiffSide(ctx, a, t.Path, t.OldMode, t.OldSize, t.Op != DiffAdd)
+
+	if err != nil {
+		return err
+	}
+
+	after, aftertext, err := readDiffSide(ctx, b, t.Path, t.NewMode, t.NewSize, t.Op != DiffRemove)
+
+	if err != nil {
+		return err
+	}
+
+	if !beforetext || !aftertext {
+		t.Binary = true
+		return nil
+	}
+
+	from, to := "a/"+t.Path, "b/"+t.Path
+
+	switch t.Op {
+	case DiffAdd:
+		from = "/dev/null"
+	case DiffRemove:
+		to = "/dev/null"
+	}
+
+	t.Diff, err = unifiedDiff(string(before), string(after), from, to)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed diffing '%v'", t.Path)
+	}
+
+	return nil
+}
+
+// readDiffSide reads one side of a file diff and reports whether it is text.
+// A side that does not exist is empty text.
+func readDiffSide(ctx context.Context, tree syncTree, path string, mode os.FileMode, size int64, exists bool) ([]byte, bool, error) {
+	if !exists {
+		return nil, true, nil
+	}
+
+	if !mode.IsRegular() || size > maxTextDiffSize {
+		return nil, false, nil
+	}
+
+	r, err := tree.open(ctx, path)
+
+	if err != nil {
+		return nil, false, err
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxTextDiffSize+1))
+
+	if err != nil {
+		return nil, false, stacktrace.Propagate(err, "failed reading '%v'", path)
+	}
+
+	return data, isText(data), nil
+}
+
+// unifiedDiff renders the changes from a to b with 3 lines of context. A
+// last line without a newline is terminated and followed by the
+// "\ No newline at end of file" marker of diff, so it still differs from the
+// same line with a newline and the diff applies with patch.
+func unifiedDiff(a, b, from, to string) (string, error) {
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        markMissingNewline(splitDiffLines(a)),
+		B:        markMissingNewline(splitDiffLines(b)),
+		FromFile: from,
+		ToFile:   to,
+		Context:  3,
+	})
+}
+
+func markMissingNewline(lines []string) []string {
+	if len(lines) == 0 || strings.HasSuffix(lines[len(lines)-1], "\n") {
+		return lines
+	}
+
+	lines[len(lines)-1] += "\n\\ No newline at end of file\n"
+
+	return lines
+}
+
+// splitDiffLines splits s after each line ending. Unlike difflib.SplitLines
+// it does not add an empty last line to content ending with a newline.
+func splitDiffLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+// isText reports whether data is valid utf8 without NUL bytes in its first
+// 8000 bytes, close to the heuristic git uses.
+func isText(data []byte) bool {
+	if len(data) > maxTextDiffSize {
+		return false
+	}
+
+	head := data
+
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+
+	return bytes.IndexByte(head, 0) < 0 && utf8.Valid(data)
+}
@@ -0,0 +1,134 @@
+package sdk
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_diff_trees() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-diff")
+	defer os.RemoveAll(dir)
+
+	remote := filepath.Join(dir, "remote")
+	local := filepath.Join(dir, "local")
+
+	for _, root := range []string{remote, local} {
+		os.MkdirAll(filepath.Join(root, "conf"), 0755)
+		ioutil.WriteFile(filepath.Join(root, "conf", "same.conf"), []byte("same\n"), 0644)
+	}
+
+	ioutil.WriteFile(filepath.Join(remote, "conf", "app.conf"), []byte("listen 80\nworkers 2\n"), 0644)
+	ioutil.WriteFile(filepath.Join(local, "conf", "app.conf"), []byte("listen 80\nworkers 8\n"), 0644)
+	ioutil.WriteFile(filepath.Join(remote, "firmware.bin"), []byte{0, 1, 2}, 0644)
+	ioutil.WriteFile(filepath.Join(local, "firmware.bin"), []byte{0, 1, 3, 4}, 0644)
+	ioutil.WriteFile(filepath.Join(remote, "obsolete.txt"), []byte("old\n"), 0644)
+	ioutil.WriteFile(filepath.Join(remote, "run.sh"), []byte("#!/bin/sh\n"), 0644)
+	ioutil.WriteFile(filepath.Join(local, "run.sh"), []byte("#!/bin/sh\n"), 0755)
+	os.MkdirAll(filepath.Join(local, "extra", "nested"), 0755)
+	ioutil.WriteFile(filepath.Join(local, "extra", "nested", "new.txt"), []byte("new\n"), 0644)
+
+	device := objects.client.Device("whatever")
+
+	diff, err := Diff(context.Background(), device, remote, local)
+
+	assert.Nil(t.T(), err)
+
+	paths := []string{}
+
+	for _, file := range diff.Files {
+		paths = append(paths, string(file.Op)+" "+file.Path)
+	}
+
+	assert.Equal(t.T(), []string{
+		"modify conf/app.conf",
+		"add extra/nested/new.txt",
+		"modify firmware.bin",
+		"remove obsolete.txt",
+		"modify run.sh",
+	}, paths)
+
+	assert.Equal(t.T(), strings.Join([]string{
+		"--- a/conf/app.conf",
+		"+++ b/conf/app.conf",
+		"@@ -1,2 +1,2 @@",
+		" listen 80",
+		"-workers 2",
+		"+workers 8",
+		"",
+	}, "\n"), diff.Files[0].Diff)
+
+	assert.Contains(t.T(), diff.Files[1].Diff, "+new\n")
+	assert.True(t.T(), diff.Files[2].Binary)
+	assert.Equal(t.T(), int64(3), diff.Files[2].OldSize)
+	assert.Equal(t.T(), int64(4), diff.Files[2].NewSize)
+	assert.Contains(t.T(), diff.Files[3].Diff, "+++ /dev/null")
+	assert.Equal(t.T(), "", diff.Files[4].Diff)
+	assert.Equal(t.T(), os.FileMode(0755), diff.Files[4].NewMode)
+
+	rendered := diff.String()
+
+	assert.Contains(t.T(), rendered, "Files a/firmware.bin and b/firmware.bin differ")
+	assert.Contains(t.T(), rendered, "Mode of run.sh changed from -rw-r--r-- to -rwxr-xr-x")
+
+	diff, err = DiffTrees(context.Background(), Remote(device, remote), Remote(objects.client.Device("other"), filepath.Join(dir, "missing")))
+
+	assert.Nil(t.T(), err)
+	assert.Len(t.T(), diff.Files, 5)
+
+	for _, file := range diff.Files {
+		assert.Equal(t.T(), DiffRemove, file.Op)
+	}
+
+	diff, err = DiffDevices(context.Background(), device, objects.client.Device("other"), remote)
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), diff.Empty())
+}
+
+func (t *Test_DeviceFilesystem) Test_diff_without_final_newline() {
+	dir, _ := ioutil.TempDir("", "go-sdk-diff")
+	defer os.RemoveAll(dir)
+
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+
+	os.MkdirAll(a, 0755)
+	os.MkdirAll(b, 0755)
+
+	ioutil.WriteFile(filepath.Join(a, "app.conf"), []byte("a\nx"), 0644)
+	ioutil.WriteFile(filepath.Join(b, "app.conf"), []byte("a\ny"), 0644)
+	ioutil.WriteFile(filepath.Join(a, "eol.conf"), []byte("a\nx"), 0644)
+	ioutil.WriteFile(filepath.Join(b, "eol.conf"), []byte("a\ny\n"), 0644)
+
+	diff, err := DiffTrees(context.Background(), Local(a), Local(b))
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), strings.Join([]string{
+		"--- a/app.conf",
+		"+++ b/app.conf",
+		"@@ -1,2 +1,2 @@",
+		" a",
+		"-x",
+		`\ No newline at end of file`,
+		"+y",
+		`\ No newline at end of file`,
+		"--- a/eol.conf",
+		"+++ b/eol.conf",
+		"@@ -1,2 +1,2 @@",
+		" a",
+		"-x",
+		`\ No newline at end of file`,
+		"+y",
+		"",
+	}, "\n"), diff.String())
+}
@@ -0,0 +1,385 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deviceio/hmapi"
+	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// EncryptionNaClBox is the end-to-end encryption agents advertise through
+// the Encoding of the "encryption" field of their read and write forms.
+//
+// A stream starts with a header made of e2eMagic, the public key of the
+// sender and a random nonce prefix, followed by chunks of at most
+// e2eChunkSize bytes each sealed with nacl/box and prefixed with their sealed
+// length as a big endian uint32. The nonce of a chunk is the prefix followed
+// by the big endian index of the chunk, with the top bit set for the last
+// chunk so a truncated stream is detected. Writes are sealed with a key pair
+// generated for the stream to the key of the device, whose public key is
+// sent in the "sender" field, reads are sealed by the device to a key pair
+// generated for the stream whose public key is sent in the "recipient"
+// field. Either key is signed with the ed25519 key of the client in the
+// "signature" field together with the form, the path and the unix time in
+// the "timestamp" field, see streamKeyMessage. An agent that knows the public
+// key of the client rejects keys the hub substituted, and by refusing
+// timestamps further than e2eKeyMaxAge from its clock and keys it has seen
+// before also writes the hub replays, to the same path or another one.
+const EncryptionNaClBox = "nacl-box"
+
+const (
+	e2eChunkSize  = 64 << 10
+	e2eHeaderSize = 4 + 32 + 16
+	e2eKeyMaxAge  = 5 * time.Minute
+)
+
+var e2eMagic = []byte("DIE1")
+
+// e2eKeyContext prefixes the stream keys the client signs so their
+// signatures cannot pass for the request signatures of ClientAuth made with
+// the same key.
+var e2eKeyContext = []byte("deviceio-e2e-stream-key\n")
+
+// PublicKey returns the end-to-end encryption key the device presents,
+// pinning it when the device is seen for the first time.
+func (t *device) PublicKey(ctx context.Context) ([]byte, error) {
+	resource, err := t.client.hmclient.
+		Resource(fmt.Sprintf("/device/%v", t.id)).
+		Get(ctx)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed retrieving device resource")
+	}
+
+	encoded := contentString(resource, "publicKey")
+
+	if encoded == "" {
+		return nil, &ErrUnsupportedOperation{Operation: "end-to-end encryption"}
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+
+	if err != nil || len(key) != 32 {
+		return nil, stacktrace.NewError("device '%v' presented an invalid key '%v'", t.id, encoded)
+	}
+
+	pinned, ok, err := t.client.keys.PinnedKey(t.id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ok && !bytes.Equal(pinned, key) {
+		return nil, &ErrKeyMismatch{
+			DeviceID:  t.id,
+			Pinned:    base64.StdEncoding.EncodeToString(pinned),
+			Presented: encoded,
+		}
+	}
+
+	if !ok {
+		if err := t.client.keys.PinKey(t.id, key); err != nil {
+			return nil, err
+		}
+	}
+
+	return key, nil
+}
+
+// endToEndKey returns the key to seal streams of the named form to, or nil
+// when the client does not encrypt end-to-end. A pinned key is used without
+// asking the device, so a key substituted later cannot take effect.
+func (t *device) endToEndKey(ctx context.Context, resourcePath, name string) (*[32]byte, error) {
+	if !t.client.endToEnd {
+		return nil, nil
+	}
+
+	if len(t.client.signingKey) != ed25519.PrivateKeySize {
+		return nil, stacktrace.NewError("end-to-end encryption needs the ClientConfig.PrivateKey to sign stream keys")
+	}
+
+	resource, err := t.resource(ctx, resourcePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	supported, signed := false, false
+
+	if form, ok := resource.Forms[name]; ok {
+		for _, field := range form.Fields {
+			signed = signed || field.Name == "signature"
+
+			if field.Name != "encryption" {
+				continue
+			}
+
+			for _, offered := range strings.Split(field.Encoding.String(), ",") {
+				supported = supported || strings.TrimSpace(offered) == EncryptionNaClBox
+			}
+		}
+	}
+
+	// an agent that does not check the signature of stream keys would seal
+	// reads to whatever key the hub puts in their place
+	if !supported || !signed {
+		return nil, &ErrUnsupportedOperation{Operation: "end-to-end encryption of " + name}
+	}
+
+	key, ok, err := t.client.keys.PinnedKey(t.id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		if key, err = t.PublicKey(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	recipient := &[32]byte{}
+	copy(recipient[:], key)
+
+	return recipient, nil
+}
+
+// streamKey generates the key pair of an end-to-end encrypted stream of the
+// named form on path and adds its public key to form as the given field,
+// followed by the time and the signature binding them together.
+func (t *device) streamKey(form hmapi.FormRequest, name, path, field string) (*[32]byte, *[32]byte, error) {
+	public, private, err := box.GenerateKey(rand.Reader)
+
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "failed generating stream key")
+	}
+
+	timestamp := time.Now().Unix()
+	signature := ed25519.Sign(t.client.signingKey, streamKeyMessage(name, path, timestamp, public[:]))
+
+	form.AddFieldAsString("encryption", EncryptionNaClBox).
+		AddFieldAsString(field, base64.StdEncoding.EncodeToString(public[:])).
+		AddFieldAsString("timestamp", strconv.FormatInt(timestamp, 10)).
+		AddFieldAsString("signature", base64.StdEncoding.EncodeToString(signature))
+
+	return public, private, nil
+}
+
+// streamKeyMessage returns what the client signs for a stream key: the form
+// and the path it is used with, the time it was signed at and the key,
+// separated by NUL bytes which paths cannot contain.
+func streamKeyMessage(name, path string, timestamp int64, key []byte) []byte {
+	message := append([]byte{}, e2eKeyContext...)
+	message = append(message, name+"\x00"+path+"\x00"+strconv.FormatInt(timestamp, 10)+"\x00"...)
+
+	return append(message, key...)
+}
+
+// newSealingReader returns a reader producing r sealed by sender to
+// recipient in the framing described at EncryptionNaClBox.
+func newSealingReader(r io.Reader, public, private, recipient *[32]byte) (io.ReadCloser, error) {
+	sealer := &sealingReader{
+		r:     r,
+		plain: make([]byte, e2eChunkSize),
+	}
+
+	header := append(append([]byte{}, e2eMagic...), public[:]...)
+	header = append(header, make([]byte, 16)...)
+
+	if _, err := io.ReadFull(rand.Reader, header[len(header)-16:]); err != nil {
+		return nil, stacktrace.Propagate(err, "failed generating nonce")
+	}
+
+	copy(sealer.prefix[:], header[len(header)-16:])
+	box.Precompute(&sealer.shared, recipient, private)
+	sealer.pending = header
+
+	return sealer, nil
+}
+
+type sealingReader struct {
+	r       io.Reader
+	shared  [32]byte
+	prefix  [16]byte
+	counter uint64
+	plain   []byte
+	pending []byte
+	done    bool
+}
+
+func (t *sealingReader) Read(p []byte) (int, error) {
+	for len(t.pending) == 0 {
+		if t.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(t.r, t.plain)
+
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			t.done = true
+		default:
+			return 0, err
+		}
+
+		nonce := e2eNonce(t.prefix, t.counter, t.done)
+		t.counter++
+
+		frame := make([]byte, 4, 4+n+box.Overhead)
+		binary.BigEndian.PutUint32(frame, uint32(n+box.Overhead))
+
+		t.pending = box.SealAfterPrecomputation(frame, t.plain[:n], &nonce, &t.shared)
+	}
+
+	n := copy(p, t.pending)
+	t.pending = t.pending[n:]
+
+	return n, nil
+}
+
+func (t *sealingReader) Close() error {
+	if closer, ok := t.r.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// openStream returns a reader opening a stream sealed to the key pair whose
+// private key is given. A stream sealed by another sender than sender, when
+// one is given, fails.
+func openStream(r io.Reader, private, sender *[32]byte) io.Reader {
+	return &openingReader{
+		r:       r,
+		private: private,
+		sender:  sender,
+	}
+}
+
+type openingReader struct {
+	r       io.Reader
+	private *[32]byte
+	sender  *[32]byte
+	shared  [32]byte
+	prefix  [16]byte
+	counter uint64
+	started bool
+	done    bool
+	pending []byte
+	err     error
+}
+
+func (t *openingReader) Read(p []byte) (int, error) {
+	for len(t.pending) == 0 && t.err == nil {
+		t.err = t.next()
+	}
+
+	if len(t.pending) == 0 {
+		return 0, t.err
+	}
+
+	n := copy(p, t.pending)
+	t.pending = t.pending[n:]
+
+	return n, nil
+}
+
+func (t *openingReader) next() error {
+	if t.done {
+		if n, _ := t.r.Read(make([]byte, 1)); n > 0 {
+			return stacktrace.NewError("encrypted stream continues after its last chunk")
+		}
+
+		return io.EOF
+	}
+
+	if !t.started {
+		header := make([]byte, e2eHeaderSize)
+
+		if _, err := io.ReadFull(t.r, header); err != nil {
+			return t.truncated(err)
+		}
+
+		if !bytes.Equal(header[:4], e2eMagic) {
+			return stacktrace.NewError("stream is not end-to-end encrypted")
+		}
+
+		sender := &[32]byte{}
+		copy(sender[:], header[4:36])
+		copy(t.prefix[:], header[36:])
+
+		if t.sender != nil && *sender != *t.sender {
+			return stacktrace.NewError("stream was sealed by an unexpected key")
+		}
+
+		box.Precompute(&t.shared, sender, t.private)
+		t.started = true
+
+		return nil
+	}
+
+	length := make([]byte, 4)
+
+	if _, err := io.ReadFull(t.r, length); err != nil {
+		return t.truncated(err)
+	}
+
+	size := binary.BigEndian.Uint32(length)
+
+	if size < box.Overhead || size > e2eChunkSize+box.Overhead {
+		return stacktrace.NewError("invalid chunk size %v in encrypted stream", size)
+	}
+
+	sealed := make([]byte, size)
+
+	if _, err := io.ReadFull(t.r, sealed); err != nil {
+		return t.truncated(err)
+	}
+
+	for _, last := range []bool{false, true} {
+		nonce := e2eNonce(t.prefix, t.counter, last)
+
+		if plain, ok := box.OpenAfterPrecomputation(nil, sealed, &nonce, &t.shared); ok {
+			t.pending = plain
+			t.done = last
+			t.counter++
+
+			return nil
+		}
+	}
+
+	return stacktrace.NewError("failed authenticating chunk %v of encrypted stream", t.counter)
+}
+
+func (t *openingReader) truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return stacktrace.NewError("encrypted stream ended before its last chunk")
+	}
+
+	return err
+}
+
+func e2eNonce(prefix [16]byte, counter uint64, last bool) [24]byte {
+	nonce := [24]byte{}
+	copy(nonce[:], prefix[:])
+
+	if last {
+		counter |= 1 << 63
+	}
+
+	binary.BigEndian.PutUint64(nonce[16:], counter)
+
+	return nonce
+}
@@ -0,0 +1,437 @@
+package sdk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func (t *Test_DeviceFilesystem) Test_end_to_end_encryption() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	objects.client.(*client).endToEnd = true
+
+	agent := newTestFilesystemAgent().withEndToEnd()
+	write := agent.handlers["write"]
+	wire := ""
+
+	agent.handlers["write"] = func(rw http.ResponseWriter, r *http.Request) {
+		wire = r.FormValue("data")
+		write(rw, r)
+	}
+
+	agent.register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-e2e")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "token")
+	secret := strings.Repeat("api-token-", 20000)
+
+	fs := objects.client.Device("whatever").Filesystem()
+
+	assert.Nil(t.T(), fs.WriteFile(context.Background(), path, []byte(secret), WriterOptions{}))
+	assert.NotContains(t.T(), wire, "api-token-")
+
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t.T(), secret, string(data))
+
+	file, err := fs.Open(context.Background(), path)
+	assert.Nil(t.T(), err)
+
+	read, err := ioutil.ReadAll(file)
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), secret, string(read))
+
+	partial, err := ioutil.ReadAll(fs.Reader(context.Background(), path, 10, 5))
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "api-t", string(partial))
+}
+
+func (t *Test_DeviceFilesystem) Test_end_to_end_key_pinning() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	objects.client.(*client).endToEnd = true
+
+	agent := newTestFilesystemAgent().withEndToEnd()
+	agent.register(objects.mux)
+
+	device := objects.client.Device("whatever")
+
+	key, err := device.PublicKey(context.Background())
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), agent.public[:], key)
+
+	// the hub presents a key of its own
+	agent.withEndToEnd()
+
+	_, err = device.PublicKey(context.Background())
+
+	_, ok := err.(*ErrKeyMismatch)
+	assert.True(t.T(), ok)
+
+	err = device.Filesystem().WriteFile(context.Background(), filepath.Join(os.TempDir(), "go-sdk-e2e-pinned"), []byte("x"), WriterOptions{})
+	assert.NotNil(t.T(), err)
+
+	store := NewFileKeyStore(filepath.Join(os.TempDir(), "go-sdk-e2e-keys", "known_devices"))
+	defer os.RemoveAll(filepath.Join(os.TempDir(), "go-sdk-e2e-keys"))
+
+	assert.Nil(t.T(), store.PinKey("a", []byte("key-a")))
+	assert.Nil(t.T(), store.PinKey("b", []byte("key-b")))
+
+	pinned, ok, err := store.PinnedKey("a")
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), ok)
+	assert.Equal(t.T(), []byte("key-a"), pinned)
+}
+
+func (t *Test_DeviceFilesystem) Test_end_to_end_unsupported_agent() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	objects.client.(*client).endToEnd = true
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	err := objects.client.Device("whatever").Filesystem().WriteFile(context.Background(), filepath.Join(os.TempDir(), "go-sdk-e2e-plain"), []byte("x"), WriterOptions{})
+
+	_, ok := err.(*ErrUnsupportedOperation)
+	assert.True(t.T(), ok)
+}
+
+func (t *Test_DeviceFilesystem) Test_sealed_stream_framing() {
+	senderpub, senderpriv, _ := box.GenerateKey(rand.Reader)
+	recipientpub, recipientpriv, _ := box.GenerateKey(rand.Reader)
+
+	for _, size := range []int{0, 1, e2eChunkSize, 3*e2eChunkSize + 7} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		sealer, _ := newSealingReader(bytes.NewReader(plain), senderpub, senderpriv, recipientpub)
+		sealed, _ := ioutil.ReadAll(sealer)
+
+		opened, err := ioutil.ReadAll(openStream(bytes.NewReader(sealed), recipientpriv, senderpub))
+
+		assert.Nil(t.T(), err)
+		assert.True(t.T(), bytes.Equal(plain, opened))
+
+		// truncated at a chunk boundary
+		if size > e2eChunkSize {
+			_, err = ioutil.ReadAll(openStream(bytes.NewReader(sealed[:e2eHeaderSize+4+e2eChunkSize+box.Overhead]), recipientpriv, senderpub))
+			assert.NotNil(t.T(), err)
+		}
+
+		tampered := append([]byte{}, sealed...)
+		tampered[len(tampered)-1] ^= 1
+
+		_, err = ioutil.ReadAll(openStream(bytes.NewReader(tampered), recipientpriv, senderpub))
+		assert.NotNil(t.T(), err)
+
+		_, err = ioutil.ReadAll(openStream(bytes.NewReader(sealed), recipientpriv, recipientpub))
+		assert.NotNil(t.T(), err)
+	}
+}
+
+func (t *Test_DeviceFilesystem) Test_end_to_end_rejects_keys_substituted_by_the_hub() {
+	dir, _ := ioutil.TempDir("", "go-sdk-e2e")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "token")
+	secret := strings.Repeat("api-token-", 1000)
+	ioutil.WriteFile(path, []byte(secret), 0600)
+
+	hubpub, hubpriv, _ := box.GenerateKey(rand.Reader)
+	hubkey := base64.StdEncoding.EncodeToString(hubpub[:])
+
+	for _, strip := range []bool{false, true} {
+		objects := t.getTestObjects()
+		objects.client.(*client).endToEnd = true
+
+		agent := newTestFilesystemAgent().withEndToEnd()
+		read, write := agent.handlers["read"], agent.handlers["write"]
+		relayed := &bytes.Buffer{}
+
+		// the hub puts a key of its own in place of the key of the client,
+		// keeping or dropping the signature of the client
+		substitute := func(handler http.HandlerFunc, field string, r *http.Request) *httptest.ResponseRecorder {
+			r.ParseMultipartForm(32 << 20)
+			r.Form.Set(field, hubkey)
+
+			if strip {
+				r.Form.Del("signature")
+			}
+
+			recorder := httptest.NewRecorder()
+			handler(recorder, r)
+			relayed.Write(recorder.Body.Bytes())
+
+			return recorder
+		}
+
+		agent.handlers["read"] = func(rw http.ResponseWriter, r *http.Request) {
+			recorder := substitute(read, "recipient", r)
+			rw.WriteHeader(recorder.Code)
+			rw.Write(recorder.Body.Bytes())
+		}
+		agent.handlers["write"] = func(rw http.ResponseWriter, r *http.Request) {
+			sealer, _ := newSealingReader(strings.NewReader("hub-token"), hubpub, hubpriv, agent.public)
+			forged, _ := ioutil.ReadAll(sealer)
+			r.ParseMultipartForm(32 << 20)
+			r.Form.Set("data", string(forged))
+
+			recorder := substitute(write, "sender", r)
+			rw.WriteHeader(recorder.Code)
+			rw.Write(recorder.Body.Bytes())
+		}
+		agent.register(objects.mux)
+
+		fs := objects.client.Device("whatever").Filesystem()
+
+		data, err := ioutil.ReadAll(fs.Reader(context.Background(), path, 0, -1))
+
+		assert.NotNil(t.T(), err, "strip %v", strip)
+		assert.Empty(t.T(), data)
+
+		file, err := fs.Open(context.Background(), path)
+		assert.Nil(t.T(), err)
+
+		data, err = ioutil.ReadAll(file)
+		file.Close()
+
+		assert.NotNil(t.T(), err, "strip %v", strip)
+		assert.Empty(t.T(), data)
+
+		opened, _ := ioutil.ReadAll(openStream(bytes.NewReader(relayed.Bytes()), hubpriv, nil))
+
+		assert.NotContains(t.T(), relayed.String(), "api-token-")
+		assert.Empty(t.T(), opened)
+
+		err = fs.WriteFile(context.Background(), path, []byte("client-token"), WriterOptions{})
+
+		assert.NotNil(t.T(), err, "strip %v", strip)
+
+		data, _ = ioutil.ReadFile(path)
+		assert.Equal(t.T(), secret, string(data))
+
+		objects.server.Close()
+	}
+}
+
+func (t *Test_DeviceFilesystem) Test_end_to_end_rejects_redirected_and_replayed_writes() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	objects.client.(*client).endToEnd = true
+
+	dir, _ := ioutil.TempDir("", "go-sdk-e2e")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "token")
+	exposed := filepath.Join(dir, "public")
+
+	agent := newTestFilesystemAgent().withEndToEnd()
+	write := agent.handlers["write"]
+	redirect := true
+	var captured url.Values
+
+	agent.handlers["write"] = func(rw http.ResponseWriter, r *http.Request) {
+		r.ParseMultipartForm(32 << 20)
+
+		// the hub writes the stream to a world readable location instead
+		if redirect {
+			r.Form.Set("path", exposed)
+		}
+
+		captured = url.Values{}
+
+		for name, values := range r.Form {
+			captured[name] = append([]string{}, values...)
+		}
+
+		write(rw, r)
+	}
+	agent.register(objects.mux)
+
+	fs := objects.client.Device("whatever").Filesystem()
+
+	assert.NotNil(t.T(), fs.WriteFile(context.Background(), path, []byte("old-token"), WriterOptions{}))
+
+	_, err := os.Stat(exposed)
+	assert.True(t.T(), os.IsNotExist(err))
+
+	redirect = false
+
+	assert.Nil(t.T(), fs.WriteFile(context.Background(), path, []byte("old-token"), WriterOptions{}))
+
+	old := captured
+
+	assert.Nil(t.T(), fs.WriteFile(context.Background(), path, []byte("new-token"), WriterOptions{}))
+
+	// the hub replays the first write to roll the file back
+	request := httptest.NewRequest(http.MethodPost, "/filesystem/write", nil)
+	request.Form = old
+	request.PostForm = old
+
+	recorder := httptest.NewRecorder()
+	write(recorder, request)
+
+	assert.NotEqual(t.T(), http.StatusOK, recorder.Code)
+
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t.T(), "new-token", string(data))
+}
+
+// hubRecorder captures every request and response body passing the test
+// server, standing in for what a hub relays.
+type hubRecorder struct {
+	mu      sync.Mutex
+	relayed bytes.Buffer
+}
+
+func (t *hubRecorder) wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		t.record(body)
+		handler.ServeHTTP(&hubRecordingWriter{ResponseWriter: rw, recorder: t}, r)
+	})
+}
+
+func (t *hubRecorder) record(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.relayed.Write(p)
+}
+
+func (t *hubRecorder) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.relayed.String()
+}
+
+type hubRecordingWriter struct {
+	http.ResponseWriter
+	recorder *hubRecorder
+}
+
+func (t *hubRecordingWriter) Write(p []byte) (int, error) {
+	t.recorder.record(p)
+	return t.ResponseWriter.Write(p)
+}
+
+func (t *hubRecordingWriter) Flush() {
+	t.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (t *Test_DeviceFilesystem) Test_end_to_end_keeps_every_stream_sealed() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	recorder := &hubRecorder{}
+	objects.server.Config.Handler = recorder.wrap(objects.server.Config.Handler)
+
+	objects.client.(*client).endToEnd = true
+	objects.client.(*client).disableCompression = true
+
+	agent := newTestFilesystemAgent().withEndToEnd()
+	agent.register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-e2e")
+	defer os.RemoveAll(dir)
+
+	remote := filepath.Join(dir, "remote")
+	local := filepath.Join(dir, "local")
+	os.MkdirAll(remote, 0755)
+	os.MkdirAll(local, 0755)
+
+	content := strings.Repeat("classified line\n", 4000)
+	ioutil.WriteFile(filepath.Join(remote, "app.log"), []byte(content), 0644)
+	ioutil.WriteFile(filepath.Join(local, "app.log"), []byte(content+"classified tail\n"), 0644)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	device := objects.client.Device("whatever")
+	fs := device.Filesystem()
+	opts := SyncOptions{Delta: true, DeltaMinSize: 1}
+
+	_, err := Sync(ctx, Local(local), Remote(device, remote), opts)
+	assert.Nil(t.T(), err)
+
+	ioutil.WriteFile(filepath.Join(remote, "app.log"), []byte(content+"classified change\n"), 0644)
+
+	_, err = Sync(ctx, Remote(device, remote), Local(local), opts)
+	assert.Nil(t.T(), err)
+
+	data, _ := ioutil.ReadFile(filepath.Join(local, "app.log"))
+	assert.Equal(t.T(), content+"classified change\n", string(data))
+
+	archive := &bytes.Buffer{}
+	tw := tar.NewWriter(archive)
+	tw.WriteHeader(&tar.Header{Name: "notes.txt", Mode: 0644, Size: 16, Typeflag: tar.TypeReg})
+	tw.Write([]byte("classified note\n"))
+	tw.Close()
+
+	result, err := fs.PutArchive(ctx, filepath.Join(dir, "extracted"), archive, ArchiveTar)
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), 1, result.Entries)
+
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "extracted", "notes.txt"))
+	assert.Equal(t.T(), "classified note\n", string(data))
+
+	reader, err := fs.GetArchive(ctx, remote, ArchiveTar)
+	assert.Nil(t.T(), err)
+
+	data, err = ioutil.ReadAll(reader)
+	assert.Nil(t.T(), err)
+	assert.Contains(t.T(), string(data), "classified change")
+	reader.Close()
+
+	follower, err := fs.Follow(ctx, filepath.Join(remote, "app.log"), FollowOptions{
+		FromStart:    true,
+		PollInterval: 10 * time.Millisecond,
+	})
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "classified line\n", t.readFollowed(follower, 16))
+	follower.Close()
+
+	matches := 0
+	err = fs.Grep(ctx, remote, "change", GrepOptions{}, func(*GrepMatch) error {
+		matches++
+		return nil
+	})
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), 1, matches)
+
+	_, err = objects.client.CopyBetween(ctx, device, filepath.Join(remote, "app.log"), objects.client.Device("edge"), filepath.Join(dir, "copy.log"), CopyOptions{})
+	assert.Nil(t.T(), err)
+	assert.Empty(t.T(), agent.fetched)
+
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "copy.log"))
+	assert.Equal(t.T(), content+"classified change\n", string(data))
+
+	assert.NotContains(t.T(), recorder.String(), "classified")
+}
@@ -0,0 +1,302 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// EditFileOptions controls EditFile. Editor is the command line of the
+// editor, defaulting to $VISUAL, $EDITOR and then vi, or notepad on windows.
+// Like git, the command line is run by the shell with the file as its last
+// argument, so it may quote paths with spaces and carry options. The editor
+// is attached to the standard streams unless others are given.
+type EditFileOptions struct {
+	Editor string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func (t EditFileOptions) withDefaults() EditFileOptions {
+	for _, editor := range []string{t.Editor, os.Getenv("VISUAL"), os.Getenv("EDITOR")} {
+		if strings.TrimSpace(editor) != "" {
+			t.Editor = editor
+			break
+		}
+	}
+
+	if strings.TrimSpace(t.Editor) == "" {
+		t.Editor = "vi"
+
+		if runtime.GOOS == "windows" {
+			t.Editor = "notepad"
+		}
+	}
+
+	if t.Stdin == nil {
+		t.Stdin = os.Stdin
+	}
+
+	if t.Stdout == nil {
+		t.Stdout = os.Stdout
+	}
+
+	if t.Stderr == nil {
+		t.Stderr = os.Stderr
+	}
+
+	return t
+}
+
+// EditFile downloads path to a local temporary file, opens it in an editor
+// and writes the result back once the editor exits. The write is atomic,
+// keeps the mode and owner of the file and only happens when the file still
+// has the content that was downloaded. Otherwise an *ErrEditConflict holding
+// a three-way merge of the edit and the current content is returned and the
+// file is left alone. Nothing is written when the content was not changed.
+//
+// This is the library side of deviceio edit in cmd/deviceio.
+func EditFile(ctx context.Context, fs DeviceFilesystem, path string, opts EditFileOptions) (*EditResult, error) {
+	opts = opts.withDefaults()
+
+	original, _, err := readEditable(ctx, fs, path, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "deviceio-edit")
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed creating temporary directory")
+	}
+	defer os.RemoveAll(dir)
+
+	// the local copy keeps the name of the file so editors pick the right
+	// syntax
+	local := filepath.Join(dir, editBaseName(path))
+
+	if err := ioutil.WriteFile(local, original, 0600); err != nil {
+		return nil, stacktrace.Propagate(err, "failed writing '%v'", local)
+	}
+
+	cmd := editorCommand(ctx, opts.Editor, local)
+	cmd.Stdin = opts.Stdin
+	cmd.Stdout = opts.Stdout
+	cmd.Stderr = opts.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, stacktrace.Propagate(err, "editor '%v' failed", opts.Editor)
+	}
+
+	edited, err := ioutil.ReadFile(local)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed reading '%v'", local)
+	}
+
+	if bytes.Equal(original, edited) {
+		return &EditResult{}, nil
+	}
+
+	diff, err := unifiedDiff(string(original), string(edited), path, path)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed diffing '%v'", path)
+	}
+
+	err = fs.WriteFile(ctx, path, edited, WriterOptions{
+		ExpectedHash: hashBytes(original),
+	})
+
+	if _, ok := err.(*ErrPreconditionFailed); ok {
+		remote, _, readerr := readEditable(ctx, fs, path, true)
+
+		if readerr != nil {
+			return nil, readerr
+		}
+
+		merged, conflicts := merge3(original, edited, remote)
+
+		return nil, &ErrEditConflict{
+			Path:      path,
+			Base:      original,
+			Local:     edited,
+			Remote:    remote,
+			Merged:    merged,
+			Conflicts: conflicts,
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &EditResult{
+		Changed: true,
+		Diff:    diff,
+	}, nil
+}
+
+// editorCommand runs the editor command line on file through sh, or on
+// windows, where there may be no sh, splits it on spaces outside double
+// quotes.
+func editorCommand(ctx context.Context, editor, file string) *exec.Cmd {
+	if runtime.GOOS != "windows" {
+		return exec.CommandContext(ctx, "/bin/sh", "-c", editor+` "$@"`, editor, file)
+	}
+
+	args := []string{}
+	arg := &strings.Builder{}
+	quoted := false
+
+	for _, r := range strings.TrimSpace(editor) {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if arg.Len() > 0 {
+				args = append(args, arg.String())
+				arg.Reset()
+			}
+		default:
+			arg.WriteRune(r)
+		}
+	}
+
+	args = append(args, arg.String())
+
+	return exec.CommandContext(ctx, args[0], append(args[1:], file)...)
+}
+
+func editBaseName(p string) string {
+	return path.Base(strings.Replace(p, `\`, "/", -1))
+}
+
+// mergeChange replaces the lines [lo, hi) of the base of a merge.
+type mergeChange struct {
+	lo    int
+	hi    int
+	lines []string
+}
+
+// merge3 merges the changes local and remote made to base the way diff3 -m
+// does, returning the merge and the number of regions both changed
+// differently, which are surrounded by conflict markers.
+func merge3(base, local, remote []byte) ([]byte, int) {
+	baselines := splitDiffLines(string(base))
+	localchanges := mergeChanges(baselines, splitDiffLines(string(local)))
+	remotechanges := mergeChanges(baselines, splitDiffLines(string(remote)))
+
+	merged := []string{}
+	conflicts := 0
+	pos, i, j := 0, 0, 0
+
+	for i < len(localchanges) || j < len(remotechanges) {
+		lo := -1
+
+		if i < len(localchanges) {
+			lo = localchanges[i].lo
+		}
+
+		if j < len(remotechanges) && (lo < 0 || remotechanges[j].lo < lo) {
+			lo = remotechanges[j].lo
+		}
+
+		// a region grows while changes of either side touch it
+		hi, li, ri := lo, i, j
+
+		for {
+			if i < len(localchanges) && localchanges[i].lo <= hi {
+				if localchanges[i].hi > hi {
+					hi = localchanges[i].hi
+				}
+
+				i++
+			} else if j < len(remotechanges) && remotechanges[j].lo <= hi {
+				if remotechanges[j].hi > hi {
+					hi = remotechanges[j].hi
+				}
+
+				j++
+			} else {
+				break
+			}
+		}
+
+		merged = append(merged, baselines[pos:lo]...)
+		pos = hi
+
+		localside := applyChanges(baselines, lo, hi, localchanges[li:i])
+		remoteside := applyChanges(baselines, lo, hi, remotechanges[ri:j])
+
+		switch {
+		case ri == j:
+			merged = append(merged, localside...)
+		case li == i || equalLines(localside, remoteside):
+			merged = append(merged, remoteside...)
+		default:
+			conflicts++
+			merged = append(merged, "<<<<<<< edited\n")
+			merged = append(merged, terminateLines(localside)...)
+			merged = append(merged, "||||||| original\n")
+			merged = append(merged, terminateLines(baselines[lo:hi])...)
+			merged = append(merged, "=======\n")
+			merged = append(merged, terminateLines(remoteside)...)
+			merged = append(merged, ">>>>>>> device\n")
+		}
+	}
+
+	merged = append(merged, baselines[pos:]...)
+
+	return []byte(strings.Join(merged, "")), conflicts
+}
+
+func mergeChanges(base, changed []string) []mergeChange {
+	changes := []mergeChange{}
+
+	for _, op := range difflib.NewMatcher(base, changed).GetOpCodes() {
+		if op.Tag != 'e' {
+			changes = append(changes, mergeChange{lo: op.I1, hi: op.I2, lines: changed[op.J1:op.J2]})
+		}
+	}
+
+	return changes
+}
+
+// applyChanges returns the lines [lo, hi) of base with changes applied.
+func applyChanges(base []string, lo, hi int, changes []mergeChange) []string {
+	lines := []string{}
+
+	for _, change := range changes {
+		lines = append(lines, base[lo:change.lo]...)
+		lines = append(lines, change.lines...)
+		lo = change.hi
+	}
+
+	return append(lines, base[lo:hi]...)
+}
+
+// terminateLines makes sure a conflict marker following lines starts on a
+// line of its own.
+func terminateLines(lines []string) []string {
+	if len(lines) == 0 || strings.HasSuffix(lines[len(lines)-1], "\n") {
+		return lines
+	}
+
+	terminated := append([]string{}, lines...)
+	terminated[len(terminated)-1] += "\n"
+
+	return terminated
+}
@@ -0,0 +1,116 @@
+package sdk
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_edit_file() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-editor")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.conf")
+	ioutil.WriteFile(path, []byte("listen 80\ntimeout 5\nworkers 2\nretries 3\nlog info\n"), 0640)
+
+	editor := filepath.Join(dir, "editor.sh")
+	ioutil.WriteFile(editor, []byte("sed -i 's/workers 2/workers 8/' \"$1\"\n"), 0755)
+
+	fs := objects.client.Device("whatever").Filesystem()
+
+	result, err := EditFile(context.Background(), fs, path, EditFileOptions{Editor: "/bin/sh " + editor})
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), result.Changed)
+	assert.Contains(t.T(), result.Diff, "-workers 2\n+workers 8\n")
+
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t.T(), "listen 80\ntimeout 5\nworkers 8\nretries 3\nlog info\n", string(data))
+
+	info, _ := os.Stat(path)
+	assert.Equal(t.T(), os.FileMode(0640), info.Mode().Perm())
+
+	result, err = EditFile(context.Background(), fs, path, EditFileOptions{Editor: "true"})
+
+	assert.Nil(t.T(), err)
+	assert.False(t.T(), result.Changed)
+
+	// the editor races with a change on the device
+	ioutil.WriteFile(editor, []byte(strings.Join([]string{
+		`sed -i 's/workers 8/workers 16/; s/log info/log debug/' "$1"`,
+		`sed -i 's/workers 8/workers 4/; s/listen 80/listen 443/' ` + path,
+		``,
+	}, "\n")), 0755)
+
+	_, err = EditFile(context.Background(), fs, path, EditFileOptions{Editor: "/bin/sh " + editor})
+
+	conflict, ok := err.(*ErrEditConflict)
+
+	assert.True(t.T(), ok)
+	assert.Equal(t.T(), 1, conflict.Conflicts)
+	assert.Equal(t.T(), strings.Join([]string{
+		"listen 443",
+		"timeout 5",
+		"<<<<<<< edited",
+		"workers 16",
+		"||||||| original",
+		"workers 8",
+		"=======",
+		"workers 4",
+		">>>>>>> device",
+		"retries 3",
+		"log debug",
+		"",
+	}, "\n"), string(conflict.Merged))
+
+	data, _ = ioutil.ReadFile(path)
+	assert.Equal(t.T(), "listen 443\ntimeout 5\nworkers 4\nretries 3\nlog info\n", string(data))
+}
+
+func (t *Test_DeviceFilesystem) Test_edit_file_editor_path_with_spaces() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-editor")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.conf")
+	ioutil.WriteFile(path, []byte("workers 2\n"), 0644)
+
+	editor := filepath.Join(dir, "my editor", "edit.sh")
+	os.MkdirAll(filepath.Dir(editor), 0755)
+	ioutil.WriteFile(editor, []byte("#!/bin/sh\n[ \"$1\" = --wait ] && sed -i 's/workers 2/workers 8/' \"$2\"\n"), 0755)
+
+	fs := objects.client.Device("whatever").Filesystem()
+
+	result, err := EditFile(context.Background(), fs, path, EditFileOptions{Editor: `"` + editor + `" --wait`})
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), result.Changed)
+
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t.T(), "workers 8\n", string(data))
+}
+
+func (t *Test_DeviceFilesystem) Test_merge3() {
+	merged, conflicts := merge3([]byte("a\nb\nc\n"), []byte("a\nB\nc\n"), []byte("a\nb\nc\nd\n"))
+
+	assert.Equal(t.T(), 0, conflicts)
+	assert.Equal(t.T(), "a\nB\nc\nd\n", string(merged))
+
+	merged, conflicts = merge3([]byte("a\n"), []byte("a\nx"), []byte("a\ny\n"))
+
+	assert.Equal(t.T(), 1, conflicts)
+	assert.Equal(t.T(), "a\n<<<<<<< edited\nx\n||||||| original\n=======\ny\n>>>>>>> device\n", string(merged))
+}
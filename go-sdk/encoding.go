@@ -0,0 +1,307 @@
+package sdk
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/deviceio/hmapi"
+	"github.com/klauspost/compress/zstd"
+	"github.com/palantir/stacktrace"
+)
+
+// ContentEncoding is the coding applied to a stream on the wire. Agents
+// advertise the codings they accept for a form through the Encoding of its
+// "encoding" field, in order of preference, and label a link response they
+// compressed with a Content-Encoding header. Streams of older agents, and of
+// agents offering only codings the sdk does not implement, are left
+// uncompressed.
+type ContentEncoding string
+
+const (
+	EncodingIdentity = ContentEncoding("")
+	EncodingGzip     = ContentEncoding("gzip")
+	EncodingZstd     = ContentEncoding("zstd")
+)
+
+// StreamStats compares the bytes a stream moved over the connection with the
+// bytes it carried once decoded.
+type StreamStats struct {
+	Wire    int64
+	Logical int64
+}
+
+// StreamCounter is implemented by the readers and writers of filesystem and
+// process streams.
+type StreamCounter interface {
+	Stats() StreamStats
+}
+
+type streamStats struct {
+	wire    int64
+	logical int64
+}
+
+func (t *streamStats) Stats() StreamStats {
+	return StreamStats{
+		Wire:    atomic.LoadInt64(&t.wire),
+		Logical: atomic.LoadInt64(&t.logical),
+	}
+}
+
+// negotiateEncoding picks the first coding of a comma separated list that
+// the sdk implements.
+func negotiateEncoding(offered hmapi.MediaType) ContentEncoding {
+	for _, coding := range strings.Split(offered.String(), ",") {
+		switch encoding := ContentEncoding(strings.TrimSpace(coding)); encoding {
+		case EncodingGzip, EncodingZstd:
+			return encoding
+		}
+	}
+
+	return EncodingIdentity
+}
+
+// formEncoding returns the coding to request from the named form.
+func (t *device) formEncoding(ctx context.Context, resourcePath, name string) (ContentEncoding, error) {
+	if t.client.disableCompression {
+		return EncodingIdentity, nil
+	}
+
+	resource, err := t.resource(ctx, resourcePath)
+
+	if err != nil {
+		return EncodingIdentity, err
+	}
+
+	form, ok := resource.Forms[name]
+
+	if !ok {
+		return EncodingIdentity, nil
+	}
+
+	for _, field := range form.Fields {
+		if field.Name == "encoding" {
+			return negotiateEncoding(field.Encoding), nil
+		}
+	}
+
+	return EncodingIdentity, nil
+}
+
+// linkEncoding returns the coding to request from the named link and the href
+// the request goes to. Links advertise the codings they can send through their
+// Encoding, in order of preference.
+func (t *device) linkEncoding(ctx context.Context, resourcePath, name string) (ContentEncoding, string, error) {
+	resource, err := t.resource(ctx, resourcePath)
+
+	if err != nil {
+		return EncodingIdentity, "", err
+	}
+
+	link, ok := resource.Links[name]
+
+	if !ok {
+		return EncodingIdentity, "", nil
+	}
+
+	if t.client.disableCompression {
+		return EncodingIdentity, link.Href, nil
+	}
+
+	return negotiateEncoding(link.Encoding), link.Href, nil
+}
+
+// encodingAuth signs requests with auth and asks link requests registered
+// through accept for their negotiated coding. hmapi offers no other way to set
+// headers on a link request. Setting Accept-Encoding explicitly also stops the
+// transport from decompressing the response itself, which would hide the wire
+// size from StreamStats and limit links to gzip.
+type encodingAuth struct {
+	auth    hmapi.Auth
+	linksmu sync.Mutex
+	links   map[string]ContentEncoding
+}
+
+func newEncodingAuth(auth hmapi.Auth) *encodingAuth {
+	return &encodingAuth{
+		auth:  auth,
+		links: map[string]ContentEncoding{},
+	}
+}
+
+// accept requests encoding from GETs of href until the returned func is
+// called.
+func (t *encodingAuth) accept(href string, encoding ContentEncoding) func() {
+	t.linksmu.Lock()
+	defer t.linksmu.Unlock()
+
+	t.links[href] = encoding
+
+	return func() {
+		t.linksmu.Lock()
+		defer t.linksmu.Unlock()
+
+		delete(t.links, href)
+	}
+}
+
+func (t *encodingAuth) Sign(r *http.Request) {
+	t.linksmu.Lock()
+	encoding, ok := t.links[r.URL.RequestURI()]
+	t.linksmu.Unlock()
+
+	if ok && r.Method == http.MethodGet {
+		if encoding == EncodingIdentity {
+			r.Header.Set("Accept-Encoding", "identity")
+		} else {
+			r.Header.Set("Accept-Encoding", string(encoding))
+		}
+	}
+
+	t.auth.Sign(r)
+}
+
+// responseEncoding returns the coding of a link response. Responses the
+// transport already decompressed, and responses without a Content-Encoding,
+// are plain.
+func responseEncoding(resp *http.Response) (ContentEncoding, error) {
+	coding := ContentEncoding(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+
+	if resp.Uncompressed || coding == EncodingIdentity || coding == "identity" {
+		return EncodingIdentity, nil
+	}
+
+	if coding != EncodingGzip && coding != EncodingZstd {
+		return EncodingIdentity, stacktrace.NewError("unsupported content encoding '%v'", coding)
+	}
+
+	return coding, nil
+}
+
+// encodeStream returns a reader producing r encoded with encoding. Closing
+// it stops the encoder when the consumer gives up early.
+func encodeStream(r io.Reader, encoding ContentEncoding, stats *streamStats, meter *streamMeter) io.ReadCloser {
+	logical := &statsReader{r: r, n: &stats.logical, meter: meter}
+
+	if encoding != EncodingGzip && encoding != EncodingZstd {
+		return ioutil.NopCloser(meter.wire(&statsReader{r: logical, n: &stats.wire}))
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		var encoder io.WriteCloser = gzip.NewWriter(pw)
+
+		if encoding == EncodingZstd {
+			zw, err := zstd.NewWriter(pw, zstd.WithEncoderConcurrency(1))
+
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+
+			encoder = zw
+		}
+
+		if _, err := io.Copy(encoder, logical); err != nil {
+			encoder.Close()
+			pw.CloseWithError(err)
+			return
+		}
+
+		pw.CloseWithError(encoder.Close())
+	}()
+
+	return &encodedStream{
+		Reader: meter.wire(&statsReader{r: pr, n: &stats.wire}),
+		pipe:   pr,
+	}
+}
+
+type encodedStream struct {
+	io.Reader
+	pipe *io.PipeReader
+}
+
+func (t *encodedStream) Close() error {
+	return t.pipe.Close()
+}
+
+// decodeStream returns a reader decoding r. The decoder is created on the
+// first read so a stream whose first bytes are delayed, such as process
+// output, does not block the caller.
+func decodeStream(r io.Reader, encoding ContentEncoding, stats *streamStats, meter *streamMeter) io.Reader {
+	return &decodingReader{
+		wire:     &statsReader{r: meter.wire(r), n: &stats.wire},
+		encoding: encoding,
+		logical:  &stats.logical,
+		meter:    meter,
+	}
+}
+
+type decodingReader struct {
+	wire     io.Reader
+	encoding ContentEncoding
+	decoder  io.Reader
+	logical  *int64
+	meter    *streamMeter
+}
+
+func (t *decodingReader) Read(p []byte) (int, error) {
+	if t.decoder == nil {
+		switch t.encoding {
+		case EncodingGzip:
+			gz, err := gzip.NewReader(t.wire)
+
+			if err == io.EOF {
+				return 0, err
+			}
+
+			if err != nil {
+				return 0, stacktrace.Propagate(err, "failed decoding gzip stream")
+			}
+
+			t.decoder = gz
+		case EncodingZstd:
+			zr, err := zstd.NewReader(t.wire, zstd.WithDecoderConcurrency(1))
+
+			if err != nil {
+				return 0, stacktrace.Propagate(err, "failed decoding zstd stream")
+			}
+
+			t.decoder = zr.IOReadCloser()
+		default:
+			t.decoder = t.wire
+		}
+	}
+
+	n, err := t.decoder.Read(p)
+	atomic.AddInt64(t.logical, int64(n))
+	t.meter.count(n)
+
+	// the zstd decoder holds buffers until it is closed
+	if closer, ok := t.decoder.(io.Closer); ok && err != nil && t.decoder != t.wire {
+		closer.Close()
+	}
+
+	return n, err
+}
+
+type statsReader struct {
+	r     io.Reader
+	n     *int64
+	meter *streamMeter
+}
+
+func (t *statsReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	atomic.AddInt64(t.n, int64(n))
+	t.meter.count(n)
+	return n, err
+}
@@ -0,0 +1,248 @@
+package sdk
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/deviceio/hmapi"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_compressed_write_and_read() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	agent := newTestFilesystemAgent().withEncoding(hmapi.MediaType("zstd, gzip"))
+	codings := []string{}
+	write := agent.handlers["write"]
+	agent.handlers["write"] = func(rw http.ResponseWriter, r *http.Request) {
+		codings = append(codings, r.FormValue("encoding"))
+		write(rw, r)
+	}
+	agent.register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-encoding")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	data := strings.Repeat("2017-06-01 12:00:00 INFO request served in 12ms\n", 20000)
+
+	fs := objects.client.Device("whatever").Filesystem()
+	writer := fs.Writer(context.Background(), path, WriterOptions{})
+
+	writer.Write([]byte(data))
+
+	assert.Nil(t.T(), writer.Close())
+	assert.Equal(t.T(), []string{"zstd"}, codings)
+
+	stats := writer.(StreamCounter).Stats()
+
+	assert.Equal(t.T(), int64(len(data)), stats.Logical)
+	assert.True(t.T(), stats.Wire*10 < stats.Logical, "wire %v logical %v", stats.Wire, stats.Logical)
+
+	written, _ := ioutil.ReadFile(path)
+
+	assert.Equal(t.T(), data, string(written))
+
+	reader := fs.Reader(context.Background(), path, 0, -1)
+	read, err := ioutil.ReadAll(reader)
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), data, string(read))
+
+	stats = reader.(StreamCounter).Stats()
+
+	assert.Equal(t.T(), int64(len(data)), stats.Logical)
+	assert.True(t.T(), stats.Wire*10 < stats.Logical, "wire %v logical %v", stats.Wire, stats.Logical)
+
+	file, err := fs.Open(context.Background(), path)
+
+	assert.Nil(t.T(), err)
+
+	part := make([]byte, 10)
+	_, err = file.ReadAt(part, 20)
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), data[20:30], string(part))
+
+	file.Close()
+}
+
+func (t *Test_DeviceFilesystem) Test_compression_disabled_and_unsupported() {
+	for _, config := range []struct {
+		encodings hmapi.MediaType
+		disable   bool
+	}{
+		{encodings: "gzip", disable: true},
+		{encodings: "br"},
+	} {
+		objects := t.getTestObjects()
+
+		newTestFilesystemAgent().withEncoding(config.encodings).register(objects.mux)
+
+		objects.client.(*client).disableCompression = config.disable
+
+		tmpfile, _ := ioutil.TempFile("", "go-sdk-encoding")
+		tmpfile.Close()
+
+		fs := objects.client.Device("whatever").Filesystem()
+		writer := fs.Writer(context.Background(), tmpfile.Name(), WriterOptions{})
+
+		writer.Write([]byte("hello"))
+
+		assert.Nil(t.T(), writer.Close())
+		assert.Equal(t.T(), StreamStats{Wire: 5, Logical: 5}, writer.(StreamCounter).Stats())
+
+		read, err := ioutil.ReadAll(fs.Reader(context.Background(), tmpfile.Name(), 0, -1))
+
+		assert.Nil(t.T(), err)
+		assert.Equal(t.T(), "hello", string(read))
+
+		os.Remove(tmpfile.Name())
+		objects.server.Close()
+	}
+}
+
+func (t *Test_DeviceFilesystem) Test_negotiated_encoding_is_cached() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	agent := newTestFilesystemAgent().withEncoding(hmapi.MediaType("gzip"))
+	gets := 0
+	objects.mux.HandleFunc("/device/{id}/filesystem", func(rw http.ResponseWriter, r *http.Request) {
+		gets++
+		agent.get(rw, r)
+	})
+	agent.register(objects.mux)
+
+	tmpfile, _ := ioutil.TempFile("", "go-sdk-encoding")
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+
+	fs := objects.client.Device("whatever").Filesystem()
+	counts := []int{}
+
+	for i := 0; i < 2; i++ {
+		before := gets
+
+		assert.Nil(t.T(), fs.WriteFile(context.Background(), tmpfile.Name(), []byte("hello"), WriterOptions{}))
+
+		counts = append(counts, gets-before)
+	}
+
+	// the first write also fetches the resource for listing the directory
+	// when it sweeps it for stale staging files
+	assert.Equal(t.T(), counts[0]-2, counts[1], "resource retrieved %v times per write", counts)
+}
+
+func (t *Test_DeviceFilesystem) Test_compressed_process_output() {
+	data := strings.Repeat("2017-06-01 12:00:00 INFO request served in 12ms\n", 20000)
+
+	for _, config := range []struct {
+		disable  bool
+		accepted string
+	}{
+		{accepted: "zstd"},
+		{disable: true, accepted: "identity"},
+	} {
+		objects := t.getTestObjects()
+		accepted := []string{}
+
+		objects.mux.HandleFunc("/device/{id}/process/1", func(rw http.ResponseWriter, r *http.Request) {
+			resource := &hmapi.Resource{
+				Links: map[string]*hmapi.Link{
+					"stdout": {Type: hmapi.MediaTypeOctetStream, Href: r.URL.Path + "/stdout", Encoding: "zstd, gzip"},
+				},
+			}
+
+			rw.Header().Set("Content-Type", hmapi.MediaTypeJSON.String())
+			rw.WriteHeader(http.StatusOK)
+			json.NewEncoder(rw).Encode(&resource)
+		})
+		objects.mux.HandleFunc("/device/{id}/process/1/stdout", func(rw http.ResponseWriter, r *http.Request) {
+			coding := r.Header.Get("Accept-Encoding")
+			accepted = append(accepted, coding)
+
+			var out io.Writer = rw
+
+			switch coding {
+			case "gzip":
+				rw.Header().Set("Content-Encoding", coding)
+				gz := gzip.NewWriter(rw)
+				defer gz.Close()
+
+				out = gz
+			case "zstd":
+				rw.Header().Set("Content-Encoding", coding)
+				zw, _ := zstd.NewWriter(rw)
+				defer zw.Close()
+
+				out = zw
+			}
+
+			rw.WriteHeader(http.StatusOK)
+			io.WriteString(out, data)
+		})
+
+		objects.client.(*client).disableCompression = config.disable
+
+		process := &deviceProcessInstance{
+			device:       objects.client.Device("whatever").(*device),
+			resourcePath: "/device/whatever/process/1",
+		}
+
+		stdout := process.Stdout(context.Background())
+		read, err := ioutil.ReadAll(stdout)
+
+		assert.Nil(t.T(), err)
+		assert.Equal(t.T(), data, string(read))
+		assert.Equal(t.T(), []string{config.accepted}, accepted)
+
+		stats := stdout.(StreamCounter).Stats()
+
+		assert.Equal(t.T(), int64(len(data)), stats.Logical)
+
+		if config.disable {
+			assert.Equal(t.T(), stats.Logical, stats.Wire)
+		} else {
+			assert.True(t.T(), stats.Wire*10 < stats.Logical, "wire %v logical %v", stats.Wire, stats.Logical)
+		}
+
+		objects.server.Close()
+	}
+}
+
+func (t *Test_DeviceFilesystem) Test_response_encoding() {
+	for _, test := range []struct {
+		header       string
+		uncompressed bool
+		expected     ContentEncoding
+		fails        bool
+	}{
+		{expected: EncodingIdentity},
+		{header: "identity", expected: EncodingIdentity},
+		{header: "gzip", expected: EncodingGzip},
+		{header: "zstd", expected: EncodingZstd},
+		{header: "gzip", uncompressed: true, expected: EncodingIdentity},
+		{header: "br", fails: true},
+	} {
+		resp := &http.Response{Header: http.Header{}, Uncompressed: test.uncompressed}
+
+		if test.header != "" {
+			resp.Header.Set("Content-Encoding", test.header)
+		}
+
+		encoding, err := responseEncoding(resp)
+
+		assert.Equal(t.T(), test.fails, err != nil, "%+v", test)
+		assert.Equal(t.T(), test.expected, encoding, "%+v", test)
+	}
+}
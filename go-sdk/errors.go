@@ -1,6 +1,10 @@
 package sdk
 
-import "fmt"
+import (
+	"fmt"
+	"net/http"
+	"os"
+)
 
 type ErrInvalidAPIResponse struct {
 	StatusCode int
@@ -10,3 +14,98 @@ type ErrInvalidAPIResponse struct {
 func (t *ErrInvalidAPIResponse) Error() string {
 	return fmt.Sprintf("StatusCode: %v Message: %v", t.StatusCode, t.Message)
 }
+
+// Is lets errors.Is(err, os.ErrNotExist) match agents that report missing
+// paths with a 404.
+func (t *ErrInvalidAPIResponse) Is(target error) bool {
+	return target == os.ErrNotExist && t.StatusCode == http.StatusNotFound
+}
+
+type ErrUnsupportedOperation struct {
+	Operation string
+}
+
+func (t *ErrUnsupportedOperation) Error() string {
+	return fmt.Sprintf("operation '%v' is not supported by the agent", t.Operation)
+}
+
+type ErrPreconditionFailed struct {
+	Path         string
+	ExpectedHash string
+	Message      string
+}
+
+func (t *ErrPreconditionFailed) Error() string {
+	return fmt.Sprintf("precondition failed for '%v' expected hash %v: %v", t.Path, t.ExpectedHash, t.Message)
+}
+
+type ErrChecksumMismatch struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+func (t *ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf("checksum mismatch for '%v' expected %v got %v", t.Path, t.Expected, t.Actual)
+}
+
+type ErrInsufficientSpace struct {
+	Path      string
+	Required  int64
+	Available int64
+}
+
+func (t *ErrInsufficientSpace) Error() string {
+	return fmt.Sprintf("insufficient space for '%v' required %v bytes available %v", t.Path, t.Required, t.Available)
+}
+
+// ErrEditConflict is returned by EditFile when the file changed on the
+// device while it was being edited. Merged holds a three-way merge of the
+// edited and the current content, with conflict markers around the
+// Conflicts regions both changed.
+type ErrEditConflict struct {
+	Path      string
+	Base      []byte
+	Local     []byte
+	Remote    []byte
+	Merged    []byte
+	Conflicts int
+}
+
+func (t *ErrEditConflict) Error() string {
+	return fmt.Sprintf("'%v' changed on the device while it was edited, %v conflicting regions", t.Path, t.Conflicts)
+}
+
+// ErrKeyMismatch is returned when a device presents a public key other than
+// the one pinned for it, which either means the device was re-keyed or that
+// something between the client and the device substitutes its own key.
+type ErrKeyMismatch struct {
+	DeviceID  string
+	Pinned    string
+	Presented string
+}
+
+func (t *ErrKeyMismatch) Error() string {
+	return fmt.Sprintf("device '%v' presented key %v but %v is pinned", t.DeviceID, t.Presented, t.Pinned)
+}
+
+// ErrUnverifiedArtifact is returned by UploadVerified when an artifact is
+// unsigned, not signed by a trusted key or does not match what was signed.
+type ErrUnverifiedArtifact struct {
+	Path   string
+	Reason string
+}
+
+func (t *ErrUnverifiedArtifact) Error() string {
+	return fmt.Sprintf("refusing unverified artifact '%v': %v", t.Path, t.Reason)
+}
+
+// ErrInvalidSecret is reported for a file of the secret directory that is
+// not a sealed secret.
+type ErrInvalidSecret struct {
+	Path string
+}
+
+func (t *ErrInvalidSecret) Error() string {
+	return fmt.Sprintf("'%v' is not a sealed secret", t.Path)
+}
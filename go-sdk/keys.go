@@ -0,0 +1,186 @@
+package sdk
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/palantir/stacktrace"
+)
+
+// KeyStore pins the public keys devices use for end-to-end encryption. The
+// first key seen for a device is pinned and later keys have to match it, so
+// a hub presenting its own key is detected instead of trusted.
+type KeyStore interface {
+	PinnedKey(deviceID string) ([]byte, bool, error)
+	PinKey(deviceID string, key []byte) error
+}
+
+type memoryKeyStore struct {
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+// NewMemoryKeyStore returns a KeyStore pinning keys for the lifetime of the
+// process.
+func NewMemoryKeyStore() KeyStore {
+	return &memoryKeyStore{
+		keys: map[string][]byte{},
+	}
+}
+
+func (t *memoryKeyStore) PinnedKey(deviceID string) ([]byte, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key, ok := t.keys[deviceID]
+
+	return key, ok, nil
+}
+
+func (t *memoryKeyStore) PinKey(deviceID string, key []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.keys[deviceID] = append([]byte{}, key...)
+
+	return nil
+}
+
+type fileKeyStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileKeyStore returns a KeyStore keeping pins in a file of lines made of
+// a device id and the base64 encoded key, like ssh's known_hosts. Removing
+// the line of a device lets it present a new key.
+func NewFileKeyStore(path string) KeyStore {
+	return &fileKeyStore{
+		path: path,
+	}
+}
+
+func (t *fileKeyStore) PinnedKey(deviceID string) ([]byte, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	keys, err := t.load()
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	key, ok := keys[deviceID]
+
+	return key, ok, nil
+}
+
+func (t *fileKeyStore) PinKey(deviceID string, key []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	keys, err := t.load()
+
+	if err != nil {
+		return err
+	}
+
+	keys[deviceID] = key
+	ids := []string{}
+
+	for id := range keys {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	buf := &strings.Builder{}
+
+	for _, id := range ids {
+		fmt.Fprintf(buf, "%v %v\n", id, base64.StdEncoding.EncodeToString(keys[id]))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(t.path), 0700); err != nil {
+		return stacktrace.Propagate(err, "failed creating directory of '%v'", t.path)
+	}
+
+	staging := t.path + ".tmp"
+
+	if err := writeFileSync(staging, []byte(buf.String()), 0600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(staging, t.path); err != nil {
+		return stacktrace.Propagate(err, "failed replacing '%v'", t.path)
+	}
+
+	return nil
+}
+
+func (t *fileKeyStore) load() (map[string][]byte, error) {
+	keys := map[string][]byte{}
+	file, err := os.Open(t.path)
+
+	if os.IsNotExist(err) {
+		return keys, nil
+	}
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed opening '%v'", t.path)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) != 2 {
+			return nil, stacktrace.NewError("'%v' line %v: expected a device id and a key", t.path, line)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "'%v' line %v: invalid key", t.path, line)
+		}
+
+		keys[fields[0]] = key
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "failed reading '%v'", t.path)
+	}
+
+	return keys, nil
+}
+
+func writeFileSync(path string, data []byte, mode os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed creating '%v'", path)
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return stacktrace.Propagate(err, "failed writing '%v'", path)
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return stacktrace.Propagate(err, "failed syncing '%v'", path)
+	}
+
+	return file.Close()
+}
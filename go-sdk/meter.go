@@ -0,0 +1,251 @@
+package sdk
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// meterChunkSize bounds how many bytes a metered stream moves per read so a
+// large buffer cannot overdraw a bandwidth limit in one go.
+const meterChunkSize = 32 * 1024
+
+// StreamOptions meters the streams opened with a context returned by
+// WithStreamOptions. BandwidthLimit caps the bytes per second moved over the
+// connection, after compression, and is shared by every stream of the
+// context. Progress is called as decoded bytes pass through a stream. Total
+// is the expected number of decoded bytes used to estimate the remaining
+// time, reads of a known count default to that count.
+type StreamOptions struct {
+	BandwidthLimit int64
+	Total          int64
+	Progress       func(TransferProgress)
+}
+
+type streamOptionsKey struct{}
+
+type streamConfig struct {
+	parent   *streamConfig
+	limiter  *rateLimiter
+	total    int64
+	progress func(TransferProgress)
+}
+
+// WithStreamOptions returns a context that meters the Reader, Writer and
+// process streams opened with it. When contexts are nested every bandwidth
+// limit along the chain applies while only the innermost Progress and Total
+// are used. Limits configured on the device with SetBandwidthLimit and on
+// the client through ClientConfig apply on top.
+func WithStreamOptions(ctx context.Context, opts StreamOptions) context.Context {
+	config := &streamConfig{
+		parent:   streamConfigFrom(ctx),
+		total:    opts.Total,
+		progress: opts.Progress,
+	}
+
+	if opts.BandwidthLimit > 0 {
+		config.limiter = newRateLimiter(opts.BandwidthLimit)
+	}
+
+	return context.WithValue(ctx, streamOptionsKey{}, config)
+}
+
+func streamConfigFrom(ctx context.Context) *streamConfig {
+	config, _ := ctx.Value(streamOptionsKey{}).(*streamConfig)
+	return config
+}
+
+// streamMeter applies the bandwidth limits and the progress callback that
+// are in effect for one stream.
+type streamMeter struct {
+	ctx      context.Context
+	limiters []*rateLimiter
+	tracker  *progressTracker
+	logical  int64
+}
+
+// meter collects the limits that apply to a stream of the device opened
+// with ctx. total is the expected size when the caller knows it.
+func (t *device) meter(ctx context.Context, total int64) *streamMeter {
+	meter := &streamMeter{ctx: ctx}
+	config := streamConfigFrom(ctx)
+
+	if total < 0 {
+		total = 0
+	}
+
+	if config != nil {
+		if config.total > 0 {
+			total = config.total
+		}
+
+		if config.progress != nil {
+			meter.tracker = newProgressTracker(0, total, config.progress)
+		}
+	}
+
+	for ; config != nil; config = config.parent {
+		if config.limiter != nil {
+			meter.limiters = append(meter.limiters, config.limiter)
+		}
+	}
+
+	if limiter := t.client.deviceLimiter(t.id); limiter != nil {
+		meter.limiters = append(meter.limiters, limiter)
+	}
+
+	if t.client.limiter != nil {
+		meter.limiters = append(meter.limiters, t.client.limiter)
+	}
+
+	return meter
+}
+
+// wire throttles r, which carries bytes as they appear on the connection.
+func (t *streamMeter) wire(r io.Reader) io.Reader {
+	if t == nil || len(t.limiters) == 0 {
+		return r
+	}
+
+	return &throttledReader{r: r, meter: t}
+}
+
+// count reports n more decoded bytes to the progress callback.
+func (t *streamMeter) count(n int) {
+	if t == nil || t.tracker == nil || n == 0 {
+		return
+	}
+
+	t.tracker.report(atomic.AddInt64(&t.logical, int64(n)))
+}
+
+type throttledReader struct {
+	r     io.Reader
+	meter *streamMeter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > meterChunkSize {
+		p = p[:meterChunkSize]
+	}
+
+	n, err := t.r.Read(p)
+
+	for _, limiter := range t.meter.limiters {
+		if waiterr := limiter.wait(t.meter.ctx, n); waiterr != nil {
+			return n, waiterr
+		}
+	}
+
+	return n, err
+}
+
+// rateLimiter is a token bucket refilled at rate bytes per second holding
+// at most one second worth of tokens. Callers take tokens after moving the
+// bytes and wait off any debt, so concurrent streams share the rate.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+func (t *rateLimiter) setRate(bytesPerSecond int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rate = float64(bytesPerSecond)
+
+	if t.tokens > t.rate {
+		t.tokens = t.rate
+	}
+}
+
+func (t *rateLimiter) wait(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	t.last = now
+
+	if t.tokens > t.rate {
+		t.tokens = t.rate
+	}
+
+	t.tokens -= float64(n)
+	delay := time.Duration(-t.tokens / t.rate * float64(time.Second))
+
+	t.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// progressTracker derives the rate and remaining time of a transfer from
+// the bytes moved since it was created. base is the number of bytes already
+// transferred by an earlier, resumed run.
+type progressTracker struct {
+	mu    sync.Mutex
+	start time.Time
+	base  int64
+	total int64
+	fn    func(TransferProgress)
+}
+
+func newProgressTracker(base, total int64, fn func(TransferProgress)) *progressTracker {
+	return &progressTracker{
+		start: time.Now(),
+		base:  base,
+		total: total,
+		fn:    fn,
+	}
+}
+
+func (t *progressTracker) report(transferred int64) {
+	if t == nil || t.fn == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	progress := TransferProgress{
+		Transferred: transferred,
+		Total:       t.total,
+	}
+
+	if elapsed := time.Since(t.start).Seconds(); elapsed > 0 {
+		progress.Rate = float64(transferred-t.base) / elapsed
+	}
+
+	if progress.Rate > 0 && t.total > transferred {
+		progress.ETA = time.Duration(float64(t.total-transferred) / progress.Rate * float64(time.Second))
+	}
+
+	t.fn(progress)
+}
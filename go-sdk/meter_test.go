@@ -0,0 +1,100 @@
+package sdk
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_stream_progress_and_bandwidth_limits() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-meter")
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+
+	path := filepath.Join(dir, "image.bin")
+	ioutil.WriteFile(path, data, 0644)
+
+	device := objects.client.Device("cellular")
+
+	var progress []TransferProgress
+
+	ctx := WithStreamOptions(context.Background(), StreamOptions{
+		BandwidthLimit: 128 * 1024,
+		Progress: func(p TransferProgress) {
+			progress = append(progress, p)
+		},
+	})
+
+	start := time.Now()
+	read, err := ioutil.ReadAll(device.Filesystem().Reader(ctx, path, 0, len(data)))
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), data, read)
+	assert.True(t.T(), time.Since(start) > 700*time.Millisecond, "read took %v", time.Since(start))
+	assert.NotEmpty(t.T(), progress)
+
+	last := progress[len(progress)-1]
+
+	assert.Equal(t.T(), int64(len(data)), last.Transferred)
+	assert.Equal(t.T(), int64(len(data)), last.Total)
+	assert.True(t.T(), last.Rate > 0)
+	assert.True(t.T(), progress[0].ETA > 0)
+
+	device.SetBandwidthLimit(128 * 1024)
+
+	start = time.Now()
+	err = device.Filesystem().WriteFile(context.Background(), path, data, WriterOptions{})
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), time.Since(start) > 700*time.Millisecond, "write took %v", time.Since(start))
+
+	device.SetBandwidthLimit(0)
+
+	start = time.Now()
+	err = device.Filesystem().WriteFile(context.Background(), path, data, WriterOptions{})
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), time.Since(start) < 500*time.Millisecond, "write took %v", time.Since(start))
+}
+
+func (t *Test_DeviceFilesystem) Test_rate_limiter_shares_budget() {
+	limiter := newRateLimiter(1000)
+
+	start := time.Now()
+
+	assert.Nil(t.T(), limiter.wait(context.Background(), 1000))
+	assert.True(t.T(), time.Since(start) < 100*time.Millisecond)
+
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			limiter.wait(context.Background(), 250)
+		}()
+	}
+
+	wg.Wait()
+
+	assert.True(t.T(), time.Since(start) > 400*time.Millisecond, "waited %v", time.Since(start))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.Equal(t.T(), context.Canceled, limiter.wait(ctx, 1000))
+}
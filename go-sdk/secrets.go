@@ -0,0 +1,422 @@
+package sdk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// DefaultSecretDir is where secrets are deployed unless SecretOptions says
+// otherwise.
+const DefaultSecretDir = "/etc/deviceio/secrets"
+
+const (
+	secretFormat  = "deviceio-secret/1"
+	secretSuffix  = ".sealed"
+	secretDirMode = 0711
+)
+
+var secretName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// SecretOptions controls where secrets are deployed and who can read them.
+// Sealed files are only readable by their owner, which should be the user
+// of the service consuming the secret. The directory can be traversed but
+// not listed by other users. OperatorKey is the private key of the
+// operator deploying secrets, see GenerateOperatorKey, and is required by
+// DeploySecret: secrets are sealed by it so devices opening them with the
+// operator's public key know who deployed them.
+type SecretOptions struct {
+	Dir         string
+	Owner       *FileOwner
+	OperatorKey *[32]byte
+}
+
+func (t SecretOptions) dir() string {
+	if t.Dir == "" {
+		return DefaultSecretDir
+	}
+
+	return t.Dir
+}
+
+// SecretInfo describes a deployed secret without revealing its value. Key is
+// the base64 encoded device key the secret is sealed to, secrets sealed to a
+// key other than the one the device presents have to be deployed again.
+// Operator is the base64 encoded public key of the operator who sealed it.
+// Err is set by ListSecrets on files of the secret directory that are not
+// sealed secrets, only Name, DeviceID and Path are known for those.
+type SecretInfo struct {
+	Format   string    `json:"format"`
+	Name     string    `json:"name"`
+	Version  int       `json:"version"`
+	Created  time.Time `json:"created"`
+	Key      string    `json:"key"`
+	Operator string    `json:"operator"`
+	DeviceID string    `json:"-"`
+	Path     string    `json:"-"`
+	Err      error     `json:"-"`
+}
+
+// secretPayload is what gets sealed, repeating the header so a sealed blob
+// cannot be passed off as another secret or version.
+type secretPayload struct {
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+	Value   []byte `json:"value"`
+}
+
+// GenerateOperatorKey generates the key pair an operator seals secrets
+// with. The private key goes into SecretOptions, the public key is what
+// processes on the device pass to ReadSecret.
+func GenerateOperatorKey() (public, private *[32]byte, err error) {
+	public, private, err = box.GenerateKey(rand.Reader)
+
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "failed generating operator key")
+	}
+
+	return public, private, nil
+}
+
+// DeploySecret seals value from the operator key to the pinned key of device
+// and writes it to the secret directory, replacing the previous version of
+// the secret. The value never leaves the client in plaintext, so neither the
+// hub nor the disk of the device see it; only a process holding the private
+// key of the device can open it with OpenSecret. Deploying a secret again
+// rotates it, concurrent rotations each get a version of their own.
+func DeploySecret(ctx context.Context, device Device, name string, value []byte, opts SecretOptions) (*SecretInfo, error) {
+	if !secretName.MatchString(name) {
+		return nil, stacktrace.NewError("invalid secret name '%v'", name)
+	}
+
+	if opts.OperatorKey == nil {
+		return nil, stacktrace.NewError("no operator key to seal secret '%v' with", name)
+	}
+
+	key, err := device.PublicKey(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fs := device.Filesystem()
+	dst := path.Join(opts.dir(), name+secretSuffix)
+
+	// the owner of a secret has to reach it through the directory, which
+	// only lets others traverse it since secrets of several owners share it
+	if err := fs.MkdirAll(ctx, opts.dir(), secretDirMode); err != nil {
+		return nil, stacktrace.Propagate(err, "failed creating '%v'", opts.dir())
+	}
+
+	if opts.Owner != nil {
+		if err := fs.Chmod(ctx, opts.dir(), secretDirMode); err != nil {
+			return nil, err
+		}
+	}
+
+	var info *SecretInfo
+
+	// the version is sealed into the secret, so a rotation that lost the
+	// race to another one is sealed again with the next version
+	for attempt := 1; ; attempt++ {
+		current, exists, err := readEditable(ctx, fs, dst, true)
+
+		if err != nil {
+			return nil, err
+		}
+
+		info = &SecretInfo{
+			Format:   secretFormat,
+			Name:     name,
+			Version:  1,
+			Created:  time.Now().UTC(),
+			Key:      base64.StdEncoding.EncodeToString(key),
+			DeviceID: device.ID(),
+			Path:     dst,
+		}
+
+		wopts := WriterOptions{
+			Mode:    0600,
+			Owner:   opts.Owner,
+			Durable: true,
+		}
+
+		if exists {
+			if newline := bytes.IndexByte(current, '\n'); newline >= 0 {
+				if previous, err := parseSecretInfo(current[:newline]); err == nil {
+					info.Version = previous.Version + 1
+				}
+			}
+
+			wopts.ExpectedHash = hashBytes(current)
+		}
+
+		sealed, err := sealSecret(info, value, key, opts.OperatorKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = fs.WriteFile(ctx, dst, sealed, wopts)
+
+		if _, ok := err.(*ErrPreconditionFailed); ok && attempt < defaultEditRetries {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		break
+	}
+
+	// agents predating the mode field create files with their umask
+	if err := fs.Chmod(ctx, dst, 0600); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// RevokeSecret removes the secret from device. Revoking a secret that is not
+// deployed is not an error.
+func RevokeSecret(ctx context.Context, device Device, name string, opts SecretOptions) error {
+	if !secretName.MatchString(name) {
+		return stacktrace.NewError("invalid secret name '%v'", name)
+	}
+
+	err := device.Filesystem().Remove(ctx, path.Join(opts.dir(), name+secretSuffix))
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// ListSecrets lists the secrets deployed to device, sorted by name. Only the
+// headers of the sealed files are read. Files that are not sealed secrets are
+// listed with Err set rather than failing the listing.
+func ListSecrets(ctx context.Context, device Device, opts SecretOptions) ([]*SecretInfo, error) {
+	fs := device.Filesystem()
+	secrets := []*SecretInfo{}
+
+	infos, err := fs.ReadDir(ctx, opts.dir())
+
+	if errors.Is(err, os.ErrNotExist) {
+		return secrets, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fi := range infos {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), secretSuffix) {
+			continue
+		}
+
+		info, err := readSecretInfo(ctx, fs, path.Join(opts.dir(), fi.Name()))
+
+		if invalid, ok := err.(*ErrInvalidSecret); ok {
+			info = &SecretInfo{
+				Name: strings.TrimSuffix(fi.Name(), secretSuffix),
+				Path: invalid.Path,
+				Err:  invalid,
+			}
+		} else if err != nil {
+			return nil, err
+		}
+
+		info.DeviceID = device.ID()
+		secrets = append(secrets, info)
+	}
+
+	sort.Slice(secrets, func(i, j int) bool {
+		return secrets[i].Name < secrets[j].Name
+	})
+
+	return secrets, nil
+}
+
+// SecretDeployments lists the secrets deployed to each of devices, keyed by
+// the id of the device.
+func SecretDeployments(ctx context.Context, devices []Device, opts SecretOptions) (map[string][]*SecretInfo, error) {
+	deployments := map[string][]*SecretInfo{}
+
+	for _, device := range devices {
+		secrets, err := ListSecrets(ctx, device, opts)
+
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed listing secrets of device '%v'", device.ID())
+		}
+
+		deployments[device.ID()] = secrets
+	}
+
+	return deployments, nil
+}
+
+// ReadSecret opens the sealed secret at path with the private key of the
+// device, checking that it was sealed by the operator with the given public
+// key. It is meant for processes running on the device, which should keep
+// the value in memory only.
+func ReadSecret(path string, private, operator *[32]byte) ([]byte, *SecretInfo, error) {
+	sealed, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "failed reading '%v'", path)
+	}
+
+	value, info, err := OpenSecret(sealed, private, operator)
+
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "failed opening '%v'", path)
+	}
+
+	info.Path = path
+
+	return value, info, nil
+}
+
+// OpenSecret opens a sealed secret with the private key of the device it was
+// deployed to. Secrets not sealed by the operator with the given public key
+// are refused, so whoever can write to the secret directory cannot plant a
+// secret of their own.
+func OpenSecret(sealed []byte, private, operator *[32]byte) ([]byte, *SecretInfo, error) {
+	if operator == nil {
+		return nil, nil, stacktrace.NewError("no operator key to authenticate the secret with")
+	}
+
+	newline := bytes.IndexByte(sealed, '\n')
+
+	if newline < 0 {
+		return nil, nil, stacktrace.NewError("not a sealed secret")
+	}
+
+	info, err := parseSecretInfo(sealed[:newline])
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if info.Operator != base64.StdEncoding.EncodeToString(operator[:]) {
+		return nil, nil, stacktrace.NewError("secret '%v' was not sealed by operator %v", info.Name, base64.StdEncoding.EncodeToString(operator[:]))
+	}
+
+	plain, err := ioutil.ReadAll(openStream(bytes.NewReader(sealed[newline+1:]), private, operator))
+
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "failed opening secret '%v'", info.Name)
+	}
+
+	payload := &secretPayload{}
+
+	if err := json.Unmarshal(plain, payload); err != nil {
+		return nil, nil, stacktrace.Propagate(err, "failed decoding secret '%v'", info.Name)
+	}
+
+	if payload.Name != info.Name || payload.Version != info.Version {
+		return nil, nil, stacktrace.NewError("sealed secret '%v' version %v does not match its header", info.Name, info.Version)
+	}
+
+	return payload.Value, info, nil
+}
+
+// sealSecret returns the header of info on a line of its own followed by the
+// payload sealed by operator to key in the framing of end-to-end encrypted
+// streams.
+func sealSecret(info *SecretInfo, value, key []byte, operator *[32]byte) ([]byte, error) {
+	public := &[32]byte{}
+	curve25519.ScalarBaseMult(public, operator)
+	info.Operator = base64.StdEncoding.EncodeToString(public[:])
+
+	header, err := json.Marshal(info)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed encoding secret header")
+	}
+
+	plain, err := json.Marshal(&secretPayload{
+		Name:    info.Name,
+		Version: info.Version,
+		Value:   value,
+	})
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed encoding secret")
+	}
+
+	recipient := &[32]byte{}
+	copy(recipient[:], key)
+
+	sealer, err := newSealingReader(bytes.NewReader(plain), public, operator, recipient)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := ioutil.ReadAll(sealer)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed sealing secret '%v'", info.Name)
+	}
+
+	return append(append(header, '\n'), sealed...), nil
+}
+
+func readSecretInfo(ctx context.Context, fs DeviceFilesystem, path string) (*SecretInfo, error) {
+	file, err := fs.Open(ctx, path)
+
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// the header is small, there is no need to download the sealed payload
+	line, err := bufio.NewReader(io.LimitReader(file, 4096)).ReadBytes('\n')
+
+	if err == io.EOF {
+		return nil, &ErrInvalidSecret{Path: path}
+	}
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed reading '%v'", path)
+	}
+
+	info, err := parseSecretInfo(line)
+
+	if err != nil {
+		return nil, &ErrInvalidSecret{Path: path}
+	}
+
+	info.Path = path
+
+	return info, nil
+}
+
+func parseSecretInfo(header []byte) (*SecretInfo, error) {
+	info := &SecretInfo{}
+
+	if err := json.Unmarshal(header, info); err != nil || info.Format != secretFormat {
+		return nil, stacktrace.NewError("not a sealed secret")
+	}
+
+	return info, nil
+}
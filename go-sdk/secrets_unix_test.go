@@ -0,0 +1,62 @@
+//go:build !windows
+// +build !windows
+
+package sdk
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_secret_is_readable_by_its_owner() {
+	if os.Geteuid() != 0 {
+		t.T().Skip("changing ownership requires root")
+	}
+
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	agent := newTestFilesystemAgent().withEndToEnd().withSyncedWrites()
+	agent.register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-secrets")
+	defer os.RemoveAll(dir)
+	os.Chmod(dir, 0755)
+
+	operator, operatorkey, _ := GenerateOperatorKey()
+	opts := SecretOptions{
+		Dir:         filepath.Join(dir, "secrets"),
+		Owner:       OwnerID(65534, 65534),
+		OperatorKey: operatorkey,
+	}
+
+	// an earlier deployment left the directory closed to everyone else
+	os.Mkdir(opts.Dir, 0700)
+
+	info, err := DeploySecret(context.Background(), objects.client.Device("whatever"), "api-token", []byte("s3cr3t"), opts)
+	assert.Nil(t.T(), err)
+
+	// the service reads the secret as the user owning it
+	cat := exec.Command("cat", info.Path)
+	cat.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 65534, Gid: 65534}}
+	sealed, err := cat.Output()
+
+	assert.Nil(t.T(), err)
+
+	value, _, err := OpenSecret(sealed, agent.private, operator)
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "s3cr3t", string(value))
+
+	// other users still cannot list the directory
+	ls := exec.Command("ls", opts.Dir)
+	ls.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 65533, Gid: 65533}}
+
+	assert.NotNil(t.T(), ls.Run())
+}
@@ -0,0 +1,732 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+const defaultSyncDeltaMinSize = 1024 * 1024
+
+// SyncEndpoint is one side of a Sync. A nil Device refers to the local disk.
+type SyncEndpoint struct {
+	Device Device
+	Path   string
+}
+
+func Local(path string) SyncEndpoint {
+	return SyncEndpoint{Path: path}
+}
+
+func Remote(device Device, path string) SyncEndpoint {
+	return SyncEndpoint{Device: device, Path: path}
+}
+
+// SyncOptions controls a Sync. Exclude holds path.Match patterns tested
+// against every slash separated path element and the full relative path.
+// Delta enables rolling checksum transfers of modified files of at least
+// DeltaMinSize bytes between the local disk and a device.
+type SyncOptions struct {
+	Delete        bool
+	DryRun        bool
+	Exclude       []string
+	PreserveMode  bool
+	PreserveTimes bool
+	Delta         bool
+	DeltaMinSize  int64
+	BlockSize     int
+	Algorithm     HashAlgorithm
+	OnAction      func(SyncAction)
+}
+
+type SyncOp string
+
+const (
+	SyncMkdir   = SyncOp("mkdir")
+	SyncCopy    = SyncOp("copy")
+	SyncUpdate  = SyncOp("update")
+	SyncChmod   = SyncOp("chmod")
+	SyncChtimes = SyncOp("chtimes")
+	SyncDelete  = SyncOp("delete")
+)
+
+type SyncAction struct {
+	Op    SyncOp
+	Path  string
+	Size  int64
+	Mode  os.FileMode
+	Delta bool
+}
+
+func (t SyncAction) String() string {
+	switch t.Op {
+	case SyncCopy, SyncUpdate:
+		if t.Delta {
+			return fmt.Sprintf("%v %v (%v bytes, delta)", t.Op, t.Path, t.Size)
+		}
+
+		return fmt.Sprintf("%v %v (%v bytes)", t.Op, t.Path, t.Size)
+	case SyncChmod, SyncMkdir:
+		return fmt.Sprintf("%v %v %v", t.Op, t.Path, t.Mode)
+	default:
+		return fmt.Sprintf("%v %v", t.Op, t.Path)
+	}
+}
+
+// SyncResult lists the actions a Sync took. Skipped holds the source paths
+// that are neither files nor directories, such as symlinks, which Sync does
+// not copy.
+type SyncResult struct {
+	Actions     []SyncAction
+	Skipped     []string
+	Transferred int64
+}
+
+func (t SyncOptions) withDefaults() SyncOptions {
+	if t.DeltaMinSize <= 0 {
+		t.DeltaMinSize = defaultSyncDeltaMinSize
+	}
+
+	if t.BlockSize <= 0 {
+		t.BlockSize = defaultDeltaBlockSize
+	}
+
+	if t.Algorithm == "" {
+		t.Algorithm = HashSHA256
+	}
+
+	return t
+}
+
+// Sync makes the tree at dst match the tree at src. Either side can be the
+// local disk or a device. Trees are compared through manifests so only
+// changed files are transferred.
+func Sync(ctx context.Context, src, dst SyncEndpoint, opts SyncOptions) (*SyncResult, error) {
+	opts = opts.withDefaults()
+
+	srctree := newSyncTree(src)
+	dsttree := newSyncTree(dst)
+
+	srcmanifest, err := srctree.manifest(ctx, opts.Algorithm)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dstmanifest, err := dsttree.manifest(ctx, opts.Algorithm)
+	dstmissing := errors.Is(err, os.ErrNotExist)
+
+	if dstmissing {
+		dstmanifest, err = Manifest{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	syncer := &syncer{
+		opts:    opts,
+		src:     srctree,
+		dst:     dsttree,
+		result:  &SyncResult{},
+		touched: map[string]bool{},
+	}
+
+	if dstmissing {
+		if err := syncer.apply(ctx, SyncAction{Op: SyncMkdir, Path: ".", Mode: 0755}); err != nil {
+			return syncer.result, err
+		}
+	}
+
+	if err := syncer.run(ctx, srcmanifest, dstmanifest); err != nil {
+		return syncer.result, err
+	}
+
+	return syncer.result, nil
+}
+
+type syncer struct {
+	opts    SyncOptions
+	src     syncTree
+	dst     syncTree
+	result  *SyncResult
+	touched map[string]bool
+}
+
+func (t *syncer) run(ctx context.Context, srcmanifest, dstmanifest Manifest) error {
+	paths := []string{}
+
+	for p := range srcmanifest {
+		if !t.excluded(p) {
+			paths = append(paths, p)
+		}
+	}
+
+	sort.Strings(paths)
+
+	dirtimes := []*ManifestEntry{}
+
+	for _, p := range paths {
+		s := srcmanifest[p]
+		d, exists := dstmanifest[p]
+
+		if !s.Mode.IsDir() && !s.Mode.IsRegular() {
+			t.result.Skipped = append(t.result.Skipped, p)
+			continue
+		}
+
+		if exists && d.Mode.IsDir() != s.Mode.IsDir() {
+			if err := t.apply(ctx, SyncAction{Op: SyncDelete, Path: p}); err != nil {
+				return err
+			}
+
+			exists = false
+		}
+
+		switch {
+		case s.Mode.IsDir() && !exists:
+			if err := t.apply(ctx, SyncAction{Op: SyncMkdir, Path: p, Mode: s.Mode.Perm()}); err != nil {
+				return err
+			}
+
+		case !s.Mode.IsDir() && !exists:
+			if err := t.apply(ctx, SyncAction{Op: SyncCopy, Path: p, Size: s.Size, Mode: s.Mode.Perm()}); err != nil {
+				return err
+			}
+
+		case !s.Mode.IsDir() && s.Hash != d.Hash:
+			action := SyncAction{
+				Op:    SyncUpdate,
+				Path:  p,
+				Size:  s.Size,
+				Mode:  s.Mode.Perm(),
+				Delta: t.deltaEligible(s, d),
+			}
+
+			if err := t.apply(ctx, action); err != nil {
+				return err
+			}
+
+		default:
+			if t.opts.PreserveMode && s.Mode.Perm() != d.Mode.Perm() {
+				if err := t.apply(ctx, SyncAction{Op: SyncChmod, Path: p, Mode: s.Mode.Perm()}); err != nil {
+					return err
+				}
+			}
+
+			if t.opts.PreserveTimes && !s.Mode.IsDir() && !s.ModTime.Equal(d.ModTime) {
+				if err := t.apply(ctx, SyncAction{Op: SyncChtimes, Path: p}); err != nil {
+					return err
+				}
+			}
+		}
+
+		if s.Mode.IsDir() {
+			dirtimes = append(dirtimes, s)
+		}
+	}
+
+	if t.opts.Delete {
+		extraneous := []string{}
+
+		for p := range dstmanifest {
+			if _, ok := srcmanifest[p]; !ok && !t.excluded(p) {
+				extraneous = append(extraneous, p)
+			}
+		}
+
+		sort.Strings(extraneous)
+
+		deleted := map[string]bool{}
+
+		for _, p := range extraneous {
+			if deletedAncestor(deleted, p) {
+				continue
+			}
+
+			if err := t.apply(ctx, SyncAction{Op: SyncDelete, Path: p}); err != nil {
+				return err
+			}
+
+			deleted[p] = true
+		}
+	}
+
+	// directory times are applied last since populating a directory
+	// updates its modification time
+	if t.opts.PreserveTimes {
+		for i := len(dirtimes) - 1; i >= 0; i-- {
+			d, exists := dstmanifest[dirtimes[i].Path]
+
+			if exists && dirtimes[i].ModTime.Equal(d.ModTime) && !t.touched[dirtimes[i].Path] {
+				continue
+			}
+
+			if err := t.apply(ctx, SyncAction{Op: SyncChtimes, Path: dirtimes[i].Path}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func deletedAncestor(deleted map[string]bool, p string) bool {
+	for dir := path.Dir(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if deleted[dir] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *syncer) excluded(p string) bool {
+	for _, pattern := range t.opts.Exclude {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+
+		for _, element := range strings.Split(p, "/") {
+			if ok, _ := path.Match(pattern, element); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (t *syncer) deltaEligible(s, d *ManifestEntry) bool {
+	if !t.opts.Delta || !d.Mode.IsRegular() || s.Size < t.opts.DeltaMinSize {
+		return false
+	}
+
+	_, fromlocal := t.src.(*localSyncTree)
+	_, tolocal := t.dst.(*localSyncTree)
+
+	// delta literals and signatures are not sealed end-to-end
+	if remote, ok := t.dst.(*remoteSyncTree); ok && fromlocal {
+		return remote.fs != nil && !remote.fs.device.client.endToEnd
+	}
+
+	if remote, ok := t.src.(*remoteSyncTree); ok && tolocal {
+		return remote.fs != nil && !remote.fs.device.client.endToEnd
+	}
+
+	return false
+}
+
+func (t *syncer) apply(ctx context.Context, action SyncAction) error {
+	t.result.Actions = append(t.result.Actions, action)
+
+	if action.Op != SyncChtimes && action.Op != SyncChmod {
+		for dir := path.Dir(action.Path); dir != "."; dir = path.Dir(dir) {
+			t.touched[dir] = true
+		}
+
+		t.touched["."] = true
+	}
+
+	if t.opts.OnAction != nil {
+		t.opts.OnAction(action)
+	}
+
+	if t.opts.DryRun {
+		return nil
+	}
+
+	var err error
+
+	switch action.Op {
+	case SyncMkdir:
+		err = t.dst.mkdir(ctx, action.Path, action.Mode)
+
+	case SyncCopy, SyncUpdate:
+		err = t.copy(ctx, action)
+
+		if err == nil && t.opts.PreserveMode {
+			err = t.dst.chmod(ctx, action.Path, action.Mode)
+		}
+
+		if err == nil && t.opts.PreserveTimes {
+			err = t.chtimes(ctx, action.Path)
+		}
+
+	case SyncChmod:
+		err = t.dst.chmod(ctx, action.Path, action.Mode)
+
+	case SyncChtimes:
+		err = t.chtimes(ctx, action.Path)
+
+	case SyncDelete:
+		err = t.dst.removeAll(ctx, action.Path)
+	}
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to %v", action)
+	}
+
+	return nil
+}
+
+func (t *syncer) chtimes(ctx context.Context, rel string) error {
+	info, err := t.src.stat(ctx, rel)
+
+	if err != nil {
+		return err
+	}
+
+	return t.dst.chtimes(ctx, rel, info.ModTime())
+}
+
+func (t *syncer) copy(ctx context.Context, action SyncAction) error {
+	if action.Delta {
+		var err error
+
+		switch dst := t.dst.(type) {
+		case *remoteSyncTree:
+			err = t.deltaUpload(ctx, action.Path, t.src.(*localSyncTree), dst)
+		case *localSyncTree:
+			err = t.deltaDownload(ctx, action.Path, t.src.(*remoteSyncTree), dst)
+		}
+
+		if err == nil {
+			return nil
+		}
+
+		// agents without delta support, or a delta that did not reproduce
+		// the source, fall back to a full copy
+	}
+
+	reader, err := t.src.open(ctx, action.Path)
+
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	counter := &countingReader{r: reader}
+
+	// updates keep the mode of the file they replace
+	var mode os.FileMode
+
+	if action.Op == SyncCopy {
+		mode = action.Mode
+	}
+
+	if err := t.dst.create(ctx, action.Path, counter, mode); err != nil {
+		return err
+	}
+
+	t.result.Transferred += counter.n
+
+	return nil
+}
+
+func (t *syncer) deltaUpload(ctx context.Context, rel string, src *localSyncTree, dst *remoteSyncTree) error {
+	signature, err := dst.fs.signature(ctx, dst.path(rel), t.opts.BlockSize)
+
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(src.path(rel))
+
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	deltar, deltaw := io.Pipe()
+	counter := &countingReader{r: deltar}
+
+	go func() {
+		deltaw.CloseWithError(writeDelta(signature, file, deltaw))
+	}()
+
+	err = dst.fs.patch(ctx, dst.path(rel), t.opts.BlockSize, counter)
+	deltar.Close()
+
+	if err != nil {
+		return err
+	}
+
+	t.result.Transferred += counter.n
+
+	return t.verify(ctx, rel)
+}
+
+func (t *syncer) deltaDownload(ctx context.Context, rel string, src *remoteSyncTree, dst *localSyncTree) error {
+	basis, err := os.Open(dst.path(rel))
+
+	if err != nil {
+		return err
+	}
+	defer basis.Close()
+
+	signature, err := computeSignature(basis, t.opts.BlockSize)
+
+	if err != nil {
+		return err
+	}
+
+	delta, err := src.fs.delta(ctx, src.path(rel), signature)
+
+	if err != nil {
+		return err
+	}
+	defer delta.Close()
+
+	counter := &countingReader{r: delta}
+
+	err = dst.replace(rel, func(w io.Writer) error {
+		return applyDelta(basis, signature, counter, w)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	t.result.Transferred += counter.n
+
+	return t.verify(ctx, rel)
+}
+
+func (t *syncer) verify(ctx context.Context, rel string) error {
+	expected, err := t.src.hash(ctx, rel, t.opts.Algorithm)
+
+	if err != nil {
+		return err
+	}
+
+	actual, err := t.dst.hash(ctx, rel, t.opts.Algorithm)
+
+	if err != nil {
+		return err
+	}
+
+	if expected != actual {
+		return &ErrChecksumMismatch{
+			Path:     rel,
+			Expected: expected,
+			Actual:   actual,
+		}
+	}
+
+	return nil
+}
+
+type syncTree interface {
+	manifest(ctx context.Context, algorithm HashAlgorithm) (Manifest, error)
+	hash(ctx context.Context, rel string, algorithm HashAlgorithm) (string, error)
+	stat(ctx context.Context, rel string) (os.FileInfo, error)
+	open(ctx context.Context, rel string) (io.ReadCloser, error)
+	create(ctx context.Context, rel string, r io.Reader, mode os.FileMode) error
+	mkdir(ctx context.Context, rel string, mode os.FileMode) error
+	removeAll(ctx context.Context, rel string) error
+	chmod(ctx context.Context, rel string, mode os.FileMode) error
+	chtimes(ctx context.Context, rel string, mtime time.Time) error
+}
+
+func newSyncTree(endpoint SyncEndpoint) syncTree {
+	if endpoint.Device == nil {
+		return &localSyncTree{root: endpoint.Path}
+	}
+
+	fs := endpoint.Device.Filesystem()
+	devicefs, _ := fs.(*deviceFilesystem)
+
+	return &remoteSyncTree{
+		root:     endpoint.Path,
+		fs:       devicefs,
+		generics: fs,
+	}
+}
+
+type localSyncTree struct {
+	root string
+}
+
+func (t *localSyncTree) path(rel string) string {
+	return filepath.Join(t.root, filepath.FromSlash(rel))
+}
+
+func (t *localSyncTree) manifest(ctx context.Context, algorithm HashAlgorithm) (Manifest, error) {
+	if _, err := os.Stat(t.root); err != nil {
+		return nil, err
+	}
+
+	return LocalManifest(t.root, algorithm)
+}
+
+func (t *localSyncTree) hash(ctx context.Context, rel string, algorithm HashAlgorithm) (string, error) {
+	return hashFile(t.path(rel), algorithm)
+}
+
+func (t *localSyncTree) stat(ctx context.Context, rel string) (os.FileInfo, error) {
+	return os.Stat(t.path(rel))
+}
+
+func (t *localSyncTree) open(ctx context.Context, rel string) (io.ReadCloser, error) {
+	return os.Open(t.path(rel))
+}
+
+func (t *localSyncTree) create(ctx context.Context, rel string, r io.Reader, mode os.FileMode) error {
+	err := t.replace(rel, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+
+	if err != nil || mode == 0 {
+		return err
+	}
+
+	return os.Chmod(t.path(rel), mode)
+}
+
+// replace writes a sibling temp file and renames it over rel so readers
+// never observe a partially written file.
+func (t *localSyncTree) replace(rel string, write func(w io.Writer) error) error {
+	target := t.path(rel)
+
+	tmpfile, err := ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target)+".deviceio-")
+
+	if err != nil {
+		return err
+	}
+
+	if err := write(tmpfile); err != nil {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+		return err
+	}
+
+	if err := tmpfile.Close(); err != nil {
+		os.Remove(tmpfile.Name())
+		return err
+	}
+
+	if info, err := os.Stat(target); err == nil {
+		os.Chmod(tmpfile.Name(), info.Mode().Perm())
+	} else {
+		os.Chmod(tmpfile.Name(), 0644)
+	}
+
+	return os.Rename(tmpfile.Name(), target)
+}
+
+func (t *localSyncTree) mkdir(ctx context.Context, rel string, mode os.FileMode) error {
+	return os.MkdirAll(t.path(rel), mode)
+}
+
+func (t *localSyncTree) removeAll(ctx context.Context, rel string) error {
+	return os.RemoveAll(t.path(rel))
+}
+
+func (t *localSyncTree) chmod(ctx context.Context, rel string, mode os.FileMode) error {
+	return os.Chmod(t.path(rel), mode)
+}
+
+func (t *localSyncTree) chtimes(ctx context.Context, rel string, mtime time.Time) error {
+	return os.Chtimes(t.path(rel), mtime, mtime)
+}
+
+type remoteSyncTree struct {
+	root     string
+	fs       *deviceFilesystem
+	generics DeviceFilesystem
+}
+
+func (t *remoteSyncTree) path(rel string) string {
+	if rel == "." {
+		return t.root
+	}
+
+	return strings.TrimRight(t.root, `/\`) + "/" + rel
+}
+
+func (t *remoteSyncTree) manifest(ctx context.Context, algorithm HashAlgorithm) (Manifest, error) {
+	return t.generics.Manifest(ctx, t.root, algorithm)
+}
+
+func (t *remoteSyncTree) hash(ctx context.Context, rel string, algorithm HashAlgorithm) (string, error) {
+	return t.generics.Hash(ctx, t.path(rel), algorithm)
+}
+
+func (t *remoteSyncTree) stat(ctx context.Context, rel string) (os.FileInfo, error) {
+	return t.generics.Stat(ctx, t.path(rel))
+}
+
+func (t *remoteSyncTree) open(ctx context.Context, rel string) (io.ReadCloser, error) {
+	return t.generics.Open(ctx, t.path(rel))
+}
+
+func (t *remoteSyncTree) create(ctx context.Context, rel string, r io.Reader, mode os.FileMode) error {
+	moded := false
+
+	if mode != 0 && t.fs != nil {
+		var err error
+
+		if moded, err = t.fs.supportsField(ctx, "write", "mode"); err != nil {
+			return err
+		}
+	}
+
+	opts := WriterOptions{}
+
+	if moded {
+		opts.Mode = mode
+	}
+
+	writer := t.generics.Writer(ctx, t.path(rel), opts)
+
+	if _, err := io.Copy(writer, r); err != nil {
+		writer.Abort()
+		return err
+	}
+
+	if err := writer.Close(); err != nil || mode == 0 || moded {
+		return err
+	}
+
+	// agents predating the mode field create files with their umask
+	return t.generics.Chmod(ctx, t.path(rel), mode)
+}
+
+func (t *remoteSyncTree) mkdir(ctx context.Context, rel string, mode os.FileMode) error {
+	return t.generics.MkdirAll(ctx, t.path(rel), mode)
+}
+
+func (t *remoteSyncTree) removeAll(ctx context.Context, rel string) error {
+	return t.generics.RemoveAll(ctx, t.path(rel))
+}
+
+func (t *remoteSyncTree) chmod(ctx context.Context, rel string, mode os.FileMode) error {
+	return t.generics.Chmod(ctx, t.path(rel), mode)
+}
+
+func (t *remoteSyncTree) chtimes(ctx context.Context, rel string, mtime time.Time) error {
+	return t.generics.Chtimes(ctx, t.path(rel), mtime, mtime)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (t *countingReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.n += int64(n)
+	return n, err
+}
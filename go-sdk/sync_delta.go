@@ -0,0 +1,375 @@
+package sdk
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+
+	"github.com/palantir/stacktrace"
+)
+
+// The delta format used by the signature, delta and patch forms is a stream
+// of operations. 'C' is followed by a big endian uint32 block index of the
+// basis file to copy, 'L' by a big endian uint32 length and that many
+// literal bytes, and 'E' ends the stream.
+const (
+	deltaOpCopy    = byte('C')
+	deltaOpLiteral = byte('L')
+	deltaOpEnd     = byte('E')
+
+	defaultDeltaBlockSize = 8 * 1024
+	maxDeltaLiteral       = 256 * 1024
+)
+
+type deltaSignature struct {
+	BlockSize int              `json:"blockSize"`
+	Size      int64            `json:"size"`
+	Blocks    []deltaBlockHash `json:"blocks"`
+}
+
+type deltaBlockHash struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+func (t *deltaSignature) blockLen(index int) int {
+	if index == len(t.Blocks)-1 {
+		if last := int(t.Size - int64(index)*int64(t.BlockSize)); last < t.BlockSize {
+			return last
+		}
+	}
+
+	return t.BlockSize
+}
+
+// weakChecksum is the rsync rolling checksum, a holds the sum of the window
+// and b the sum weighted by the distance to the end of the window.
+type weakChecksum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newWeakChecksum(block []byte) *weakChecksum {
+	t := &weakChecksum{n: uint32(len(block))}
+
+	for i, c := range block {
+		t.a += uint32(c)
+		t.b += uint32(len(block)-i) * uint32(c)
+	}
+
+	return t
+}
+
+func (t *weakChecksum) roll(out, in byte) {
+	t.a = t.a - uint32(out) + uint32(in)
+	t.b = t.b - t.n*uint32(out) + t.a
+}
+
+func (t *weakChecksum) sum() uint32 {
+	return (t.a & 0xffff) | (t.b&0xffff)<<16
+}
+
+func strongChecksum(block []byte) string {
+	sum := sha256.Sum256(block)
+	return hex.EncodeToString(sum[:16])
+}
+
+func computeSignature(r io.Reader, blockSize int) (*deltaSignature, error) {
+	signature := &deltaSignature{
+		BlockSize: blockSize,
+		Blocks:    []deltaBlockHash{},
+	}
+
+	block := make([]byte, blockSize)
+
+	for {
+		n, err := io.ReadFull(r, block)
+
+		if n > 0 {
+			signature.Size += int64(n)
+			signature.Blocks = append(signature.Blocks, deltaBlockHash{
+				Weak:   newWeakChecksum(block[:n]).sum(),
+				Strong: strongChecksum(block[:n]),
+			})
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return signature, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+type deltaWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (t *deltaWriter) copyBlock(index int) {
+	if t.err != nil {
+		return
+	}
+
+	var op [5]byte
+	op[0] = deltaOpCopy
+	binary.BigEndian.PutUint32(op[1:], uint32(index))
+	_, t.err = t.w.Write(op[:])
+}
+
+func (t *deltaWriter) literal(data []byte) {
+	if t.err != nil || len(data) == 0 {
+		return
+	}
+
+	var op [5]byte
+	op[0] = deltaOpLiteral
+	binary.BigEndian.PutUint32(op[1:], uint32(len(data)))
+
+	if _, t.err = t.w.Write(op[:]); t.err == nil {
+		_, t.err = t.w.Write(data)
+	}
+}
+
+func (t *deltaWriter) end() error {
+	if t.err != nil {
+		return t.err
+	}
+
+	if t.err = t.w.WriteByte(deltaOpEnd); t.err != nil {
+		return t.err
+	}
+
+	return t.w.Flush()
+}
+
+// writeDelta encodes src as a delta against the basis described by
+// signature. Source data is buffered only up to the pending literal plus one
+// block, so arbitrarily large files stream through.
+func writeDelta(signature *deltaSignature, src io.Reader, w io.Writer) error {
+	lookup := map[uint32][]int{}
+
+	for i, block := range signature.Blocks {
+		if signature.blockLen(i) == signature.BlockSize {
+			lookup[block.Weak] = append(lookup[block.Weak], i)
+		}
+	}
+
+	bs := signature.BlockSize
+	reader := bufio.NewReaderSize(src, 64*1024)
+	out := &deltaWriter{w: bufio.NewWriter(w)}
+
+	var data []byte
+	var eof bool
+	var weak *weakChecksum
+
+	fill := func(n int) (bool, error) {
+		for len(data) < n && !eof {
+			chunk := make([]byte, 64*1024)
+			nr, err := reader.Read(chunk)
+			data = append(data, chunk[:nr]...)
+
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return false, err
+			}
+		}
+
+		return len(data) >= n, nil
+	}
+
+	i, lit := 0, 0
+
+	for {
+		ok, err := fill(i + bs)
+
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			break
+		}
+
+		if weak == nil {
+			weak = newWeakChecksum(data[i : i+bs])
+		}
+
+		if index, ok := matchBlock(signature, lookup, weak.sum(), data[i:i+bs]); ok {
+			out.literal(data[lit:i])
+			out.copyBlock(index)
+
+			data = data[i+bs:]
+			i, lit = 0, 0
+			weak = nil
+
+			continue
+		}
+
+		more, err := fill(i + bs + 1)
+
+		if err != nil {
+			return err
+		}
+
+		if !more {
+			i++
+			break
+		}
+
+		weak.roll(data[i], data[i+bs])
+		i++
+
+		if i-lit >= maxDeltaLiteral {
+			out.literal(data[lit:i])
+			data = data[i:]
+			i, lit = 0, 0
+		}
+	}
+
+	if last := len(signature.Blocks) - 1; last >= 0 && i < len(data) {
+		tail := data[i:]
+		block := signature.Blocks[last]
+
+		if signature.blockLen(last) == len(tail) && block.Strong == strongChecksum(tail) {
+			out.literal(data[lit:i])
+			out.copyBlock(last)
+
+			return out.end()
+		}
+	}
+
+	out.literal(data[lit:])
+
+	return out.end()
+}
+
+func matchBlock(signature *deltaSignature, lookup map[uint32][]int, weak uint32, block []byte) (int, bool) {
+	candidates, ok := lookup[weak]
+
+	if !ok {
+		return 0, false
+	}
+
+	strong := strongChecksum(block)
+
+	for _, index := range candidates {
+		if signature.Blocks[index].Strong == strong {
+			return index, true
+		}
+	}
+
+	return 0, false
+}
+
+// applyDelta rebuilds the target described by delta from basis into w.
+func applyDelta(basis io.ReaderAt, signature *deltaSignature, delta io.Reader, w io.Writer) error {
+	reader := bufio.NewReader(delta)
+	block := make([]byte, signature.BlockSize)
+
+	for {
+		op, err := reader.ReadByte()
+
+		if err != nil {
+			return stacktrace.Propagate(err, "truncated delta stream")
+		}
+
+		switch op {
+		case deltaOpEnd:
+			return nil
+
+		case deltaOpCopy:
+			var arg [4]byte
+
+			if _, err := io.ReadFull(reader, arg[:]); err != nil {
+				return stacktrace.Propagate(err, "truncated delta stream")
+			}
+
+			index := int(binary.BigEndian.Uint32(arg[:]))
+
+			if index >= len(signature.Blocks) {
+				return stacktrace.NewError("delta references block %v of %v", index, len(signature.Blocks))
+			}
+
+			n := signature.blockLen(index)
+
+			if _, err := basis.ReadAt(block[:n], int64(index)*int64(signature.BlockSize)); err != nil && err != io.EOF {
+				return stacktrace.Propagate(err, "failed reading basis block %v", index)
+			}
+
+			if _, err := w.Write(block[:n]); err != nil {
+				return err
+			}
+
+		case deltaOpLiteral:
+			var arg [4]byte
+
+			if _, err := io.ReadFull(reader, arg[:]); err != nil {
+				return stacktrace.Propagate(err, "truncated delta stream")
+			}
+
+			if _, err := io.CopyN(w, reader, int64(binary.BigEndian.Uint32(arg[:]))); err != nil {
+				return stacktrace.Propagate(err, "truncated delta literal")
+			}
+
+		default:
+			return stacktrace.NewError("invalid delta operation %q", op)
+		}
+	}
+}
+
+// signature has the agent compute the block signature of path.
+func (t *deviceFilesystem) signature(ctx context.Context, path string, blockSize int) (*deltaSignature, error) {
+	resp, err := t.device.submit(ctx, t.form("signature").
+		AddFieldAsString("path", path).
+		AddFieldAsInt("blocksize", blockSize))
+
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var signature *deltaSignature
+
+	if err := json.NewDecoder(resp.Body).Decode(&signature); err != nil {
+		return nil, stacktrace.Propagate(err, "failed decoding signature of '%v'", path)
+	}
+
+	return signature, nil
+}
+
+// patch streams a delta against the current content of path to the agent,
+// which rebuilds the file next to it and renames it into place.
+func (t *deviceFilesystem) patch(ctx context.Context, path string, blockSize int, delta io.Reader) error {
+	return t.submitAndClose(ctx, t.form("patch").
+		AddFieldAsString("path", path).
+		AddFieldAsInt("blocksize", blockSize).
+		AddFieldAsOctetStream("delta", delta))
+}
+
+// delta sends the signature of a local basis file and returns the delta the
+// agent computes from path against it.
+func (t *deviceFilesystem) delta(ctx context.Context, path string, signature *deltaSignature) (io.ReadCloser, error) {
+	data, err := json.Marshal(signature)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed encoding signature")
+	}
+
+	resp, err := t.device.submit(ctx, t.form("delta").
+		AddFieldAsString("path", path).
+		AddFieldAsString("signature", string(data)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
@@ -0,0 +1,245 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_sync_upload_delete_exclude_and_dry_run() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	src := t.makeTree()
+	defer os.RemoveAll(src)
+
+	ioutil.WriteFile(filepath.Join(src, "skip.tmp"), []byte("skip"), 0644)
+
+	dst, _ := ioutil.TempDir("", "go-sdk-sync")
+	defer os.RemoveAll(dst)
+
+	ioutil.WriteFile(filepath.Join(dst, "stale.txt"), []byte("stale"), 0644)
+	os.MkdirAll(filepath.Join(dst, "old", "nested"), 0755)
+
+	device := objects.client.Device("whatever")
+	opts := SyncOptions{
+		Delete:  true,
+		DryRun:  true,
+		Exclude: []string{"*.tmp"},
+	}
+
+	result, err := Sync(context.Background(), Local(src), Remote(device, dst), opts)
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), []SyncAction{
+		{Op: SyncCopy, Path: "a.txt", Size: 1, Mode: 0644},
+		{Op: SyncMkdir, Path: "sub", Mode: 0755},
+		{Op: SyncCopy, Path: "sub/b.txt", Size: 2, Mode: 0644},
+		{Op: SyncMkdir, Path: "sub/deeper", Mode: 0755},
+		{Op: SyncCopy, Path: "sub/deeper/c.txt", Size: 3, Mode: 0644},
+		{Op: SyncDelete, Path: "old"},
+		{Op: SyncDelete, Path: "stale.txt"},
+	}, result.Actions)
+
+	_, err = os.Stat(filepath.Join(dst, "stale.txt"))
+
+	assert.Nil(t.T(), err)
+
+	opts.DryRun = false
+
+	_, err = Sync(context.Background(), Local(src), Remote(device, dst), opts)
+
+	assert.Nil(t.T(), err)
+
+	manifest, _ := LocalManifest(dst, HashSHA256)
+	srcmanifest, _ := LocalManifest(src, HashSHA256)
+	delete(srcmanifest, "skip.tmp")
+
+	assert.True(t.T(), srcmanifest.Compare(manifest).Empty())
+
+	result, err = Sync(context.Background(), Local(src), Remote(device, dst), opts)
+
+	assert.Nil(t.T(), err)
+	assert.Empty(t.T(), result.Actions)
+}
+
+func (t *Test_DeviceFilesystem) Test_sync_delta_transfers_changed_blocks() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	src, _ := ioutil.TempDir("", "go-sdk-sync-src")
+	defer os.RemoveAll(src)
+
+	dst, _ := ioutil.TempDir("", "go-sdk-sync-dst")
+	defer os.RemoveAll(dst)
+
+	data := make([]byte, 512*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	ioutil.WriteFile(filepath.Join(dst, "big.bin"), data, 0644)
+
+	modified := append([]byte{}, data[:100000]...)
+	modified = append(modified, []byte("inserted")...)
+	modified = append(modified, data[100000:]...)
+
+	ioutil.WriteFile(filepath.Join(src, "big.bin"), modified, 0644)
+
+	opts := SyncOptions{
+		Delta:        true,
+		DeltaMinSize: 1024,
+		BlockSize:    4096,
+	}
+
+	result, err := Sync(context.Background(), Local(src), Remote(objects.client.Device("whatever"), dst), opts)
+
+	assert.Nil(t.T(), err)
+	assert.Len(t.T(), result.Actions, 1)
+	assert.True(t.T(), result.Actions[0].Delta)
+	assert.True(t.T(), result.Transferred < int64(len(modified))/10, "transferred %v", result.Transferred)
+
+	synced, _ := ioutil.ReadFile(filepath.Join(dst, "big.bin"))
+
+	assert.True(t.T(), bytes.Equal(modified, synced))
+
+	// and back down again
+	ioutil.WriteFile(filepath.Join(src, "big.bin"), data, 0644)
+
+	result, err = Sync(context.Background(), Remote(objects.client.Device("whatever"), dst), Local(src), opts)
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), result.Transferred < int64(len(modified))/10, "transferred %v", result.Transferred)
+
+	synced, _ = ioutil.ReadFile(filepath.Join(src, "big.bin"))
+
+	assert.True(t.T(), bytes.Equal(modified, synced))
+}
+
+func (t *Test_DeviceFilesystem) Test_sync_upload_creates_files_with_their_mode_and_reports_symlinks() {
+	for _, moded := range []bool{true, false} {
+		objects := t.getTestObjects()
+
+		agent := newTestFilesystemAgent()
+		chmods := 0
+
+		if moded {
+			agent.withModedWrites()
+		}
+
+		chmod := agent.handlers["chmod"]
+		agent.handlers["chmod"] = func(rw http.ResponseWriter, r *http.Request) {
+			chmods++
+			chmod(rw, r)
+		}
+
+		agent.register(objects.mux)
+
+		src := t.makeTree()
+		os.Chmod(filepath.Join(src, "a.txt"), 0600)
+		os.Symlink("a.txt", filepath.Join(src, "link"))
+
+		dst, _ := ioutil.TempDir("", "go-sdk-sync")
+
+		result, err := Sync(context.Background(), Local(src), Remote(objects.client.Device("whatever"), dst), SyncOptions{})
+
+		assert.Nil(t.T(), err)
+		assert.Equal(t.T(), []string{"link"}, result.Skipped)
+
+		info, err := os.Stat(filepath.Join(dst, "a.txt"))
+
+		assert.Nil(t.T(), err)
+		assert.Equal(t.T(), os.FileMode(0600), info.Mode().Perm())
+
+		_, err = os.Lstat(filepath.Join(dst, "link"))
+
+		assert.True(t.T(), os.IsNotExist(err))
+
+		// agents with a mode field need no chmod after the rename
+		if moded {
+			assert.Equal(t.T(), 0, chmods)
+		} else {
+			assert.NotEqual(t.T(), 0, chmods)
+		}
+
+		objects.server.Close()
+		os.RemoveAll(src)
+		os.RemoveAll(dst)
+	}
+}
+
+func (t *Test_DeviceFilesystem) Test_sync_download_to_missing_dir() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	src := t.makeTree()
+	defer os.RemoveAll(src)
+
+	dst, _ := ioutil.TempDir("", "go-sdk-sync")
+	defer os.RemoveAll(dst)
+
+	target := filepath.Join(dst, "copy")
+
+	_, err := Sync(context.Background(), Remote(objects.client.Device("whatever"), src), Local(target), SyncOptions{})
+
+	assert.Nil(t.T(), err)
+
+	data, err := ioutil.ReadFile(filepath.Join(target, "sub", "deeper", "c.txt"))
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "ccc", string(data))
+}
+
+func (t *Test_DeviceFilesystem) Test_sync_download_rejects_escaping_manifest_paths() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	agent := newTestFilesystemAgent()
+	hostile := ""
+
+	agent.handlers["manifest"] = func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		json.NewEncoder(rw).Encode(&ManifestEntry{
+			Path: hostile,
+			Hash: "0000",
+			Size: 6,
+			Mode: 0644,
+		})
+	}
+
+	agent.register(objects.mux)
+
+	base, _ := ioutil.TempDir("", "go-sdk-sync-hostile")
+	defer os.RemoveAll(base)
+
+	src := filepath.Join(base, "src")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(filepath.Join(base, "escape.txt"), []byte("hijack"), 0644)
+
+	dst := filepath.Join(base, "dst")
+	target := filepath.Join(dst, "copy")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, hostile = range []string{"../escape.txt", "sub/../../escape.txt", "/escape.txt", "C:/escape.txt", `..\escape.txt`} {
+		_, err := Sync(ctx, Remote(objects.client.Device("whatever"), src), Local(target), SyncOptions{})
+
+		assert.NotNil(t.T(), err, hostile)
+
+		_, err = os.Stat(filepath.Join(dst, "escape.txt"))
+		assert.True(t.T(), os.IsNotExist(err), hostile)
+	}
+}
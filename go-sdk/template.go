@@ -0,0 +1,207 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/palantir/stacktrace"
+)
+
+// RenderTemplate renders the text/template tmpl and writes the result to dst
+// on device unless it already has that content. The facts of the device are
+// available as .Device, the keys of a map given as data are available at the
+// top level and any other data as .Data. Besides the builtin functions
+// templates can use:
+//
+//	default, required, empty             missing values
+//	upper, lower, title, trim, trimPrefix, trimSuffix, replace,
+//	contains, hasPrefix, hasSuffix, split, join, indent, nindent,
+//	quote, squote                        strings
+//	toJSON, b64enc, b64dec, sha256sum    encodings
+//	hasTag, ipv4, ipv6                   device facts
+//
+// The write is atomic and conditional on dst not changing while rendering,
+// as with EnsureLine.
+func RenderTemplate(ctx context.Context, device Device, tmpl, dst string, data interface{}) (*EditResult, error) {
+	facts, err := device.Facts(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := template.
+		New(path.Base(strings.Replace(dst, `\`, "/", -1))).
+		Funcs(templateFuncs(facts)).
+		Parse(tmpl)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed parsing template for '%v'", dst)
+	}
+
+	buf := &bytes.Buffer{}
+
+	if err := parsed.Execute(buf, templateData(facts, data)); err != nil {
+		return nil, stacktrace.Propagate(err, "failed rendering template for '%v'", dst)
+	}
+
+	return editContent(ctx, device.Filesystem(), dst, true, func([]byte) []byte {
+		return buf.Bytes()
+	})
+}
+
+func templateData(facts *DeviceFacts, data interface{}) map[string]interface{} {
+	root := map[string]interface{}{
+		"Device": facts,
+	}
+
+	if data == nil {
+		return root
+	}
+
+	value := reflect.ValueOf(data)
+
+	if value.Kind() != reflect.Map || value.Type().Key().Kind() != reflect.String {
+		root["Data"] = data
+		return root
+	}
+
+	for _, key := range value.MapKeys() {
+		root[key.String()] = value.MapIndex(key).Interface()
+	}
+
+	return root
+}
+
+func templateFuncs(facts *DeviceFacts) template.FuncMap {
+	return template.FuncMap{
+		"default": func(fallback, value interface{}) interface{} {
+			if isEmptyTemplateValue(value) {
+				return fallback
+			}
+
+			return value
+		},
+		"required": func(message string, value interface{}) (interface{}, error) {
+			if isEmptyTemplateValue(value) {
+				return nil, stacktrace.NewError("%v", message)
+			}
+
+			return value, nil
+		},
+		"empty":      isEmptyTemplateValue,
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"title":      strings.Title,
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":    func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+		"join": func(sep string, list interface{}) string {
+			return strings.Join(templateStrings(list), sep)
+		},
+		"indent": func(n int, s string) string {
+			pad := strings.Repeat(" ", n)
+			return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+		},
+		"nindent": func(n int, s string) string {
+			pad := strings.Repeat(" ", n)
+			return "\n" + pad + strings.Replace(s, "\n", "\n"+pad, -1)
+		},
+		"quote":  func(value interface{}) string { return strconv.Quote(fmt.Sprint(value)) },
+		"squote": func(value interface{}) string { return "'" + fmt.Sprint(value) + "'" },
+		"toJSON": func(value interface{}) (string, error) {
+			data, err := marshalJSON(value)
+			return string(data), err
+		},
+		"b64enc": func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"b64dec": func(s string) (string, error) {
+			data, err := base64.StdEncoding.DecodeString(s)
+			return string(data), err
+		},
+		"sha256sum": func(s string) string {
+			sum := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(sum[:])
+		},
+		"hasTag": func(tag string) bool {
+			for _, candidate := range facts.Tags {
+				if candidate == tag {
+					return true
+				}
+			}
+
+			return false
+		},
+		"ipv4": func(addresses interface{}) []string {
+			return filterAddresses(templateStrings(addresses), true)
+		},
+		"ipv6": func(addresses interface{}) []string {
+			return filterAddresses(templateStrings(addresses), false)
+		},
+	}
+}
+
+func isEmptyTemplateValue(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+
+	v := reflect.ValueOf(value)
+
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+
+	return reflect.DeepEqual(value, reflect.Zero(v.Type()).Interface())
+}
+
+func templateStrings(list interface{}) []string {
+	strs := []string{}
+	v := reflect.ValueOf(list)
+
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return append(strs, fmt.Sprint(list))
+	}
+
+	for i := 0; i < v.Len(); i++ {
+		strs = append(strs, fmt.Sprint(v.Index(i).Interface()))
+	}
+
+	return strs
+}
+
+// filterAddresses keeps the IPv4 or IPv6 addresses of addresses, dropping
+// the prefix length of ones given in CIDR notation.
+func filterAddresses(addresses []string, v4 bool) []string {
+	filtered := []string{}
+
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+
+		if ip == nil {
+			ip, _, _ = net.ParseCIDR(address)
+		}
+
+		if ip != nil && (ip.To4() != nil) == v4 {
+			filtered = append(filtered, ip.String())
+		}
+	}
+
+	return filtered
+}
@@ -0,0 +1,78 @@
+package sdk
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func (t *Test_DeviceFilesystem) Test_render_template() {
+	objects := t.getTestObjects()
+	defer objects.server.Close()
+
+	newTestFilesystemAgent().register(objects.mux)
+
+	dir, _ := ioutil.TempDir("", "go-sdk-template")
+	defer os.RemoveAll(dir)
+
+	device := objects.client.Device("edge")
+	dst := filepath.Join(dir, "agent.conf")
+
+	tmpl := strings.Join([]string{
+		`name = {{ .Device.Hostname | quote }}`,
+		`arch = {{ .Device.Platform }}/{{ .Device.Architecture }}`,
+		`listen = {{ index (ipv4 .Device.Addresses) 0 }}:{{ .port | default 80 }}`,
+		`{{- if hasTag "edge" }}`,
+		`role = edge`,
+		`{{- end }}`,
+		`peers = {{ join "," .peers }}`,
+		``,
+	}, "\n")
+
+	data := map[string]interface{}{
+		"port":  8080,
+		"peers": []string{"a", "b"},
+	}
+
+	result, err := RenderTemplate(context.Background(), device, tmpl, dst, data)
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), result.Changed)
+
+	expected := strings.Join([]string{
+		`name = "edge-01"`,
+		`arch = linux/arm64`,
+		`listen = 10.0.0.5:8080`,
+		`role = edge`,
+		`peers = a,b`,
+		``,
+	}, "\n")
+
+	content, _ := ioutil.ReadFile(dst)
+	assert.Equal(t.T(), expected, string(content))
+
+	result, err = RenderTemplate(context.Background(), device, tmpl, dst, data)
+
+	assert.Nil(t.T(), err)
+	assert.False(t.T(), result.Changed)
+
+	data["port"] = 9090
+
+	result, err = RenderTemplate(context.Background(), device, tmpl, dst, data)
+
+	assert.Nil(t.T(), err)
+	assert.Contains(t.T(), result.Diff, "-listen = 10.0.0.5:8080\n+listen = 10.0.0.5:9090\n")
+
+	_, err = RenderTemplate(context.Background(), device, `{{ required "token is required" .token }}`, dst, nil)
+	assert.NotNil(t.T(), err)
+
+	_, err = RenderTemplate(context.Background(), device, `{{ .Data.Name }}`, dst, struct{ Name string }{"x"})
+	assert.Nil(t.T(), err)
+
+	content, _ = ioutil.ReadFile(dst)
+	assert.Equal(t.T(), "x", string(content))
+}